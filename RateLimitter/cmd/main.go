@@ -1,27 +1,65 @@
 package main
 
 import (
-	"log"
+	"context"
+	"flag"
+	"log/slog"
+	"os"
+	"time"
 
 	"rate-limiter/internal/config"
 	"rate-limiter/internal/server"
+	"rate-limiter/internal/telemetry"
 )
 
 func main() {
+	mode := flag.String("mode", "", "server mode: server (demo API) or proxy (reverse proxy to PROXY_UPSTREAMS), overrides SERVER_MODE")
+	flag.Parse()
+
+	// Log JSON until the configuration says otherwise
+	telemetry.InitLogging(os.Stderr, slog.LevelInfo, telemetry.LogJSON)
+
 	// Load configuration
 	cfg, err := config.Load()
 	if err != nil {
-		log.Fatalf("Failed to load configuration: %v", err)
+		fatal("Failed to load configuration", err)
+	}
+
+	if *mode != "" {
+		cfg.Server.Mode = *mode
+	}
+
+	telemetry.InitLogging(os.Stderr, cfg.Telemetry.LogLevel, cfg.Telemetry.LogFormat)
+
+	// Export traces when a collector is configured
+	if cfg.Telemetry.TracingEnabled() {
+		tp, err := telemetry.InitTracing(cfg.Telemetry.ServiceName, cfg.Telemetry.OTLPEndpoint)
+		if err != nil {
+			fatal("Failed to initialize tracing", err)
+		}
+		defer func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := tp.Shutdown(ctx); err != nil {
+				slog.Error("Error shutting down tracing", "error", err)
+			}
+		}()
 	}
 
 	// Create and start server
 	srv, err := server.NewServer(cfg)
 	if err != nil {
-		log.Fatalf("Failed to create server: %v", err)
+		fatal("Failed to create server", err)
 	}
 
 	// Start server (this will block until shutdown)
 	if err := srv.Start(); err != nil {
-		log.Fatalf("Server error: %v", err)
+		fatal("Server error", err)
 	}
 }
+
+// fatal logs err and exits
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
+}
@@ -0,0 +1,182 @@
+// Package audit records blocks, unblocks and admin actions as structured events, so
+// that what happened to a client can be reconstructed later.
+package audit
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+
+	"rate-limiter/internal/metrics"
+	"rate-limiter/internal/telemetry"
+)
+
+// Event types
+const (
+	// EventBlock is a key being blocked, by the limiter or an admin
+	EventBlock = "block"
+	// EventUnblock is an admin removing the block on a key
+	EventUnblock = "unblock"
+	// EventResetCounters is an admin dropping the counters of a key
+	EventResetCounters = "reset_counters"
+	// EventSetTokenLimit and EventDeleteTokenLimit are an admin changing the limit of a token
+	EventSetTokenLimit    = "set_token_limit"
+	EventDeleteTokenLimit = "delete_token_limit"
+	// EventResetTokenLimit is an admin dropping their change to the limit of a token
+	EventResetTokenLimit = "reset_token_limit"
+)
+
+// Actor is who caused an event
+type Actor struct {
+	// Name is the rate limiter itself, or the name an admin gave with X-Audit-Actor
+	Name string `json:"name"`
+	// IP is the address an admin request came from
+	IP string `json:"ip,omitempty"`
+}
+
+// System is the actor of the decisions the rate limiter makes on its own
+var System = Actor{Name: "rate-limiter"}
+
+// Event is a block, unblock or admin action
+type Event struct {
+	Time  time.Time `json:"time"`
+	Type  string    `json:"type"`
+	Actor Actor     `json:"actor"`
+	// Key is the storage key the event applies to, or the token whose limit changed
+	Key     string `json:"key"`
+	KeyType string `json:"key_type,omitempty"`
+	Policy  string `json:"policy,omitempty"`
+	// IP is the client whose request caused a block
+	IP     string `json:"ip,omitempty"`
+	Reason string `json:"reason,omitempty"`
+
+	// Limit, WindowSeconds and Cost describe the limit a block was caused by
+	Limit         int     `json:"limit,omitempty"`
+	WindowSeconds float64 `json:"window_seconds,omitempty"`
+	Cost          int     `json:"cost,omitempty"`
+	// Offenses is how many recent offenses the key has while blocks escalate
+	Offenses int `json:"offenses,omitempty"`
+	// DurationSeconds is how long a block lasts
+	DurationSeconds float64 `json:"duration_seconds,omitempty"`
+}
+
+// Sink delivers events somewhere
+type Sink interface {
+	Write(ctx context.Context, event Event) error
+}
+
+// Log hands events over to its sinks in the background, so requests never wait on a
+// slow sink. A nil Log discards events.
+type Log struct {
+	sinks  []Sink
+	events chan Event
+	done   chan struct{}
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+// DefaultBuffer is how many events wait for delivery when New is given no buffer size
+const DefaultBuffer = 1024
+
+// New starts a log delivering events to sinks. Up to buffer events wait for delivery;
+// events beyond that are dropped and counted.
+func New(buffer int, sinks ...Sink) *Log {
+	if buffer <= 0 {
+		buffer = DefaultBuffer
+	}
+
+	l := &Log{
+		sinks:  sinks,
+		events: make(chan Event, buffer),
+		done:   make(chan struct{}),
+	}
+	go l.run()
+	return l
+}
+
+// Record queues an event, stamping its time when unset
+func (l *Log) Record(event Event) {
+	if l == nil {
+		return
+	}
+
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if l.closed {
+		return
+	}
+
+	select {
+	case l.events <- event:
+	default:
+		metrics.AuditEvents.WithLabelValues(event.Type, metrics.Dropped).Inc()
+		slog.Warn("Audit log buffer is full, dropping event", "type", event.Type, "key_hash", telemetry.HashKey(event.Key))
+	}
+}
+
+// run delivers queued events until the log is closed
+func (l *Log) run() {
+	defer close(l.done)
+
+	for event := range l.events {
+		outcome := metrics.Delivered
+		for _, sink := range l.sinks {
+			if err := sink.Write(context.Background(), event); err != nil {
+				outcome = metrics.Failed
+				slog.Warn("Failed to deliver audit event", "type", event.Type, "key_hash", telemetry.HashKey(event.Key), "error", err)
+			}
+		}
+		metrics.AuditEvents.WithLabelValues(event.Type, outcome).Inc()
+	}
+}
+
+// Close delivers the queued events and closes the sinks that need it
+func (l *Log) Close() error {
+	if l == nil {
+		return nil
+	}
+
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return nil
+	}
+	l.closed = true
+	close(l.events)
+	l.mu.Unlock()
+
+	<-l.done
+
+	var errs []error
+	for _, sink := range l.sinks {
+		if closer, ok := sink.(io.Closer); ok {
+			errs = append(errs, closer.Close())
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// actorKey is the context key of the actor
+type actorKey struct{}
+
+// WithActor returns a context whose actions are recorded as made by actor
+func WithActor(ctx context.Context, actor Actor) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+// ActorFromContext returns the actor set with WithActor, System when there is none
+func ActorFromContext(ctx context.Context) Actor {
+	if actor, ok := ctx.Value(actorKey{}).(Actor); ok {
+		return actor
+	}
+	return System
+}
@@ -0,0 +1,133 @@
+package audit
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// FileSink appends events to a file as JSON lines
+type FileSink struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// NewFileSink opens path for appending, creating it when needed
+func NewFileSink(path string) (*FileSink, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit file: %w", err)
+	}
+	return &FileSink{file: file}, nil
+}
+
+// Write appends event as a single line
+func (s *FileSink) Write(ctx context.Context, event Event) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err = s.file.Write(append(line, '\n'))
+	return err
+}
+
+// Close closes the file
+func (s *FileSink) Close() error {
+	return s.file.Close()
+}
+
+// StreamWriter appends entries to a Redis stream, as storage.RedisStorage does
+type StreamWriter interface {
+	AddToStream(ctx context.Context, stream string, maxLen int64, values []any) error
+}
+
+// RedisStreamSink adds events to a Redis stream. Entries hold the type and key of the
+// event, to filter on, and the whole event as JSON.
+type RedisStreamSink struct {
+	writer StreamWriter
+	stream string
+	// maxLen caps the stream at about that many entries, unbounded when zero
+	maxLen int64
+}
+
+// NewRedisStreamSink writes events to stream through writer
+func NewRedisStreamSink(writer StreamWriter, stream string, maxLen int64) *RedisStreamSink {
+	return &RedisStreamSink{writer: writer, stream: stream, maxLen: maxLen}
+}
+
+// Write adds event to the stream
+func (s *RedisStreamSink) Write(ctx context.Context, event Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	return s.writer.AddToStream(ctx, s.stream, s.maxLen, []any{
+		"type", event.Type,
+		"key", event.Key,
+		"event", string(data),
+	})
+}
+
+// SignatureHeader holds the HMAC-SHA256 of a webhook body, as sha256=<hex>, when the
+// webhook has a secret
+const SignatureHeader = "X-Audit-Signature"
+
+// WebhookSink posts each event as JSON to a URL
+type WebhookSink struct {
+	url    string
+	secret []byte
+	client *http.Client
+}
+
+// NewWebhookSink posts events to url, giving up on a call after timeout. With a
+// secret, bodies are signed in SignatureHeader.
+func NewWebhookSink(url string, secret []byte, timeout time.Duration) *WebhookSink {
+	return &WebhookSink{
+		url:    url,
+		secret: secret,
+		client: &http.Client{Timeout: timeout},
+	}
+}
+
+// Write posts event, failing unless the webhook answers with a 2xx status
+func (s *WebhookSink) Write(ctx context.Context, event Event) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(s.secret) > 0 {
+		mac := hmac.New(sha256.New, s.secret)
+		mac.Write(body)
+		req.Header.Set(SignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"rate-limiter/internal/config"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// ErrInvalidToken is returned for tokens whose signature or claims do not verify
+var ErrInvalidToken = errors.New("invalid token")
+
+// Claims identify the holder of a signed token
+type Claims struct {
+	// Subject is who the token was issued to, the sub claim
+	Subject string
+	// Plan names the tier of the token
+	Plan string
+	// Values holds every claim of the token
+	Values map[string]any
+}
+
+// Verify checks the signature and claims of a JWT (three dot separated parts) or a
+// signed API key (two parts)
+func Verify(settings config.TokenAuth, token string) (*Claims, error) {
+	var (
+		claims jwt.MapClaims
+		err    error
+	)
+
+	switch strings.Count(token, ".") {
+	case 2:
+		claims, err = verifyJWT(settings, token)
+	case 1:
+		claims, err = verifyAPIKey(settings, token)
+	default:
+		err = errors.New("malformed token")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+
+	subject, err := claims.GetSubject()
+	if err != nil || subject == "" {
+		return nil, fmt.Errorf("%w: token has no subject", ErrInvalidToken)
+	}
+
+	planClaim := settings.PlanClaim
+	if planClaim == "" {
+		planClaim = config.DefaultPlanClaim
+	}
+
+	plan := settings.DefaultPlan
+	if value, exists := claims[planClaim]; exists {
+		name, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("%w: %s claim must be a string", ErrInvalidToken, planClaim)
+		}
+		plan = name
+	}
+	if plan == "" {
+		return nil, fmt.Errorf("%w: token has no %s claim", ErrInvalidToken, planClaim)
+	}
+
+	return &Claims{Subject: subject, Plan: plan, Values: claims}, nil
+}
+
+// verifyJWT verifies a JWT signed with the JWT secret or public key
+func verifyJWT(settings config.TokenAuth, token string) (jwt.MapClaims, error) {
+	var methods []string
+	if len(settings.JWTSecret) > 0 {
+		methods = append(methods, "HS256", "HS384", "HS512")
+	}
+	switch settings.JWTPublicKey.(type) {
+	case *rsa.PublicKey:
+		methods = append(methods, "RS256", "RS384", "RS512", "PS256", "PS384", "PS512")
+	case *ecdsa.PublicKey:
+		methods = append(methods, "ES256", "ES384", "ES512")
+	case ed25519.PublicKey:
+		methods = append(methods, "EdDSA")
+	}
+	if len(methods) == 0 {
+		return nil, errors.New("JWTs are not accepted")
+	}
+
+	opts := []jwt.ParserOption{jwt.WithValidMethods(methods)}
+	if settings.JWTIssuer != "" {
+		opts = append(opts, jwt.WithIssuer(settings.JWTIssuer))
+	}
+	if settings.JWTAudience != "" {
+		opts = append(opts, jwt.WithAudience(settings.JWTAudience))
+	}
+
+	claims := jwt.MapClaims{}
+	_, err := jwt.NewParser(opts...).ParseWithClaims(token, claims, func(t *jwt.Token) (any, error) {
+		if _, ok := t.Method.(*jwt.SigningMethodHMAC); ok {
+			return settings.JWTSecret, nil
+		}
+		return settings.JWTPublicKey, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return claims, nil
+}
+
+// verifyAPIKey verifies an API key made of base64url encoded JSON claims and their
+// HMAC-SHA256, separated by a dot
+func verifyAPIKey(settings config.TokenAuth, token string) (jwt.MapClaims, error) {
+	if len(settings.APIKeySecret) == 0 {
+		return nil, errors.New("signed API keys are not accepted")
+	}
+
+	payload, signature, _ := strings.Cut(token, ".")
+
+	sig, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil || !hmac.Equal(sig, apiKeySignature(settings.APIKeySecret, payload)) {
+		return nil, errors.New("signature is invalid")
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, errors.New("malformed API key")
+	}
+
+	claims := jwt.MapClaims{}
+	if err := json.Unmarshal(data, &claims); err != nil {
+		return nil, errors.New("malformed API key")
+	}
+
+	// API keys may expire like JWTs
+	if err := jwt.NewValidator().Validate(claims); err != nil {
+		return nil, err
+	}
+
+	return claims, nil
+}
+
+// SignAPIKey issues an API key holding claims, which should include sub and the plan
+// claim, and may include exp
+func SignAPIKey(secret []byte, claims map[string]any) (string, error) {
+	if len(secret) == 0 {
+		return "", errors.New("API key secret must not be empty")
+	}
+
+	data, err := json.Marshal(claims)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode API key claims: %w", err)
+	}
+
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	return payload + "." + base64.RawURLEncoding.EncodeToString(apiKeySignature(secret, payload)), nil
+}
+
+// apiKeySignature signs the payload of an API key
+func apiKeySignature(secret []byte, payload string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
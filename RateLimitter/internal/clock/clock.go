@@ -0,0 +1,169 @@
+// Package clock lets the rate limiter and its storage read the time from a source
+// that tests and simulations can control.
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock tells the current time and schedules periodic work against it
+type Clock interface {
+	Now() time.Time
+	// NewTicker returns a ticker firing every d as measured by the clock
+	NewTicker(d time.Duration) Ticker
+}
+
+// Ticker delivers ticks at a fixed interval until it is stopped
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// Real reads the system clock
+var Real Clock = realClock{}
+
+// realClock reads the system clock
+type realClock struct{}
+
+// Now implements Clock
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+// NewTicker implements Clock
+func (realClock) NewTicker(d time.Duration) Ticker {
+	return realTicker{time.NewTicker(d)}
+}
+
+// realTicker adapts a time.Ticker to the Ticker interface
+type realTicker struct {
+	ticker *time.Ticker
+}
+
+// C implements Ticker
+func (t realTicker) C() <-chan time.Time {
+	return t.ticker.C
+}
+
+// Stop implements Ticker
+func (t realTicker) Stop() {
+	t.ticker.Stop()
+}
+
+// Fake is a clock that only moves when told to. It is safe for concurrent use.
+type Fake struct {
+	mu      sync.Mutex
+	now     time.Time
+	tickers []*fakeTicker
+	// firing serializes the delivery of ticks between concurrent moves
+	firing sync.Mutex
+}
+
+// NewFake returns a fake clock stopped at now
+func NewFake(now time.Time) *Fake {
+	return &Fake{now: now}
+}
+
+// Now implements Clock
+func (f *Fake) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+// NewTicker implements Clock. The ticker only fires when the clock is moved past
+// its next tick.
+func (f *Fake) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("clock: non-positive interval for NewTicker")
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	ticker := &fakeTicker{
+		c:       make(chan time.Time),
+		period:  d,
+		next:    f.now.Add(d),
+		stopped: make(chan struct{}),
+	}
+	f.tickers = append(f.tickers, ticker)
+	return ticker
+}
+
+// Advance moves the clock forward by d
+func (f *Fake) Advance(d time.Duration) {
+	f.mu.Lock()
+	f.now = f.now.Add(d)
+	f.mu.Unlock()
+	f.fire()
+}
+
+// Set moves the clock to now
+func (f *Fake) Set(now time.Time) {
+	f.mu.Lock()
+	f.now = now
+	f.mu.Unlock()
+	f.fire()
+}
+
+// fire delivers every tick that is due, one per elapsed interval. Ticks are sent
+// unbuffered, so when Advance or Set returns each running ticker has received its
+// ticks and finished handling all but the last one.
+func (f *Fake) fire() {
+	f.firing.Lock()
+	defer f.firing.Unlock()
+
+	f.mu.Lock()
+	now := f.now
+	tickers := make([]*fakeTicker, 0, len(f.tickers))
+	for _, ticker := range f.tickers {
+		if !ticker.isStopped() {
+			tickers = append(tickers, ticker)
+		}
+	}
+	f.tickers = tickers
+	f.mu.Unlock()
+
+	for _, ticker := range tickers {
+		for !ticker.next.After(now) {
+			select {
+			case ticker.c <- ticker.next:
+				ticker.next = ticker.next.Add(ticker.period)
+			case <-ticker.stopped:
+				ticker.next = now.Add(ticker.period)
+			}
+		}
+	}
+}
+
+// fakeTicker is a Ticker driven by a Fake clock
+type fakeTicker struct {
+	c      chan time.Time
+	period time.Duration
+	// next is only touched by NewTicker and while the clock is firing
+	next    time.Time
+	stopped chan struct{}
+	stop    sync.Once
+}
+
+// C implements Ticker
+func (t *fakeTicker) C() <-chan time.Time {
+	return t.c
+}
+
+// Stop implements Ticker
+func (t *fakeTicker) Stop() {
+	t.stop.Do(func() { close(t.stopped) })
+}
+
+// isStopped reports whether Stop was called
+func (t *fakeTicker) isStopped() bool {
+	select {
+	case <-t.stopped:
+		return true
+	default:
+		return false
+	}
+}
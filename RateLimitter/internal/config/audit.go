@@ -0,0 +1,77 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"time"
+)
+
+// AuditConfig holds where block, unblock and admin events are sent; any combination
+// of sinks can be set
+type AuditConfig struct {
+	// File is a file events are appended to as JSON lines
+	File string
+	// RedisStream is a Redis stream events are added to, on the Redis storage
+	RedisStream string
+	// RedisStreamMaxLen caps the stream at about that many entries, unbounded when zero
+	RedisStreamMaxLen int64
+	// WebhookURL receives each event as a JSON POST
+	WebhookURL string
+	// WebhookSecret signs webhook bodies with HMAC-SHA256 when set
+	WebhookSecret string
+	// WebhookTimeout bounds each webhook call
+	WebhookTimeout time.Duration
+	// Buffer is how many events may wait for delivery before new ones are dropped
+	Buffer int
+}
+
+// Enabled reports whether any audit sink is configured
+func (a AuditConfig) Enabled() bool {
+	return a.File != "" || a.RedisStream != "" || a.WebhookURL != ""
+}
+
+// validate checks the webhook URL and the sizes
+func (a AuditConfig) validate(backend string) error {
+	if a.WebhookURL != "" {
+		u, err := url.Parse(a.WebhookURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("AUDIT_WEBHOOK_URL: expected an http or https URL, got %q", a.WebhookURL)
+		}
+		if a.WebhookTimeout <= 0 {
+			return fmt.Errorf("AUDIT_WEBHOOK_TIMEOUT_MS must be positive")
+		}
+	}
+
+	if a.RedisStream != "" && backend != StorageRedis {
+		return fmt.Errorf("AUDIT_REDIS_STREAM needs the %s storage backend", StorageRedis)
+	}
+
+	if a.RedisStreamMaxLen < 0 {
+		return fmt.Errorf("AUDIT_REDIS_STREAM_MAXLEN must not be negative")
+	}
+
+	if a.Buffer <= 0 {
+		return fmt.Errorf("AUDIT_BUFFER must be positive")
+	}
+
+	return nil
+}
+
+// loadAudit reads the audit sinks from the environment
+func loadAudit(backend string) (AuditConfig, error) {
+	audit := AuditConfig{
+		File:              getEnv("AUDIT_FILE", ""),
+		RedisStream:       getEnv("AUDIT_REDIS_STREAM", ""),
+		RedisStreamMaxLen: int64(getEnvAsInt("AUDIT_REDIS_STREAM_MAXLEN", 100000)),
+		WebhookURL:        getEnv("AUDIT_WEBHOOK_URL", ""),
+		WebhookSecret:     getEnv("AUDIT_WEBHOOK_SECRET", ""),
+		WebhookTimeout:    time.Duration(getEnvAsInt("AUDIT_WEBHOOK_TIMEOUT_MS", 5000)) * time.Millisecond,
+		Buffer:            getEnvAsInt("AUDIT_BUFFER", 1024),
+	}
+
+	if err := audit.validate(backend); err != nil {
+		return AuditConfig{}, err
+	}
+
+	return audit, nil
+}
@@ -0,0 +1,104 @@
+package config
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+)
+
+// DefaultPlanClaim is the claim naming the plan of a signed token
+const DefaultPlanClaim = "plan"
+
+// TokenAuth verifies signed tokens: JWTs and API keys signed with an HMAC. A signed
+// token is limited by its subject, with the limits of the tier named by its plan
+// claim, so it does not need to be listed in the token limits.
+type TokenAuth struct {
+	// JWTSecret verifies JWTs signed with HS256, HS384 or HS512
+	JWTSecret []byte
+	// JWTPublicKey verifies JWTs signed with RSA, ECDSA or Ed25519
+	JWTPublicKey crypto.PublicKey
+	// JWTIssuer and JWTAudience are required of JWTs when set
+	JWTIssuer   string
+	JWTAudience string
+	// APIKeySecret verifies signed API keys
+	APIKeySecret []byte
+	// PlanClaim is the claim naming the tier of a token
+	PlanClaim string
+	// DefaultPlan is the tier of tokens without a plan claim; such tokens are refused
+	// when it is empty
+	DefaultPlan string
+}
+
+// Enabled reports whether signed tokens are verified
+func (a TokenAuth) Enabled() bool {
+	return len(a.JWTSecret) > 0 || a.JWTPublicKey != nil || len(a.APIKeySecret) > 0
+}
+
+// validate checks that tokens can be given a tier
+func (a TokenAuth) validate(tiers map[string]TokenLimit) error {
+	for plan, limit := range tiers {
+		if err := limit.Validate(); err != nil {
+			return fmt.Errorf("tier %s: %w", plan, err)
+		}
+	}
+
+	if !a.Enabled() {
+		return nil
+	}
+
+	if len(tiers) == 0 {
+		return fmt.Errorf("signed tokens need at least one tier")
+	}
+
+	if _, exists := tiers[a.DefaultPlan]; a.DefaultPlan != "" && !exists {
+		return fmt.Errorf("default plan %s has no tier", a.DefaultPlan)
+	}
+
+	return nil
+}
+
+// loadTokenAuth reads the token verification settings from the environment
+func loadTokenAuth() (TokenAuth, error) {
+	auth := TokenAuth{
+		JWTSecret:    []byte(getEnv("RATE_LIMIT_JWT_SECRET", "")),
+		JWTIssuer:    getEnv("RATE_LIMIT_JWT_ISSUER", ""),
+		JWTAudience:  getEnv("RATE_LIMIT_JWT_AUDIENCE", ""),
+		APIKeySecret: []byte(getEnv("RATE_LIMIT_API_KEY_SECRET", "")),
+		PlanClaim:    getEnv("RATE_LIMIT_PLAN_CLAIM", DefaultPlanClaim),
+		DefaultPlan:  getEnv("RATE_LIMIT_DEFAULT_PLAN", ""),
+	}
+
+	if path := getEnv("RATE_LIMIT_JWT_PUBLIC_KEY_FILE", ""); path != "" {
+		key, err := readPublicKey(path)
+		if err != nil {
+			return TokenAuth{}, fmt.Errorf("RATE_LIMIT_JWT_PUBLIC_KEY_FILE: %w", err)
+		}
+		auth.JWTPublicKey = key
+	}
+
+	return auth, nil
+}
+
+// readPublicKey reads a PEM encoded RSA, ECDSA or Ed25519 public key
+func readPublicKey(path string) (crypto.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data found", path)
+	}
+
+	switch block.Type {
+	case "PUBLIC KEY":
+		return x509.ParsePKIXPublicKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("%s: unsupported PEM block %q", path, block.Type)
+	}
+}
@@ -0,0 +1,105 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Storage backends
+const (
+	// StorageRedis shares the limits through Redis
+	StorageRedis = "redis"
+	// StoragePeers shares the limits between the replicas themselves
+	StoragePeers = "peers"
+)
+
+// ClusterConfig holds how replicas find each other to share limits without Redis
+type ClusterConfig struct {
+	// Peers is a static list of replica URLs such as http://10.0.0.1:8080
+	Peers []string
+	// DNS is a host:port whose addresses are the replicas, such as a headless service
+	DNS string
+	// Self is the URL of this replica, found among the peers by address when empty
+	Self string
+	// Secret authenticates the calls between replicas, required when peers are set
+	Secret string
+	// Refresh is how often the peers are discovered again
+	Refresh time.Duration
+}
+
+// Enabled reports whether any peer discovery is configured
+func (c ClusterConfig) Enabled() bool {
+	return len(c.Peers) > 0 || c.DNS != ""
+}
+
+// loadCluster reads the cluster settings from the environment
+func loadCluster() (ClusterConfig, error) {
+	cluster := ClusterConfig{
+		DNS:     getEnv("CLUSTER_DNS", ""),
+		Self:    getEnv("CLUSTER_SELF", ""),
+		Secret:  getEnv("CLUSTER_SECRET", ""),
+		Refresh: time.Duration(getEnvAsInt("CLUSTER_REFRESH_SECONDS", 10)) * time.Second,
+	}
+
+	for _, peer := range strings.Split(getEnv("CLUSTER_PEERS", ""), ",") {
+		if peer = strings.TrimSpace(peer); peer == "" {
+			continue
+		}
+		if err := validatePeerURL(peer); err != nil {
+			return ClusterConfig{}, fmt.Errorf("CLUSTER_PEERS: %w", err)
+		}
+		cluster.Peers = append(cluster.Peers, peer)
+	}
+
+	if cluster.DNS != "" {
+		if len(cluster.Peers) > 0 {
+			return ClusterConfig{}, fmt.Errorf("set either CLUSTER_PEERS or CLUSTER_DNS, not both")
+		}
+		if _, _, err := net.SplitHostPort(cluster.DNS); err != nil {
+			return ClusterConfig{}, fmt.Errorf("CLUSTER_DNS: expected host:port, got %q", cluster.DNS)
+		}
+	}
+
+	// The peer endpoint changes blocks and counters, it must never be open
+	if cluster.Enabled() && cluster.Secret == "" {
+		return ClusterConfig{}, fmt.Errorf("CLUSTER_SECRET is required when CLUSTER_PEERS or CLUSTER_DNS is set")
+	}
+
+	if cluster.Self != "" {
+		if err := validatePeerURL(cluster.Self); err != nil {
+			return ClusterConfig{}, fmt.Errorf("CLUSTER_SELF: %w", err)
+		}
+	}
+
+	if cluster.Refresh <= 0 {
+		return ClusterConfig{}, fmt.Errorf("CLUSTER_REFRESH_SECONDS must be positive")
+	}
+
+	return cluster, nil
+}
+
+// validateStorage checks the storage backend and that the peers backend can find peers
+func validateStorage(backend string, cluster ClusterConfig) error {
+	switch backend {
+	case StorageRedis:
+		return nil
+	case StoragePeers:
+		if !cluster.Enabled() {
+			return fmt.Errorf("peers storage requires CLUSTER_PEERS or CLUSTER_DNS")
+		}
+		return nil
+	}
+	return fmt.Errorf("STORAGE_BACKEND must be %q or %q, got %q", StorageRedis, StoragePeers, backend)
+}
+
+// validatePeerURL checks that a peer is an http or https base URL
+func validatePeerURL(peer string) error {
+	u, err := url.Parse(peer)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid peer URL %q", peer)
+	}
+	return nil
+}
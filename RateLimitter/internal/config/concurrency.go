@@ -0,0 +1,124 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultLeaseTTL is how long a concurrency slot survives without being renewed when
+// the policy does not say
+const DefaultLeaseTTL = 30 * time.Second
+
+// ConcurrencyPolicy caps how many requests matching a set of paths, methods and route
+// group a client may have in flight at once. Clients are told apart by token when the
+// token is known, by IP otherwise.
+type ConcurrencyPolicy struct {
+	Name string
+	// Methods, Paths and Group match requests like the fields of a Policy
+	Methods []string
+	Paths   []string
+	Group   string
+	// Limit is how many requests of a client may be in flight at once
+	Limit int
+	// LeaseTTL is how long a slot is held without being renewed. Slots are renewed
+	// while their request runs, so only the slots of a crashed instance expire.
+	LeaseTTL time.Duration
+}
+
+// Matches reports whether a request falls under the policy, see Policy.Matches
+func (p ConcurrencyPolicy) Matches(method, routePath, requestPath, group string) bool {
+	return p.route().Matches(method, routePath, requestPath, group)
+}
+
+// route is the Policy matching the same requests
+func (p ConcurrencyPolicy) route() Policy {
+	return Policy{Name: p.Name, Methods: p.Methods, Paths: p.Paths, Group: p.Group, Window: time.Second}
+}
+
+// validate checks that the policy can be applied
+func (p ConcurrencyPolicy) validate() error {
+	if err := p.route().validate(); err != nil {
+		return fmt.Errorf("concurrency %w", err)
+	}
+
+	if p.Limit <= 0 {
+		return fmt.Errorf("concurrency policy %s: limit must be positive", p.Name)
+	}
+
+	if p.LeaseTTL <= 0 {
+		return fmt.Errorf("concurrency policy %s: lease must be positive", p.Name)
+	}
+
+	return nil
+}
+
+// loadConcurrencyPolicies loads concurrency policies from environment variables,
+// ordered by name
+func loadConcurrencyPolicies() ([]ConcurrencyPolicy, error) {
+	var policies []ConcurrencyPolicy
+
+	for _, env := range os.Environ() {
+		if !strings.HasPrefix(env, "RATE_LIMIT_CONCURRENCY_") {
+			continue
+		}
+
+		name, value, _ := strings.Cut(strings.TrimPrefix(env, "RATE_LIMIT_CONCURRENCY_"), "=")
+
+		policy, err := parseConcurrencyPolicy(name, value)
+		if err != nil {
+			return nil, err
+		}
+
+		policies = append(policies, policy)
+	}
+
+	sort.Slice(policies, func(i, j int) bool {
+		return policies[i].Name < policies[j].Name
+	})
+
+	return policies, nil
+}
+
+// parseConcurrencyPolicy parses a concurrency policy in the format
+// methods=GET;paths=/api/export/**;group=api;limit=5;lease=30s
+func parseConcurrencyPolicy(name, value string) (ConcurrencyPolicy, error) {
+	policy := ConcurrencyPolicy{Name: name, LeaseTTL: DefaultLeaseTTL}
+
+	for _, field := range strings.Split(value, ";") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+
+		key, val, found := strings.Cut(field, "=")
+		if !found {
+			return ConcurrencyPolicy{}, fmt.Errorf("concurrency policy %s: expected key=value, got %q", name, field)
+		}
+
+		var err error
+		switch strings.TrimSpace(key) {
+		case "methods":
+			policy.Methods = splitList(val)
+		case "paths":
+			policy.Paths = splitList(val)
+		case "group":
+			policy.Group = strings.TrimSpace(val)
+		case "limit":
+			policy.Limit, err = strconv.Atoi(strings.TrimSpace(val))
+		case "lease":
+			policy.LeaseTTL, err = time.ParseDuration(strings.TrimSpace(val))
+		default:
+			return ConcurrencyPolicy{}, fmt.Errorf("concurrency policy %s: unknown field %q", name, key)
+		}
+
+		if err != nil {
+			return ConcurrencyPolicy{}, fmt.Errorf("concurrency policy %s: invalid %s: %w", name, key, err)
+		}
+	}
+
+	return policy, nil
+}
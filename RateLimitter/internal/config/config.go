@@ -1,9 +1,12 @@
 package config
 
 import (
+	"fmt"
+	"net/netip"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 )
@@ -13,6 +16,21 @@ type Config struct {
 	Redis     RedisConfig
 	RateLimit RateLimitConfig
 	Server    ServerConfig
+
+	// Storage is the backend sharing the limits, StorageRedis or StoragePeers
+	Storage string
+	// Cluster finds the replicas for StoragePeers, and serves as the Redis fallback
+	// in fail-open mode when configured
+	Cluster ClusterConfig
+	// Audit says where block, unblock and admin events are sent
+	Audit AuditConfig
+	// Telemetry says where traces are exported and how logs are written
+	Telemetry TelemetryConfig
+
+	// PolicyFile is the optional YAML or JSON file merged over the environment limits
+	PolicyFile string
+	// envRateLimit keeps the limits read from the environment, so the file can be reapplied
+	envRateLimit RateLimitConfig
 }
 
 // RedisConfig holds Redis connection configuration
@@ -21,27 +39,183 @@ type RedisConfig struct {
 	Port     string
 	Password string
 	DB       int
+	// Username authenticates with Redis ACLs
+	Username string
+
+	// SentinelAddrs and MasterName connect to the master monitored by the Sentinels
+	SentinelAddrs    []string
+	MasterName       string
+	SentinelPassword string
+	// ClusterAddrs are the seed nodes of a Redis Cluster
+	ClusterAddrs []string
+
+	TLS RedisTLSConfig
+
+	// Pool and timeout settings, the client defaults when zero
+	PoolSize     int
+	MinIdleConns int
+	PoolTimeout  time.Duration
+	DialTimeout  time.Duration
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+
+	// FailMode is what happens to requests while Redis is unavailable: FailOpen limits
+	// them with a local in-memory limiter, FailClosed refuses them
+	FailMode string
+	// BreakerThreshold is how many consecutive errors open the circuit to Redis
+	BreakerThreshold int
+	// BreakerCooldown is how long the circuit stays open before Redis is tried again
+	BreakerCooldown time.Duration
 }
 
+// Storage fail modes
+const (
+	FailOpen   = "open"
+	FailClosed = "closed"
+)
+
+// Supported rate limiting algorithms
+const (
+	AlgorithmFixedWindow          = "fixed_window"
+	AlgorithmTokenBucket          = "token_bucket"
+	AlgorithmSlidingWindowLog     = "sliding_window_log"
+	AlgorithmSlidingWindowCounter = "sliding_window_counter"
+	AlgorithmGCRA                 = "gcra"
+)
+
 // RateLimitConfig holds rate limiting configuration
 type RateLimitConfig struct {
+	// Algorithm is the default algorithm, used for IPs and for tokens without their own
+	Algorithm              string
 	IPRequestsPerSecond    int
 	IPBlockDurationMinutes int
 	TokenLimits            map[string]TokenLimit
+	// Tiers are the limits of signed tokens, by the plan in their claims
+	Tiers map[string]TokenLimit
+	// Auth verifies signed tokens
+	Auth TokenAuth
+	// IPLimits override the IP limits for specific addresses
+	IPLimits map[string]TokenLimit
+	// CIDRLimits override the IP limits for addresses within a range, most specific first
+	CIDRLimits []CIDRLimit
+	// Allowlist holds ranges that are never limited
+	Allowlist []netip.Prefix
+	// Denylist holds ranges that are always refused, it wins over the allowlist
+	Denylist []netip.Prefix
+	// IPv4PrefixLength and IPv6PrefixLength group addresses into subnets that share
+	// one IP limit. Zero keeps one limit per address.
+	IPv4PrefixLength int
+	IPv6PrefixLength int
+	// Policies are checked in order; the first one matching a request limits it
+	Policies []Policy
+	// Escalation lengthens the blocks of repeat offenders
+	Escalation BlockEscalation
+	// ConcurrencyPolicies are checked in order; the first one matching a request caps
+	// the requests of its client in flight
+	ConcurrencyPolicies []ConcurrencyPolicy
+}
+
+// CIDRLimit holds the limit applied to every address within a range
+type CIDRLimit struct {
+	Prefix netip.Prefix
+	Limit  TokenLimit
 }
 
 // TokenLimit holds configuration for a specific token
 type TokenLimit struct {
 	RequestsPerSecond    int
 	BlockDurationMinutes int
+	// Algorithm overrides RateLimitConfig.Algorithm when set
+	Algorithm string
+	// Quotas cap the requests of a token per calendar hour, day or month in UTC,
+	// on top of the per second limit
+	Quotas map[string]int
+}
+
+// AlgorithmFor returns the algorithm to apply to a token limit
+func (r RateLimitConfig) AlgorithmFor(limit TokenLimit) string {
+	if limit.Algorithm != "" {
+		return limit.Algorithm
+	}
+	return r.DefaultAlgorithm()
+}
+
+// DefaultAlgorithm returns the global algorithm, falling back to a fixed window
+func (r RateLimitConfig) DefaultAlgorithm() string {
+	if r.Algorithm != "" {
+		return r.Algorithm
+	}
+	return AlgorithmFixedWindow
+}
+
+// PolicyAlgorithm returns the algorithm to apply to a policy
+func (r RateLimitConfig) PolicyAlgorithm(policy Policy) string {
+	if policy.Algorithm != "" {
+		return policy.Algorithm
+	}
+	return r.DefaultAlgorithm()
+}
+
+// IPLimit returns the limit that overrides the IP limits for an address, if any.
+// Exact addresses take precedence over ranges.
+func (r RateLimitConfig) IPLimit(ip string) (TokenLimit, bool) {
+	if len(r.IPLimits) == 0 && len(r.CIDRLimits) == 0 {
+		return TokenLimit{}, false
+	}
+
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return TokenLimit{}, false
+	}
+	addr = addr.Unmap()
+
+	if limit, exists := r.IPLimits[addr.String()]; exists {
+		return limit, true
+	}
+
+	for _, cidr := range r.CIDRLimits {
+		if cidr.Prefix.Contains(addr) {
+			return cidr.Limit, true
+		}
+	}
+
+	return TokenLimit{}, false
+}
+
+// IsValidAlgorithm reports whether name is a supported algorithm
+func IsValidAlgorithm(name string) bool {
+	switch name {
+	case AlgorithmFixedWindow, AlgorithmTokenBucket, AlgorithmSlidingWindowLog,
+		AlgorithmSlidingWindowCounter, AlgorithmGCRA:
+		return true
+	}
+	return false
 }
 
 // ServerConfig holds server configuration
 type ServerConfig struct {
 	Port string
+	// TrustedProxies are the proxies allowed to report the client IP through forwarding
+	// headers or the PROXY protocol
+	TrustedProxies []netip.Prefix
+	// ClientIPHeader is the forwarding header trusted proxies report the client IP in,
+	// one of the ClientIPHeader constants
+	ClientIPHeader string
+	// ProxyProtocol accepts PROXY protocol v1 and v2 headers on the listener
+	ProxyProtocol bool
+	// AdminToken is the bearer token required by the admin API, which is disabled when empty
+	AdminToken string
+
+	// GRPCPort serves the Envoy rate limit service when set
+	GRPCPort string
+
+	// Mode is ModeServer or ModeProxy
+	Mode string
+	// Upstreams are the services proxied in ModeProxy, longest prefix first
+	Upstreams []Upstream
 }
 
-// Load loads configuration from environment variables
+// Load loads configuration from environment variables and the optional policy file
 func Load() (*Config, error) {
 	// Try to load .env file if it exists
 	_ = godotenv.Load("config.env")
@@ -52,58 +226,332 @@ func Load() (*Config, error) {
 			Port:     getEnv("REDIS_PORT", "6379"),
 			Password: getEnv("REDIS_PASSWORD", ""),
 			DB:       getEnvAsInt("REDIS_DB", 0),
+			Username: getEnv("REDIS_USERNAME", ""),
+
+			SentinelAddrs:    splitList(getEnv("REDIS_SENTINEL_ADDRS", "")),
+			MasterName:       getEnv("REDIS_SENTINEL_MASTER", ""),
+			SentinelPassword: getEnv("REDIS_SENTINEL_PASSWORD", ""),
+			ClusterAddrs:     splitList(getEnv("REDIS_CLUSTER_ADDRS", "")),
+
+			TLS: RedisTLSConfig{
+				Enabled:            getEnvAsBool("REDIS_TLS", false),
+				CAFile:             getEnv("REDIS_TLS_CA_FILE", ""),
+				CertFile:           getEnv("REDIS_TLS_CERT_FILE", ""),
+				KeyFile:            getEnv("REDIS_TLS_KEY_FILE", ""),
+				ServerName:         getEnv("REDIS_TLS_SERVER_NAME", ""),
+				InsecureSkipVerify: getEnvAsBool("REDIS_TLS_INSECURE_SKIP_VERIFY", false),
+			},
+
+			PoolSize:     getEnvAsInt("REDIS_POOL_SIZE", 0),
+			MinIdleConns: getEnvAsInt("REDIS_MIN_IDLE_CONNS", 0),
+			PoolTimeout:  time.Duration(getEnvAsInt("REDIS_POOL_TIMEOUT_MS", 0)) * time.Millisecond,
+			DialTimeout:  time.Duration(getEnvAsInt("REDIS_DIAL_TIMEOUT_MS", 0)) * time.Millisecond,
+			ReadTimeout:  time.Duration(getEnvAsInt("REDIS_READ_TIMEOUT_MS", 0)) * time.Millisecond,
+			WriteTimeout: time.Duration(getEnvAsInt("REDIS_WRITE_TIMEOUT_MS", 0)) * time.Millisecond,
+
+			FailMode:         getEnv("REDIS_FAIL_MODE", FailOpen),
+			BreakerThreshold: getEnvAsInt("REDIS_BREAKER_THRESHOLD", 5),
+			BreakerCooldown:  time.Duration(getEnvAsInt("REDIS_BREAKER_COOLDOWN_SECONDS", 10)) * time.Second,
 		},
 		RateLimit: RateLimitConfig{
+			Algorithm:              getEnv("RATE_LIMIT_ALGORITHM", AlgorithmFixedWindow),
 			IPRequestsPerSecond:    getEnvAsInt("RATE_LIMIT_IP_REQUESTS_PER_SECOND", 5),
 			IPBlockDurationMinutes: getEnvAsInt("RATE_LIMIT_IP_BLOCK_DURATION_MINUTES", 5),
-			TokenLimits:            loadTokenLimits(),
+			IPv4PrefixLength:       getEnvAsInt("RATE_LIMIT_IPV4_PREFIX", 0),
+			IPv6PrefixLength:       getEnvAsInt("RATE_LIMIT_IPV6_PREFIX", 0),
+			Escalation:             loadBlockEscalation(),
 		},
 		Server: ServerConfig{
-			Port: getEnv("SERVER_PORT", "8080"),
+			Port:           getEnv("SERVER_PORT", "8080"),
+			ProxyProtocol:  getEnvAsBool("SERVER_PROXY_PROTOCOL", false),
+			ClientIPHeader: getEnv("SERVER_CLIENT_IP_HEADER", ClientIPHeaderXForwardedFor),
+			AdminToken:     getEnv("ADMIN_TOKEN", ""),
+			GRPCPort:       getEnv("SERVER_GRPC_PORT", ""),
+			Mode:           getEnv("SERVER_MODE", ModeServer),
 		},
+		Storage:    getEnv("STORAGE_BACKEND", StorageRedis),
+		PolicyFile: getEnv("RATE_LIMIT_POLICIES_FILE", ""),
+	}
+
+	if err := config.Redis.validate(); err != nil {
+		return nil, err
+	}
+
+	var err error
+	if config.Cluster, err = loadCluster(); err != nil {
+		return nil, err
+	}
+
+	if err := validateStorage(config.Storage, config.Cluster); err != nil {
+		return nil, err
+	}
+
+	if config.Audit, err = loadAudit(config.Storage); err != nil {
+		return nil, err
+	}
+
+	if config.Telemetry, err = loadTelemetry(); err != nil {
+		return nil, err
+	}
+
+	if config.RateLimit.Allowlist, err = parsePrefixList(getEnv("RATE_LIMIT_ALLOWLIST", "")); err != nil {
+		return nil, fmt.Errorf("RATE_LIMIT_ALLOWLIST: %w", err)
+	}
+
+	if config.RateLimit.Denylist, err = parsePrefixList(getEnv("RATE_LIMIT_DENYLIST", "")); err != nil {
+		return nil, fmt.Errorf("RATE_LIMIT_DENYLIST: %w", err)
+	}
+
+	if config.Server.TrustedProxies, err = parsePrefixList(getEnv("SERVER_TRUSTED_PROXIES", "")); err != nil {
+		return nil, fmt.Errorf("SERVER_TRUSTED_PROXIES: %w", err)
+	}
+
+	if config.Server.ClientIPHeader, err = parseClientIPHeader(config.Server.ClientIPHeader); err != nil {
+		return nil, err
+	}
+
+	if config.Server.ProxyProtocol && len(config.Server.TrustedProxies) == 0 {
+		return nil, fmt.Errorf("SERVER_PROXY_PROTOCOL requires SERVER_TRUSTED_PROXIES")
+	}
+
+	if config.Server.Upstreams, err = parseUpstreams(getEnv("PROXY_UPSTREAMS", "")); err != nil {
+		return nil, fmt.Errorf("PROXY_UPSTREAMS: %w", err)
+	}
+
+	tokenLimits, err := loadTokenLimits("TOKEN_LIMIT_")
+	if err != nil {
+		return nil, err
+	}
+	if err := loadTokenQuotas("TOKEN_QUOTA_", "TOKEN_LIMIT_", tokenLimits); err != nil {
+		return nil, err
+	}
+	config.RateLimit.TokenLimits = tokenLimits
+
+	tiers, err := loadTokenLimits("TIER_LIMIT_")
+	if err != nil {
+		return nil, err
+	}
+	if err := loadTokenQuotas("TIER_QUOTA_", "TIER_LIMIT_", tiers); err != nil {
+		return nil, err
+	}
+	config.RateLimit.Tiers = tiers
+
+	if config.RateLimit.Auth, err = loadTokenAuth(); err != nil {
+		return nil, err
+	}
+
+	policies, err := loadPolicies()
+	if err != nil {
+		return nil, err
+	}
+	config.RateLimit.Policies = policies
+
+	concurrencyPolicies, err := loadConcurrencyPolicies()
+	if err != nil {
+		return nil, err
+	}
+	config.RateLimit.ConcurrencyPolicies = concurrencyPolicies
+
+	if err := config.RateLimit.validate(); err != nil {
+		return nil, err
+	}
+
+	config.envRateLimit = config.RateLimit
+	if config.PolicyFile != "" {
+		if config.RateLimit, err = config.ReloadPolicyFile(); err != nil {
+			return nil, err
+		}
 	}
 
 	return config, nil
 }
 
-// loadTokenLimits loads token-specific rate limits from environment variables
-func loadTokenLimits() map[string]TokenLimit {
+// ReloadPolicyFile reads the policy file again and returns the environment limits
+// with the file merged over them. The current configuration is left untouched.
+func (c *Config) ReloadPolicyFile() (RateLimitConfig, error) {
+	file, err := ReadPolicyFile(c.PolicyFile)
+	if err != nil {
+		return RateLimitConfig{}, err
+	}
+
+	rateLimit := file.mergeInto(c.envRateLimit)
+	if err := rateLimit.validate(); err != nil {
+		return RateLimitConfig{}, fmt.Errorf("%s: %w", c.PolicyFile, err)
+	}
+
+	return rateLimit, nil
+}
+
+// validate checks the topology, TLS, pool, fail mode and circuit breaker settings
+func (r RedisConfig) validate() error {
+	if err := r.validateConnection(); err != nil {
+		return err
+	}
+
+	if r.FailMode != FailOpen && r.FailMode != FailClosed {
+		return fmt.Errorf("REDIS_FAIL_MODE must be %q or %q, got %q", FailOpen, FailClosed, r.FailMode)
+	}
+
+	if r.BreakerThreshold < 1 {
+		return fmt.Errorf("REDIS_BREAKER_THRESHOLD must be at least 1, got %d", r.BreakerThreshold)
+	}
+
+	if r.BreakerCooldown <= 0 {
+		return fmt.Errorf("REDIS_BREAKER_COOLDOWN_SECONDS must be positive")
+	}
+
+	return nil
+}
+
+// validate checks that every configured algorithm is supported and policies are sound
+func (r RateLimitConfig) validate() error {
+	if !IsValidAlgorithm(r.DefaultAlgorithm()) {
+		return fmt.Errorf("unknown rate limit algorithm %q", r.Algorithm)
+	}
+
+	if r.IPRequestsPerSecond < 0 || r.IPBlockDurationMinutes < 0 {
+		return fmt.Errorf("IP limits must not be negative")
+	}
+
+	if err := r.Escalation.validate(); err != nil {
+		return err
+	}
+
+	if err := r.Auth.validate(r.Tiers); err != nil {
+		return err
+	}
+
+	if r.IPv4PrefixLength < 0 || r.IPv4PrefixLength > 32 {
+		return fmt.Errorf("IPv4 prefix length must be between 0 and 32, got %d", r.IPv4PrefixLength)
+	}
+
+	if r.IPv6PrefixLength < 0 || r.IPv6PrefixLength > 128 {
+		return fmt.Errorf("IPv6 prefix length must be between 0 and 128, got %d", r.IPv6PrefixLength)
+	}
+
+	for token, limit := range r.TokenLimits {
+		if err := limit.Validate(); err != nil {
+			return fmt.Errorf("token %s: %w", token, err)
+		}
+	}
+
+	for ip, limit := range r.IPLimits {
+		if _, err := netip.ParseAddr(ip); err != nil {
+			return fmt.Errorf("invalid IP address %q", ip)
+		}
+
+		if err := limit.Validate(); err != nil {
+			return fmt.Errorf("IP %s: %w", ip, err)
+		}
+
+		if len(limit.Quotas) > 0 {
+			return fmt.Errorf("IP %s: quotas are only supported for tokens", ip)
+		}
+	}
+
+	for _, cidr := range r.CIDRLimits {
+		if !cidr.Prefix.IsValid() {
+			return fmt.Errorf("invalid CIDR %q", cidr.Prefix)
+		}
+
+		if err := cidr.Limit.Validate(); err != nil {
+			return fmt.Errorf("CIDR %s: %w", cidr.Prefix, err)
+		}
+
+		if len(cidr.Limit.Quotas) > 0 {
+			return fmt.Errorf("CIDR %s: quotas are only supported for tokens", cidr.Prefix)
+		}
+	}
+
+	names := make(map[string]bool, len(r.Policies))
+	for _, policy := range r.Policies {
+		if err := policy.validate(); err != nil {
+			return err
+		}
+
+		if names[policy.Name] {
+			return fmt.Errorf("duplicate policy %s", policy.Name)
+		}
+		names[policy.Name] = true
+	}
+
+	concurrencyNames := make(map[string]bool, len(r.ConcurrencyPolicies))
+	for _, policy := range r.ConcurrencyPolicies {
+		if err := policy.validate(); err != nil {
+			return err
+		}
+
+		if concurrencyNames[policy.Name] {
+			return fmt.Errorf("duplicate concurrency policy %s", policy.Name)
+		}
+		concurrencyNames[policy.Name] = true
+	}
+
+	return nil
+}
+
+// Validate checks that a limit is not negative and uses a supported algorithm
+func (t TokenLimit) Validate() error {
+	if t.RequestsPerSecond < 0 {
+		return fmt.Errorf("requests per second must not be negative")
+	}
+
+	if t.BlockDurationMinutes < 0 {
+		return fmt.Errorf("block duration must not be negative")
+	}
+
+	if t.Algorithm != "" && !IsValidAlgorithm(t.Algorithm) {
+		return fmt.Errorf("unknown rate limit algorithm %q", t.Algorithm)
+	}
+
+	return validateQuotas(t.Quotas)
+}
+
+// loadTokenLimits loads token-specific rate limits from the environment variables
+// named prefix followed by the token, or by the plan for tiers
+func loadTokenLimits(prefix string) (map[string]TokenLimit, error) {
 	tokenLimits := make(map[string]TokenLimit)
 
 	for _, env := range os.Environ() {
-		if strings.HasPrefix(env, "TOKEN_LIMIT_") {
+		if strings.HasPrefix(env, prefix) {
 			parts := strings.SplitN(env, "=", 2)
 			if len(parts) != 2 {
 				continue
 			}
 
-			key := strings.TrimPrefix(parts[0], "TOKEN_LIMIT_")
+			key := strings.TrimPrefix(parts[0], prefix)
 			value := parts[1]
 
-			// Parse format: REQUESTS_PER_SECOND:BLOCK_DURATION_MINUTES
+			// Parse format: REQUESTS_PER_SECOND:BLOCK_DURATION_MINUTES[:ALGORITHM]
 			limitParts := strings.Split(value, ":")
-			if len(limitParts) != 2 {
-				continue
+			if len(limitParts) != 2 && len(limitParts) != 3 {
+				return nil, fmt.Errorf("%s: expected REQUESTS_PER_SECOND:BLOCK_DURATION_MINUTES[:ALGORITHM], got %q", parts[0], value)
 			}
 
 			requestsPerSecond, err := strconv.Atoi(limitParts[0])
 			if err != nil {
-				continue
+				return nil, fmt.Errorf("%s: invalid requests per second %q", parts[0], limitParts[0])
 			}
 
 			blockDurationMinutes, err := strconv.Atoi(limitParts[1])
 			if err != nil {
-				continue
+				return nil, fmt.Errorf("%s: invalid block duration %q", parts[0], limitParts[1])
+			}
+
+			var algorithm string
+			if len(limitParts) == 3 {
+				algorithm = limitParts[2]
 			}
 
 			tokenLimits[key] = TokenLimit{
 				RequestsPerSecond:    requestsPerSecond,
 				BlockDurationMinutes: blockDurationMinutes,
+				Algorithm:            algorithm,
 			}
 		}
 	}
 
-	return tokenLimits
+	return tokenLimits, nil
 }
 
 // getEnv gets an environment variable with a default value
@@ -123,3 +571,23 @@ func getEnvAsInt(key string, defaultValue int) int {
 	}
 	return defaultValue
 }
+
+// getEnvAsFloat gets an environment variable as a number with a default value
+func getEnvAsFloat(key string, defaultValue float64) float64 {
+	if value := os.Getenv(key); value != "" {
+		if floatValue, err := strconv.ParseFloat(value, 64); err == nil {
+			return floatValue
+		}
+	}
+	return defaultValue
+}
+
+// getEnvAsBool gets an environment variable as boolean with a default value
+func getEnvAsBool(key string, defaultValue bool) bool {
+	if value := os.Getenv(key); value != "" {
+		if boolValue, err := strconv.ParseBool(value); err == nil {
+			return boolValue
+		}
+	}
+	return defaultValue
+}
@@ -0,0 +1,55 @@
+package config
+
+import (
+	"fmt"
+	"time"
+)
+
+// BlockEscalation lengthens the blocks of keys that keep exceeding their limits. Each
+// block multiplies the configured block duration by Factor once per recent offense,
+// so with a factor of 2 a key is blocked for 5m, then 10m, 20m and so on up to Max.
+// One offense is forgotten every Decay without a new one.
+type BlockEscalation struct {
+	// Factor multiplies the block duration on each repeated offense; 1 or less keeps
+	// every block at the configured duration
+	Factor float64
+	// Max caps the escalated block duration
+	Max time.Duration
+	// Decay is how long it takes for one offense to be forgotten
+	Decay time.Duration
+}
+
+// Enabled reports whether blocks escalate
+func (e BlockEscalation) Enabled() bool {
+	return e.Factor > 1
+}
+
+// validate checks that escalated blocks are bounded in time
+func (e BlockEscalation) validate() error {
+	if e.Factor < 0 {
+		return fmt.Errorf("block escalation factor must not be negative")
+	}
+
+	if !e.Enabled() {
+		return nil
+	}
+
+	if e.Max <= 0 {
+		return fmt.Errorf("maximum block duration must be positive when blocks escalate")
+	}
+
+	if e.Decay <= 0 {
+		return fmt.Errorf("offense decay must be positive when blocks escalate")
+	}
+
+	return nil
+}
+
+// loadBlockEscalation reads the block escalation from the environment
+func loadBlockEscalation() BlockEscalation {
+	return BlockEscalation{
+		Factor: getEnvAsFloat("RATE_LIMIT_BLOCK_ESCALATION_FACTOR", 0),
+		Max:    time.Duration(getEnvAsInt("RATE_LIMIT_BLOCK_MAX_MINUTES", 1440)) * time.Minute,
+		Decay:  time.Duration(getEnvAsInt("RATE_LIMIT_OFFENSE_DECAY_MINUTES", 60)) * time.Minute,
+	}
+}
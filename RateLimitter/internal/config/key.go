@@ -0,0 +1,80 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Kinds of key parts
+const (
+	// KeyIP is the client IP, grouped into subnets like the IP limits
+	KeyIP = "ip"
+	// KeyToken is the token, or the subject of a signed token
+	KeyToken = "token"
+	// KeyMethod is the HTTP method
+	KeyMethod = "method"
+	// KeyRoute is the route template, or the request path when there is none
+	KeyRoute = "route"
+	// KeyHeader, KeyQuery, KeyParam and KeyClaim read the named header, query
+	// parameter, path parameter or claim of a verified signed token
+	KeyHeader = "header"
+	KeyQuery  = "query"
+	KeyParam  = "param"
+	KeyClaim  = "claim"
+)
+
+// KeyPart is one of the values a key is made of
+type KeyPart struct {
+	Kind string
+	// Name is the header, parameter or claim read, empty for the other kinds
+	Name string
+}
+
+// String returns the part as written in a key extractor, such as header:X-Tenant
+func (p KeyPart) String() string {
+	if p.Name == "" {
+		return p.Kind
+	}
+	return p.Kind + ":" + p.Name
+}
+
+// KeyExtractor builds the key requests are counted against from parts of the request,
+// written as parts joined by +, for example claim:tenant+route
+type KeyExtractor []KeyPart
+
+// String returns the extractor as written in a policy
+func (e KeyExtractor) String() string {
+	parts := make([]string, len(e))
+	for i, part := range e {
+		parts[i] = part.String()
+	}
+	return strings.Join(parts, "+")
+}
+
+// ParseKeyExtractor parses a key extractor such as header:X-Account-ID or
+// claim:tenant+route
+func ParseKeyExtractor(value string) (KeyExtractor, error) {
+	var extractor KeyExtractor
+
+	for _, field := range strings.Split(value, "+") {
+		kind, name, _ := strings.Cut(strings.TrimSpace(field), ":")
+		part := KeyPart{Kind: strings.ToLower(strings.TrimSpace(kind)), Name: strings.TrimSpace(name)}
+
+		switch part.Kind {
+		case KeyIP, KeyToken, KeyMethod, KeyRoute:
+			if part.Name != "" {
+				return nil, fmt.Errorf("key part %s takes no name", part.Kind)
+			}
+		case KeyHeader, KeyQuery, KeyParam, KeyClaim:
+			if part.Name == "" {
+				return nil, fmt.Errorf("key part %s needs a name, as in %s:<name>", part.Kind, part.Kind)
+			}
+		default:
+			return nil, fmt.Errorf("unknown key part %q", field)
+		}
+
+		extractor = append(extractor, part)
+	}
+
+	return extractor, nil
+}
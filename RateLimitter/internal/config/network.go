@@ -0,0 +1,107 @@
+package config
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// IsAllowlisted reports whether an address is exempt from limiting
+func (r RateLimitConfig) IsAllowlisted(ip string) bool {
+	return containsAddr(r.Allowlist, ip)
+}
+
+// IsDenylisted reports whether requests from an address must be refused
+func (r RateLimitConfig) IsDenylisted(ip string) bool {
+	return containsAddr(r.Denylist, ip)
+}
+
+// ClientKey returns the key an address is limited by. With a prefix length configured
+// for its family, every address in the same subnet shares the key, so a client cannot
+// escape its limit by rotating through its own range.
+func (r RateLimitConfig) ClientKey(ip string) string {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return ip
+	}
+	addr = addr.Unmap()
+
+	bits := r.IPv6PrefixLength
+	if addr.Is4() {
+		bits = r.IPv4PrefixLength
+	}
+
+	if bits <= 0 || bits >= addr.BitLen() {
+		return ip
+	}
+
+	prefix, err := addr.Prefix(bits)
+	if err != nil {
+		return ip
+	}
+
+	return prefix.String()
+}
+
+// containsAddr reports whether any of the prefixes contains ip
+func containsAddr(prefixes []netip.Prefix, ip string) bool {
+	if len(prefixes) == 0 {
+		return false
+	}
+
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Forwarding headers trusted proxies can report the client IP in
+const (
+	ClientIPHeaderXForwardedFor = "X-Forwarded-For"
+	ClientIPHeaderForwarded     = "Forwarded"
+	ClientIPHeaderXRealIP       = "X-Real-IP"
+)
+
+// parseClientIPHeader returns the ClientIPHeader constant matching value, in any case
+func parseClientIPHeader(value string) (string, error) {
+	for _, header := range []string{ClientIPHeaderXForwardedFor, ClientIPHeaderForwarded, ClientIPHeaderXRealIP} {
+		if strings.EqualFold(strings.TrimSpace(value), header) {
+			return header, nil
+		}
+	}
+	return "", fmt.Errorf("SERVER_CLIENT_IP_HEADER: expected %s, %s or %s, got %q",
+		ClientIPHeaderXForwardedFor, ClientIPHeaderForwarded, ClientIPHeaderXRealIP, value)
+}
+
+// parsePrefixList parses a comma separated list of CIDRs and single addresses
+func parsePrefixList(value string) ([]netip.Prefix, error) {
+	return parsePrefixes(splitList(value))
+}
+
+// parsePrefix parses a CIDR, or a single address as a range holding only itself
+func parsePrefix(value string) (netip.Prefix, error) {
+	if !strings.Contains(value, "/") {
+		addr, err := netip.ParseAddr(value)
+		if err != nil {
+			return netip.Prefix{}, fmt.Errorf("invalid IP address %q", value)
+		}
+		addr = addr.Unmap()
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
+	}
+
+	prefix, err := netip.ParsePrefix(value)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid CIDR %q", value)
+	}
+
+	return prefix.Masked(), nil
+}
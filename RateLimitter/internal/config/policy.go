@@ -0,0 +1,231 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Policy limits the requests that match a set of paths, methods and route group.
+// Requests that match a policy are limited by it instead of the IP and token limits,
+// unless the policy only sets their cost or runs in shadow mode.
+type Policy struct {
+	Name string
+	// Methods the policy applies to, any method when empty
+	Methods []string
+	// Paths are path.Match patterns, checked against both the route template and the
+	// request path. A pattern ending in "/**" matches everything below that prefix.
+	// Any path matches when empty.
+	Paths []string
+	// Group is the route group name given to the middleware, any group when empty
+	Group         string
+	Requests      int
+	Window        time.Duration
+	BlockDuration time.Duration
+	// Algorithm overrides RateLimitConfig.Algorithm when set
+	Algorithm string
+	// Cost is how many requests a matching request counts as, 1 when zero
+	Cost int
+	// CostOnly is set for policies that give a cost but no limit: matching requests
+	// count against the IP and token limits, Cost requests at a time
+	CostOnly bool
+	// Key counts the requests of the policy by parts of the request, such as a tenant
+	// header, instead of by IP or token. Requests missing one of the parts are
+	// counted by IP or token as usual.
+	Key KeyExtractor
+	// Shadow policies are evaluated and their would-be denials recorded, but they never
+	// refuse a request; matching requests are limited as if the policy did not exist
+	Shadow bool
+}
+
+// Matches reports whether a request falls under the policy. routePath is the route
+// template (for example /users/:id) and requestPath the actual URL path.
+func (p Policy) Matches(method, routePath, requestPath, group string) bool {
+	if p.Group != "" && p.Group != group {
+		return false
+	}
+
+	if len(p.Methods) > 0 && !containsFold(p.Methods, method) {
+		return false
+	}
+
+	if len(p.Paths) == 0 {
+		return true
+	}
+
+	for _, pattern := range p.Paths {
+		if matchPath(pattern, routePath) || matchPath(pattern, requestPath) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// validate checks that the policy can be applied
+func (p Policy) validate() error {
+	if p.Name == "" {
+		return fmt.Errorf("policy name is required")
+	}
+
+	if p.Requests < 0 {
+		return fmt.Errorf("policy %s: limit must not be negative", p.Name)
+	}
+
+	if p.Cost < 0 {
+		return fmt.Errorf("policy %s: cost must not be negative", p.Name)
+	}
+
+	if p.Shadow && p.CostOnly {
+		return fmt.Errorf("policy %s: a shadow policy needs a limit", p.Name)
+	}
+
+	if len(p.Key) > 0 && p.CostOnly {
+		return fmt.Errorf("policy %s: a policy with a key needs a limit", p.Name)
+	}
+
+	if p.Window <= 0 {
+		return fmt.Errorf("policy %s: window must be positive", p.Name)
+	}
+
+	if p.BlockDuration < 0 {
+		return fmt.Errorf("policy %s: block duration must not be negative", p.Name)
+	}
+
+	if p.Algorithm != "" && !IsValidAlgorithm(p.Algorithm) {
+		return fmt.Errorf("policy %s: unknown rate limit algorithm %q", p.Name, p.Algorithm)
+	}
+
+	for _, pattern := range p.Paths {
+		if _, err := path.Match(strings.TrimSuffix(pattern, "/**"), ""); err != nil {
+			return fmt.Errorf("policy %s: invalid path pattern %q", p.Name, pattern)
+		}
+	}
+
+	return nil
+}
+
+// matchPath matches a request path against a policy path pattern
+func matchPath(pattern, requestPath string) bool {
+	if requestPath == "" {
+		return false
+	}
+
+	if prefix, found := strings.CutSuffix(pattern, "/**"); found {
+		return requestPath == prefix || strings.HasPrefix(requestPath, prefix+"/")
+	}
+
+	matched, err := path.Match(pattern, requestPath)
+	return err == nil && matched
+}
+
+// containsFold reports whether values contains value, ignoring case
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// loadPolicies loads route policies from environment variables, ordered by name
+func loadPolicies() ([]Policy, error) {
+	var policies []Policy
+
+	for _, env := range os.Environ() {
+		if !strings.HasPrefix(env, "RATE_LIMIT_POLICY_") {
+			continue
+		}
+
+		name, value, _ := strings.Cut(strings.TrimPrefix(env, "RATE_LIMIT_POLICY_"), "=")
+
+		policy, err := parsePolicy(name, value)
+		if err != nil {
+			return nil, err
+		}
+
+		policies = append(policies, policy)
+	}
+
+	sort.Slice(policies, func(i, j int) bool {
+		return policies[i].Name < policies[j].Name
+	})
+
+	return policies, nil
+}
+
+// parsePolicy parses a policy in the format
+// methods=GET,POST;paths=/api/a,/api/b/**;limit=10;window=1s;block=5m;group=api;algorithm=gcra;cost=5;key=header:X-Tenant+route;shadow=true
+// A policy with a cost but no limit only sets the cost of its requests; any other
+// policy needs a limit.
+func parsePolicy(name, value string) (Policy, error) {
+	policy := Policy{Name: name, Window: time.Second}
+	hasLimit := false
+
+	for _, field := range strings.Split(value, ";") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+
+		key, val, found := strings.Cut(field, "=")
+		if !found {
+			return Policy{}, fmt.Errorf("policy %s: expected key=value, got %q", name, field)
+		}
+
+		var err error
+		switch strings.TrimSpace(key) {
+		case "methods":
+			policy.Methods = splitList(val)
+		case "paths":
+			policy.Paths = splitList(val)
+		case "group":
+			policy.Group = strings.TrimSpace(val)
+		case "limit":
+			policy.Requests, err = strconv.Atoi(strings.TrimSpace(val))
+			hasLimit = true
+		case "window":
+			policy.Window, err = time.ParseDuration(strings.TrimSpace(val))
+		case "block":
+			policy.BlockDuration, err = time.ParseDuration(strings.TrimSpace(val))
+		case "algorithm":
+			policy.Algorithm = strings.TrimSpace(val)
+		case "cost":
+			policy.Cost, err = strconv.Atoi(strings.TrimSpace(val))
+		case "key":
+			policy.Key, err = ParseKeyExtractor(val)
+		case "shadow":
+			policy.Shadow, err = strconv.ParseBool(strings.TrimSpace(val))
+		default:
+			return Policy{}, fmt.Errorf("policy %s: unknown field %q", name, key)
+		}
+
+		if err != nil {
+			return Policy{}, fmt.Errorf("policy %s: invalid %s: %w", name, key, err)
+		}
+	}
+
+	// Without a limit every request would be refused
+	if !hasLimit && policy.Cost == 0 {
+		return Policy{}, fmt.Errorf("policy %s: limit is required unless the policy only sets a cost", name)
+	}
+
+	policy.CostOnly = !hasLimit
+	return policy, nil
+}
+
+// splitList splits a comma separated list, dropping empty entries
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,439 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// PolicyFile is the structured policy file, written in YAML or JSON.
+// Everything in it is merged over the limits read from the environment.
+type PolicyFile struct {
+	// Algorithm replaces RATE_LIMIT_ALGORITHM when set
+	Algorithm string `yaml:"algorithm" json:"algorithm"`
+	// IP replaces the default IP limits when set
+	IP *LimitEntry `yaml:"ip" json:"ip"`
+	// IPs override the IP limits for single addresses
+	IPs map[string]LimitEntry `yaml:"ips" json:"ips"`
+	// CIDRs override the IP limits for address ranges
+	CIDRs []CIDREntry `yaml:"cidrs" json:"cidrs"`
+	// Allowlist and Denylist hold CIDRs or addresses, added to the environment ones
+	Allowlist []string `yaml:"allowlist" json:"allowlist"`
+	Denylist  []string `yaml:"denylist" json:"denylist"`
+	// IPv4Prefix and IPv6Prefix replace RATE_LIMIT_IPV4_PREFIX and RATE_LIMIT_IPV6_PREFIX when set
+	IPv4Prefix *int `yaml:"ipv4_prefix" json:"ipv4_prefix"`
+	IPv6Prefix *int `yaml:"ipv6_prefix" json:"ipv6_prefix"`
+	// Tokens are added to the token limits, replacing those with the same name
+	Tokens map[string]LimitEntry `yaml:"tokens" json:"tokens"`
+	// Tiers are added to the TIER_LIMIT_* tiers of signed tokens, replacing those with
+	// the same plan
+	Tiers map[string]LimitEntry `yaml:"tiers" json:"tiers"`
+	// Escalation replaces the block escalation read from the environment when set
+	Escalation *EscalationEntry `yaml:"escalation" json:"escalation"`
+	// Routes are checked before the policies read from the environment
+	Routes []RouteEntry `yaml:"routes" json:"routes"`
+	// Concurrency is checked before the concurrency policies read from the environment
+	Concurrency []ConcurrencyEntry `yaml:"concurrency" json:"concurrency"`
+
+	escalation          BlockEscalation
+	ipLimits            map[string]TokenLimit
+	cidrLimits          []CIDRLimit
+	allowlist           []netip.Prefix
+	denylist            []netip.Prefix
+	policies            []Policy
+	concurrencyPolicies []ConcurrencyPolicy
+}
+
+// LimitEntry is a per second limit for an address, range or token
+type LimitEntry struct {
+	RequestsPerSecond    int    `yaml:"requests_per_second" json:"requests_per_second"`
+	BlockDurationMinutes int    `yaml:"block_duration_minutes" json:"block_duration_minutes"`
+	Algorithm            string `yaml:"algorithm" json:"algorithm"`
+	// Quotas maps hour, day or month to a request quota, for tokens and tiers only
+	Quotas map[string]int `yaml:"quotas" json:"quotas"`
+}
+
+// CIDREntry is a limit shared by every address within a range
+type CIDREntry struct {
+	CIDR       string `yaml:"cidr" json:"cidr"`
+	LimitEntry `yaml:",inline"`
+}
+
+// RouteEntry is a route policy, durations use Go syntax such as 1s or 5m. Routes that
+// only set the cost of their requests leave the limit out; shadow routes are only
+// evaluated, never enforced. Key is a key extractor such as header:X-Tenant+route.
+type RouteEntry struct {
+	Name      string   `yaml:"name" json:"name"`
+	Methods   []string `yaml:"methods" json:"methods"`
+	Paths     []string `yaml:"paths" json:"paths"`
+	Group     string   `yaml:"group" json:"group"`
+	Limit     *int     `yaml:"limit" json:"limit"`
+	Window    string   `yaml:"window" json:"window"`
+	Block     string   `yaml:"block" json:"block"`
+	Algorithm string   `yaml:"algorithm" json:"algorithm"`
+	Cost      int      `yaml:"cost" json:"cost"`
+	Key       string   `yaml:"key" json:"key"`
+	Shadow    bool     `yaml:"shadow" json:"shadow"`
+}
+
+// EscalationEntry is a block escalation, durations use Go syntax such as 24h
+type EscalationEntry struct {
+	Factor float64 `yaml:"factor" json:"factor"`
+	Max    string  `yaml:"max" json:"max"`
+	Decay  string  `yaml:"decay" json:"decay"`
+}
+
+// ConcurrencyEntry is a concurrency policy, the lease uses Go syntax such as 30s and
+// defaults to DefaultLeaseTTL
+type ConcurrencyEntry struct {
+	Name    string   `yaml:"name" json:"name"`
+	Methods []string `yaml:"methods" json:"methods"`
+	Paths   []string `yaml:"paths" json:"paths"`
+	Group   string   `yaml:"group" json:"group"`
+	Limit   int      `yaml:"limit" json:"limit"`
+	Lease   string   `yaml:"lease" json:"lease"`
+}
+
+// ReadPolicyFile reads and validates a policy file. Files ending in .json are read as
+// JSON, anything else as YAML. Unknown fields are rejected so typos do not go unnoticed.
+func ReadPolicyFile(path string) (*PolicyFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read policy file: %w", err)
+	}
+
+	file, err := ParsePolicyFile(data, strings.EqualFold(filepath.Ext(path), ".json"))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return file, nil
+}
+
+// ParsePolicyFile parses and validates the contents of a policy file
+func ParsePolicyFile(data []byte, isJSON bool) (*PolicyFile, error) {
+	file := &PolicyFile{}
+
+	if isJSON {
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(file); err != nil {
+			return nil, fmt.Errorf("invalid JSON: %w", err)
+		}
+	} else {
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		if err := decoder.Decode(file); err != nil && !errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("invalid YAML: %w", err)
+		}
+	}
+
+	if err := file.compile(); err != nil {
+		return nil, err
+	}
+
+	return file, nil
+}
+
+// compile validates the entries and converts them to limits and policies
+func (f *PolicyFile) compile() error {
+	if f.Algorithm != "" && !IsValidAlgorithm(f.Algorithm) {
+		return fmt.Errorf("unknown rate limit algorithm %q", f.Algorithm)
+	}
+
+	if f.IP != nil {
+		if err := f.IP.limit().Validate(); err != nil {
+			return fmt.Errorf("ip: %w", err)
+		}
+
+		if len(f.IP.Quotas) > 0 {
+			return fmt.Errorf("ip: quotas are only supported for tokens")
+		}
+	}
+
+	if f.Escalation != nil {
+		escalation, err := f.Escalation.escalation()
+		if err != nil {
+			return fmt.Errorf("escalation: %w", err)
+		}
+
+		if err := escalation.validate(); err != nil {
+			return fmt.Errorf("escalation: %w", err)
+		}
+		f.escalation = escalation
+	}
+
+	f.ipLimits = make(map[string]TokenLimit, len(f.IPs))
+	for ip, entry := range f.IPs {
+		addr, err := netip.ParseAddr(ip)
+		if err != nil {
+			return fmt.Errorf("ips: invalid IP address %q", ip)
+		}
+
+		if err := entry.limit().Validate(); err != nil {
+			return fmt.Errorf("ips: %s: %w", ip, err)
+		}
+
+		f.ipLimits[addr.Unmap().String()] = entry.limit()
+	}
+
+	f.cidrLimits = make([]CIDRLimit, 0, len(f.CIDRs))
+	for i, entry := range f.CIDRs {
+		prefix, err := parsePrefix(entry.CIDR)
+		if err != nil {
+			return fmt.Errorf("cidrs[%d]: %w", i, err)
+		}
+
+		if err := entry.limit().Validate(); err != nil {
+			return fmt.Errorf("cidrs[%d]: %s: %w", i, entry.CIDR, err)
+		}
+
+		f.cidrLimits = append(f.cidrLimits, CIDRLimit{Prefix: prefix, Limit: entry.limit()})
+	}
+
+	// The most specific range wins when they overlap
+	sort.SliceStable(f.cidrLimits, func(i, j int) bool {
+		return f.cidrLimits[i].Prefix.Bits() > f.cidrLimits[j].Prefix.Bits()
+	})
+
+	var err error
+	if f.allowlist, err = parsePrefixes(f.Allowlist); err != nil {
+		return fmt.Errorf("allowlist: %w", err)
+	}
+
+	if f.denylist, err = parsePrefixes(f.Denylist); err != nil {
+		return fmt.Errorf("denylist: %w", err)
+	}
+
+	for token, entry := range f.Tokens {
+		if token == "" {
+			return fmt.Errorf("tokens: token must not be empty")
+		}
+
+		if err := entry.limit().Validate(); err != nil {
+			return fmt.Errorf("tokens: %s: %w", token, err)
+		}
+	}
+
+	for plan, entry := range f.Tiers {
+		if plan == "" {
+			return fmt.Errorf("tiers: plan must not be empty")
+		}
+
+		if err := entry.limit().Validate(); err != nil {
+			return fmt.Errorf("tiers: %s: %w", plan, err)
+		}
+	}
+
+	f.policies = make([]Policy, 0, len(f.Routes))
+	names := make(map[string]bool, len(f.Routes))
+	for i, route := range f.Routes {
+		policy, err := route.policy()
+		if err != nil {
+			return fmt.Errorf("routes[%d]: %w", i, err)
+		}
+
+		if err := policy.validate(); err != nil {
+			return fmt.Errorf("routes[%d]: %w", i, err)
+		}
+
+		if names[policy.Name] {
+			return fmt.Errorf("routes[%d]: duplicate policy %s", i, policy.Name)
+		}
+		names[policy.Name] = true
+
+		f.policies = append(f.policies, policy)
+	}
+
+	f.concurrencyPolicies = make([]ConcurrencyPolicy, 0, len(f.Concurrency))
+	concurrencyNames := make(map[string]bool, len(f.Concurrency))
+	for i, entry := range f.Concurrency {
+		policy, err := entry.policy()
+		if err != nil {
+			return fmt.Errorf("concurrency[%d]: %w", i, err)
+		}
+
+		if err := policy.validate(); err != nil {
+			return fmt.Errorf("concurrency[%d]: %w", i, err)
+		}
+
+		if concurrencyNames[policy.Name] {
+			return fmt.Errorf("concurrency[%d]: duplicate concurrency policy %s", i, policy.Name)
+		}
+		concurrencyNames[policy.Name] = true
+
+		f.concurrencyPolicies = append(f.concurrencyPolicies, policy)
+	}
+
+	return nil
+}
+
+// mergeInto returns base with the file applied over it
+func (f *PolicyFile) mergeInto(base RateLimitConfig) RateLimitConfig {
+	merged := base
+
+	if f.Algorithm != "" {
+		merged.Algorithm = f.Algorithm
+	}
+
+	if f.IP != nil {
+		merged.IPRequestsPerSecond = f.IP.RequestsPerSecond
+		merged.IPBlockDurationMinutes = f.IP.BlockDurationMinutes
+	}
+
+	if f.Escalation != nil {
+		merged.Escalation = f.escalation
+	}
+
+	if f.IPv4Prefix != nil {
+		merged.IPv4PrefixLength = *f.IPv4Prefix
+	}
+
+	if f.IPv6Prefix != nil {
+		merged.IPv6PrefixLength = *f.IPv6Prefix
+	}
+
+	merged.Allowlist = append(append([]netip.Prefix{}, base.Allowlist...), f.allowlist...)
+	merged.Denylist = append(append([]netip.Prefix{}, base.Denylist...), f.denylist...)
+
+	merged.TokenLimits = make(map[string]TokenLimit, len(base.TokenLimits)+len(f.Tokens))
+	for token, limit := range base.TokenLimits {
+		merged.TokenLimits[token] = limit
+	}
+	for token, entry := range f.Tokens {
+		merged.TokenLimits[token] = entry.limit()
+	}
+
+	merged.Tiers = make(map[string]TokenLimit, len(base.Tiers)+len(f.Tiers))
+	for plan, limit := range base.Tiers {
+		merged.Tiers[plan] = limit
+	}
+	for plan, entry := range f.Tiers {
+		merged.Tiers[plan] = entry.limit()
+	}
+
+	merged.IPLimits = f.ipLimits
+	merged.CIDRLimits = f.cidrLimits
+	merged.Policies = append(append([]Policy{}, f.policies...), base.Policies...)
+	merged.ConcurrencyPolicies = append(append([]ConcurrencyPolicy{}, f.concurrencyPolicies...), base.ConcurrencyPolicies...)
+
+	return merged
+}
+
+// parsePrefixes parses a list of CIDRs and single addresses
+func parsePrefixes(values []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(values))
+	for _, value := range values {
+		prefix, err := parsePrefix(value)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes, nil
+}
+
+// limit converts the entry to a TokenLimit
+func (e LimitEntry) limit() TokenLimit {
+	return TokenLimit{
+		RequestsPerSecond:    e.RequestsPerSecond,
+		BlockDurationMinutes: e.BlockDurationMinutes,
+		Algorithm:            e.Algorithm,
+		Quotas:               e.Quotas,
+	}
+}
+
+// policy converts the route to a Policy, the window defaults to one second
+func (r RouteEntry) policy() (Policy, error) {
+	policy := Policy{
+		Name:      r.Name,
+		Methods:   r.Methods,
+		Paths:     r.Paths,
+		Group:     r.Group,
+		Window:    time.Second,
+		Algorithm: r.Algorithm,
+		Cost:      r.Cost,
+		Shadow:    r.Shadow,
+	}
+
+	switch {
+	case r.Limit != nil:
+		policy.Requests = *r.Limit
+	case r.Cost != 0:
+		policy.CostOnly = true
+	default:
+		return Policy{}, fmt.Errorf("policy %s: limit is required unless the policy only sets a cost", r.Name)
+	}
+
+	var err error
+	if r.Window != "" {
+		if policy.Window, err = time.ParseDuration(r.Window); err != nil {
+			return Policy{}, fmt.Errorf("policy %s: invalid window: %w", r.Name, err)
+		}
+	}
+
+	if r.Block != "" {
+		if policy.BlockDuration, err = time.ParseDuration(r.Block); err != nil {
+			return Policy{}, fmt.Errorf("policy %s: invalid block: %w", r.Name, err)
+		}
+	}
+
+	if r.Key != "" {
+		if policy.Key, err = ParseKeyExtractor(r.Key); err != nil {
+			return Policy{}, fmt.Errorf("policy %s: invalid key: %w", r.Name, err)
+		}
+	}
+
+	return policy, nil
+}
+
+// policy converts the entry to a ConcurrencyPolicy
+func (e ConcurrencyEntry) policy() (ConcurrencyPolicy, error) {
+	policy := ConcurrencyPolicy{
+		Name:     e.Name,
+		Methods:  e.Methods,
+		Paths:    e.Paths,
+		Group:    e.Group,
+		Limit:    e.Limit,
+		LeaseTTL: DefaultLeaseTTL,
+	}
+
+	if e.Lease != "" {
+		var err error
+		if policy.LeaseTTL, err = time.ParseDuration(e.Lease); err != nil {
+			return ConcurrencyPolicy{}, fmt.Errorf("concurrency policy %s: invalid lease: %w", e.Name, err)
+		}
+	}
+
+	return policy, nil
+}
+
+// escalation converts the entry to a BlockEscalation
+func (e EscalationEntry) escalation() (BlockEscalation, error) {
+	escalation := BlockEscalation{Factor: e.Factor}
+
+	var err error
+	if e.Max != "" {
+		if escalation.Max, err = time.ParseDuration(e.Max); err != nil {
+			return BlockEscalation{}, fmt.Errorf("invalid max: %w", err)
+		}
+	}
+
+	if e.Decay != "" {
+		if escalation.Decay, err = time.ParseDuration(e.Decay); err != nil {
+			return BlockEscalation{}, fmt.Errorf("invalid decay: %w", err)
+		}
+	}
+
+	return escalation, nil
+}
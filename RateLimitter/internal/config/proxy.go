@@ -0,0 +1,96 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// Server modes
+const (
+	// ModeServer serves the demo API
+	ModeServer = "server"
+	// ModeProxy rate limits requests and forwards them to the upstreams
+	ModeProxy = "proxy"
+)
+
+// Upstream is a service the reverse proxy forwards requests to
+type Upstream struct {
+	// PathPrefix selects the requests sent to this upstream
+	PathPrefix string
+	URL        *url.URL
+}
+
+// UpstreamFor returns the upstream with the longest prefix matching path
+func (s ServerConfig) UpstreamFor(path string) (Upstream, bool) {
+	for _, upstream := range s.Upstreams {
+		if matchPrefix(upstream.PathPrefix, path) {
+			return upstream, true
+		}
+	}
+	return Upstream{}, false
+}
+
+// ValidateMode checks the server mode and that proxy mode has somewhere to forward to
+func (s ServerConfig) ValidateMode() error {
+	switch s.Mode {
+	case "", ModeServer:
+		return nil
+	case ModeProxy:
+		if len(s.Upstreams) == 0 {
+			return fmt.Errorf("proxy mode requires PROXY_UPSTREAMS")
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown server mode %q, expected %q or %q", s.Mode, ModeServer, ModeProxy)
+}
+
+// matchPrefix reports whether path is prefix or lies below it
+func matchPrefix(prefix, path string) bool {
+	if prefix == "/" {
+		return true
+	}
+	return path == prefix || strings.HasPrefix(path, strings.TrimSuffix(prefix, "/")+"/")
+}
+
+// parseUpstreams parses a comma separated list of upstreams such as
+// "/api=http://api:8080,/=http://web:8080". A URL alone is mounted at "/".
+// Upstreams are returned longest prefix first.
+func parseUpstreams(value string) ([]Upstream, error) {
+	var upstreams []Upstream
+	seen := make(map[string]bool)
+
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		prefix, rawURL := "/", entry
+		if strings.HasPrefix(entry, "/") {
+			var found bool
+			if prefix, rawURL, found = strings.Cut(entry, "="); !found {
+				return nil, fmt.Errorf("invalid upstream %q, expected <prefix>=<url>", entry)
+			}
+		}
+
+		target, err := url.Parse(rawURL)
+		if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+			return nil, fmt.Errorf("invalid upstream URL %q", rawURL)
+		}
+
+		if seen[prefix] {
+			return nil, fmt.Errorf("duplicate upstream prefix %s", prefix)
+		}
+		seen[prefix] = true
+
+		upstreams = append(upstreams, Upstream{PathPrefix: prefix, URL: target})
+	}
+
+	sort.SliceStable(upstreams, func(i, j int) bool {
+		return len(upstreams[i].PathPrefix) > len(upstreams[j].PathPrefix)
+	})
+
+	return upstreams, nil
+}
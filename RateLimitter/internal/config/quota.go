@@ -0,0 +1,117 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Quota periods, checked from the shortest to the longest
+const (
+	QuotaHour  = "hour"
+	QuotaDay   = "day"
+	QuotaMonth = "month"
+)
+
+// QuotaPeriods lists the quota periods in the order they are checked
+var QuotaPeriods = []string{QuotaHour, QuotaDay, QuotaMonth}
+
+// IsValidQuotaPeriod reports whether period is a supported quota period
+func IsValidQuotaPeriod(period string) bool {
+	for _, known := range QuotaPeriods {
+		if period == known {
+			return true
+		}
+	}
+	return false
+}
+
+// QuotaWindow returns the calendar period containing now, in UTC, and a stamp naming it
+// such as "2024-05" for a month. Quotas reset when their period ends.
+func QuotaWindow(period string, now time.Time) (start, end time.Time, stamp string) {
+	now = now.UTC()
+
+	switch period {
+	case QuotaHour:
+		start = now.Truncate(time.Hour)
+		return start, start.Add(time.Hour), start.Format("2006-01-02T15")
+	case QuotaDay:
+		start = time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+		return start, start.AddDate(0, 0, 1), start.Format("2006-01-02")
+	default:
+		start = time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+		return start, start.AddDate(0, 1, 0), start.Format("2006-01")
+	}
+}
+
+// validateQuotas checks the periods and amounts of a token's quotas
+func validateQuotas(quotas map[string]int) error {
+	for period, requests := range quotas {
+		if !IsValidQuotaPeriod(period) {
+			return fmt.Errorf("unknown quota period %q, expected %s", period, strings.Join(QuotaPeriods, ", "))
+		}
+
+		if requests <= 0 {
+			return fmt.Errorf("%s quota must be positive", period)
+		}
+	}
+	return nil
+}
+
+// loadTokenQuotas adds the quotas read from <PREFIX><TOKEN>=<REQUESTS>/<PERIOD>,...
+// (TOKEN_QUOTA_ or TIER_QUOTA_) to the limits read from limitPrefix, which must exist
+func loadTokenQuotas(prefix, limitPrefix string, tokenLimits map[string]TokenLimit) error {
+	for _, env := range os.Environ() {
+		name, value, found := strings.Cut(env, "=")
+		if !found || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+
+		token := strings.TrimPrefix(name, prefix)
+		limit, exists := tokenLimits[token]
+		if !exists {
+			return fmt.Errorf("%s: %s has no %s%s", name, token, limitPrefix, token)
+		}
+
+		quotas, err := parseQuotas(value)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+
+		limit.Quotas = quotas
+		tokenLimits[token] = limit
+	}
+
+	return nil
+}
+
+// parseQuotas parses a list of quotas such as "50000/day,1000000/month"
+func parseQuotas(value string) (map[string]int, error) {
+	quotas := make(map[string]int)
+
+	for _, entry := range splitList(value) {
+		amount, period, found := strings.Cut(entry, "/")
+		if !found {
+			return nil, fmt.Errorf("expected <REQUESTS>/<PERIOD>, got %q", entry)
+		}
+
+		requests, err := strconv.Atoi(strings.TrimSpace(amount))
+		if err != nil {
+			return nil, fmt.Errorf("invalid quota %q", entry)
+		}
+
+		period = strings.TrimSpace(period)
+		if _, duplicate := quotas[period]; duplicate {
+			return nil, fmt.Errorf("duplicate %s quota", period)
+		}
+		quotas[period] = requests
+	}
+
+	if err := validateQuotas(quotas); err != nil {
+		return nil, err
+	}
+
+	return quotas, nil
+}
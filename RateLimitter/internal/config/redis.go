@@ -0,0 +1,102 @@
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+)
+
+// RedisTLSConfig holds the TLS settings of the Redis connection
+type RedisTLSConfig struct {
+	Enabled bool
+	// CAFile verifies the server with a custom CA instead of the system pool
+	CAFile string
+	// CertFile and KeyFile present a client certificate
+	CertFile string
+	KeyFile  string
+	// ServerName overrides the name the server certificate is checked against
+	ServerName         string
+	InsecureSkipVerify bool
+}
+
+// Addrs returns the addresses to connect to: the Cluster seeds, the Sentinels or the
+// single node
+func (r RedisConfig) Addrs() []string {
+	switch {
+	case len(r.ClusterAddrs) > 0:
+		return r.ClusterAddrs
+	case r.MasterName != "":
+		return r.SentinelAddrs
+	}
+	return []string{net.JoinHostPort(r.Host, r.Port)}
+}
+
+// TLSConfig builds the TLS configuration, nil when TLS is disabled
+func (r RedisConfig) TLSConfig() (*tls.Config, error) {
+	if !r.TLS.Enabled {
+		return nil, nil
+	}
+
+	cfg := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         r.TLS.ServerName,
+		InsecureSkipVerify: r.TLS.InsecureSkipVerify,
+	}
+
+	if r.TLS.CAFile != "" {
+		pem, err := os.ReadFile(r.TLS.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("REDIS_TLS_CA_FILE: %w", err)
+		}
+
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("REDIS_TLS_CA_FILE: no certificates found in %s", r.TLS.CAFile)
+		}
+	}
+
+	if r.TLS.CertFile != "" || r.TLS.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(r.TLS.CertFile, r.TLS.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("REDIS_TLS_CERT_FILE/REDIS_TLS_KEY_FILE: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	return cfg, nil
+}
+
+// validateConnection checks that a single topology is configured, with the settings
+// it needs, and that the TLS files load
+func (r RedisConfig) validateConnection() error {
+	if len(r.ClusterAddrs) > 0 && (r.MasterName != "" || len(r.SentinelAddrs) > 0) {
+		return fmt.Errorf("set either REDIS_CLUSTER_ADDRS or the REDIS_SENTINEL_* settings, not both")
+	}
+
+	if (r.MasterName == "") != (len(r.SentinelAddrs) == 0) {
+		return fmt.Errorf("REDIS_SENTINEL_ADDRS and REDIS_SENTINEL_MASTER must be set together")
+	}
+
+	if len(r.ClusterAddrs) > 0 && r.DB != 0 {
+		return fmt.Errorf("REDIS_DB is not supported by Redis Cluster")
+	}
+
+	for _, addr := range r.Addrs() {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return fmt.Errorf("invalid Redis address %q, expected host:port", addr)
+		}
+	}
+
+	if r.PoolSize < 0 || r.MinIdleConns < 0 {
+		return fmt.Errorf("REDIS_POOL_SIZE and REDIS_MIN_IDLE_CONNS must not be negative")
+	}
+
+	if r.PoolTimeout < 0 || r.DialTimeout < 0 || r.ReadTimeout < 0 || r.WriteTimeout < 0 {
+		return fmt.Errorf("REDIS_*_TIMEOUT_MS must not be negative")
+	}
+
+	_, err := r.TLSConfig()
+	return err
+}
@@ -0,0 +1,45 @@
+package config
+
+import (
+	"fmt"
+	"log/slog"
+
+	"rate-limiter/internal/telemetry"
+)
+
+// TelemetryConfig holds where traces are exported and how logs are written
+type TelemetryConfig struct {
+	// ServiceName names the rate limiter in traces
+	ServiceName string
+	// OTLPEndpoint is the OpenTelemetry Collector spans are sent to over OTLP HTTP,
+	// tracing is off when empty
+	OTLPEndpoint string
+	// LogLevel is the lowest level logged
+	LogLevel slog.Level
+	// LogFormat is telemetry.LogJSON or telemetry.LogText
+	LogFormat string
+}
+
+// TracingEnabled reports whether spans are exported
+func (t TelemetryConfig) TracingEnabled() bool {
+	return t.OTLPEndpoint != ""
+}
+
+// loadTelemetry reads the tracing and logging settings from the environment
+func loadTelemetry() (TelemetryConfig, error) {
+	settings := TelemetryConfig{
+		ServiceName:  getEnv("OTEL_SERVICE_NAME", "rate-limiter"),
+		OTLPEndpoint: getEnv("OTEL_EXPORTER_OTLP_ENDPOINT", ""),
+		LogFormat:    getEnv("LOG_FORMAT", telemetry.LogJSON),
+	}
+
+	if err := settings.LogLevel.UnmarshalText([]byte(getEnv("LOG_LEVEL", "info"))); err != nil {
+		return TelemetryConfig{}, fmt.Errorf("LOG_LEVEL: expected debug, info, warn or error, got %q", getEnv("LOG_LEVEL", ""))
+	}
+
+	if settings.LogFormat != telemetry.LogJSON && settings.LogFormat != telemetry.LogText {
+		return TelemetryConfig{}, fmt.Errorf("LOG_FORMAT: expected %s or %s, got %q", telemetry.LogJSON, telemetry.LogText, settings.LogFormat)
+	}
+
+	return settings, nil
+}
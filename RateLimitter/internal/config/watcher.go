@@ -0,0 +1,90 @@
+package config
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// reloadDelay groups the bursts of events editors and deploy tools produce for one save
+const reloadDelay = 100 * time.Millisecond
+
+// PolicyWatcher reloads the policy file when it changes
+type PolicyWatcher struct {
+	watcher *fsnotify.Watcher
+	done    chan struct{}
+}
+
+// WatchPolicyFile watches the policy file and calls apply with the merged limits every
+// time it changes. A file that fails to load is reported to onError and the previous
+// limits stay in place.
+func (c *Config) WatchPolicyFile(apply func(RateLimitConfig), onError func(error)) (*PolicyWatcher, error) {
+	if c.PolicyFile == "" {
+		return nil, fmt.Errorf("no policy file configured")
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("failed to watch policy file: %w", err)
+	}
+
+	// The directory is watched so files replaced by a rename or a symlink swap are seen
+	dir := filepath.Dir(c.PolicyFile)
+	if err := watcher.Add(dir); err != nil {
+		watcher.Close()
+		return nil, fmt.Errorf("failed to watch policy file: %w", err)
+	}
+
+	w := &PolicyWatcher{watcher: watcher, done: make(chan struct{})}
+	go w.run(c, apply, onError)
+
+	return w, nil
+}
+
+// run reloads the file after each burst of changes until the watcher is closed
+func (w *PolicyWatcher) run(c *Config, apply func(RateLimitConfig), onError func(error)) {
+	defer close(w.done)
+
+	name := filepath.Clean(c.PolicyFile)
+	timer := time.NewTimer(reloadDelay)
+	timer.Stop()
+
+	for {
+		select {
+		case event, ok := <-w.watcher.Events:
+			if !ok {
+				timer.Stop()
+				return
+			}
+
+			// Kubernetes swaps mounted files through the ..data symlink
+			if filepath.Clean(event.Name) == name || filepath.Base(event.Name) == "..data" {
+				timer.Reset(reloadDelay)
+			}
+
+		case err, ok := <-w.watcher.Errors:
+			if !ok {
+				timer.Stop()
+				return
+			}
+			onError(err)
+
+		case <-timer.C:
+			rateLimit, err := c.ReloadPolicyFile()
+			if err != nil {
+				onError(err)
+				continue
+			}
+			apply(rateLimit)
+		}
+	}
+}
+
+// Close stops watching the file
+func (w *PolicyWatcher) Close() error {
+	err := w.watcher.Close()
+	<-w.done
+	return err
+}
@@ -0,0 +1,336 @@
+package envoy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"rate-limiter/internal/config"
+	"rate-limiter/internal/limiter"
+	"rate-limiter/internal/middleware"
+	"rate-limiter/internal/storage"
+
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	ratelimitv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/common/ratelimit/v3"
+	rls "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	typev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// Descriptor entry keys the service understands
+const (
+	// EntryRemoteAddress holds the client IP, as sent by the remote_address action
+	EntryRemoteAddress = "remote_address"
+	// EntryToken holds the access token, usually from a request_headers action
+	EntryToken = "api_key"
+	// EntryPolicy names the policy to apply, usually from a generic_key action
+	EntryPolicy = "generic_key"
+	// EntryMethod and EntryPath let policies match on the request like the middleware does
+	EntryMethod = "method"
+	EntryPath   = "path"
+)
+
+// Service implements the Envoy ratelimit.v3 RateLimitService on top of a RateLimiter.
+// Every descriptor is checked on its own and the request is over limit when any of
+// them is. Within a descriptor:
+//
+//   - remote_address and api_key give the IP and token, as the middleware reads them
+//   - generic_key names the policy to apply; otherwise method and path are matched
+//     against the policies, with the request domain as the route group
+//   - a descriptor with neither an IP nor a token is limited by its entries, so
+//     descriptors such as [("tenant", "acme")] each get their own counter
+//   - a limit override in the descriptor replaces the configured limit
+//   - hits_addend, of the descriptor or else of the request, is the cost of the request
+type Service struct {
+	rls.UnimplementedRateLimitServiceServer
+
+	rateLimiter *limiter.RateLimiter
+}
+
+// NewService creates the rate limit service
+func NewService(rateLimiter *limiter.RateLimiter) *Service {
+	return &Service{rateLimiter: rateLimiter}
+}
+
+// ShouldRateLimit checks every descriptor of a request
+func (s *Service) ShouldRateLimit(ctx context.Context, req *rls.RateLimitRequest) (*rls.RateLimitResponse, error) {
+	if len(req.GetDescriptors()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "rate limit request has no descriptors")
+	}
+
+	response := &rls.RateLimitResponse{OverallCode: rls.RateLimitResponse_OK}
+
+	// The headers describe the most restrictive descriptor, the first denied one if any
+	var headerResult *limiter.LimiterResult
+
+	for _, descriptor := range req.GetDescriptors() {
+		result, err := s.check(withHitsAddend(ctx, req, descriptor), req.GetDomain(), descriptor)
+		if errors.Is(err, storage.ErrUnavailable) {
+			return nil, status.Error(codes.Unavailable, "rate limiter unavailable")
+		}
+		if errors.Is(err, limiter.ErrUnknownPolicy) {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+
+		response.Statuses = append(response.Statuses, descriptorStatus(result))
+
+		if !result.Allowed {
+			response.OverallCode = rls.RateLimitResponse_OVER_LIMIT
+		}
+
+		if result.Exempt || result.Denied || result.Unauthenticated {
+			continue
+		}
+		if headerResult == nil || (headerResult.Allowed && (!result.Allowed || result.Remaining < headerResult.Remaining)) {
+			headerResult = result
+		}
+	}
+
+	if headerResult != nil {
+		response.ResponseHeadersToAdd = rateLimitHeaders(headerResult)
+	}
+
+	return response, nil
+}
+
+// check checks a single descriptor
+func (s *Service) check(ctx context.Context, domain string, descriptor *ratelimitv3.RateLimitDescriptor) (*limiter.LimiterResult, error) {
+	var ip, token, policyName, method, path, query string
+	entries := make(map[string]string, len(descriptor.GetEntries()))
+	for _, entry := range descriptor.GetEntries() {
+		entries[strings.ToLower(entry.GetKey())] = entry.GetValue()
+
+		switch entry.GetKey() {
+		case EntryRemoteAddress:
+			ip = entry.GetValue()
+		case EntryToken:
+			token = entry.GetValue()
+		case EntryPolicy:
+			policyName = entry.GetValue()
+		case EntryMethod, ":method":
+			method = entry.GetValue()
+		case EntryPath, ":path":
+			path, query, _ = strings.Cut(entry.GetValue(), "?")
+		}
+	}
+
+	policy, err := s.policy(domain, descriptor, policyName, method, path)
+	if err != nil {
+		return nil, err
+	}
+
+	// Shadow policies are matched like route policies; a named one is evaluated on its own
+	var shadow []*config.Policy
+	if policyName == "" {
+		shadow = s.rateLimiter.MatchShadowPolicies(method, path, path, domain)
+	}
+
+	source := descriptorKeySource{entries: entries, method: method, path: path, query: query}
+	key := s.rateLimiter.BuildKey(ip, token, source, append(shadow, policy)...)
+
+	// Descriptors of other entries are counted by them, not taken for an address
+	if ip == "" && token == "" {
+		key.Custom = descriptorKey(descriptor)
+	}
+
+	return s.rateLimiter.CheckPolicies(ctx, policy, shadow, key)
+}
+
+// descriptorKeySource reads key parts from a descriptor. Headers and path parameters
+// are the entries named like them, for example the descriptor_key of a request_headers
+// action, and query parameters come from the path entry.
+type descriptorKeySource struct {
+	entries      map[string]string
+	method, path string
+	query        string
+}
+
+func (s descriptorKeySource) Method() string            { return s.method }
+func (s descriptorKeySource) Route() string             { return s.path }
+func (s descriptorKeySource) Header(name string) string { return s.entries[strings.ToLower(name)] }
+func (s descriptorKeySource) Param(name string) string  { return s.entries[strings.ToLower(name)] }
+
+func (s descriptorKeySource) Query(name string) string {
+	values, _ := url.ParseQuery(s.query)
+	return values.Get(name)
+}
+
+// policy resolves the policy a descriptor is limited by, nil for the IP and token limits
+func (s *Service) policy(domain string, descriptor *ratelimitv3.RateLimitDescriptor, name, method, path string) (*config.Policy, error) {
+	if override := descriptor.GetLimit(); override != nil {
+		if window, ok := unitDuration(override.GetUnit()); ok {
+			// Named after the entry keys only, as the name ends up in metric labels,
+			// audit events and traces; the values are part of the counted key
+			return &config.Policy{
+				Name:     domain + ":" + descriptorEntryKeys(descriptor),
+				Requests: int(override.GetRequestsPerUnit()),
+				Window:   window,
+				Key:      descriptorKeyExtractor(descriptor),
+			}, nil
+		}
+	}
+
+	if name != "" {
+		limits := s.rateLimiter.Limits()
+		for i := range limits.Policies {
+			if limits.Policies[i].Name == name {
+				return &limits.Policies[i], nil
+			}
+		}
+		return nil, fmt.Errorf("%w %q", limiter.ErrUnknownPolicy, name)
+	}
+
+	if method == "" && path == "" {
+		return nil, nil
+	}
+	return s.rateLimiter.MatchPolicy(method, path, path, domain), nil
+}
+
+// withHitsAddend carries the hits_addend of a descriptor, or else of the request, as
+// the cost of the check. Zero keeps the cost of the policy, or 1.
+func withHitsAddend(ctx context.Context, req *rls.RateLimitRequest, descriptor *ratelimitv3.RateLimitDescriptor) context.Context {
+	hits := uint64(req.GetHitsAddend())
+	if addend := descriptor.GetHitsAddend(); addend != nil {
+		hits = addend.GetValue()
+	}
+
+	if hits == 0 {
+		return ctx
+	}
+	return limiter.WithCost(ctx, int(min(hits, math.MaxInt32)))
+}
+
+// descriptorKey joins the entries of a descriptor into a key such as "tenant=acme/plan=free"
+func descriptorKey(descriptor *ratelimitv3.RateLimitDescriptor) string {
+	entries := make([]string, 0, len(descriptor.GetEntries()))
+	for _, entry := range descriptor.GetEntries() {
+		entries = append(entries, entry.GetKey()+"="+entry.GetValue())
+	}
+	return strings.Join(entries, "/")
+}
+
+// descriptorEntryKeys joins the entry keys of a descriptor, such as "tenant/plan"
+func descriptorEntryKeys(descriptor *ratelimitv3.RateLimitDescriptor) string {
+	keys := make([]string, 0, len(descriptor.GetEntries()))
+	for _, entry := range descriptor.GetEntries() {
+		keys = append(keys, entry.GetKey())
+	}
+	return strings.Join(keys, "/")
+}
+
+// descriptorKeyExtractor counts a descriptor by all of its entries, so that descriptors
+// with the same keys and other values are counted apart. It is nil when the entries are
+// the IP and token only, which make up the usual key already.
+func descriptorKeyExtractor(descriptor *ratelimitv3.RateLimitDescriptor) config.KeyExtractor {
+	var extractor config.KeyExtractor
+	others := false
+
+	for _, entry := range descriptor.GetEntries() {
+		switch entry.GetKey() {
+		case EntryRemoteAddress:
+			extractor = append(extractor, config.KeyPart{Kind: config.KeyIP})
+		case EntryToken:
+			extractor = append(extractor, config.KeyPart{Kind: config.KeyToken})
+		default:
+			// Entries are read by descriptorKeySource like headers
+			extractor = append(extractor, config.KeyPart{Kind: config.KeyHeader, Name: entry.GetKey()})
+			others = true
+		}
+	}
+
+	if !others {
+		return nil
+	}
+	return extractor
+}
+
+// descriptorStatus describes the outcome of a descriptor
+func descriptorStatus(result *limiter.LimiterResult) *rls.RateLimitResponse_DescriptorStatus {
+	code := rls.RateLimitResponse_OK
+	if !result.Allowed {
+		code = rls.RateLimitResponse_OVER_LIMIT
+	}
+
+	descriptorStatus := &rls.RateLimitResponse_DescriptorStatus{Code: code}
+	if result.Exempt || result.Denied || result.Unauthenticated {
+		return descriptorStatus
+	}
+
+	descriptorStatus.CurrentLimit = currentLimit(result)
+	descriptorStatus.LimitRemaining = uint32(max(0, result.Remaining))
+	descriptorStatus.DurationUntilReset = durationpb.New(result.ResetAfter)
+	return descriptorStatus
+}
+
+// currentLimit expresses the applied limit in Envoy's units. Windows that are not one
+// unit long are reported as UNKNOWN, with the window in the name.
+func currentLimit(result *limiter.LimiterResult) *rls.RateLimitResponse_RateLimit {
+	limit := &rls.RateLimitResponse_RateLimit{
+		Name:            fmt.Sprintf("%d;w=%d", result.Limit, int(result.Window.Seconds())),
+		RequestsPerUnit: uint32(max(0, result.Limit)),
+	}
+
+	switch result.Window {
+	case time.Second:
+		limit.Unit = rls.RateLimitResponse_RateLimit_SECOND
+	case time.Minute:
+		limit.Unit = rls.RateLimitResponse_RateLimit_MINUTE
+	case time.Hour:
+		limit.Unit = rls.RateLimitResponse_RateLimit_HOUR
+	case 24 * time.Hour:
+		limit.Unit = rls.RateLimitResponse_RateLimit_DAY
+	}
+
+	return limit
+}
+
+// unitDuration returns the window of a limit override unit
+func unitDuration(unit typev3.RateLimitUnit) (time.Duration, bool) {
+	switch unit {
+	case typev3.RateLimitUnit_SECOND:
+		return time.Second, true
+	case typev3.RateLimitUnit_MINUTE:
+		return time.Minute, true
+	case typev3.RateLimitUnit_HOUR:
+		return time.Hour, true
+	case typev3.RateLimitUnit_DAY:
+		return 24 * time.Hour, true
+	}
+	return 0, false
+}
+
+// rateLimitHeaders returns the RateLimit headers for Envoy to add to the response,
+// quota headers included
+func rateLimitHeaders(result *limiter.LimiterResult) []*corev3.HeaderValue {
+	header := http.Header{}
+	middleware.SetRateLimitHeaders(header, result)
+	if !result.Allowed {
+		header.Set("Retry-After", strconv.Itoa(middleware.RetryAfterSeconds(result)))
+	}
+
+	keys := []string{"RateLimit-Limit", "RateLimit-Remaining", "RateLimit-Reset", "RateLimit-Policy"}
+	for _, quota := range result.Quotas {
+		prefix := middleware.QuotaHeaderPrefix(quota.Period)
+		keys = append(keys, prefix+"-Limit", prefix+"-Remaining", prefix+"-Reset")
+	}
+	keys = append(keys, "Retry-After")
+
+	var headers []*corev3.HeaderValue
+	for _, key := range keys {
+		if value := header.Get(key); value != "" {
+			headers = append(headers, &corev3.HeaderValue{Key: key, Value: value})
+		}
+	}
+	return headers
+}
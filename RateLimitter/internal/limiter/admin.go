@@ -0,0 +1,228 @@
+package limiter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+	"time"
+
+	"rate-limiter/internal/audit"
+	"rate-limiter/internal/config"
+	"rate-limiter/internal/storage"
+)
+
+// ErrUnknownPolicy is returned when a key refers to a policy that is not configured
+var ErrUnknownPolicy = errors.New("unknown policy")
+
+// StorageKey returns the storage key that counters and blocks for a client are kept
+// under. keyType is KeyTypeIP or KeyTypeToken; IPs are grouped into subnets as the
+// limits say. With a policy name, the key is the one used by that policy.
+func (rl *RateLimiter) StorageKey(keyType, key, policy string) (string, error) {
+	limits := rl.limits.Load()
+
+	switch keyType {
+	case KeyTypeIP:
+		if _, err := netip.ParseAddr(key); err != nil {
+			return "", fmt.Errorf("invalid IP address %q", key)
+		}
+		key = limits.ClientKey(key)
+	case KeyTypeToken:
+		if key == "" {
+			return "", fmt.Errorf("token must not be empty")
+		}
+	default:
+		return "", fmt.Errorf("invalid key type %q, must be %q or %q", keyType, KeyTypeIP, KeyTypeToken)
+	}
+
+	if policy == "" {
+		return key, nil
+	}
+
+	for _, p := range limits.Policies {
+		if p.Name == policy {
+			return policyKey(policy, key), nil
+		}
+	}
+
+	return "", fmt.Errorf("%w %s", ErrUnknownPolicy, policy)
+}
+
+// Blocks returns every key that is currently blocked
+func (rl *RateLimiter) Blocks(ctx context.Context) ([]storage.BlockInfo, error) {
+	return rl.storage.ListBlocks(ctx)
+}
+
+// Block blocks a storage key for duration. Like the other admin operations, it is
+// audited as made by the actor of ctx.
+func (rl *RateLimiter) Block(ctx context.Context, key string, duration time.Duration) error {
+	if duration <= 0 {
+		return fmt.Errorf("block duration must be positive")
+	}
+
+	if err := rl.storage.Block(ctx, key, duration); err != nil {
+		return err
+	}
+
+	event := keyEvent(ctx, audit.EventBlock, key)
+	event.DurationSeconds = duration.Seconds()
+	rl.record(event)
+
+	return nil
+}
+
+// Unblock removes the block on a storage key
+func (rl *RateLimiter) Unblock(ctx context.Context, key string) error {
+	if err := rl.storage.Unblock(ctx, key); err != nil {
+		return err
+	}
+
+	rl.record(keyEvent(ctx, audit.EventUnblock, key))
+	return nil
+}
+
+// Counters returns the live state of every algorithm for the keys starting with prefix
+func (rl *RateLimiter) Counters(ctx context.Context, prefix string) ([]storage.CounterInfo, error) {
+	counters := []storage.CounterInfo{}
+	for _, algorithm := range Algorithms() {
+		found, err := rl.storage.ListCounters(ctx, algorithm, prefix)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list %s counters: %w", algorithm.Name(), err)
+		}
+		counters = append(counters, found...)
+	}
+	return counters, nil
+}
+
+// ResetCounters drops the state of every algorithm for a storage key, so its next
+// request starts with the whole limit available. Blocks are left in place.
+func (rl *RateLimiter) ResetCounters(ctx context.Context, key string) error {
+	for _, algorithm := range Algorithms() {
+		if err := rl.storage.ResetCounter(ctx, algorithm, key); err != nil {
+			return fmt.Errorf("failed to reset %s counter: %w", algorithm.Name(), err)
+		}
+	}
+
+	rl.record(keyEvent(ctx, audit.EventResetCounters, key))
+	return nil
+}
+
+// SetTokenLimit adds or replaces the limit of a token at runtime. The change outlives
+// policy file reloads, until the process restarts.
+func (rl *RateLimiter) SetTokenLimit(ctx context.Context, token string, limit config.TokenLimit) error {
+	if token == "" {
+		return fmt.Errorf("token must not be empty")
+	}
+
+	if err := limit.Validate(); err != nil {
+		return err
+	}
+
+	rl.overrideTokenLimit(token, &limit)
+
+	rl.record(audit.Event{
+		Type:    audit.EventSetTokenLimit,
+		Actor:   audit.ActorFromContext(ctx),
+		Key:     token,
+		KeyType: KeyTypeToken,
+		Limit:   limit.RequestsPerSecond,
+	})
+
+	return nil
+}
+
+// DeleteTokenLimit removes the limit of a token, which is then limited by IP.
+// It reports whether the token had a limit.
+func (rl *RateLimiter) DeleteTokenLimit(ctx context.Context, token string) bool {
+	existed := rl.overrideTokenLimit(token, nil)
+
+	if existed {
+		rl.record(audit.Event{
+			Type:    audit.EventDeleteTokenLimit,
+			Actor:   audit.ActorFromContext(ctx),
+			Key:     token,
+			KeyType: KeyTypeToken,
+		})
+	}
+
+	return existed
+}
+
+// ResetTokenLimit drops the change made to the limit of a token through SetTokenLimit or
+// DeleteTokenLimit, so the token is limited as the configuration says again. It reports
+// whether the token had been changed.
+func (rl *RateLimiter) ResetTokenLimit(ctx context.Context, token string) bool {
+	rl.mu.Lock()
+	_, changed := rl.tokenOverrides[token]
+	if changed {
+		delete(rl.tokenOverrides, token)
+		rl.storeLimits()
+	}
+	rl.mu.Unlock()
+
+	if changed {
+		rl.record(audit.Event{
+			Type:    audit.EventResetTokenLimit,
+			Actor:   audit.ActorFromContext(ctx),
+			Key:     token,
+			KeyType: KeyTypeToken,
+		})
+	}
+
+	return changed
+}
+
+// overrideTokenLimit sets the limit of a token, deleting it when limit is nil, on top
+// of the limits loaded from the configuration. It reports whether the token had a limit;
+// deleting a token without one changes nothing.
+func (rl *RateLimiter) overrideTokenLimit(token string, limit *config.TokenLimit) bool {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	_, existed := rl.limits.Load().TokenLimits[token]
+	if limit == nil && !existed {
+		return false
+	}
+
+	if rl.tokenOverrides == nil {
+		rl.tokenOverrides = make(map[string]*config.TokenLimit)
+	}
+	rl.tokenOverrides[token] = limit
+
+	rl.storeLimits()
+	return existed
+}
+
+// keyEvent describes an admin operation on a storage key
+func keyEvent(ctx context.Context, eventType, key string) audit.Event {
+	keyType, policy := describeKey(key)
+	return audit.Event{
+		Type:    eventType,
+		Actor:   audit.ActorFromContext(ctx),
+		Key:     key,
+		KeyType: keyType,
+		Policy:  policy,
+	}
+}
+
+// describeKey tells the key type and policy of a storage key, the reverse of
+// StorageKey and policyKey
+func describeKey(key string) (keyType, policy string) {
+	if rest, found := strings.CutPrefix(key, "policy:"); found {
+		if name, client, found := strings.Cut(rest, ":"); found {
+			policy, key = name, client
+		}
+	}
+
+	if _, err := netip.ParseAddr(key); err == nil {
+		return KeyTypeIP, policy
+	}
+	if _, err := netip.ParsePrefix(key); err == nil {
+		return KeyTypeIP, policy
+	}
+	if strings.Contains(key, "=") {
+		return KeyTypeCustom, policy
+	}
+	return KeyTypeToken, policy
+}
@@ -0,0 +1,61 @@
+package limiter
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"rate-limiter/internal/config"
+	"rate-limiter/internal/storage"
+)
+
+// Limit describes how many requests a key may make within a window
+type Limit struct {
+	Requests      int
+	Window        time.Duration
+	BlockDuration time.Duration
+}
+
+// Algorithm decides whether a request for a key fits within a limit. Algorithms run
+// atomically inside the storage, in Go under a lock for MemoryStorage and as a Lua
+// script for RedisStorage, so Eval and Lua must implement the same rules.
+type Algorithm interface {
+	storage.Script
+}
+
+// NewAlgorithm returns the algorithm registered under name
+func NewAlgorithm(name string) (Algorithm, error) {
+	switch name {
+	case config.AlgorithmFixedWindow:
+		return FixedWindow{}, nil
+	case config.AlgorithmTokenBucket:
+		return TokenBucket{}, nil
+	case config.AlgorithmSlidingWindowLog:
+		return SlidingWindowLog{}, nil
+	case config.AlgorithmSlidingWindowCounter:
+		return SlidingWindowCounter{}, nil
+	case config.AlgorithmGCRA:
+		return GCRA{}, nil
+	default:
+		return nil, fmt.Errorf("unknown rate limit algorithm %q", name)
+	}
+}
+
+// Algorithms returns every supported algorithm
+func Algorithms() []Algorithm {
+	return []Algorithm{FixedWindow{}, TokenBucket{}, SlidingWindowLog{}, SlidingWindowCounter{}, GCRA{}}
+}
+
+// remainingAfter clamps the number of remaining requests to zero
+func remainingAfter(limit, used int) int {
+	if remaining := limit - used; remaining > 0 {
+		return remaining
+	}
+	return 0
+}
+
+// microseconds converts a possibly fractional number of microseconds to a duration,
+// rounding up like the Lua scripts do
+func microseconds(us float64) time.Duration {
+	return time.Duration(math.Ceil(us)) * time.Microsecond
+}
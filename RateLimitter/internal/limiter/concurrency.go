@@ -0,0 +1,191 @@
+package limiter
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"rate-limiter/internal/config"
+	"rate-limiter/internal/metrics"
+	"rate-limiter/internal/storage"
+	"rate-limiter/internal/telemetry"
+)
+
+// ConcurrencyResult is the outcome of asking for a concurrency slot
+type ConcurrencyResult struct {
+	Acquired bool
+	Reason   string
+	// Policy is the name of the concurrency policy applied
+	Policy string
+	// KeyType tells whether the slots are counted by IP or by token
+	KeyType string
+	// Exempt is set for allowlisted IPs, which are not limited at all
+	Exempt bool
+	Limit  int
+	// InFlight is how many requests of the client are in flight, this one included
+	// when it got a slot
+	InFlight int
+	// Lease holds the slot until it is released, nil when no slot was taken
+	Lease *Lease
+}
+
+// Lease is a concurrency slot held by a request. It is renewed in the background
+// until Release is called, so it only expires when the instance holding it stops.
+type Lease struct {
+	storage storage.Storage
+	key     string
+	id      string
+
+	stop chan struct{}
+	done chan struct{}
+	once sync.Once
+}
+
+// MatchConcurrency returns the first concurrency policy matching a request, or nil if
+// none does
+func (rl *RateLimiter) MatchConcurrency(method, routePath, requestPath, group string) *config.ConcurrencyPolicy {
+	limits := rl.limits.Load()
+	for i := range limits.ConcurrencyPolicies {
+		policy := &limits.ConcurrencyPolicies[i]
+		if policy.Matches(method, routePath, requestPath, group) {
+			return policy
+		}
+	}
+	return nil
+}
+
+// Acquire takes one of the slots policy gives the client of a request. Known and
+// signed tokens get their own slots, anything else shares the slots of its IP. The
+// lease of an acquired slot must be released once the request is done.
+func (rl *RateLimiter) Acquire(ctx context.Context, policy *config.ConcurrencyPolicy, ip, token string) (*ConcurrencyResult, error) {
+	limits := rl.limits.Load()
+
+	if limits.IsAllowlisted(ip) && !limits.IsDenylisted(ip) {
+		return &ConcurrencyResult{Acquired: true, Exempt: true, Reason: "IP is allowlisted", Policy: policy.Name, KeyType: KeyTypeIP}, nil
+	}
+
+	// Invalid tokens are refused by the rate limiter, which runs first, so here they
+	// simply share the slots of their IP
+	key, keyType := limits.ClientKey(ip), KeyTypeIP
+	if id, err := identify(limits, token); err == nil && id != nil && id.known {
+		key, keyType = id.key, KeyTypeToken
+	}
+	key = concurrencyKey(policy.Name, key)
+
+	id, err := leaseID()
+	if err != nil {
+		return nil, err
+	}
+
+	acquired, err := rl.storage.AcquireLease(ctx, storage.LeaseRequest{
+		Key:   key,
+		ID:    id,
+		Limit: policy.Limit,
+		TTL:   policy.LeaseTTL,
+		Now:   rl.clock.Now(),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to acquire concurrency slot: %w", err)
+	}
+
+	result := &ConcurrencyResult{
+		Acquired: acquired.Acquired,
+		Reason:   "Request allowed",
+		Policy:   policy.Name,
+		KeyType:  keyType,
+		Limit:    policy.Limit,
+		InFlight: acquired.InFlight,
+	}
+
+	decision := metrics.Allowed
+	if acquired.Acquired {
+		result.Lease = rl.holdLease(key, id, policy)
+	} else {
+		decision = metrics.Denied
+		result.Reason = fmt.Sprintf("Concurrency limit exceeded: %d requests in flight", policy.Limit)
+	}
+	metrics.Concurrency.WithLabelValues(decision, policy.Name, keyType).Inc()
+
+	return result, nil
+}
+
+// holdLease renews a lease every third of its TTL until it is released
+func (rl *RateLimiter) holdLease(key, id string, policy *config.ConcurrencyPolicy) *Lease {
+	lease := &Lease{
+		storage: rl.storage,
+		key:     key,
+		id:      id,
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+
+	// The ticker starts with the lease, not whenever the goroutine is scheduled
+	ticker := rl.clock.NewTicker(max(policy.LeaseTTL/3, time.Millisecond))
+
+	go func() {
+		defer close(lease.done)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-lease.stop:
+				return
+			case <-ticker.C():
+				ctx, cancel := context.WithTimeout(context.Background(), policy.LeaseTTL)
+				_, err := rl.storage.AcquireLease(ctx, storage.LeaseRequest{
+					Key:   key,
+					ID:    id,
+					Limit: policy.Limit,
+					TTL:   policy.LeaseTTL,
+					Now:   rl.clock.Now(),
+				})
+				cancel()
+				if err != nil {
+					slog.Warn("Failed to renew concurrency lease", "key_hash", telemetry.HashKey(key), "error", err)
+				}
+			}
+		}
+	}()
+
+	return lease
+}
+
+// Release frees the slot. It is safe to call on a nil lease and more than once.
+func (l *Lease) Release(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+
+	var err error
+	l.once.Do(func() {
+		close(l.stop)
+		<-l.done
+
+		// The slot is freed even when the request was cancelled
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+		defer cancel()
+
+		if err = l.storage.ReleaseLease(ctx, l.key, l.id); err != nil {
+			err = fmt.Errorf("failed to release concurrency slot: %w", err)
+		}
+	})
+	return err
+}
+
+// concurrencyKey is where the leases of a client under a concurrency policy are kept
+func concurrencyKey(policy, key string) string {
+	return fmt.Sprintf("concurrency:%s:%s", policy, key)
+}
+
+// leaseID returns a random lease ID
+func leaseID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", fmt.Errorf("failed to generate lease ID: %w", err)
+	}
+	return hex.EncodeToString(id), nil
+}
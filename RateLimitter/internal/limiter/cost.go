@@ -0,0 +1,34 @@
+package limiter
+
+import (
+	"context"
+
+	"rate-limiter/internal/config"
+)
+
+// costKey is the context key of the request cost
+type costKey struct{}
+
+// WithCost returns a context whose requests count as cost requests against the limits
+// and quotas, taking precedence over the cost of the matching policy
+func WithCost(ctx context.Context, cost int) context.Context {
+	return context.WithValue(ctx, costKey{}, cost)
+}
+
+// CostFromContext returns the cost set with WithCost, 0 when there is none
+func CostFromContext(ctx context.Context) int {
+	cost, _ := ctx.Value(costKey{}).(int)
+	return cost
+}
+
+// requestCost returns how many requests a request counts as: the cost in its context,
+// then the cost of its policy, then 1
+func requestCost(ctx context.Context, policy *config.Policy) int {
+	if cost := CostFromContext(ctx); cost > 0 {
+		return cost
+	}
+	if policy != nil && policy.Cost > 0 {
+		return policy.Cost
+	}
+	return 1
+}
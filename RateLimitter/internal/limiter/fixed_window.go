@@ -0,0 +1,67 @@
+package limiter
+
+import (
+	"rate-limiter/internal/config"
+	"rate-limiter/internal/storage"
+)
+
+// FixedWindow counts requests in consecutive windows that reset once they expire.
+// Bursts at the edge of two windows may let through up to twice the limit.
+type FixedWindow struct{}
+
+// Name returns the configuration name of the algorithm
+func (FixedWindow) Name() string {
+	return config.AlgorithmFixedWindow
+}
+
+// ScalarField names the single number the algorithm keeps per key
+func (FixedWindow) ScalarField() string {
+	return "count"
+}
+
+// Lua returns the Redis implementation of the algorithm
+func (FixedWindow) Lua() string {
+	return `
+local count = tonumber(redis.call('GET', KEYS[1]) or '0')
+local ttl = math.max(0, redis.call('PTTL', KEYS[1])) * 1000
+if count + cost > limit then
+	return 0, math.max(0, limit - count), ttl, ttl
+end
+if cost > 0 then
+	redis.call('INCRBY', KEYS[1], cost)
+	if count == 0 then
+		redis.call('PEXPIRE', KEYS[1], math.max(1, math.floor(window / 1000)))
+		ttl = window
+	end
+end
+return 1, limit - count - cost, ttl, 0
+`
+}
+
+// Eval runs the algorithm against in-memory state
+func (FixedWindow) Eval(state *storage.State, req storage.ConsumeRequest) storage.Outcome {
+	count := int(state.Fields["count"])
+	if count+req.Cost > req.Limit {
+		// Nothing frees up before the window ends
+		return storage.Outcome{
+			Allowed:    false,
+			Remaining:  remainingAfter(req.Limit, count),
+			ResetAfter: state.TTL,
+			RetryAfter: state.TTL,
+		}
+	}
+
+	if req.Cost > 0 {
+		state.Fields["count"] = float64(count + req.Cost)
+		// The window starts with its first request and is not extended by later ones
+		if count == 0 {
+			state.TTL = req.Window
+		}
+	}
+
+	return storage.Outcome{
+		Allowed:    true,
+		Remaining:  remainingAfter(req.Limit, count+req.Cost),
+		ResetAfter: state.TTL,
+	}
+}
@@ -0,0 +1,76 @@
+package limiter
+
+import (
+	"math"
+	"time"
+
+	"rate-limiter/internal/config"
+	"rate-limiter/internal/storage"
+)
+
+// GCRA implements the generic cell rate algorithm. It stores a single theoretical
+// arrival time (TAT) per key, spacing requests limit.Window/limit.Requests apart
+// while tolerating bursts of up to limit.Requests.
+type GCRA struct{}
+
+// Name returns the configuration name of the algorithm
+func (GCRA) Name() string {
+	return config.AlgorithmGCRA
+}
+
+// ScalarField names the single number the algorithm keeps per key
+func (GCRA) ScalarField() string {
+	return "tat"
+}
+
+// Lua returns the Redis implementation of the algorithm
+func (GCRA) Lua() string {
+	return `
+local interval = math.max(1, math.floor(window / limit))
+local burst = interval * limit
+local tat = math.max(tonumber(redis.call('GET', KEYS[1]) or '0'), now)
+local new_tat = tat + interval * cost
+if new_tat - burst > now then
+	return 0, math.max(0, (burst - (tat - now)) / interval), tat - now, new_tat - burst - now
+end
+if cost > 0 then
+	redis.call('SET', KEYS[1], string.format('%.0f', new_tat), 'PX', math.max(1, math.floor((new_tat - now) / 1000)))
+end
+return 1, (burst - (new_tat - now)) / interval, new_tat - now, 0
+`
+}
+
+// Eval runs the algorithm against in-memory state
+func (GCRA) Eval(state *storage.State, req storage.ConsumeRequest) storage.Outcome {
+	now := req.Now.UnixMicro()
+
+	// Emission interval and burst tolerance, in whole microseconds like the Lua version
+	interval := int64(math.Max(1, float64(req.Window.Microseconds()/int64(req.Limit))))
+	burst := interval * int64(req.Limit)
+
+	tat := int64(state.Fields["tat"])
+	if tat < now {
+		tat = now
+	}
+
+	newTAT := tat + interval*int64(req.Cost)
+	if newTAT-burst > now {
+		return storage.Outcome{
+			Allowed:    false,
+			Remaining:  int(math.Max(0, float64((burst-(tat-now))/interval))),
+			ResetAfter: time.Duration(tat-now) * time.Microsecond,
+			RetryAfter: time.Duration(newTAT-burst-now) * time.Microsecond,
+		}
+	}
+
+	if req.Cost > 0 {
+		state.Fields["tat"] = float64(newTAT)
+		state.TTL = time.Duration(newTAT-now) * time.Microsecond
+	}
+
+	return storage.Outcome{
+		Allowed:    true,
+		Remaining:  int((burst - (newTAT - now)) / interval),
+		ResetAfter: time.Duration(newTAT-now) * time.Microsecond,
+	}
+}
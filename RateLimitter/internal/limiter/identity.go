@@ -0,0 +1,61 @@
+package limiter
+
+import (
+	"fmt"
+	"strings"
+
+	"rate-limiter/internal/auth"
+	"rate-limiter/internal/config"
+)
+
+// identity is who the token of a request belongs to
+type identity struct {
+	// key counts the requests of the token: the token itself, or the subject of a
+	// signed token so that its counters outlive the token
+	key string
+	// limit applies when known is set; unknown tokens are limited by IP
+	limit config.TokenLimit
+	known bool
+	// claims are those of a verified signed token, nil for any other token
+	claims map[string]any
+}
+
+// identify resolves the token of a request, nil when there is none. Listed tokens use
+// their own limits. Once signed tokens are verified, any other token must be a JWT or
+// API key with a valid signature and a plan that has a tier; otherwise an error
+// wrapping auth.ErrInvalidToken is returned.
+func identify(limits *config.RateLimitConfig, token string) (*identity, error) {
+	if token == "" {
+		return nil, nil
+	}
+
+	if limit, exists := limits.TokenLimits[token]; exists {
+		return &identity{key: token, limit: limit, known: true}, nil
+	}
+
+	if !limits.Auth.Enabled() {
+		return &identity{key: token}, nil
+	}
+
+	claims, err := auth.Verify(limits.Auth, token)
+	if err != nil {
+		return nil, err
+	}
+
+	tier, exists := limits.Tiers[claims.Plan]
+	if !exists {
+		return nil, fmt.Errorf("%w: unknown plan %q", auth.ErrInvalidToken, claims.Plan)
+	}
+
+	return &identity{key: subjectKey(claims.Subject), limit: tier, known: true, claims: claims.Values}, nil
+}
+
+// subjectKey is the key of the holder of signed tokens
+func subjectKey(subject string) string {
+	return "subject:" + subject
+}
+
+// invalidTokenReason describes why a token was refused
+func invalidTokenReason(err error) string {
+	return "Invalid token" + strings.TrimPrefix(err.Error(), auth.ErrInvalidToken.Error())
+}
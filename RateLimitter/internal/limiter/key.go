@@ -0,0 +1,115 @@
+package limiter
+
+import (
+	"fmt"
+	"strings"
+
+	"rate-limiter/internal/config"
+)
+
+// Key is what a request is limited by. Middlewares build it with BuildKey.
+type Key struct {
+	// IP is the client IP
+	IP string
+	// Token is the token sent with the request, empty when there is none
+	Token string
+	// Values holds what the key extractors of the matching policies read from the
+	// request, by key part (header:X-Tenant, route and so on)
+	Values map[string]string
+	// Custom counts a request that has neither an IP nor a token, such as an Envoy
+	// descriptor of other entries, under the IP limits. It is ignored otherwise.
+	Custom string
+}
+
+// KeySource gives key extractors access to the request being limited
+type KeySource interface {
+	Method() string
+	// Route is the route template, or the request path when there is none
+	Route() string
+	Header(name string) string
+	Query(name string) string
+	Param(name string) string
+}
+
+// BuildKey builds the key of a request, reading from source the parts that the key
+// extractors of policies need. Claims are read when the request is checked, from the
+// token once it is verified.
+func (rl *RateLimiter) BuildKey(ip, token string, source KeySource, policies ...*config.Policy) Key {
+	key := Key{IP: ip, Token: token}
+
+	for _, policy := range policies {
+		if policy == nil {
+			continue
+		}
+
+		for _, part := range policy.Key {
+			if _, done := key.Values[part.String()]; done {
+				continue
+			}
+
+			var value string
+			switch part.Kind {
+			case config.KeyMethod:
+				value = source.Method()
+			case config.KeyRoute:
+				value = source.Route()
+			case config.KeyHeader:
+				value = source.Header(part.Name)
+			case config.KeyQuery:
+				value = source.Query(part.Name)
+			case config.KeyParam:
+				value = source.Param(part.Name)
+			default:
+				// The IP and token are part of the key already, and claims come with
+				// the identity of the token
+				continue
+			}
+
+			if key.Values == nil {
+				key.Values = make(map[string]string)
+			}
+			key.Values[part.String()] = value
+		}
+	}
+
+	return key
+}
+
+// keyValueEscaper escapes the separators of custom keys in the values of their parts,
+// so that no two sets of values compose the same key
+var keyValueEscaper = strings.NewReplacer("%", "%25", "|", "%7C", "=", "%3D")
+
+// custom composes the key of a policy with a key extractor, reporting false when the
+// request lacks one of its parts. Only known tokens can be part of a key, since any
+// other token is chosen by the client, and only verified tokens have claims.
+func (k Key) custom(limits *config.RateLimitConfig, extractor config.KeyExtractor, id *identity) (string, bool) {
+	parts := make([]string, 0, len(extractor))
+
+	for _, part := range extractor {
+		var value string
+		switch part.Kind {
+		case config.KeyIP:
+			value = limits.ClientKey(k.IP)
+		case config.KeyToken:
+			if id != nil && id.known {
+				value = id.key
+			}
+		case config.KeyClaim:
+			if id == nil {
+				break
+			}
+			if claim, exists := id.claims[part.Name]; exists {
+				value = fmt.Sprint(claim)
+			}
+		default:
+			value = k.Values[part.String()]
+		}
+
+		if value == "" {
+			return "", false
+		}
+		parts = append(parts, part.String()+"="+keyValueEscaper.Replace(value))
+	}
+
+	return strings.Join(parts, "|"), true
+}
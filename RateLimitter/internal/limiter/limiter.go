@@ -3,154 +3,579 @@ package limiter
 import (
 	"context"
 	"fmt"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"rate-limiter/internal/audit"
+	"rate-limiter/internal/clock"
 	"rate-limiter/internal/config"
+	"rate-limiter/internal/metrics"
 	"rate-limiter/internal/storage"
+	"rate-limiter/internal/telemetry"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // LimiterResult represents the result of a rate limit check
 type LimiterResult struct {
 	Allowed bool
 	Reason  string
+	// Policy is the name of the policy that limited the request, empty for the defaults
+	Policy string
+	// KeyType tells whether the request was limited by IP, by token or by the key of
+	// its policy
+	KeyType string
+	// Blocked is set when the request was refused because its IP or token is blocked
+	Blocked bool
+	// Denied is set for denylisted IPs, which are refused rather than rate limited
+	Denied bool
+	// Exempt is set for allowlisted IPs, which are not limited at all
+	Exempt bool
+	// Unauthenticated is set for tokens whose signature or claims do not verify, which
+	// are refused rather than rate limited
+	Unauthenticated bool
+
+	// Limit and Window describe the limit that was applied
+	Limit  int
+	Window time.Duration
+	// Remaining is how many requests are left in the current window
+	Remaining int
+	// ResetAfter is how long until the whole limit is available again
+	ResetAfter time.Duration
+	// RetryAfter is how long a denied caller should wait, including the time left on a block
+	RetryAfter time.Duration
+	// Cost is how many requests the request counted as
+	Cost int
+	// Offenses is how many recent offenses the limited key has, set when the request
+	// got it blocked while blocks escalate
+	Offenses int
+
+	// Quotas holds the usage of the token's quotas; the fields above describe the per
+	// second limit
+	Quotas []QuotaResult
+	// Quota is the period of the quota that denied the request, if one did
+	Quota string
+	// ShadowDenials names the shadow policies that would have denied the request
+	ShadowDenials []string
 }
 
 // RateLimiter handles rate limiting logic
 type RateLimiter struct {
 	storage storage.Storage
-	config  *config.Config
+	// limits is swapped as a whole when the policy file is reloaded
+	limits atomic.Pointer[config.RateLimitConfig]
+	// mu serializes changes made on top of the current limits
+	mu sync.Mutex
+	// tokenOverrides are the token limits set or deleted through the admin API, a nil
+	// limit marking a deleted one. They are applied over every set of limits in use,
+	// so they survive policy file reloads.
+	tokenOverrides map[string]*config.TokenLimit
+	// base is the last set of limits given to UpdateLimits, before the overrides
+	base config.RateLimitConfig
+	// audit records blocks and admin operations, nil when nothing is audited
+	audit *audit.Log
+	// clock tells the time requests are counted at
+	clock clock.Clock
 }
 
 // NewRateLimiter creates a new rate limiter instance
 func NewRateLimiter(storage storage.Storage, config *config.Config) *RateLimiter {
-	return &RateLimiter{
+	rl := &RateLimiter{
 		storage: storage,
-		config:  config,
+		clock:   clock.Real,
+	}
+	rl.UpdateLimits(config.RateLimit)
+	return rl
+}
+
+// UpdateLimits replaces the limits and policies in use, keeping the token limits changed
+// through SetTokenLimit and DeleteTokenLimit. Requests already being checked finish with
+// the limits they started with.
+func (rl *RateLimiter) UpdateLimits(limits config.RateLimitConfig) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	rl.base = limits
+	rl.storeLimits()
+}
+
+// storeLimits applies the token overrides to the base limits and swaps them in. It is
+// called with mu held.
+func (rl *RateLimiter) storeLimits() {
+	limits := rl.base
+	if len(rl.tokenOverrides) > 0 {
+		tokenLimits := make(map[string]config.TokenLimit, len(limits.TokenLimits)+len(rl.tokenOverrides))
+		for token, limit := range limits.TokenLimits {
+			tokenLimits[token] = limit
+		}
+		for token, limit := range rl.tokenOverrides {
+			if limit == nil {
+				delete(tokenLimits, token)
+			} else {
+				tokenLimits[token] = *limit
+			}
+		}
+		limits.TokenLimits = tokenLimits
+	}
+
+	rl.limits.Store(&limits)
+}
+
+// SetAuditLog records blocks and admin operations to log from then on. It should be
+// called before the limiter is used.
+func (rl *RateLimiter) SetAuditLog(log *audit.Log) {
+	rl.audit = log
+}
+
+// SetClock makes the limiter read the time from c, as the storage should, so that
+// windows and blocks follow it rather than the system clock. It should be called
+// before the limiter is used.
+func (rl *RateLimiter) SetClock(c clock.Clock) {
+	rl.clock = c
+}
+
+// Now returns the time of the limiter's clock
+func (rl *RateLimiter) Now() time.Time {
+	return rl.clock.Now()
+}
+
+// record stamps event with the time of the limiter's clock and queues it for audit
+func (rl *RateLimiter) record(event audit.Event) {
+	event.Time = rl.clock.Now()
+	rl.audit.Record(event)
+}
+
+// Limits returns the limits and policies currently in use
+func (rl *RateLimiter) Limits() config.RateLimitConfig {
+	return *rl.limits.Load()
+}
+
+// Key types a request can be limited by
+const (
+	KeyTypeIP    = "ip"
+	KeyTypeToken = "token"
+	// KeyTypeCustom is for requests counted by the key extractor of their policy, or
+	// by their Key.Custom
+	KeyTypeCustom = "custom"
+)
+
+// target is what a request is counted against
+type target struct {
+	// key is the storage key, namespaced by policy when one applies
+	key string
+	// keyType tells whether the request is limited by IP, by token or by a custom key
+	keyType   string
+	policy    string
+	limit     Limit
+	algorithm Algorithm
+}
+
+// CheckRequest checks if a request should be allowed based on the IP and token of its
+// key. Shadow policies that match any request are evaluated too.
+func (rl *RateLimiter) CheckRequest(ctx context.Context, key Key) (*LimiterResult, error) {
+	return rl.CheckPolicies(ctx, nil, rl.MatchShadowPolicies("", "", "", ""), key)
+}
+
+// CheckPolicy checks a request against policy, or against the IP and token limits
+// when policy is nil. A shadow policy is only evaluated, the request being checked
+// against the IP and token limits.
+func (rl *RateLimiter) CheckPolicy(ctx context.Context, policy *config.Policy, key Key) (*LimiterResult, error) {
+	return rl.CheckPolicies(ctx, policy, nil, key)
+}
+
+// CheckPolicies checks a request like CheckPolicy and evaluates the shadow policies
+// matching it, without letting them change the outcome
+func (rl *RateLimiter) CheckPolicies(ctx context.Context, policy *config.Policy, shadow []*config.Policy, key Key) (*LimiterResult, error) {
+	ctx, span := telemetry.Tracer.Start(ctx, "ratelimit.CheckRequest")
+	defer span.End()
+
+	if policy != nil && policy.Shadow {
+		shadow = append([]*config.Policy{policy}, shadow...)
+		policy = nil
+	}
+
+	limits := rl.limits.Load()
+
+	// Tokens with a bad signature are refused outright
+	id, err := identify(limits, key.Token)
+	if err != nil {
+		result := &LimiterResult{Allowed: false, Unauthenticated: true, Reason: invalidTokenReason(err), KeyType: KeyTypeToken}
+		recordDecision(span, result)
+		return result, nil
+	}
+
+	result, err := rl.checkPolicy(ctx, limits, policy, key, id)
+	if err != nil {
+		telemetry.SpanError(span, err)
+		return nil, err
+	}
+	recordDecision(span, result)
+
+	result.ShadowDenials = rl.checkShadow(ctx, limits, shadow, key, id)
+	if len(result.ShadowDenials) > 0 {
+		span.SetAttributes(attribute.StringSlice("rate_limiter.shadow_denials", result.ShadowDenials))
+	}
+
+	return result, nil
+}
+
+// recordDecision counts the decision made on a request and adds it to its span
+func recordDecision(span trace.Span, result *LimiterResult) {
+	decision := metrics.Denied
+	if result.Allowed {
+		decision = metrics.Allowed
+	}
+	metrics.Decisions.WithLabelValues(decision, policyLabel(result.Policy), result.KeyType, reasonLabel(result)).Inc()
+
+	span.SetAttributes(
+		attribute.String("rate_limiter.decision", decision),
+		attribute.String("rate_limiter.policy", policyLabel(result.Policy)),
+		attribute.String("rate_limiter.key_type", result.KeyType),
+		attribute.String("rate_limiter.reason", reasonLabel(result)),
+	)
+	if result.Limit > 0 {
+		span.SetAttributes(attribute.Int("rate_limiter.remaining", result.Remaining))
 	}
 }
 
-// CheckRequest checks if a request should be allowed based on IP and token
-func (rl *RateLimiter) CheckRequest(ctx context.Context, ip, token string) (*LimiterResult, error) {
-	// First check if IP or token is blocked
-	ipBlocked, err := rl.storage.IsBlocked(ctx, ip)
+// checkPolicy does the work of CheckPolicy for a request whose token was identified
+func (rl *RateLimiter) checkPolicy(ctx context.Context, limits *config.RateLimitConfig, policy *config.Policy, key Key, id *identity) (*LimiterResult, error) {
+	ip := key.IP
+
+	// The denylist wins over the allowlist
+	if limits.IsDenylisted(ip) {
+		return &LimiterResult{Allowed: false, Denied: true, Reason: "IP is denied", KeyType: KeyTypeIP}, nil
+	}
+
+	if limits.IsAllowlisted(ip) {
+		return &LimiterResult{Allowed: true, Exempt: true, Reason: "IP is allowlisted", KeyType: KeyTypeIP}, nil
+	}
+
+	// Determine which limits to apply (token limits override IP limits)
+	t, err := rl.resolve(limits, policy, key, id)
 	if err != nil {
-		return nil, fmt.Errorf("failed to check IP block status: %w", err)
+		return nil, err
 	}
 
-	if ipBlocked {
+	// Blocks from the enforced limits are not what a shadow policy is evaluated for
+	shadow := policy != nil && policy.Shadow
+
+	// Keys may be tokens, so traces only get a hash of them
+	if !shadow {
+		trace.SpanFromContext(ctx).SetAttributes(attribute.String("rate_limiter.key_hash", telemetry.HashKey(t.key)))
+	}
+
+	// Consume checks the block on the limited key, so only the others are checked here
+	if ipKey := limits.ClientKey(ip); ip != "" && t.key != ipKey && !shadow {
+		if result, err := rl.checkBlock(ctx, ipKey, KeyTypeIP, "IP is blocked", t); result != nil || err != nil {
+			return result, err
+		}
+	}
+
+	if id != nil && t.key != id.key && !shadow {
+		if result, err := rl.checkBlock(ctx, id.key, KeyTypeToken, "Token is blocked", t); result != nil || err != nil {
+			return result, err
+		}
+	}
+
+	if t.limit.Requests <= 0 {
 		return &LimiterResult{
 			Allowed: false,
-			Reason:  "IP is blocked",
+			Reason:  "Rate limit exceeded: no requests allowed",
+			Policy:  t.policy,
+			KeyType: t.keyType,
+			Window:  t.limit.Window,
 		}, nil
 	}
 
-	// Check token block status if token is provided
-	if token != "" {
-		tokenBlocked, err := rl.storage.IsBlocked(ctx, token)
-		if err != nil {
-			return nil, fmt.Errorf("failed to check token block status: %w", err)
-		}
+	now := rl.clock.Now()
+	cost := requestCost(ctx, policy)
 
-		if tokenBlocked {
-			return &LimiterResult{
-				Allowed: false,
-				Reason:  "Token is blocked",
-			}, nil
-		}
+	req := storage.ConsumeRequest{
+		Key:           t.key,
+		Limit:         t.limit.Requests,
+		Window:        t.limit.Window,
+		Cost:          cost,
+		BlockDuration: t.limit.BlockDuration,
+		Now:           now,
+	}
+	if limits.Escalation.Enabled() {
+		req.BlockFactor = limits.Escalation.Factor
+		req.MaxBlock = limits.Escalation.Max
+		req.OffenseDecay = limits.Escalation.Decay
 	}
 
-	// Determine which limits to apply (token limits override IP limits)
-	var requestsPerSecond int
-	var blockDurationMinutes int
-	var key string
-
-	if token != "" {
-		if tokenLimit, exists := rl.config.RateLimit.TokenLimits[token]; exists {
-			// Use token-specific limits
-			requestsPerSecond = tokenLimit.RequestsPerSecond
-			blockDurationMinutes = tokenLimit.BlockDurationMinutes
-			key = token
-		} else {
-			// Use IP limits for unknown tokens
-			requestsPerSecond = rl.config.RateLimit.IPRequestsPerSecond
-			blockDurationMinutes = rl.config.RateLimit.IPBlockDurationMinutes
-			key = ip
+	// The token's quotas are inspected first, so a request they deny uses up none of
+	// the rate limit. Shadow policies leave them alone.
+	var quotas []QuotaResult
+	var quotaShort *QuotaResult
+	if !shadow {
+		if quotas, quotaShort, err = rl.consumeQuotas(ctx, id, cost, false, now); err != nil {
+			return nil, err
 		}
-	} else {
-		// Use IP limits
-		requestsPerSecond = rl.config.RateLimit.IPRequestsPerSecond
-		blockDurationMinutes = rl.config.RateLimit.IPBlockDurationMinutes
-		key = ip
 	}
 
-	// Check current request count
-	currentCount, err := rl.storage.GetRequestCount(ctx, key)
+	// A request costing more than the limit can never be allowed, but it is not an
+	// offense either, so the key is only inspected for a block instead of being counted
+	oversized := cost > t.limit.Requests
+	if oversized || quotaShort != nil {
+		req.Cost = 0
+	}
+
+	// Check the block, count the request and block the key if the limit is exceeded in one step
+	consumed, err := rl.storage.Consume(ctx, t.algorithm, req)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get request count: %w", err)
+		return nil, fmt.Errorf("failed to apply %s rate limit: %w", t.algorithm.Name(), err)
+	}
+	if oversized || quotaShort != nil {
+		consumed.Allowed = false
 	}
 
-	// If limit exceeded, block the key and deny request
-	if currentCount >= requestsPerSecond {
-		blockDuration := time.Duration(blockDurationMinutes) * time.Minute
-		err = rl.storage.Block(ctx, key, blockDuration)
-		if err != nil {
-			return nil, fmt.Errorf("failed to block key: %w", err)
+	result := &LimiterResult{
+		Allowed:    consumed.Allowed,
+		Reason:     "Request allowed",
+		Policy:     t.policy,
+		KeyType:    t.keyType,
+		Limit:      t.limit.Requests,
+		Window:     t.limit.Window,
+		Remaining:  consumed.Remaining,
+		ResetAfter: consumed.ResetAfter,
+		RetryAfter: consumed.RetryAfter,
+		Blocked:    consumed.Blocked,
+		Cost:       cost,
+		Offenses:   consumed.Offenses,
+		Quotas:     quotas,
+	}
+
+	switch {
+	case consumed.Blocked && t.keyType == KeyTypeIP:
+		result.Reason = "IP is blocked"
+	case consumed.Blocked:
+		result.Reason = "Token is blocked"
+	case oversized:
+		result.Reason = fmt.Sprintf("Rate limit exceeded: request costs %d, limit is %d requests per %s", cost, t.limit.Requests, windowName(t.limit.Window))
+	case quotaShort != nil:
+		denyQuota(result, *quotaShort)
+	case !consumed.Allowed:
+		result.Reason = fmt.Sprintf("Rate limit exceeded: %d requests per %s", t.limit.Requests, windowName(t.limit.Window))
+	}
+
+	// Blocks of shadow policies refuse nothing
+	if shadow {
+		return result, nil
+	}
+
+	// The storage blocked the key along with denying the request
+	if !consumed.Allowed && !consumed.Blocked && req.Cost > 0 && t.limit.BlockDuration > 0 {
+		rl.record(audit.Event{
+			Type:            audit.EventBlock,
+			Actor:           audit.ActorFromContext(ctx),
+			Key:             t.key,
+			KeyType:         t.keyType,
+			Policy:          t.policy,
+			IP:              ip,
+			Reason:          result.Reason,
+			Limit:           t.limit.Requests,
+			WindowSeconds:   t.limit.Window.Seconds(),
+			Cost:            cost,
+			Offenses:        consumed.Offenses,
+			DurationSeconds: consumed.RetryAfter.Seconds(),
+		})
+	}
+
+	// Requests within the per second limit are then counted against the token's quotas
+	if result.Allowed && quotas != nil {
+		if result.Quotas, quotaShort, err = rl.consumeQuotas(ctx, id, cost, true, now); err != nil {
+			return nil, err
 		}
 
-		return &LimiterResult{
-			Allowed: false,
-			Reason:  fmt.Sprintf("Rate limit exceeded: %d requests per second", requestsPerSecond),
-		}, nil
+		// Another request may have used a quota up since it was inspected
+		if quotaShort != nil {
+			denyQuota(result, *quotaShort)
+		}
+	}
+
+	return result, nil
+}
+
+// MatchPolicy returns the first enforced policy matching a request, or nil if none does
+func (rl *RateLimiter) MatchPolicy(method, routePath, requestPath, group string) *config.Policy {
+	limits := rl.limits.Load()
+	for i := range limits.Policies {
+		policy := &limits.Policies[i]
+		if !policy.Shadow && policy.Matches(method, routePath, requestPath, group) {
+			return policy
+		}
 	}
+	return nil
+}
 
-	// Increment request count
-	expiration := time.Second
-	err = rl.storage.IncrementRequestCount(ctx, key, expiration)
+// checkBlock returns a denied result if key is blocked, or nil if it is not
+func (rl *RateLimiter) checkBlock(ctx context.Context, key, keyType, reason string, t *target) (*LimiterResult, error) {
+	left, err := rl.storage.BlockTTL(ctx, key)
 	if err != nil {
-		return nil, fmt.Errorf("failed to increment request count: %w", err)
+		return nil, fmt.Errorf("failed to check block status: %w", err)
+	}
+
+	if left <= 0 {
+		return nil, nil
 	}
 
 	return &LimiterResult{
-		Allowed: true,
-		Reason:  "Request allowed",
+		Allowed:    false,
+		Reason:     reason,
+		Policy:     t.policy,
+		KeyType:    keyType,
+		Blocked:    true,
+		Limit:      t.limit.Requests,
+		Window:     t.limit.Window,
+		ResetAfter: left,
+		RetryAfter: left,
 	}, nil
 }
 
 // GetRemainingRequests returns the number of remaining requests for a key
 func (rl *RateLimiter) GetRemainingRequests(ctx context.Context, ip, token string) (int, error) {
-	var requestsPerSecond int
-	var key string
-
-	if token != "" {
-		if tokenLimit, exists := rl.config.RateLimit.TokenLimits[token]; exists {
-			requestsPerSecond = tokenLimit.RequestsPerSecond
-			key = token
-		} else {
-			requestsPerSecond = rl.config.RateLimit.IPRequestsPerSecond
-			key = ip
-		}
-	} else {
-		requestsPerSecond = rl.config.RateLimit.IPRequestsPerSecond
-		key = ip
+	limits := rl.limits.Load()
+
+	id, err := identify(limits, token)
+	if err != nil {
+		return 0, err
+	}
+
+	t, err := rl.resolve(limits, nil, Key{IP: ip, Token: token}, id)
+	if err != nil {
+		return 0, err
+	}
+
+	if t.limit.Requests <= 0 {
+		return 0, nil
 	}
 
-	currentCount, err := rl.storage.GetRequestCount(ctx, key)
+	// A zero cost request inspects the state without counting against the limit
+	result, err := rl.storage.Consume(ctx, t.algorithm, storage.ConsumeRequest{
+		Key:    t.key,
+		Limit:  t.limit.Requests,
+		Window: t.limit.Window,
+		Now:    rl.clock.Now(),
+	})
 	if err != nil {
 		return 0, err
 	}
 
-	remaining := requestsPerSecond - currentCount
-	if remaining < 0 {
-		remaining = 0
+	return result.Remaining, nil
+}
+
+// resolve returns the key, limit and algorithm that apply to a request.
+// Known tokens use their own limits, or those of their tier, anything else is limited by IP (or by subnet, when
+// addresses are grouped), with the address and range overrides applied. A policy
+// replaces those limits and gets its own keys, unless it only sets a cost; with a key
+// extractor, its requests are counted by the key it builds.
+func (rl *RateLimiter) resolve(limits *config.RateLimitConfig, policy *config.Policy, key Key, id *identity) (*target, error) {
+	ip := key.IP
+
+	t := &target{key: limits.ClientKey(ip), keyType: KeyTypeIP}
+	if ip == "" && key.Token == "" && key.Custom != "" {
+		t.key, t.keyType = key.Custom, KeyTypeCustom
 	}
+	requestsPerSecond := limits.IPRequestsPerSecond
+	blockDurationMinutes := limits.IPBlockDurationMinutes
+	algorithmName := limits.DefaultAlgorithm()
 
-	return remaining, nil
+	if ipLimit, exists := limits.IPLimit(ip); exists {
+		requestsPerSecond = ipLimit.RequestsPerSecond
+		blockDurationMinutes = ipLimit.BlockDurationMinutes
+		algorithmName = limits.AlgorithmFor(ipLimit)
+	}
+
+	if id != nil && id.known {
+		t.key = id.key
+		t.keyType = KeyTypeToken
+		requestsPerSecond = id.limit.RequestsPerSecond
+		blockDurationMinutes = id.limit.BlockDurationMinutes
+		algorithmName = limits.AlgorithmFor(id.limit)
+	}
+
+	t.limit = Limit{
+		Requests:      requestsPerSecond,
+		Window:        time.Second,
+		BlockDuration: time.Duration(blockDurationMinutes) * time.Minute,
+	}
+
+	if policy != nil && !policy.CostOnly {
+		if len(policy.Key) > 0 {
+			if custom, ok := key.custom(limits, policy.Key, id); ok {
+				t.key, t.keyType = custom, KeyTypeCustom
+			}
+		}
+		t.key = policyKey(policy.Name, t.key)
+		t.policy = policy.Name
+		t.limit = Limit{
+			Requests:      policy.Requests,
+			Window:        policy.Window,
+			BlockDuration: policy.BlockDuration,
+		}
+		algorithmName = limits.PolicyAlgorithm(*policy)
+	}
+
+	algorithm, err := NewAlgorithm(algorithmName)
+	if err != nil {
+		return nil, err
+	}
+	t.algorithm = algorithm
+
+	return t, nil
+}
+
+// policyKey namespaces a key under a policy, so it gets its own counters and blocks
+func policyKey(policy, key string) string {
+	return fmt.Sprintf("policy:%s:%s", policy, key)
+}
+
+// policyLabel names the policy of a result for metrics, "default" for the IP and token limits
+func policyLabel(policy string) string {
+	if policy == "" {
+		return "default"
+	}
+	return policy
+}
+
+// reasonLabel is a short, fixed reason for metrics; Reason itself holds the limits
+func reasonLabel(result *LimiterResult) string {
+	switch {
+	case result.Denied:
+		return "denylisted"
+	case result.Unauthenticated:
+		return "invalid_token"
+	case result.Exempt:
+		return "allowlisted"
+	case result.Allowed:
+		return "within_limit"
+	case result.Blocked:
+		return "blocked"
+	case result.Quota != "":
+		return "quota_exceeded"
+	default:
+		return "limit_exceeded"
+	}
+}
+
+// windowName describes a window for denial reasons, "second" for the default one
+func windowName(window time.Duration) string {
+	if window == time.Second {
+		return "second"
+	}
+	return window.String()
 }
 
 // IsBlocked checks if a key is currently blocked
 func (rl *RateLimiter) IsBlocked(ctx context.Context, ip, token string) (bool, error) {
+	limits := rl.limits.Load()
+
 	// Check IP block
-	ipBlocked, err := rl.storage.IsBlocked(ctx, ip)
+	ipBlocked, err := rl.storage.IsBlocked(ctx, limits.ClientKey(ip))
 	if err != nil {
 		return false, err
 	}
@@ -159,9 +584,9 @@ func (rl *RateLimiter) IsBlocked(ctx context.Context, ip, token string) (bool, e
 		return true, nil
 	}
 
-	// Check token block if token is provided
-	if token != "" {
-		tokenBlocked, err := rl.storage.IsBlocked(ctx, token)
+	// Check token block if token is provided; signed tokens are blocked by subject
+	if id, err := identify(limits, token); err == nil && id != nil {
+		tokenBlocked, err := rl.storage.IsBlocked(ctx, id.key)
 		if err != nil {
 			return false, err
 		}
@@ -0,0 +1,91 @@
+package limiter
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"rate-limiter/internal/config"
+	"rate-limiter/internal/storage"
+)
+
+// QuotaResult describes the usage of one of a token's quotas
+type QuotaResult struct {
+	// Period is hour, day or month
+	Period    string
+	Limit     int
+	Remaining int
+	// Window is the length of the current period
+	Window time.Duration
+	// ResetAfter is how long until the period ends and the quota is restored
+	ResetAfter time.Duration
+}
+
+// consumeQuotas counts cost against every quota of a token in a single step, none of
+// them unless they can all take it, or only inspects them when count is unset. It
+// returns the usage of each quota and the first one that cannot take cost, nil when
+// they all can.
+func (rl *RateLimiter) consumeQuotas(ctx context.Context, id *identity, cost int, count bool, now time.Time) ([]QuotaResult, *QuotaResult, error) {
+	if id == nil || !id.known || len(id.limit.Quotas) == 0 {
+		return nil, nil, nil
+	}
+
+	var quotas []QuotaResult
+	var reqs []storage.ConsumeRequest
+	for _, period := range config.QuotaPeriods {
+		requests, exists := id.limit.Quotas[period]
+		if !exists {
+			continue
+		}
+		start, end, stamp := config.QuotaWindow(period, now)
+
+		// The period is part of the key, so a quota restarts with its period even if
+		// the storage kept the previous one a little longer
+		req := storage.ConsumeRequest{
+			Key:    quotaKey(period, stamp, id.key),
+			Limit:  requests,
+			Window: end.Sub(now),
+			Now:    now,
+		}
+		if count {
+			req.Cost = cost
+		}
+		reqs = append(reqs, req)
+		quotas = append(quotas, QuotaResult{Period: period, Limit: requests, Window: end.Sub(start)})
+	}
+
+	outcomes, err := rl.storage.ConsumeAll(ctx, FixedWindow{}, "quota:"+id.key, reqs)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to apply quotas: %w", err)
+	}
+
+	var short *QuotaResult
+	for i, outcome := range outcomes {
+		quotas[i].Remaining = outcome.Remaining
+
+		// A new quota has no expiry yet, so it resets with its period
+		quotas[i].ResetAfter = outcome.ResetAfter
+		if quotas[i].ResetAfter <= 0 {
+			quotas[i].ResetAfter = reqs[i].Window
+		}
+
+		if short == nil && (!outcome.Allowed || !count && outcome.Remaining < cost) {
+			short = &quotas[i]
+		}
+	}
+
+	return quotas, short, nil
+}
+
+// denyQuota denies a request because quota cannot take it
+func denyQuota(result *LimiterResult, quota QuotaResult) {
+	result.Allowed = false
+	result.Quota = quota.Period
+	result.Reason = fmt.Sprintf("Quota exceeded: %d requests per %s", quota.Limit, quota.Period)
+	result.RetryAfter = quota.ResetAfter
+}
+
+// quotaKey is where the usage of a token's quota for one period is kept
+func quotaKey(period, stamp, token string) string {
+	return fmt.Sprintf("quota:%s:%s:%s", period, stamp, token)
+}
@@ -0,0 +1,55 @@
+package limiter
+
+import (
+	"context"
+	"log/slog"
+
+	"rate-limiter/internal/config"
+	"rate-limiter/internal/metrics"
+)
+
+// MatchShadowPolicies returns every shadow policy matching a request
+func (rl *RateLimiter) MatchShadowPolicies(method, routePath, requestPath, group string) []*config.Policy {
+	var policies []*config.Policy
+
+	limits := rl.limits.Load()
+	for i := range limits.Policies {
+		policy := &limits.Policies[i]
+		if policy.Shadow && policy.Matches(method, routePath, requestPath, group) {
+			policies = append(policies, policy)
+		}
+	}
+	return policies
+}
+
+// checkShadow evaluates shadow policies against a request and returns the names of
+// those that would have denied it. Shadow policies count requests under their own
+// keys like any policy, but their decisions are only logged and recorded in metrics.
+// A shadow policy that cannot be evaluated is logged and skipped, so it never
+// affects the request.
+func (rl *RateLimiter) checkShadow(ctx context.Context, limits *config.RateLimitConfig, policies []*config.Policy, key Key, id *identity) []string {
+	var denials []string
+
+	for _, policy := range policies {
+		result, err := rl.checkPolicy(ctx, limits, policy, key, id)
+		if err != nil {
+			slog.WarnContext(ctx, "Failed to evaluate shadow policy", "policy", policy.Name, "error", err)
+			continue
+		}
+
+		// Denylisted IPs are refused by the enforced limits, whatever the policy says
+		if result.Denied {
+			continue
+		}
+
+		decision := metrics.Allowed
+		if !result.Allowed {
+			decision = metrics.Denied
+			denials = append(denials, policy.Name)
+			slog.InfoContext(ctx, "Shadow policy would deny request", "policy", policy.Name, "key_type", result.KeyType, "ip", key.IP, "reason", result.Reason)
+		}
+		metrics.Shadow.WithLabelValues(decision, policy.Name, result.KeyType, reasonLabel(result)).Inc()
+	}
+
+	return denials
+}
@@ -0,0 +1,118 @@
+package limiter
+
+import (
+	"math"
+
+	"rate-limiter/internal/config"
+	"rate-limiter/internal/storage"
+)
+
+// SlidingWindowCounter approximates a sliding window with two fixed window counters,
+// weighting the previous window by how much of it still overlaps the trailing window.
+type SlidingWindowCounter struct{}
+
+// Name returns the configuration name of the algorithm
+func (SlidingWindowCounter) Name() string {
+	return config.AlgorithmSlidingWindowCounter
+}
+
+// Lua returns the Redis implementation of the algorithm
+func (SlidingWindowCounter) Lua() string {
+	return `
+local current_window = math.floor(now / window)
+local elapsed = now - current_window * window
+local state = redis.call('HMGET', KEYS[1], 'window', 'current', 'previous')
+local stored = tonumber(state[1])
+local current, previous = 0, 0
+if stored == current_window then
+	current, previous = tonumber(state[2]), tonumber(state[3])
+elseif stored == current_window - 1 then
+	previous = tonumber(state[2])
+end
+local estimate = previous * (1 - elapsed / window) + current
+if estimate + cost > limit then
+	local target = limit - cost
+	local retry_after = 2 * window - elapsed
+	if target >= 0 and current <= target then
+		retry_after = window * (1 - (target - current) / previous) - elapsed
+	elseif target >= 0 then
+		retry_after = window - elapsed + window * (1 - target / current)
+	end
+	return 0, math.max(0, limit - estimate), 2 * window - elapsed, retry_after
+end
+if cost > 0 then
+	current = current + cost
+	redis.call('HSET', KEYS[1], 'window', string.format('%.0f', current_window), 'current', current, 'previous', previous)
+	redis.call('PEXPIRE', KEYS[1], math.max(1, math.floor(2 * window / 1000)))
+end
+local reset_after = 0
+if current > 0 then
+	reset_after = 2 * window - elapsed
+elseif previous > 0 then
+	reset_after = window - elapsed
+end
+return 1, limit - estimate - cost, reset_after, 0
+`
+}
+
+// Eval runs the algorithm against in-memory state
+func (SlidingWindowCounter) Eval(state *storage.State, req storage.ConsumeRequest) storage.Outcome {
+	now := req.Now.UnixMicro()
+	size := float64(req.Window.Microseconds())
+	window := float64(now / req.Window.Microseconds())
+	elapsed := float64(now) - window*size
+
+	var current, previous float64
+	switch state.Fields["window"] {
+	case window:
+		current, previous = state.Fields["current"], state.Fields["previous"]
+	case window - 1:
+		previous = state.Fields["current"]
+	}
+
+	estimate := previous*(1-elapsed/size) + current
+	limit := float64(req.Limit)
+	cost := float64(req.Cost)
+
+	if estimate+cost > limit {
+		// Wait for the previous window to decay enough, or for the next window
+		// when the current one alone is already too full
+		target := limit - cost
+		retryAfter := 2*size - elapsed
+		if target >= 0 && current <= target {
+			retryAfter = size*(1-(target-current)/previous) - elapsed
+		} else if target >= 0 {
+			retryAfter = size - elapsed + size*(1-target/current)
+		}
+
+		return storage.Outcome{
+			Allowed:    false,
+			Remaining:  int(math.Max(0, math.Floor(limit-estimate))),
+			ResetAfter: microseconds(2*size - elapsed),
+			RetryAfter: microseconds(retryAfter),
+		}
+	}
+
+	if req.Cost > 0 {
+		current += cost
+		state.Fields["window"] = window
+		state.Fields["current"] = current
+		state.Fields["previous"] = previous
+		// Keep the counter around for the next window, where it becomes the previous one
+		state.TTL = 2 * req.Window
+	}
+
+	// Current requests keep weighing through the next window, previous ones until this one ends
+	var resetAfter float64
+	if current > 0 {
+		resetAfter = 2*size - elapsed
+	} else if previous > 0 {
+		resetAfter = size - elapsed
+	}
+
+	return storage.Outcome{
+		Allowed:    true,
+		Remaining:  int(math.Floor(limit - estimate - cost)),
+		ResetAfter: microseconds(resetAfter),
+	}
+}
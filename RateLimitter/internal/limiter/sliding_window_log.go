@@ -0,0 +1,103 @@
+package limiter
+
+import (
+	"time"
+
+	"rate-limiter/internal/config"
+	"rate-limiter/internal/storage"
+)
+
+// SlidingWindowLog keeps the timestamp of every accepted request and allows a new
+// one only while fewer than limit.Requests fall within the trailing window. It is
+// exact, at the cost of storing one entry per request.
+type SlidingWindowLog struct{}
+
+// Name returns the configuration name of the algorithm
+func (SlidingWindowLog) Name() string {
+	return config.AlgorithmSlidingWindowLog
+}
+
+// Lua returns the Redis implementation of the algorithm
+func (SlidingWindowLog) Lua() string {
+	return `
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', string.format('%.0f', now - window))
+local count = redis.call('ZCARD', KEYS[1])
+local function expires_after(index)
+	local entry = redis.call('ZRANGE', KEYS[1], index, index, 'WITHSCORES')
+	if #entry == 0 then
+		return 0
+	end
+	return tonumber(entry[2]) + window - now
+end
+if count + cost > limit then
+	local retry_after = window
+	if cost <= limit then
+		retry_after = expires_after(count + cost - limit - 1)
+	end
+	return 0, math.max(0, limit - count), expires_after(-1), retry_after
+end
+for i = 1, cost do
+	redis.call('ZADD', KEYS[1], string.format('%.0f', now), string.format('%.0f-%d', now, count + i))
+end
+if cost > 0 then
+	redis.call('PEXPIRE', KEYS[1], math.max(1, math.floor(window / 1000)))
+end
+return 1, limit - count - cost, expires_after(-1), 0
+`
+}
+
+// Eval runs the algorithm against in-memory state
+func (l SlidingWindowLog) Eval(state *storage.State, req storage.ConsumeRequest) storage.Outcome {
+	now := req.Now.UnixMicro()
+	since := now - req.Window.Microseconds()
+
+	kept := state.Log[:0]
+	for _, timestamp := range state.Log {
+		if timestamp > since {
+			kept = append(kept, timestamp)
+		}
+	}
+	state.Log = kept
+
+	count := len(state.Log)
+	if count+req.Cost > req.Limit {
+		// Wait until enough of the oldest entries leave the window to fit the cost
+		retryAfter := req.Window
+		if req.Cost <= req.Limit {
+			retryAfter = l.expiresAfter(state.Log[count+req.Cost-req.Limit-1], req)
+		}
+
+		return storage.Outcome{
+			Allowed:    false,
+			Remaining:  remainingAfter(req.Limit, count),
+			ResetAfter: l.resetAfter(state, req),
+			RetryAfter: retryAfter,
+		}
+	}
+
+	for i := 0; i < req.Cost; i++ {
+		state.Log = append(state.Log, now)
+	}
+	if req.Cost > 0 {
+		state.TTL = req.Window
+	}
+
+	return storage.Outcome{
+		Allowed:    true,
+		Remaining:  remainingAfter(req.Limit, count+req.Cost),
+		ResetAfter: l.resetAfter(state, req),
+	}
+}
+
+// resetAfter returns how long until the newest entry leaves the window
+func (l SlidingWindowLog) resetAfter(state *storage.State, req storage.ConsumeRequest) time.Duration {
+	if len(state.Log) == 0 {
+		return 0
+	}
+	return l.expiresAfter(state.Log[len(state.Log)-1], req)
+}
+
+// expiresAfter returns how long until a log entry leaves the window
+func (SlidingWindowLog) expiresAfter(timestamp int64, req storage.ConsumeRequest) time.Duration {
+	return time.Duration(timestamp+req.Window.Microseconds()-req.Now.UnixMicro()) * time.Microsecond
+}
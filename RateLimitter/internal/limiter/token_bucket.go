@@ -0,0 +1,75 @@
+package limiter
+
+import (
+	"math"
+
+	"rate-limiter/internal/config"
+	"rate-limiter/internal/storage"
+)
+
+// TokenBucket holds up to limit.Requests tokens per key and refills them evenly
+// over limit.Window. Each request takes one token and is denied when none are left.
+type TokenBucket struct{}
+
+// Name returns the configuration name of the algorithm
+func (TokenBucket) Name() string {
+	return config.AlgorithmTokenBucket
+}
+
+// Lua returns the Redis implementation of the algorithm
+func (TokenBucket) Lua() string {
+	return `
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = limit
+if state[2] then
+	local elapsed = math.max(0, now - tonumber(state[2]))
+	tokens = math.min(limit, tonumber(state[1]) + elapsed * limit / window)
+end
+if tokens < cost then
+	return 0, tokens, (limit - tokens) * window / limit, (cost - tokens) * window / limit
+end
+if cost > 0 then
+	tokens = tokens - cost
+	redis.call('HSET', KEYS[1], 'tokens', string.format('%.6f', tokens), 'ts', string.format('%.0f', now))
+	redis.call('PEXPIRE', KEYS[1], math.max(1, math.floor(window / 1000)))
+end
+return 1, tokens, (limit - tokens) * window / limit, 0
+`
+}
+
+// Eval runs the algorithm against in-memory state
+func (TokenBucket) Eval(state *storage.State, req storage.ConsumeRequest) storage.Outcome {
+	capacity := float64(req.Limit)
+	now := float64(req.Now.UnixMicro())
+	refillTime := float64(req.Window.Microseconds()) / capacity
+
+	// Refill the tokens earned since the last request, up to the capacity
+	tokens := capacity
+	if last, exists := state.Fields["ts"]; exists {
+		elapsed := math.Max(0, now-last)
+		tokens = math.Min(capacity, state.Fields["tokens"]+elapsed/refillTime)
+	}
+
+	cost := float64(req.Cost)
+	if tokens < cost {
+		return storage.Outcome{
+			Allowed:    false,
+			Remaining:  int(math.Floor(tokens)),
+			ResetAfter: microseconds((capacity - tokens) * refillTime),
+			RetryAfter: microseconds((cost - tokens) * refillTime),
+		}
+	}
+
+	if req.Cost > 0 {
+		tokens -= cost
+		state.Fields["tokens"] = tokens
+		state.Fields["ts"] = now
+		state.TTL = req.Window
+	}
+
+	return storage.Outcome{
+		Allowed:    true,
+		Remaining:  int(math.Floor(tokens)),
+		ResetAfter: microseconds((capacity - tokens) * refillTime),
+	}
+}
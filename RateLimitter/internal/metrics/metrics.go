@@ -0,0 +1,157 @@
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "rate_limiter"
+
+var (
+	// Decisions counts checked requests by decision (allowed or denied), policy,
+	// key type and reason
+	Decisions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "requests_total",
+		Help:      "Requests checked by the rate limiter.",
+	}, []string{"decision", "policy", "key_type", "reason"})
+
+	// Shadow counts the requests evaluated by shadow policies by the decision the
+	// policy would have made (allowed or denied), policy, key type and reason
+	Shadow = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "shadow_requests_total",
+		Help:      "Requests evaluated by shadow policies, which are never enforced.",
+	}, []string{"decision", "policy", "key_type", "reason"})
+
+	// StorageLatency observes how long storage operations take, by backend and operation
+	StorageLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "storage_operation_duration_seconds",
+		Help:      "Duration of rate limiter storage operations.",
+		Buckets:   []float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+	}, []string{"backend", "operation"})
+
+	// Concurrency counts requests asking for a concurrency slot by decision (allowed
+	// or denied), concurrency policy and key type
+	Concurrency = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "concurrency_requests_total",
+		Help:      "Requests that asked the concurrency limiter for a slot.",
+	}, []string{"decision", "policy", "key_type"})
+
+	// FailOpen counts the times requests were let through, or a weaker storage used,
+	// because the configured storage could not be reached
+	FailOpen = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "fail_open_total",
+		Help:      "Times the rate limiter failed open because its storage was unavailable.",
+	}, []string{"reason"})
+
+	// AuditEvents counts audit events by type and outcome (delivered, failed or dropped)
+	AuditEvents = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "audit_events_total",
+		Help:      "Audit events handed to the audit sinks.",
+	}, []string{"type", "outcome"})
+)
+
+// Decision values
+const (
+	Allowed = "allowed"
+	Denied  = "denied"
+)
+
+// Audit event outcomes
+const (
+	Delivered = "delivered"
+	Failed    = "failed"
+	Dropped   = "dropped"
+)
+
+// ObserveStorage records the duration of a storage operation started at start,
+// meant to be deferred at the top of the operation
+func ObserveStorage(backend, operation string, start time.Time) {
+	StorageLatency.WithLabelValues(backend, operation).Observe(time.Since(start).Seconds())
+}
+
+// activeBlocks reports the number of blocked keys, counted at most once per TTL
+type activeBlocks struct {
+	desc  *prometheus.Desc
+	count func(ctx context.Context) (int, error)
+	ttl   time.Duration
+
+	// mu keeps concurrent scrapes from counting at the same time
+	mu        sync.Mutex
+	cached    int
+	countedAt time.Time
+}
+
+// NewActiveBlocksCollector returns a collector reporting the number of keys count finds
+// blocked. Counting lists every block in the storage, so the count is kept for ttl and
+// scrapes within it report the same value; it is still right across replicas.
+func NewActiveBlocksCollector(count func(ctx context.Context) (int, error), ttl time.Duration) prometheus.Collector {
+	return &activeBlocks{
+		desc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "active_blocks"),
+			"Keys currently blocked.",
+			nil, nil,
+		),
+		count: count,
+		ttl:   ttl,
+	}
+}
+
+// Describe implements prometheus.Collector
+func (a *activeBlocks) Describe(ch chan<- *prometheus.Desc) {
+	ch <- a.desc
+}
+
+// Collect implements prometheus.Collector
+func (a *activeBlocks) Collect(ch chan<- prometheus.Metric) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.countedAt.IsZero() || time.Since(a.countedAt) >= a.ttl {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		count, err := a.count(ctx)
+		if err != nil {
+			ch <- prometheus.NewInvalidMetric(a.desc, err)
+			return
+		}
+		a.cached, a.countedAt = count, time.Now()
+	}
+
+	ch <- prometheus.MustNewConstMetric(a.desc, prometheus.GaugeValue, float64(a.cached))
+}
+
+// NewRegistry returns a registry with the rate limiter metrics and the Go runtime and
+// process collectors registered, plus any extra collectors
+func NewRegistry(extra ...prometheus.Collector) *prometheus.Registry {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		Decisions,
+		Shadow,
+		StorageLatency,
+		Concurrency,
+		FailOpen,
+		AuditEvents,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	registry.MustRegister(extra...)
+	return registry
+}
+
+// Handler serves the metrics of registry in the Prometheus exposition format
+func Handler(registry *prometheus.Registry) http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
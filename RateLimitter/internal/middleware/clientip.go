@@ -0,0 +1,127 @@
+package middleware
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"rate-limiter/internal/config"
+)
+
+// ClientIP extracts the client IP from a request. The forwarding header named by
+// header, X-Forwarded-For when empty, is only read when the request comes from a
+// trusted proxy; the RFC 7239 Forwarded header is parsed for its for= nodes. The
+// chain is walked from the right, skipping trusted proxies, so entries a client
+// prepends itself are never used. Other forwarding headers are ignored, as a proxy
+// that only appends to one of them passes the others on from the client untouched.
+// Requests from anywhere else are identified by RemoteAddr.
+func ClientIP(r *http.Request, trustedProxies []netip.Prefix, header string) string {
+	return ForwardedClientIP(r.RemoteAddr, r.Header, trustedProxies, header)
+}
+
+// ForwardedClientIP works as ClientIP for a connection from remoteAddr that carried
+// headers, for transports other than net/http such as gRPC metadata
+func ForwardedClientIP(remoteAddr string, headers http.Header, trustedProxies []netip.Prefix, header string) string {
+	remote := remoteIP(remoteAddr)
+
+	addr, err := netip.ParseAddr(remote)
+	if err != nil || !IsTrustedProxy(trustedProxies, addr) {
+		return remote
+	}
+
+	if header == "" {
+		header = config.ClientIPHeaderXForwardedFor
+	}
+
+	var chain []string
+	if values := headers.Values(header); strings.EqualFold(header, config.ClientIPHeaderForwarded) {
+		chain = parseForwarded(values)
+	} else {
+		chain = splitHeaderList(values)
+	}
+
+	client := addr
+	for i := len(chain) - 1; i >= 0; i-- {
+		hop, err := netip.ParseAddr(chain[i])
+		if err != nil {
+			// Whatever comes before a malformed entry cannot be trusted
+			break
+		}
+
+		client = hop.Unmap()
+		if !IsTrustedProxy(trustedProxies, client) {
+			break
+		}
+	}
+
+	return client.String()
+}
+
+// remoteIP strips the port from a RemoteAddr
+func remoteIP(remoteAddr string) string {
+	ip, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return remoteAddr
+	}
+	return ip
+}
+
+// IsTrustedProxy reports whether addr belongs to one of the trusted proxies
+func IsTrustedProxy(trustedProxies []netip.Prefix, addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// splitHeaderList splits every value of a comma separated header into its entries
+func splitHeaderList(values []string) []string {
+	var entries []string
+	for _, value := range values {
+		for _, entry := range strings.Split(value, ",") {
+			entries = append(entries, strings.TrimSpace(entry))
+		}
+	}
+	return entries
+}
+
+// parseForwarded returns the for= node of every element of the Forwarded headers,
+// in order. Obfuscated or unknown nodes are kept so the walk stops at them.
+func parseForwarded(values []string) []string {
+	var nodes []string
+	for _, element := range splitHeaderList(values) {
+		node := ""
+		for _, pair := range strings.Split(element, ";") {
+			key, value, found := strings.Cut(strings.TrimSpace(pair), "=")
+			if found && strings.EqualFold(key, "for") {
+				node = forwardedNode(value)
+			}
+		}
+		nodes = append(nodes, node)
+	}
+	return nodes
+}
+
+// forwardedNode extracts the address from a Forwarded node such as
+// 192.0.2.60, "192.0.2.60:4711" or "[2001:db8::1]:4711"
+func forwardedNode(value string) string {
+	node := strings.Trim(strings.TrimSpace(value), `"`)
+
+	if strings.HasPrefix(node, "[") {
+		if end := strings.Index(node, "]"); end > 0 {
+			return node[1:end]
+		}
+		return node
+	}
+
+	// IPv4 with a port; a bare IPv6 address is not valid here without brackets
+	if host, _, err := net.SplitHostPort(node); err == nil {
+		return host
+	}
+
+	return node
+}
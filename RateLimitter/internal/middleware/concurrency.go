@@ -0,0 +1,69 @@
+package middleware
+
+import (
+	"errors"
+	"log/slog"
+
+	"rate-limiter/internal/limiter"
+	"rate-limiter/internal/storage"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ConcurrencyLimiterMiddleware caps the requests a client has in flight on the routes
+// matching a concurrency policy. A slot is taken before the handler runs and freed
+// once it returns; requests over the cap are refused with 429. It goes right after
+// RateLimiterMiddleware, with the same options.
+func ConcurrencyLimiterMiddleware(rateLimiter *limiter.RateLimiter, opts ...Option) gin.HandlerFunc {
+	o := &options{}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	return func(c *gin.Context) {
+		policy := rateLimiter.MatchConcurrency(c.Request.Method, c.FullPath(), c.Request.URL.Path, o.group)
+		if policy == nil {
+			c.Next()
+			return
+		}
+
+		ip := ClientIP(c.Request, o.trustedProxies, o.clientIPHeader)
+		token := c.GetHeader("API_KEY")
+
+		result, err := rateLimiter.Acquire(c.Request.Context(), policy, ip, token)
+		if errors.Is(err, storage.ErrUnavailable) {
+			c.Header("Retry-After", "1")
+			c.JSON(503, gin.H{
+				"error": "rate limiter unavailable",
+			})
+			c.Abort()
+			return
+		}
+		if err != nil {
+			c.JSON(500, gin.H{
+				"error": "Internal server error",
+			})
+			c.Abort()
+			return
+		}
+
+		if !result.Acquired {
+			// Slots free up as soon as a request finishes, so there is no better estimate
+			c.Header("Retry-After", "1")
+			c.JSON(429, gin.H{
+				"error":  "too many concurrent requests",
+				"reason": result.Reason,
+			})
+			c.Abort()
+			return
+		}
+
+		defer func() {
+			if err := result.Lease.Release(c.Request.Context()); err != nil {
+				slog.WarnContext(c.Request.Context(), "Slot held until its lease expires", "error", err)
+			}
+		}()
+
+		c.Next()
+	}
+}
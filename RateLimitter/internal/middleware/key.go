@@ -0,0 +1,43 @@
+package middleware
+
+import (
+	"net/http"
+
+	"rate-limiter/internal/limiter"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ginKeySource reads key parts from a gin request
+type ginKeySource struct {
+	c *gin.Context
+}
+
+func (s ginKeySource) Method() string            { return s.c.Request.Method }
+func (s ginKeySource) Header(name string) string { return s.c.GetHeader(name) }
+func (s ginKeySource) Query(name string) string  { return s.c.Query(name) }
+func (s ginKeySource) Param(name string) string  { return s.c.Param(name) }
+
+func (s ginKeySource) Route() string {
+	if route := s.c.FullPath(); route != "" {
+		return route
+	}
+	return s.c.Request.URL.Path
+}
+
+// requestKeySource reads key parts from a net/http request
+type requestKeySource struct {
+	r *http.Request
+}
+
+// RequestKeySource reads the key parts of a net/http request. Path parameters are
+// those of the patterns of http.ServeMux, and the route is the request path.
+func RequestKeySource(r *http.Request) limiter.KeySource {
+	return requestKeySource{r: r}
+}
+
+func (s requestKeySource) Method() string            { return s.r.Method }
+func (s requestKeySource) Route() string             { return s.r.URL.Path }
+func (s requestKeySource) Header(name string) string { return s.r.Header.Get(name) }
+func (s requestKeySource) Query(name string) string  { return s.r.URL.Query().Get(name) }
+func (s requestKeySource) Param(name string) string  { return s.r.PathValue(name) }
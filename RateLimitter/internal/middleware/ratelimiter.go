@@ -1,25 +1,96 @@
 package middleware
 
 import (
-	"net"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/netip"
+	"strconv"
 	"strings"
+	"time"
 
 	"rate-limiter/internal/limiter"
+	"rate-limiter/internal/storage"
 
 	"github.com/gin-gonic/gin"
 )
 
+// Option configures RateLimiterMiddleware
+type Option func(*options)
+
+type options struct {
+	group          string
+	trustedProxies []netip.Prefix
+	clientIPHeader string
+}
+
+// WithGroup names the route group the middleware is attached to, so policies can target it
+func WithGroup(name string) Option {
+	return func(o *options) {
+		o.group = name
+	}
+}
+
+// WithTrustedProxies sets the proxies whose forwarding headers are believed.
+// Without it the client IP is always taken from RemoteAddr.
+func WithTrustedProxies(prefixes []netip.Prefix) Option {
+	return func(o *options) {
+		o.trustedProxies = prefixes
+	}
+}
+
+// WithClientIPHeader names the forwarding header trusted proxies report the client IP
+// in: X-Forwarded-For, the default, Forwarded or X-Real-IP
+func WithClientIPHeader(header string) Option {
+	return func(o *options) {
+		o.clientIPHeader = header
+	}
+}
+
+// Cost makes the requests it handles count as cost requests against the limits and
+// quotas. It must run before RateLimiterMiddleware, for example as the first handler
+// of a route group.
+func Cost(cost int) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Request = c.Request.WithContext(limiter.WithCost(c.Request.Context(), cost))
+		c.Next()
+	}
+}
+
 // RateLimiterMiddleware creates a rate limiter middleware
-func RateLimiterMiddleware(rateLimiter *limiter.RateLimiter) gin.HandlerFunc {
+func RateLimiterMiddleware(rateLimiter *limiter.RateLimiter, opts ...Option) gin.HandlerFunc {
+	o := &options{}
+	for _, opt := range opts {
+		opt(o)
+	}
+
 	return func(c *gin.Context) {
 		// Extract IP address
-		ip := getClientIP(c)
+		ip := ClientIP(c.Request, o.trustedProxies, o.clientIPHeader)
 
 		// Extract token from API_KEY header
 		token := c.GetHeader("API_KEY")
 
+		// Route policies take precedence over the IP and token limits, shadow policies
+		// are only evaluated
+		policy := rateLimiter.MatchPolicy(c.Request.Method, c.FullPath(), c.Request.URL.Path, o.group)
+		shadow := rateLimiter.MatchShadowPolicies(c.Request.Method, c.FullPath(), c.Request.URL.Path, o.group)
+
+		// The key holds whatever the key extractors of the policies read from the request
+		key := rateLimiter.BuildKey(ip, token, ginKeySource{c: c}, append(shadow, policy)...)
+
 		// Check rate limit
-		result, err := rateLimiter.CheckRequest(c.Request.Context(), ip, token)
+		result, err := rateLimiter.CheckPolicies(c.Request.Context(), policy, shadow, key)
+		// Failing closed, requests are refused until the storage is back
+		if errors.Is(err, storage.ErrUnavailable) {
+			c.Header("Retry-After", "1")
+			c.JSON(503, gin.H{
+				"error": "rate limiter unavailable",
+			})
+			c.Abort()
+			return
+		}
 		if err != nil {
 			c.JSON(500, gin.H{
 				"error": "Internal server error",
@@ -28,8 +99,38 @@ func RateLimiterMiddleware(rateLimiter *limiter.RateLimiter) gin.HandlerFunc {
 			return
 		}
 
+		// Denylisted IPs are refused outright
+		if result.Denied {
+			c.JSON(403, gin.H{
+				"error":  "forbidden",
+				"reason": result.Reason,
+			})
+			c.Abort()
+			return
+		}
+
+		// So are tokens that fail verification
+		if result.Unauthenticated {
+			c.JSON(401, gin.H{
+				"error":  "invalid token",
+				"reason": result.Reason,
+			})
+			c.Abort()
+			return
+		}
+
+		// Allowlisted IPs are not limited, so there is no limit to describe
+		if result.Exempt {
+			c.Next()
+			return
+		}
+
+		// Add rate limit info to headers, on both allowed and denied responses
+		SetRateLimitHeaders(c.Writer.Header(), result)
+
 		// If request is not allowed, return 429
 		if !result.Allowed {
+			c.Header("Retry-After", strconv.Itoa(RetryAfterSeconds(result)))
 			c.JSON(429, gin.H{
 				"error":  "you have reached the maximum number of requests or actions allowed within a certain time frame",
 				"reason": result.Reason,
@@ -38,42 +139,49 @@ func RateLimiterMiddleware(rateLimiter *limiter.RateLimiter) gin.HandlerFunc {
 			return
 		}
 
-		// Add rate limit info to headers
-		remaining, err := rateLimiter.GetRemainingRequests(c.Request.Context(), ip, token)
-		if err == nil {
-			c.Header("X-RateLimit-Remaining", string(rune(remaining)))
-		}
-
 		// Continue to next handler
 		c.Next()
 	}
 }
 
-// getClientIP extracts the real client IP from the request
-func getClientIP(c *gin.Context) string {
-	// Check X-Forwarded-For header first
-	if xff := c.GetHeader("X-Forwarded-For"); xff != "" {
-		ips := strings.Split(xff, ",")
-		if len(ips) > 0 {
-			ip := strings.TrimSpace(ips[0])
-			if net.ParseIP(ip) != nil {
-				return ip
-			}
-		}
-	}
+// SetRateLimitHeaders writes the IETF RateLimit headers describing the applied limit.
+// Each quota gets its own RateLimit-<Period>-Limit, -Remaining and -Reset headers and
+// is listed in RateLimit-Policy after the per second limit.
+func SetRateLimitHeaders(header http.Header, result *limiter.LimiterResult) {
+	header.Set("RateLimit-Limit", strconv.Itoa(result.Limit))
+	header.Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+	header.Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(result.ResetAfter)))
 
-	// Check X-Real-IP header
-	if xri := c.GetHeader("X-Real-IP"); xri != "" {
-		if net.ParseIP(xri) != nil {
-			return xri
-		}
+	policies := []string{fmt.Sprintf("%d;w=%d", result.Limit, ceilSeconds(result.Window))}
+	for _, quota := range result.Quotas {
+		prefix := QuotaHeaderPrefix(quota.Period)
+		header.Set(prefix+"-Limit", strconv.Itoa(quota.Limit))
+		header.Set(prefix+"-Remaining", strconv.Itoa(quota.Remaining))
+		header.Set(prefix+"-Reset", strconv.Itoa(ceilSeconds(quota.ResetAfter)))
+
+		policies = append(policies, fmt.Sprintf("%d;w=%d;name=%q", quota.Limit, ceilSeconds(quota.Window), quota.Period))
 	}
+	header.Set("RateLimit-Policy", strings.Join(policies, ", "))
+
+	// Kept for clients that still read the legacy header
+	header.Set("X-RateLimit-Remaining", strconv.Itoa(result.Remaining))
+}
 
-	// Fall back to RemoteAddr
-	ip, _, err := net.SplitHostPort(c.Request.RemoteAddr)
-	if err != nil {
-		return c.Request.RemoteAddr
+// QuotaHeaderPrefix returns the prefix of the headers describing a quota, such as
+// RateLimit-Day
+func QuotaHeaderPrefix(period string) string {
+	if period == "" {
+		return "RateLimit"
 	}
+	return "RateLimit-" + strings.ToUpper(period[:1]) + period[1:]
+}
+
+// RetryAfterSeconds returns the Retry-After value of a denied request, at least one second
+func RetryAfterSeconds(result *limiter.LimiterResult) int {
+	return max(1, ceilSeconds(result.RetryAfter))
+}
 
-	return ip
+// ceilSeconds rounds a duration up to whole seconds, as the headers require
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
 }
@@ -0,0 +1,73 @@
+package middleware
+
+import (
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"time"
+
+	"rate-limiter/internal/telemetry"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TelemetryMiddleware traces each request and logs it once done. The request keeps
+// the ID the client sent in X-Request-ID when it is valid, or else gets a new one,
+// which is echoed back and attached to every log line written with the request
+// context. Incoming W3C trace context is continued, so the spans join the caller's trace.
+func TelemetryMiddleware(trustedProxies []netip.Prefix, clientIPHeader string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+
+		id := c.GetHeader(telemetry.RequestIDHeader)
+		if !telemetry.ValidRequestID(id) {
+			id = telemetry.NewRequestID()
+		}
+		c.Header(telemetry.RequestIDHeader, id)
+
+		// Unmatched routes, proxied requests among them, are named after their method only
+		route := c.FullPath()
+		name := c.Request.Method
+		if route != "" {
+			name += " " + route
+		}
+
+		ctx := telemetry.Propagator.Extract(c.Request.Context(), propagation.HeaderCarrier(c.Request.Header))
+		ctx = telemetry.WithRequestID(ctx, id)
+		ctx, span := telemetry.Tracer.Start(ctx, name,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(c.Request.Method),
+				semconv.URLPath(c.Request.URL.Path),
+				semconv.ClientAddress(ClientIP(c.Request, trustedProxies, clientIPHeader)),
+			),
+		)
+		defer span.End()
+		if route != "" {
+			span.SetAttributes(semconv.HTTPRoute(route))
+		}
+
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+
+		status := c.Writer.Status()
+		span.SetAttributes(semconv.HTTPResponseStatusCode(status))
+
+		level := slog.LevelInfo
+		if status >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(status))
+			level = slog.LevelError
+		}
+		slog.Log(ctx, level, "Request handled",
+			"method", c.Request.Method,
+			"path", c.Request.URL.Path,
+			"status", status,
+			"duration_ms", time.Since(start).Milliseconds(),
+			"client_ip", ClientIP(c.Request, trustedProxies, clientIPHeader),
+		)
+	}
+}
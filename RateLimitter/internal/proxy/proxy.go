@@ -0,0 +1,83 @@
+package proxy
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/httputil"
+	"net/netip"
+
+	"rate-limiter/internal/config"
+	"rate-limiter/internal/middleware"
+	"rate-limiter/internal/telemetry"
+
+	"go.opentelemetry.io/otel/propagation"
+)
+
+// Proxy forwards requests to the upstream whose prefix matches their path
+type Proxy struct {
+	server config.ServerConfig
+	proxy  *httputil.ReverseProxy
+}
+
+// New creates a reverse proxy to the upstreams of cfg. Forwarding headers coming from
+// trusted proxies are extended, from anywhere else they are replaced.
+func New(cfg config.ServerConfig) *Proxy {
+	p := &Proxy{server: cfg}
+
+	p.proxy = &httputil.ReverseProxy{
+		Rewrite: p.rewrite,
+		// Flush every write so streamed and server-sent responses are not held back
+		FlushInterval: -1,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			slog.ErrorContext(r.Context(), "Failed to proxy request", "method", r.Method, "path", r.URL.Path, "error", err)
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.WriteHeader(http.StatusBadGateway)
+			w.Write([]byte(`{"error":"bad gateway"}`))
+		},
+	}
+
+	return p
+}
+
+// ServeHTTP forwards the request, WebSocket upgrades included
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if _, ok := p.server.UpstreamFor(r.URL.Path); !ok {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"error":"no upstream for this path"}`))
+		return
+	}
+
+	// Let the upstream answer while the request body is still being streamed in
+	_ = http.NewResponseController(w).EnableFullDuplex()
+
+	p.proxy.ServeHTTP(w, r)
+}
+
+// rewrite points the outgoing request at its upstream and sets the forwarding headers
+func (p *Proxy) rewrite(pr *httputil.ProxyRequest) {
+	upstream, _ := p.server.UpstreamFor(pr.In.URL.Path)
+	pr.SetURL(upstream.URL)
+
+	// Keep the original Host, legacy services often build links from it
+	pr.Out.Host = pr.In.Host
+
+	// Rewrite drops the incoming forwarding headers; a trusted proxy's chain is kept
+	// and SetXForwarded appends the peer to it
+	remote, err := netip.ParseAddrPort(pr.In.RemoteAddr)
+	if err == nil && middleware.IsTrustedProxy(p.server.TrustedProxies, remote.Addr()) {
+		if xff := pr.In.Header.Values("X-Forwarded-For"); len(xff) > 0 {
+			pr.Out.Header["X-Forwarded-For"] = xff
+		}
+	}
+	pr.SetXForwarded()
+
+	// The client IP the limits were applied to, for upstreams that want it as is
+	pr.Out.Header.Set("X-Real-IP", middleware.ClientIP(pr.In, p.server.TrustedProxies, p.server.ClientIPHeader))
+
+	// Continue the trace and keep the request ID, so upstream logs can be joined with ours
+	telemetry.Propagator.Inject(pr.Out.Context(), propagation.HeaderCarrier(pr.Out.Header))
+	if id := telemetry.RequestIDFromContext(pr.Out.Context()); id != "" {
+		pr.Out.Header.Set(telemetry.RequestIDHeader, id)
+	}
+}
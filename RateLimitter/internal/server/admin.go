@@ -0,0 +1,347 @@
+package server
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"rate-limiter/internal/audit"
+	"rate-limiter/internal/config"
+	"rate-limiter/internal/limiter"
+	"rate-limiter/internal/middleware"
+	"rate-limiter/internal/storage"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ActorHeader names the person or system behind an admin request in the audit log
+const ActorHeader = "X-Audit-Actor"
+
+// keyRequest identifies the client an admin operation applies to
+type keyRequest struct {
+	Type string `json:"type" form:"type" binding:"required"` // "ip" or "token"
+	Key  string `json:"key" form:"key" binding:"required"`
+	// Policy targets the counters and blocks of a route policy instead of the defaults
+	Policy string `json:"policy" form:"policy"`
+}
+
+// blockRequest blocks a client for a duration such as "10m"
+type blockRequest struct {
+	keyRequest
+	Duration string `json:"duration" binding:"required"`
+}
+
+// tokenLimitJSON is the JSON form of a token limit, in requests and responses
+type tokenLimitJSON struct {
+	RequestsPerSecond    int            `json:"requests_per_second"`
+	BlockDurationMinutes int            `json:"block_duration_minutes"`
+	Algorithm            string         `json:"algorithm,omitempty"`
+	Quotas               map[string]int `json:"quotas,omitempty"`
+}
+
+// setupAdminRoutes configures the admin API, which requires the admin token
+func (s *Server) setupAdminRoutes() {
+	admin := s.router.Group("/admin")
+	admin.Use(adminAuth(s.config.Server.AdminToken), s.adminActor)
+
+	admin.GET("/blocks", s.listBlocks)
+	admin.POST("/blocks", s.block)
+	admin.DELETE("/blocks", s.unblock)
+	// Kept for existing clients, same as DELETE /admin/blocks
+	admin.POST("/unblock", s.unblock)
+
+	admin.GET("/counters", s.listCounters)
+	admin.DELETE("/counters", s.resetCounters)
+
+	admin.GET("/tokens", s.listTokens)
+	admin.GET("/tokens/:token", s.getToken)
+	admin.PUT("/tokens/:token", s.putToken)
+	admin.DELETE("/tokens/:token", s.deleteToken)
+	admin.DELETE("/tokens/:token/override", s.resetToken)
+}
+
+// adminAuth checks the bearer token of admin requests
+func adminAuth(token string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if token == "" {
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "Admin API is disabled, set ADMIN_TOKEN to enable it"})
+			return
+		}
+
+		given, found := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if !found || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			c.Header("WWW-Authenticate", `Bearer realm="admin"`)
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// adminActor records who makes an admin request, so the operations it causes are
+// audited as theirs
+func (s *Server) adminActor(c *gin.Context) {
+	actor := audit.Actor{
+		Name: "admin",
+		IP:   middleware.ClientIP(c.Request, s.config.Server.TrustedProxies, s.config.Server.ClientIPHeader),
+	}
+	if name := strings.TrimSpace(c.GetHeader(ActorHeader)); name != "" {
+		actor.Name = name
+	}
+
+	c.Request = c.Request.WithContext(audit.WithActor(c.Request.Context(), actor))
+	c.Next()
+}
+
+// storageKey resolves the storage key of a request, answering 400 or 404 when it is invalid
+func (s *Server) storageKey(c *gin.Context, request keyRequest) (string, bool) {
+	key, err := s.rateLimiter.StorageKey(request.Type, request.Key, request.Policy)
+	if errors.Is(err, limiter.ErrUnknownPolicy) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return "", false
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return "", false
+	}
+	return key, true
+}
+
+// listBlocks lists the blocked keys and when their blocks expire
+func (s *Server) listBlocks(c *gin.Context) {
+	blocks, err := s.rateLimiter.Blocks(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list blocks"})
+		return
+	}
+
+	now := s.rateLimiter.Now()
+	response := make([]gin.H, 0, len(blocks))
+	for _, block := range blocks {
+		response = append(response, gin.H{
+			"key":                block.Key,
+			"expires_in_seconds": ceilSeconds(block.ExpiresIn),
+			"expires_at":         now.Add(block.ExpiresIn).Format(time.RFC3339),
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{"blocks": response})
+}
+
+// block blocks a key for the requested duration
+func (s *Server) block(c *gin.Context) {
+	var request blockRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	duration, err := time.ParseDuration(request.Duration)
+	if err != nil || duration <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid duration %q", request.Duration)})
+		return
+	}
+
+	key, ok := s.storageKey(c, request.keyRequest)
+	if !ok {
+		return
+	}
+
+	if err := s.rateLimiter.Block(c.Request.Context(), key, duration); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to block"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"message":    fmt.Sprintf("%s %s blocked for %s", request.Type, request.Key, duration),
+		"key":        key,
+		"expires_at": s.rateLimiter.Now().Add(duration).Format(time.RFC3339),
+	})
+}
+
+// unblock removes the block on a key, read from the query string for DELETE requests
+// and from the JSON body otherwise
+func (s *Server) unblock(c *gin.Context) {
+	var request keyRequest
+	bind := c.ShouldBindJSON
+	if c.Request.Method == http.MethodDelete {
+		bind = c.ShouldBindQuery
+	}
+
+	if err := bind(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	key, ok := s.storageKey(c, request)
+	if !ok {
+		return
+	}
+
+	if err := s.rateLimiter.Unblock(c.Request.Context(), key); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to unblock"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": fmt.Sprintf("%s %s unblocked successfully", request.Type, request.Key),
+		"key":     key,
+	})
+}
+
+// listCounters lists the live counters of a key, or of every key when none is given
+func (s *Server) listCounters(c *gin.Context) {
+	prefix := ""
+	if c.Query("key") != "" {
+		var request keyRequest
+		if err := c.ShouldBindQuery(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+			return
+		}
+
+		key, ok := s.storageKey(c, request)
+		if !ok {
+			return
+		}
+		prefix = key
+	}
+
+	counters, err := s.rateLimiter.Counters(c.Request.Context(), prefix)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list counters"})
+		return
+	}
+
+	response := make([]gin.H, 0, len(counters))
+	for _, counter := range counters {
+		// A key's prefix also matches longer keys, so only keep exact matches
+		if prefix != "" && counter.Key != prefix {
+			continue
+		}
+		response = append(response, counterResponse(counter))
+	}
+
+	c.JSON(http.StatusOK, gin.H{"counters": response})
+}
+
+// resetCounters drops the counters of a key
+func (s *Server) resetCounters(c *gin.Context) {
+	var request keyRequest
+	if err := c.ShouldBindQuery(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	key, ok := s.storageKey(c, request)
+	if !ok {
+		return
+	}
+
+	if err := s.rateLimiter.ResetCounters(c.Request.Context(), key); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reset counters"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": fmt.Sprintf("%s %s counters reset", request.Type, request.Key),
+		"key":     key,
+	})
+}
+
+// listTokens lists every token limit in use
+func (s *Server) listTokens(c *gin.Context) {
+	tokenLimits := s.rateLimiter.Limits().TokenLimits
+
+	tokens := make([]string, 0, len(tokenLimits))
+	for token := range tokenLimits {
+		tokens = append(tokens, token)
+	}
+	sort.Strings(tokens)
+
+	response := make([]gin.H, 0, len(tokens))
+	for _, token := range tokens {
+		limit := tokenLimits[token]
+		response = append(response, gin.H{
+			"token":                  token,
+			"requests_per_second":    limit.RequestsPerSecond,
+			"block_duration_minutes": limit.BlockDurationMinutes,
+			"algorithm":              limit.Algorithm,
+			"quotas":                 limit.Quotas,
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{"tokens": response})
+}
+
+// getToken returns the limit of a token
+func (s *Server) getToken(c *gin.Context) {
+	limit, exists := s.rateLimiter.Limits().TokenLimits[c.Param("token")]
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Token not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, tokenLimitJSON(limit))
+}
+
+// putToken creates or replaces the limit of a token
+func (s *Server) putToken(c *gin.Context) {
+	var request tokenLimitJSON
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	limit := config.TokenLimit(request)
+	if err := s.rateLimiter.SetTokenLimit(c.Request.Context(), c.Param("token"), limit); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, tokenLimitJSON(limit))
+}
+
+// deleteToken removes the limit of a token
+func (s *Server) deleteToken(c *gin.Context) {
+	if !s.rateLimiter.DeleteTokenLimit(c.Request.Context(), c.Param("token")) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Token not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": fmt.Sprintf("token %s removed", c.Param("token"))})
+}
+
+// resetToken drops the admin change to the limit of a token
+func (s *Server) resetToken(c *gin.Context) {
+	if !s.rateLimiter.ResetTokenLimit(c.Request.Context(), c.Param("token")) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Token has no override"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": fmt.Sprintf("token %s override removed", c.Param("token"))})
+}
+
+// counterResponse is the JSON form of a counter
+func counterResponse(counter storage.CounterInfo) gin.H {
+	response := gin.H{
+		"key":                counter.Key,
+		"algorithm":          counter.Script,
+		"fields":             counter.Fields,
+		"expires_in_seconds": ceilSeconds(counter.ExpiresIn),
+	}
+	if counter.Entries > 0 {
+		response["entries"] = counter.Entries
+	}
+	return response
+}
+
+// ceilSeconds rounds a duration up to whole seconds
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
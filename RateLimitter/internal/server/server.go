@@ -3,83 +3,265 @@ package server
 import (
 	"context"
 	"fmt"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
+	"net/netip"
 	"os"
 	"os/signal"
 	"syscall"
 	"time"
 
+	"rate-limiter/internal/audit"
 	"rate-limiter/internal/config"
+	"rate-limiter/internal/envoy"
 	"rate-limiter/internal/limiter"
+	"rate-limiter/internal/metrics"
 	"rate-limiter/internal/middleware"
+	"rate-limiter/internal/proxy"
 	"rate-limiter/internal/storage"
 
+	rls "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
 	"github.com/gin-gonic/gin"
+	"github.com/pires/go-proxyproto"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc"
 )
 
+// activeBlocksTTL is how long the number of blocked keys is reused between scrapes, as
+// counting them lists every block in the storage
+const activeBlocksTTL = 15 * time.Second
+
 // Server represents the HTTP server
 type Server struct {
 	config      *config.Config
 	storage     storage.Storage
 	rateLimiter *limiter.RateLimiter
 	router      *gin.Engine
+	registry    *prometheus.Registry
+	// peers is the storage shared with the other replicas, nil when not clustered
+	peers *storage.PeerStorage
+	// policyWatcher reloads the policy file, nil when none is configured
+	policyWatcher *config.PolicyWatcher
+	// audit records blocks and admin operations, nil when no sink is configured
+	audit *audit.Log
 }
 
 // NewServer creates a new server instance
 func NewServer(cfg *config.Config) (*Server, error) {
-	// Initialize storage
-	var store storage.Storage
-	var err error
+	// Replicas share the limits between themselves without Redis, or while it is down
+	var peers *storage.PeerStorage
+	if cfg.Cluster.Enabled() {
+		var err error
+		if peers, err = newPeerStorage(cfg); err != nil {
+			return nil, err
+		}
+	}
 
-	// Try Redis first, fallback to memory storage
-	store, err = storage.NewRedisStorage(
-		cfg.Redis.Host,
-		cfg.Redis.Port,
-		cfg.Redis.Password,
-		cfg.Redis.DB,
-	)
+	if cfg.Storage == config.StoragePeers {
+		server, err := New(cfg, peers)
+		if err != nil {
+			peers.Close()
+			return nil, err
+		}
+		return server, nil
+	}
+
+	tlsConfig, err := cfg.Redis.TLSConfig()
 	if err != nil {
-		log.Printf("Failed to connect to Redis, using memory storage: %v", err)
-		store = storage.NewMemoryStorage()
+		if peers != nil {
+			peers.Close()
+		}
+		return nil, err
+	}
+
+	redis := storage.DialRedisOptions(storage.RedisOptions{
+		Addrs:            cfg.Redis.Addrs(),
+		MasterName:       cfg.Redis.MasterName,
+		Cluster:          len(cfg.Redis.ClusterAddrs) > 0,
+		Username:         cfg.Redis.Username,
+		Password:         cfg.Redis.Password,
+		SentinelPassword: cfg.Redis.SentinelPassword,
+		DB:               cfg.Redis.DB,
+		TLS:              tlsConfig,
+		PoolSize:         cfg.Redis.PoolSize,
+		MinIdleConns:     cfg.Redis.MinIdleConns,
+		PoolTimeout:      cfg.Redis.PoolTimeout,
+		DialTimeout:      cfg.Redis.DialTimeout,
+		ReadTimeout:      cfg.Redis.ReadTimeout,
+		WriteTimeout:     cfg.Redis.WriteTimeout,
+	})
+
+	// Redis is used behind a circuit breaker, which takes it back once it recovers
+	options := storage.BreakerOptions{
+		FailOpen:  cfg.Redis.FailMode == config.FailOpen,
+		Threshold: cfg.Redis.BreakerThreshold,
+		Cooldown:  cfg.Redis.BreakerCooldown,
+	}
+	if peers != nil {
+		options.Fallback = peers
+	}
+	store := storage.NewCircuitBreaker(redis, options)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := redis.Ping(ctx); err != nil {
+		slog.Warn("Failed to connect to Redis, failing until it is available", "fail_mode", cfg.Redis.FailMode, "error", err)
+		store.Trip()
+	}
+
+	server, err := New(cfg, store)
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
+
+	return server, nil
+}
+
+// newPeerStorage creates a storage shared with the replicas found by cfg.Cluster
+func newPeerStorage(cfg *config.Config) (*storage.PeerStorage, error) {
+	var discovery storage.Discovery = storage.StaticPeers(cfg.Cluster.Peers)
+	if cfg.Cluster.DNS != "" {
+		host, port, err := net.SplitHostPort(cfg.Cluster.DNS)
+		if err != nil {
+			return nil, err
+		}
+		discovery = storage.DNSPeers{Host: host, Port: port}
+	}
+
+	var scripts []storage.Script
+	for _, algorithm := range limiter.Algorithms() {
+		scripts = append(scripts, algorithm)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	return storage.NewPeerStorage(ctx, storage.PeerOptions{
+		Self:      cfg.Cluster.Self,
+		Discovery: discovery,
+		Refresh:   cfg.Cluster.Refresh,
+		Secret:    cfg.Cluster.Secret,
+		Scripts:   scripts,
+	})
+}
+
+// New creates a server on top of an existing storage
+func New(cfg *config.Config, store storage.Storage) (*Server, error) {
+	if err := cfg.Server.ValidateMode(); err != nil {
+		return nil, err
 	}
 
+	var err error
+
 	// Initialize rate limiter
 	rateLimiter := limiter.NewRateLimiter(store, cfg)
 
-	// Initialize router
-	router := gin.Default()
+	// Initialize router, logging requests with their request and trace IDs
+	router := gin.New()
+	router.Use(gin.Recovery(), middleware.TelemetryMiddleware(cfg.Server.TrustedProxies, cfg.Server.ClientIPHeader))
 
 	server := &Server{
 		config:      cfg,
 		storage:     store,
 		rateLimiter: rateLimiter,
+		peers:       peerStorage(store),
 		router:      router,
+		registry: metrics.NewRegistry(metrics.NewActiveBlocksCollector(func(ctx context.Context) (int, error) {
+			blocks, err := rateLimiter.Blocks(ctx)
+			return len(blocks), err
+		}, activeBlocksTTL)),
+	}
+
+	if cfg.Audit.Enabled() {
+		if server.audit, err = newAuditLog(cfg.Audit, store); err != nil {
+			return nil, err
+		}
+		rateLimiter.SetAuditLog(server.audit)
+	}
+
+	// Reload the policy file into the running limiter when it changes
+	if cfg.PolicyFile != "" {
+		server.policyWatcher, err = cfg.WatchPolicyFile(
+			func(limits config.RateLimitConfig) {
+				rateLimiter.UpdateLimits(limits)
+				slog.Info("Reloaded rate limit policies", "file", cfg.PolicyFile)
+			},
+			func(err error) {
+				slog.Error("Failed to reload rate limit policies, keeping the previous ones", "file", cfg.PolicyFile, "error", err)
+			},
+		)
+		if err != nil {
+			server.audit.Close()
+			return nil, err
+		}
 	}
 
 	// Setup routes
-	server.setupRoutes()
+	if cfg.Server.Mode == config.ModeProxy {
+		server.setupProxyRoutes()
+	} else {
+		server.setupRoutes()
+	}
 
 	return server, nil
 }
 
+// newAuditLog creates the audit log writing to the sinks of cfg. The Redis stream is
+// written through the Redis storage of store.
+func newAuditLog(cfg config.AuditConfig, store storage.Storage) (*audit.Log, error) {
+	var sinks []audit.Sink
+
+	if cfg.RedisStream != "" {
+		redis := redisStorage(store)
+		if redis == nil {
+			return nil, fmt.Errorf("AUDIT_REDIS_STREAM needs the %s storage backend", config.StorageRedis)
+		}
+		sinks = append(sinks, audit.NewRedisStreamSink(redis, cfg.RedisStream, cfg.RedisStreamMaxLen))
+	}
+
+	if cfg.WebhookURL != "" {
+		sinks = append(sinks, audit.NewWebhookSink(cfg.WebhookURL, []byte(cfg.WebhookSecret), cfg.WebhookTimeout))
+	}
+
+	// Opened last, so that nothing is left to close when another sink fails
+	if cfg.File != "" {
+		file, err := audit.NewFileSink(cfg.File)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, file)
+	}
+
+	return audit.New(cfg.Buffer, sinks...), nil
+}
+
+// Handler returns the HTTP handler serving every route
+func (s *Server) Handler() http.Handler {
+	return s.router
+}
+
 // setupRoutes configures the HTTP routes
 func (s *Server) setupRoutes() {
-	// Health check endpoint (no rate limiting)
-	s.router.GET("/health", func(c *gin.Context) {
-		c.JSON(200, gin.H{
-			"status": "ok",
-			"time":   time.Now().Format(time.RFC3339),
-		})
-	})
+	s.setupCommonRoutes()
 
 	// API endpoints with rate limiting
 	api := s.router.Group("/api")
-	api.Use(middleware.RateLimiterMiddleware(s.rateLimiter))
+	apiOptions := []middleware.Option{
+		middleware.WithGroup("api"),
+		middleware.WithTrustedProxies(s.config.Server.TrustedProxies),
+		middleware.WithClientIPHeader(s.config.Server.ClientIPHeader),
+	}
+	api.Use(
+		middleware.RateLimiterMiddleware(s.rateLimiter, apiOptions...),
+		middleware.ConcurrencyLimiterMiddleware(s.rateLimiter, apiOptions...),
+	)
 
 	// Test endpoint
 	api.GET("/test", func(c *gin.Context) {
-		ip := c.ClientIP()
+		ip := middleware.ClientIP(c.Request, s.config.Server.TrustedProxies, s.config.Server.ClientIPHeader)
 		token := c.GetHeader("API_KEY")
 
 		c.JSON(200, gin.H{
@@ -92,7 +274,7 @@ func (s *Server) setupRoutes() {
 
 	// Rate limit status endpoint
 	api.GET("/status", func(c *gin.Context) {
-		ip := c.ClientIP()
+		ip := middleware.ClientIP(c.Request, s.config.Server.TrustedProxies, s.config.Server.ClientIPHeader)
 		token := c.GetHeader("API_KEY")
 
 		remaining, err := s.rateLimiter.GetRemainingRequests(c.Request.Context(), ip, token)
@@ -114,41 +296,85 @@ func (s *Server) setupRoutes() {
 			"token":              token,
 		})
 	})
+}
 
-	// Admin endpoint to unblock IPs/tokens (no rate limiting)
-	admin := s.router.Group("/admin")
-	admin.POST("/unblock", func(c *gin.Context) {
-		var request struct {
-			Type string `json:"type" binding:"required"` // "ip" or "token"
-			Key  string `json:"key" binding:"required"`
-		}
+// setupProxyRoutes rate limits every request outside the health, metrics and admin
+// routes and forwards it to its upstream
+func (s *Server) setupProxyRoutes() {
+	s.setupCommonRoutes()
 
-		if err := c.ShouldBindJSON(&request); err != nil {
-			c.JSON(400, gin.H{"error": "Invalid request"})
-			return
+	proxyOptions := []middleware.Option{
+		middleware.WithGroup("proxy"),
+		middleware.WithTrustedProxies(s.config.Server.TrustedProxies),
+		middleware.WithClientIPHeader(s.config.Server.ClientIPHeader),
+	}
+	s.router.NoRoute(
+		middleware.RateLimiterMiddleware(s.rateLimiter, proxyOptions...),
+		middleware.ConcurrencyLimiterMiddleware(s.rateLimiter, proxyOptions...),
+		gin.WrapH(proxy.New(s.config.Server)),
+	)
+}
+
+// setupCommonRoutes configures the routes served in every mode
+func (s *Server) setupCommonRoutes() {
+	// Health check endpoint (no rate limiting)
+	s.router.GET("/health", func(c *gin.Context) {
+		health := gin.H{
+			"status":  "ok",
+			"storage": s.storageStatus(),
+			"time":    time.Now().Format(time.RFC3339),
+		}
+		if s.peers != nil {
+			health["peers"] = s.peers.Peers()
 		}
+		c.JSON(200, health)
+	})
 
-		ctx := c.Request.Context()
-		var err error
+	// Operations forwarded by the other replicas (no rate limiting)
+	if s.peers != nil {
+		s.router.POST(storage.PeerPath, gin.WrapH(s.peers.Handler()))
+	}
 
-		if request.Type == "ip" {
-			err = s.storage.Unblock(ctx, request.Key)
-		} else if request.Type == "token" {
-			err = s.storage.Unblock(ctx, request.Key)
-		} else {
-			c.JSON(400, gin.H{"error": "Invalid type. Must be 'ip' or 'token'"})
-			return
-		}
+	// Prometheus metrics (no rate limiting)
+	s.router.GET("/metrics", gin.WrapH(metrics.Handler(s.registry)))
 
-		if err != nil {
-			c.JSON(500, gin.H{"error": "Failed to unblock"})
-			return
-		}
+	// Admin endpoints (no rate limiting)
+	s.setupAdminRoutes()
+}
 
-		c.JSON(200, gin.H{
-			"message": fmt.Sprintf("%s %s unblocked successfully", request.Type, request.Key),
-		})
-	})
+// storageStatus reports whether the storage is fully available or bypassed by its
+// circuit breaker
+func (s *Server) storageStatus() string {
+	if breaker, ok := s.storage.(*storage.CircuitBreaker); ok && breaker.Degraded() {
+		return "degraded"
+	}
+	return "ok"
+}
+
+// peerStorage returns the peer storage behind store, directly or as the fallback of
+// its circuit breaker, or nil
+func peerStorage(store storage.Storage) *storage.PeerStorage {
+	if breaker, ok := store.(*storage.CircuitBreaker); ok {
+		store = breaker.Fallback()
+	}
+	peers, _ := store.(*storage.PeerStorage)
+	return peers
+}
+
+// redisStorage returns the Redis storage behind store, nil when it has none
+func redisStorage(store storage.Storage) *storage.RedisStorage {
+	if breaker, ok := store.(*storage.CircuitBreaker); ok {
+		store = breaker.Primary()
+	}
+	redis, _ := store.(*storage.RedisStorage)
+	return redis
+}
+
+// GRPCServer returns a gRPC server implementing the Envoy rate limit service
+func (s *Server) GRPCServer() *grpc.Server {
+	grpcServer := grpc.NewServer()
+	rls.RegisterRateLimitServiceServer(grpcServer, envoy.NewService(s.rateLimiter))
+	return grpcServer
 }
 
 // Start starts the HTTP server
@@ -159,34 +385,107 @@ func (s *Server) Start() error {
 		Handler: s.router,
 	}
 
+	listener, err := Listen(s.config.Server)
+	if err != nil {
+		return err
+	}
+
 	// Start server in a goroutine
 	go func() {
-		log.Printf("Server starting on port %s", s.config.Server.Port)
-		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Fatalf("Failed to start server: %v", err)
+		slog.Info("Server starting", "port", s.config.Server.Port)
+		if err := srv.Serve(listener); err != nil && err != http.ErrServerClosed {
+			slog.Error("Failed to start server", "error", err)
+			os.Exit(1)
 		}
 	}()
 
+	// Serve the Envoy rate limit service alongside when enabled
+	var grpcServer *grpc.Server
+	if s.config.Server.GRPCPort != "" {
+		grpcListener, err := net.Listen("tcp", ":"+s.config.Server.GRPCPort)
+		if err != nil {
+			return fmt.Errorf("failed to listen on port %s: %w", s.config.Server.GRPCPort, err)
+		}
+
+		grpcServer = s.GRPCServer()
+		go func() {
+			slog.Info("Rate limit service starting", "port", s.config.Server.GRPCPort)
+			if err := grpcServer.Serve(grpcListener); err != nil {
+				slog.Error("Failed to start rate limit service", "error", err)
+				os.Exit(1)
+			}
+		}()
+	}
+
 	// Wait for interrupt signal to gracefully shutdown the server
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 	<-quit
-	log.Println("Shutting down server...")
+	slog.Info("Shutting down server")
 
 	// Give outstanding requests 30 seconds to complete
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
 
+	if grpcServer != nil {
+		grpcServer.GracefulStop()
+	}
+
 	if err := srv.Shutdown(ctx); err != nil {
-		log.Printf("Server forced to shutdown: %v", err)
+		slog.Error("Server forced to shutdown", "error", err)
 		return err
 	}
 
+	if s.policyWatcher != nil {
+		if err := s.policyWatcher.Close(); err != nil {
+			slog.Error("Error closing policy watcher", "error", err)
+		}
+	}
+
+	// Deliver the pending audit events while the storage is still open
+	if err := s.audit.Close(); err != nil {
+		slog.Error("Error closing audit log", "error", err)
+	}
+
 	// Close storage connection
 	if err := s.storage.Close(); err != nil {
-		log.Printf("Error closing storage: %v", err)
+		slog.Error("Error closing storage", "error", err)
 	}
 
-	log.Println("Server exited")
+	slog.Info("Server exited")
 	return nil
 }
+
+// Listen opens the server port, reading PROXY protocol headers when enabled
+func Listen(cfg config.ServerConfig) (net.Listener, error) {
+	listener, err := net.Listen("tcp", ":"+cfg.Port)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on port %s: %w", cfg.Port, err)
+	}
+
+	if !cfg.ProxyProtocol {
+		return listener, nil
+	}
+
+	return &proxyproto.Listener{
+		Listener:          listener,
+		Policy:            proxyProtocolPolicy(cfg.TrustedProxies),
+		ReadHeaderTimeout: 10 * time.Second,
+	}, nil
+}
+
+// proxyProtocolPolicy accepts PROXY headers from the trusted proxies only. Headers sent
+// by any other peer are ignored, so those connections keep the peer address and a client
+// cannot claim someone else's IP.
+func proxyProtocolPolicy(trustedProxies []netip.Prefix) proxyproto.PolicyFunc {
+	return func(upstream net.Addr) (proxyproto.Policy, error) {
+		addrPort, err := netip.ParseAddrPort(upstream.String())
+		if err != nil {
+			return proxyproto.IGNORE, nil
+		}
+		if middleware.IsTrustedProxy(trustedProxies, addrPort.Addr()) {
+			return proxyproto.USE, nil
+		}
+		return proxyproto.IGNORE, nil
+	}
+}
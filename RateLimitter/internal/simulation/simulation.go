@@ -0,0 +1,190 @@
+// Package simulation replays synthetic request traces against an algorithm and a
+// storage on a fake clock, so that what an algorithm decides over time can be checked
+// exactly and compared across algorithms and storages.
+package simulation
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"rate-limiter/internal/clock"
+	"rate-limiter/internal/limiter"
+	"rate-limiter/internal/storage"
+)
+
+// Request is a request of a trace
+type Request struct {
+	// At is when the request arrives, from the start of the trace
+	At  time.Duration
+	Key string
+	// Cost is how many requests it counts as, one when zero
+	Cost int
+}
+
+// Decision is what was decided on a request of a trace
+type Decision struct {
+	Request
+	Allowed bool
+	// Blocked is set when the request was refused because its key was blocked
+	Blocked    bool
+	Remaining  int
+	RetryAfter time.Duration
+}
+
+// Timeline holds the decisions on the requests of a trace, in the order they arrived
+type Timeline []Decision
+
+// Allowed counts the allowed requests
+func (t Timeline) Allowed() int {
+	allowed := 0
+	for _, decision := range t {
+		if decision.Allowed {
+			allowed++
+		}
+	}
+	return allowed
+}
+
+// Denied counts the denied requests, blocked ones included
+func (t Timeline) Denied() int {
+	return len(t) - t.Allowed()
+}
+
+// Key returns the decisions on the requests for key
+func (t Timeline) Key(key string) Timeline {
+	var decisions Timeline
+	for _, decision := range t {
+		if decision.Key == key {
+			decisions = append(decisions, decision)
+		}
+	}
+	return decisions
+}
+
+// Pattern draws the timeline with one character per request: + for allowed, - for
+// denied and x for refused while blocked
+func (t Timeline) Pattern() string {
+	var pattern strings.Builder
+	for _, decision := range t {
+		switch {
+		case decision.Allowed:
+			pattern.WriteByte('+')
+		case decision.Blocked:
+			pattern.WriteByte('x')
+		default:
+			pattern.WriteByte('-')
+		}
+	}
+	return pattern.String()
+}
+
+// String reports one decision per line
+func (t Timeline) String() string {
+	var report strings.Builder
+	for _, decision := range t {
+		outcome := "allowed"
+		switch {
+		case decision.Blocked:
+			outcome = "blocked"
+		case !decision.Allowed:
+			outcome = "denied"
+		}
+
+		fmt.Fprintf(&report, "%8s  %-20s %-8s remaining=%d", decision.At, decision.Key, outcome, decision.Remaining)
+		if decision.RetryAfter > 0 {
+			fmt.Fprintf(&report, " retry_after=%s", decision.RetryAfter)
+		}
+		report.WriteByte('\n')
+	}
+	return report.String()
+}
+
+// Simulator replays traces against a storage, letting time pass up to each request.
+// The storage must read the time from the simulator's clock, or from the requests it
+// is given, as the algorithms do.
+type Simulator struct {
+	storage storage.Storage
+	clock   clock.Clock
+	advance func(time.Duration)
+}
+
+// New creates a simulator for store reading the time from c. Advance lets time pass:
+// it moves c forward, as clock.Fake.Advance does, along with any storage keeping time
+// of its own, such as a Redis storage on miniredis.
+func New(store storage.Storage, c clock.Clock, advance func(time.Duration)) *Simulator {
+	return &Simulator{storage: store, clock: c, advance: advance}
+}
+
+// Run replays trace against algorithm and limit, starting at the current time of the
+// clock. Requests are replayed in the order they arrive, those arriving together in
+// the order of the trace.
+func (s *Simulator) Run(ctx context.Context, algorithm limiter.Algorithm, limit limiter.Limit, trace []Request) (Timeline, error) {
+	requests := append([]Request(nil), trace...)
+	sort.SliceStable(requests, func(i, j int) bool {
+		return requests[i].At < requests[j].At
+	})
+
+	start := s.clock.Now()
+	timeline := make(Timeline, 0, len(requests))
+
+	for _, request := range requests {
+		if request.Cost == 0 {
+			request.Cost = 1
+		}
+
+		if elapsed := start.Add(request.At).Sub(s.clock.Now()); elapsed > 0 {
+			s.advance(elapsed)
+		}
+
+		result, err := s.storage.Consume(ctx, algorithm, storage.ConsumeRequest{
+			Key:           request.Key,
+			Limit:         limit.Requests,
+			Window:        limit.Window,
+			Cost:          request.Cost,
+			BlockDuration: limit.BlockDuration,
+			Now:           s.clock.Now(),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("request %s at %s: %w", request.Key, request.At, err)
+		}
+
+		timeline = append(timeline, Decision{
+			Request:    request,
+			Allowed:    result.Allowed,
+			Blocked:    result.Blocked,
+			Remaining:  result.Remaining,
+			RetryAfter: result.RetryAfter,
+		})
+	}
+
+	return timeline, nil
+}
+
+// Steady returns n requests for key, the first at start and the others every interval
+func Steady(key string, start, interval time.Duration, n int) []Request {
+	requests := make([]Request, n)
+	for i := range requests {
+		requests[i] = Request{At: start + time.Duration(i)*interval, Key: key}
+	}
+	return requests
+}
+
+// Burst returns n requests for key arriving together at at
+func Burst(key string, at time.Duration, n int) []Request {
+	return Steady(key, at, 0, n)
+}
+
+// Merge combines traces into one, ordered by arrival
+func Merge(traces ...[]Request) []Request {
+	var merged []Request
+	for _, trace := range traces {
+		merged = append(merged, trace...)
+	}
+	sort.SliceStable(merged, func(i, j int) bool {
+		return merged[i].At < merged[j].At
+	})
+	return merged
+}
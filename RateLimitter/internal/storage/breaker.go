@@ -0,0 +1,301 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"rate-limiter/internal/clock"
+	"rate-limiter/internal/metrics"
+)
+
+// ErrUnavailable is returned by a fail-closed CircuitBreaker while its storage is down
+var ErrUnavailable = errors.New("rate limit storage unavailable")
+
+// BreakerOptions configures a CircuitBreaker
+type BreakerOptions struct {
+	// FailOpen serves requests from a local in-memory storage while the primary one is
+	// down. Otherwise they fail with ErrUnavailable, as blocks, unblocks, counter resets
+	// and lease releases always do.
+	FailOpen bool
+	// Threshold is how many consecutive errors open the circuit
+	Threshold int
+	// Cooldown is how long the circuit stays open before the primary storage is tried again
+	Cooldown time.Duration
+	// Fallback serves requests in fail-open mode, a new MemoryStorage when nil
+	Fallback Storage
+	// Clock times the cooldown, the system clock when nil
+	Clock clock.Clock
+}
+
+// CircuitBreaker implements the Storage interface on top of a primary storage, usually
+// Redis. After Threshold consecutive errors it stops calling the primary storage and
+// either falls back to a degraded storage, in memory by default, or refuses operations. Once Cooldown
+// has passed a single operation probes the primary storage, closing the circuit again
+// when it succeeds.
+type CircuitBreaker struct {
+	primary  Storage
+	fallback Storage
+	options  BreakerOptions
+
+	mu       sync.Mutex
+	failures int
+	open     bool
+	openedAt time.Time
+	// probing is set while an operation tests whether the primary storage is back
+	probing bool
+}
+
+// NewCircuitBreaker wraps primary in a circuit breaker
+func NewCircuitBreaker(primary Storage, options BreakerOptions) *CircuitBreaker {
+	if options.Clock == nil {
+		options.Clock = clock.Real
+	}
+
+	fallback := options.Fallback
+	if fallback == nil {
+		fallback = NewMemoryStorageWithClock(options.Clock)
+	}
+
+	return &CircuitBreaker{
+		primary:  primary,
+		fallback: fallback,
+		options:  options,
+	}
+}
+
+// Primary returns the storage wrapped by the breaker
+func (b *CircuitBreaker) Primary() Storage {
+	return b.primary
+}
+
+// Fallback returns the storage used while the circuit is open in fail-open mode
+func (b *CircuitBreaker) Fallback() Storage {
+	return b.fallback
+}
+
+// Trip opens the circuit, as when the primary storage is known to be down at startup
+func (b *CircuitBreaker) Trip() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.trip()
+}
+
+// Degraded reports whether the primary storage is currently bypassed
+func (b *CircuitBreaker) Degraded() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.open
+}
+
+// trip opens the circuit, b.mu must be held
+func (b *CircuitBreaker) trip() {
+	if !b.open {
+		slog.Warn("Rate limit storage unavailable, circuit opened", "cooldown", b.options.Cooldown.String())
+	}
+	b.open = true
+	b.openedAt = b.options.Clock.Now()
+	b.probing = false
+}
+
+// acquire reports whether the primary storage should be called. While the circuit is
+// open only one caller at a time is let through, once the cooldown has passed.
+func (b *CircuitBreaker) acquire() (primary, probe bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.open {
+		return true, false
+	}
+
+	if b.probing || b.options.Clock.Now().Sub(b.openedAt) < b.options.Cooldown {
+		return false, false
+	}
+
+	b.probing = true
+	return true, true
+}
+
+// record updates the circuit with the outcome of a call to the primary storage
+func (b *CircuitBreaker) record(probe bool, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err == nil {
+		if b.open && probe {
+			slog.Info("Rate limit storage recovered, circuit closed")
+			b.open = false
+			b.probing = false
+		}
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+	if probe || b.failures >= b.options.Threshold {
+		b.trip()
+	}
+}
+
+// call runs op against the primary storage when the circuit allows it, and against the
+// fallback, or not at all in fail-closed mode, otherwise
+func call[T any](ctx context.Context, b *CircuitBreaker, op func(Storage) (T, error)) (T, error) {
+	return run(ctx, b, b.options.FailOpen, op)
+}
+
+// mutate is exec for admin changes and lease releases, which fail instead of going to
+// the fallback: applied there they would be lost, or undo nothing, once the primary
+// storage is back
+func mutate(ctx context.Context, b *CircuitBreaker, op func(Storage) error) error {
+	_, err := run(ctx, b, false, func(s Storage) (struct{}, error) {
+		return struct{}{}, op(s)
+	})
+	return err
+}
+
+// run is call, falling back only when failOpen is set
+func run[T any](ctx context.Context, b *CircuitBreaker, failOpen bool, op func(Storage) (T, error)) (T, error) {
+	usePrimary, probe := b.acquire()
+	reason := "circuit_open"
+
+	if usePrimary {
+		value, err := op(b.primary)
+
+		// A cancelled caller says nothing about the health of the storage
+		if err != nil && ctx.Err() != nil {
+			if probe {
+				b.mu.Lock()
+				b.probing = false
+				b.mu.Unlock()
+			}
+			return value, err
+		}
+
+		b.record(probe, err)
+		if err == nil {
+			return value, nil
+		}
+		reason = "storage_error"
+
+		if !failOpen {
+			return value, fmt.Errorf("%w: %v", ErrUnavailable, err)
+		}
+	}
+
+	if !failOpen {
+		var zero T
+		return zero, ErrUnavailable
+	}
+
+	metrics.FailOpen.WithLabelValues(reason).Inc()
+	return op(b.fallback)
+}
+
+// exec is call for operations that only return an error
+func exec(ctx context.Context, b *CircuitBreaker, op func(Storage) error) error {
+	_, err := call(ctx, b, func(s Storage) (struct{}, error) {
+		return struct{}{}, op(s)
+	})
+	return err
+}
+
+// GetRequestCount returns the current request count for a key
+func (b *CircuitBreaker) GetRequestCount(ctx context.Context, key string) (int, error) {
+	return call(ctx, b, func(s Storage) (int, error) {
+		return s.GetRequestCount(ctx, key)
+	})
+}
+
+// IncrementRequestCount increments the request count for a key
+func (b *CircuitBreaker) IncrementRequestCount(ctx context.Context, key string, expiration time.Duration) error {
+	return exec(ctx, b, func(s Storage) error {
+		return s.IncrementRequestCount(ctx, key, expiration)
+	})
+}
+
+// Consume checks the block on a key and runs script against its state atomically
+func (b *CircuitBreaker) Consume(ctx context.Context, script Script, req ConsumeRequest) (*ConsumeResult, error) {
+	return call(ctx, b, func(s Storage) (*ConsumeResult, error) {
+		return s.Consume(ctx, script, req)
+	})
+}
+
+// ConsumeAll runs script against the state of several keys atomically
+func (b *CircuitBreaker) ConsumeAll(ctx context.Context, script Script, group string, reqs []ConsumeRequest) ([]Outcome, error) {
+	return call(ctx, b, func(s Storage) ([]Outcome, error) {
+		return s.ConsumeAll(ctx, script, group, reqs)
+	})
+}
+
+// IsBlocked checks if a key is currently blocked
+func (b *CircuitBreaker) IsBlocked(ctx context.Context, key string) (bool, error) {
+	return call(ctx, b, func(s Storage) (bool, error) {
+		return s.IsBlocked(ctx, key)
+	})
+}
+
+// BlockTTL returns how long a key stays blocked, zero if it is not blocked
+func (b *CircuitBreaker) BlockTTL(ctx context.Context, key string) (time.Duration, error) {
+	return call(ctx, b, func(s Storage) (time.Duration, error) {
+		return s.BlockTTL(ctx, key)
+	})
+}
+
+// Block blocks a key for the specified duration
+func (b *CircuitBreaker) Block(ctx context.Context, key string, duration time.Duration) error {
+	return mutate(ctx, b, func(s Storage) error {
+		return s.Block(ctx, key, duration)
+	})
+}
+
+// Unblock removes the block for a key
+func (b *CircuitBreaker) Unblock(ctx context.Context, key string) error {
+	return mutate(ctx, b, func(s Storage) error {
+		return s.Unblock(ctx, key)
+	})
+}
+
+// ListBlocks returns every key that is currently blocked
+func (b *CircuitBreaker) ListBlocks(ctx context.Context) ([]BlockInfo, error) {
+	return call(ctx, b, func(s Storage) ([]BlockInfo, error) {
+		return s.ListBlocks(ctx)
+	})
+}
+
+// ListCounters returns the state script keeps for every key starting with prefix
+func (b *CircuitBreaker) ListCounters(ctx context.Context, script Script, prefix string) ([]CounterInfo, error) {
+	return call(ctx, b, func(s Storage) ([]CounterInfo, error) {
+		return s.ListCounters(ctx, script, prefix)
+	})
+}
+
+// ResetCounter drops the state script keeps for a key
+func (b *CircuitBreaker) ResetCounter(ctx context.Context, script Script, key string) error {
+	return mutate(ctx, b, func(s Storage) error {
+		return s.ResetCounter(ctx, script, key)
+	})
+}
+
+// AcquireLease takes one of the concurrent slots of a key
+func (b *CircuitBreaker) AcquireLease(ctx context.Context, req LeaseRequest) (*LeaseResult, error) {
+	return call(ctx, b, func(s Storage) (*LeaseResult, error) {
+		return s.AcquireLease(ctx, req)
+	})
+}
+
+// ReleaseLease frees the slot held by a lease
+func (b *CircuitBreaker) ReleaseLease(ctx context.Context, key, id string) error {
+	return mutate(ctx, b, func(s Storage) error {
+		return s.ReleaseLease(ctx, key, id)
+	})
+}
+
+// Close closes the primary and the fallback storage
+func (b *CircuitBreaker) Close() error {
+	return errors.Join(b.primary.Close(), b.fallback.Close())
+}
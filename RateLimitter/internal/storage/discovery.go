@@ -0,0 +1,97 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// Discovery finds the replicas sharing a PeerStorage. Peers are base URLs such as
+// "http://10.0.0.1:8080".
+type Discovery interface {
+	Peers(ctx context.Context) ([]string, error)
+}
+
+// StaticPeers is a fixed list of peers
+type StaticPeers []string
+
+// Peers returns the list
+func (s StaticPeers) Peers(ctx context.Context) ([]string, error) {
+	peers := make([]string, 0, len(s))
+	for _, peer := range s {
+		peers = append(peers, normalizePeer(peer))
+	}
+	return peers, nil
+}
+
+// DNSPeers finds peers from the addresses a host name resolves to, such as a
+// Kubernetes headless service
+type DNSPeers struct {
+	Host string
+	Port string
+	// Scheme defaults to http
+	Scheme string
+	// Lookup resolves Host, net.DefaultResolver.LookupHost when nil
+	Lookup func(ctx context.Context, host string) ([]string, error)
+}
+
+// Peers resolves the host and returns one peer per address, ordered
+func (d DNSPeers) Peers(ctx context.Context) ([]string, error) {
+	lookup := d.Lookup
+	if lookup == nil {
+		lookup = net.DefaultResolver.LookupHost
+	}
+
+	addrs, err := lookup(ctx, d.Host)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve peers from %s: %w", d.Host, err)
+	}
+
+	scheme := d.Scheme
+	if scheme == "" {
+		scheme = "http"
+	}
+
+	peers := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		peers = append(peers, scheme+"://"+net.JoinHostPort(addr, d.Port))
+	}
+	sort.Strings(peers)
+
+	return peers, nil
+}
+
+// normalizePeer drops the trailing slash of a peer URL so peers compare equal
+func normalizePeer(peer string) string {
+	return strings.TrimRight(strings.TrimSpace(peer), "/")
+}
+
+// localPeer returns the peer whose host is an address of this machine
+func localPeer(peers []string) (string, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return "", err
+	}
+
+	local := make(map[string]bool, len(addrs))
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok {
+			local[ipNet.IP.String()] = true
+		}
+	}
+
+	for _, peer := range peers {
+		u, err := url.Parse(peer)
+		if err != nil {
+			continue
+		}
+		if ip := net.ParseIP(u.Hostname()); ip != nil && local[ip.String()] {
+			return peer, nil
+		}
+	}
+
+	return "", fmt.Errorf("none of the peers %v is an address of this machine", peers)
+}
@@ -2,8 +2,12 @@ package storage
 
 import (
 	"context"
+	"sort"
+	"strings"
 	"sync"
 	"time"
+
+	"rate-limiter/internal/clock"
 )
 
 // MemoryStorage implements the Storage interface using in-memory storage
@@ -13,14 +17,44 @@ type MemoryStorage struct {
 	counters    map[string]int
 	blocks      map[string]time.Time
 	expirations map[string]time.Time
+	states      map[string]memoryState
+	offenses    map[string]offense
+	// leases maps a key to the expiry of each of its leases
+	leases map[string]map[string]time.Time
+	// clock tells the time of the operations that are not given one
+	clock clock.Clock
+}
+
+// memoryState holds the state of a script for a key and its expiration
+type memoryState struct {
+	state     *State
+	expiresAt time.Time
+}
+
+// offense holds the recent offenses of a key, for block escalation. Like the Redis
+// hash, it is dropped once every offense would have decayed.
+type offense struct {
+	count     int
+	last      time.Time
+	expiresAt time.Time
 }
 
 // NewMemoryStorage creates a new in-memory storage instance
 func NewMemoryStorage() *MemoryStorage {
+	return NewMemoryStorageWithClock(clock.Real)
+}
+
+// NewMemoryStorageWithClock creates an in-memory storage reading the time from c, so
+// that blocks and counters expire as c moves
+func NewMemoryStorageWithClock(c clock.Clock) *MemoryStorage {
 	storage := &MemoryStorage{
 		counters:    make(map[string]int),
 		blocks:      make(map[string]time.Time),
 		expirations: make(map[string]time.Time),
+		states:      make(map[string]memoryState),
+		offenses:    make(map[string]offense),
+		leases:      make(map[string]map[string]time.Time),
+		clock:       c,
 	}
 
 	// Start cleanup goroutine
@@ -31,11 +65,14 @@ func NewMemoryStorage() *MemoryStorage {
 
 // GetRequestCount returns the current request count for a key
 func (m *MemoryStorage) GetRequestCount(ctx context.Context, key string) (int, error) {
+	_, done := observe(ctx, "memory", "get_request_count")
+	defer done()
+
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 
 	// Check if key has expired
-	if exp, exists := m.expirations[key]; exists && time.Now().After(exp) {
+	if exp, exists := m.expirations[key]; exists && m.clock.Now().After(exp) {
 		return 0, nil
 	}
 
@@ -44,22 +81,121 @@ func (m *MemoryStorage) GetRequestCount(ctx context.Context, key string) (int, e
 
 // IncrementRequestCount increments the request count for a key
 func (m *MemoryStorage) IncrementRequestCount(ctx context.Context, key string, expiration time.Duration) error {
+	_, done := observe(ctx, "memory", "increment_request_count")
+	defer done()
+
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
 	// Check if key has expired
-	if exp, exists := m.expirations[key]; exists && time.Now().After(exp) {
+	if exp, exists := m.expirations[key]; exists && m.clock.Now().After(exp) {
 		m.counters[key] = 0
 	}
 
 	m.counters[key]++
-	m.expirations[key] = time.Now().Add(expiration)
+	m.expirations[key] = m.clock.Now().Add(expiration)
 
 	return nil
 }
 
+// Consume runs script against the state of a key while holding the storage lock
+func (m *MemoryStorage) Consume(ctx context.Context, script Script, req ConsumeRequest) (*ConsumeResult, error) {
+	_, done := observe(ctx, "memory", "consume")
+	defer done()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if blockTime, exists := m.blocks[req.Key]; exists && req.Now.Before(blockTime) {
+		left := blockTime.Sub(req.Now)
+		return &ConsumeResult{
+			Outcome: Outcome{Allowed: false, ResetAfter: left, RetryAfter: left},
+			Blocked: true,
+		}, nil
+	}
+
+	result := &ConsumeResult{Outcome: m.eval(script, req)}
+
+	if !result.Allowed && req.Cost > 0 && req.BlockDuration > 0 {
+		block := req.BlockDuration
+		if req.BlockFactor > 1 {
+			if previous, exists := m.offenses[req.Key]; exists && req.Now.Before(previous.expiresAt) {
+				result.Offenses = decayedOffenses(previous.count, previous.last, req.Now, req.OffenseDecay)
+			}
+			result.Offenses++
+			m.offenses[req.Key] = offense{
+				count:     result.Offenses,
+				last:      req.Now,
+				expiresAt: req.Now.Add(max(time.Millisecond, req.OffenseDecay*time.Duration(result.Offenses))),
+			}
+			block = escalatedBlock(req, result.Offenses)
+		}
+
+		m.blocks[req.Key] = req.Now.Add(block)
+		result.RetryAfter = block
+		if result.ResetAfter < block {
+			result.ResetAfter = block
+		}
+	}
+
+	return result, nil
+}
+
+// ConsumeAll runs script against the state of every key under a single lock,
+// inspecting them all before counting any
+func (m *MemoryStorage) ConsumeAll(ctx context.Context, script Script, group string, reqs []ConsumeRequest) ([]Outcome, error) {
+	_, done := observe(ctx, "memory", "consume_all")
+	defer done()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	outcomes := make([]Outcome, len(reqs))
+	fits := true
+	for i, req := range reqs {
+		peek := req
+		peek.Cost = 0
+		outcomes[i] = m.eval(script, peek)
+		outcomes[i].Allowed = outcomes[i].Remaining >= req.Cost
+		fits = fits && outcomes[i].Allowed
+	}
+	if !fits {
+		return outcomes, nil
+	}
+
+	for i, req := range reqs {
+		outcomes[i] = m.eval(script, req)
+	}
+	return outcomes, nil
+}
+
+// eval runs script against the state of req.Key and keeps the state while it lives.
+// The caller must hold the write lock.
+func (m *MemoryStorage) eval(script Script, req ConsumeRequest) Outcome {
+	stateKey := script.Name() + ":" + req.Key
+
+	entry, exists := m.states[stateKey]
+	if exists && req.Now.Before(entry.expiresAt) {
+		entry.state.TTL = entry.expiresAt.Sub(req.Now)
+	} else {
+		entry = memoryState{state: &State{Fields: make(map[string]float64)}}
+	}
+
+	outcome := script.Eval(entry.state, req)
+
+	if entry.state.TTL > 0 {
+		entry.expiresAt = req.Now.Add(entry.state.TTL)
+		m.states[stateKey] = entry
+	}
+
+	return outcome
+}
+
 // IsBlocked checks if a key is currently blocked
 func (m *MemoryStorage) IsBlocked(ctx context.Context, key string) (bool, error) {
+	_, done := observe(ctx, "memory", "is_blocked")
+	defer done()
+
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 
@@ -69,28 +205,174 @@ func (m *MemoryStorage) IsBlocked(ctx context.Context, key string) (bool, error)
 	}
 
 	// Check if block has expired
-	if time.Now().After(blockTime) {
+	if m.clock.Now().After(blockTime) {
 		return false, nil
 	}
 
 	return true, nil
 }
 
+// BlockTTL returns how long a key stays blocked, zero if it is not blocked
+func (m *MemoryStorage) BlockTTL(ctx context.Context, key string) (time.Duration, error) {
+	_, done := observe(ctx, "memory", "block_ttl")
+	defer done()
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	blockTime, exists := m.blocks[key]
+	if !exists {
+		return 0, nil
+	}
+
+	if left := blockTime.Sub(m.clock.Now()); left > 0 {
+		return left, nil
+	}
+
+	return 0, nil
+}
+
 // Block blocks a key for the specified duration
 func (m *MemoryStorage) Block(ctx context.Context, key string, duration time.Duration) error {
+	_, done := observe(ctx, "memory", "block")
+	defer done()
+
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	m.blocks[key] = time.Now().Add(duration)
+	m.blocks[key] = m.clock.Now().Add(duration)
 	return nil
 }
 
 // Unblock removes the block for a key
 func (m *MemoryStorage) Unblock(ctx context.Context, key string) error {
+	_, done := observe(ctx, "memory", "unblock")
+	defer done()
+
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
+	// An unblocked key starts over rather than escalating from its past offenses
 	delete(m.blocks, key)
+	delete(m.offenses, key)
+	return nil
+}
+
+// ListBlocks returns every key that is currently blocked, ordered by key
+func (m *MemoryStorage) ListBlocks(ctx context.Context) ([]BlockInfo, error) {
+	_, done := observe(ctx, "memory", "list_blocks")
+	defer done()
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	now := m.clock.Now()
+	blocks := []BlockInfo{}
+	for key, blockTime := range m.blocks {
+		if left := blockTime.Sub(now); left > 0 {
+			blocks = append(blocks, BlockInfo{Key: key, ExpiresIn: left})
+		}
+	}
+
+	sort.Slice(blocks, func(i, j int) bool {
+		return blocks[i].Key < blocks[j].Key
+	})
+
+	return blocks, nil
+}
+
+// ListCounters returns the state script keeps for every key starting with prefix,
+// ordered by key
+func (m *MemoryStorage) ListCounters(ctx context.Context, script Script, prefix string) ([]CounterInfo, error) {
+	_, done := observe(ctx, "memory", "list_counters")
+	defer done()
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	now := m.clock.Now()
+	namespace := script.Name() + ":"
+	counters := []CounterInfo{}
+
+	for stateKey, entry := range m.states {
+		key, found := strings.CutPrefix(stateKey, namespace)
+		if !found || !strings.HasPrefix(key, prefix) || !now.Before(entry.expiresAt) {
+			continue
+		}
+
+		fields := make(map[string]float64, len(entry.state.Fields))
+		for name, value := range entry.state.Fields {
+			fields[name] = value
+		}
+
+		counters = append(counters, CounterInfo{
+			Key:       key,
+			Script:    script.Name(),
+			Fields:    fields,
+			Entries:   len(entry.state.Log),
+			ExpiresIn: entry.expiresAt.Sub(now),
+		})
+	}
+
+	sort.Slice(counters, func(i, j int) bool {
+		return counters[i].Key < counters[j].Key
+	})
+
+	return counters, nil
+}
+
+// ResetCounter drops the state script keeps for a key
+func (m *MemoryStorage) ResetCounter(ctx context.Context, script Script, key string) error {
+	_, done := observe(ctx, "memory", "reset_counter")
+	defer done()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.states, script.Name()+":"+key)
+	return nil
+}
+
+// AcquireLease takes one of the concurrent slots of a key, or renews a lease already held
+func (m *MemoryStorage) AcquireLease(ctx context.Context, req LeaseRequest) (*LeaseResult, error) {
+	_, done := observe(ctx, "memory", "acquire_lease")
+	defer done()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	leases := m.leases[req.Key]
+	if leases == nil {
+		leases = make(map[string]time.Time)
+		m.leases[req.Key] = leases
+	}
+
+	for id, expiresAt := range leases {
+		if !req.Now.Before(expiresAt) {
+			delete(leases, id)
+		}
+	}
+
+	if _, held := leases[req.ID]; !held && len(leases) >= req.Limit {
+		return &LeaseResult{Acquired: false, InFlight: len(leases)}, nil
+	}
+
+	leases[req.ID] = req.Now.Add(req.TTL)
+	return &LeaseResult{Acquired: true, InFlight: len(leases)}, nil
+}
+
+// ReleaseLease frees the slot held by a lease
+func (m *MemoryStorage) ReleaseLease(ctx context.Context, key, id string) error {
+	_, done := observe(ctx, "memory", "release_lease")
+	defer done()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.leases[key], id)
+	if len(m.leases[key]) == 0 {
+		delete(m.leases, key)
+	}
 	return nil
 }
 
@@ -106,7 +388,7 @@ func (m *MemoryStorage) cleanup() {
 
 	for range ticker.C {
 		m.mu.Lock()
-		now := time.Now()
+		now := m.clock.Now()
 
 		// Clean up expired counters
 		for key, exp := range m.expirations {
@@ -116,6 +398,32 @@ func (m *MemoryStorage) cleanup() {
 			}
 		}
 
+		// Clean up expired script state
+		for key, entry := range m.states {
+			if now.After(entry.expiresAt) {
+				delete(m.states, key)
+			}
+		}
+
+		// Clean up forgotten offenses
+		for key, o := range m.offenses {
+			if !now.Before(o.expiresAt) {
+				delete(m.offenses, key)
+			}
+		}
+
+		// Clean up expired leases
+		for key, leases := range m.leases {
+			for id, expiresAt := range leases {
+				if now.After(expiresAt) {
+					delete(leases, id)
+				}
+			}
+			if len(leases) == 0 {
+				delete(m.leases, key)
+			}
+		}
+
 		// Clean up expired blocks
 		for key, blockTime := range m.blocks {
 			if now.After(blockTime) {
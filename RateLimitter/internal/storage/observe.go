@@ -0,0 +1,30 @@
+package storage
+
+import (
+	"context"
+	"time"
+
+	"rate-limiter/internal/metrics"
+	"rate-limiter/internal/telemetry"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// observe starts the span of a storage operation. The returned function ends it and
+// records the duration of the operation, meant to be deferred at the top of it.
+func observe(ctx context.Context, backend, operation string) (context.Context, func()) {
+	start := time.Now()
+	ctx, span := telemetry.Tracer.Start(ctx, "storage."+operation,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("rate_limiter.storage.backend", backend),
+			attribute.String("rate_limiter.storage.operation", operation),
+		),
+	)
+
+	return ctx, func() {
+		span.End()
+		metrics.ObserveStorage(backend, operation, start)
+	}
+}
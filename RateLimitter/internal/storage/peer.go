@@ -0,0 +1,594 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"rate-limiter/internal/clock"
+	"rate-limiter/internal/metrics"
+	"rate-limiter/internal/telemetry"
+
+	"go.opentelemetry.io/otel/propagation"
+)
+
+// PeerPath is where replicas serve the operations forwarded to them
+const PeerPath = "/cluster/storage"
+
+// PeerOptions configures a PeerStorage
+type PeerOptions struct {
+	// Self is the URL other peers reach this replica at. When empty it is the
+	// discovered peer whose host is an address of this machine.
+	Self      string
+	Discovery Discovery
+	// Refresh is how often peers are discovered again, zero discovers them once
+	Refresh time.Duration
+	// Secret authenticates the calls between peers
+	Secret string
+	// Timeout bounds each forwarded operation, one second when zero
+	Timeout time.Duration
+	// Scripts are the algorithms peers may run, looked up by name
+	Scripts []Script
+	// Clock expires the blocks and counters this replica owns, the system clock when nil
+	Clock clock.Clock
+}
+
+// PeerStorage implements the Storage interface across replicas without a shared
+// database. Every key is owned by one replica, picked by consistent hashing over
+// the discovered peers, and operations on it are forwarded to the owner, which keeps
+// the state in its MemoryStorage. Limits are therefore global instead of applying
+// once per replica.
+//
+// When the owner cannot be reached the operation runs locally, so requests keep
+// being limited, per replica, until it is back. Counters move with their keys when
+// peers join or leave, which resets them.
+type PeerStorage struct {
+	self    string
+	local   *MemoryStorage
+	options PeerOptions
+	scripts map[string]Script
+	client  *http.Client
+	ring    atomic.Pointer[hashRing]
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// peerCall is an operation sent to the owner of a key
+type peerCall struct {
+	Op      string          `json:"op"`
+	Key     string          `json:"key,omitempty"`
+	Script  string          `json:"script,omitempty"`
+	Request *ConsumeRequest `json:"request,omitempty"`
+	// Requests are the requests of a consume_all call, whose Key is their group
+	Requests []ConsumeRequest `json:"requests,omitempty"`
+	Duration time.Duration    `json:"duration,omitempty"`
+	Prefix   string           `json:"prefix,omitempty"`
+	Lease    *LeaseRequest    `json:"lease,omitempty"`
+	ID       string           `json:"id,omitempty"`
+}
+
+// peerReply is the outcome of a peerCall
+type peerReply struct {
+	Count    int            `json:"count,omitempty"`
+	Result   *ConsumeResult `json:"result,omitempty"`
+	Outcomes []Outcome      `json:"outcomes,omitempty"`
+	Blocked  bool           `json:"blocked,omitempty"`
+	TTL      time.Duration  `json:"ttl,omitempty"`
+	Blocks   []BlockInfo    `json:"blocks,omitempty"`
+	Counters []CounterInfo  `json:"counters,omitempty"`
+	Lease    *LeaseResult   `json:"lease,omitempty"`
+	Error    string         `json:"error,omitempty"`
+}
+
+// NewPeerStorage discovers the peers and starts refreshing them
+func NewPeerStorage(ctx context.Context, options PeerOptions) (*PeerStorage, error) {
+	if options.Discovery == nil {
+		return nil, fmt.Errorf("peer storage requires a discovery")
+	}
+
+	// Handler would otherwise let anyone block, unblock and reset keys
+	if options.Secret == "" {
+		return nil, fmt.Errorf("peer storage requires a secret")
+	}
+
+	if options.Timeout <= 0 {
+		options.Timeout = time.Second
+	}
+	if options.Clock == nil {
+		options.Clock = clock.Real
+	}
+
+	p := &PeerStorage{
+		self:    normalizePeer(options.Self),
+		local:   NewMemoryStorageWithClock(options.Clock),
+		options: options,
+		scripts: make(map[string]Script, len(options.Scripts)),
+		client:  &http.Client{Timeout: options.Timeout},
+		stop:    make(chan struct{}),
+	}
+
+	for _, script := range options.Scripts {
+		p.scripts[script.Name()] = script
+	}
+
+	peers, err := options.Discovery.Peers(ctx)
+	if err != nil {
+		// Without a known address the replica cannot tell which peer it is
+		if p.self == "" {
+			return nil, err
+		}
+		slog.Warn("Failed to discover peers, starting alone", "error", err)
+	}
+
+	if p.self == "" {
+		if p.self, err = localPeer(peers); err != nil {
+			return nil, fmt.Errorf("failed to find this replica among the peers, set its address: %w", err)
+		}
+	}
+
+	p.setPeers(peers)
+
+	if options.Refresh > 0 {
+		go p.refreshLoop()
+	}
+
+	return p, nil
+}
+
+// Self returns the URL of this replica
+func (p *PeerStorage) Self() string {
+	return p.self
+}
+
+// Peers returns the replicas keys are currently spread over, this one included
+func (p *PeerStorage) Peers() []string {
+	return append([]string(nil), p.ring.Load().peers...)
+}
+
+// Owner returns the replica owning key
+func (p *PeerStorage) Owner(key string) string {
+	return p.ring.Load().owner(key)
+}
+
+// Refresh discovers the peers again, keeping the current ones when it fails
+func (p *PeerStorage) Refresh(ctx context.Context) error {
+	peers, err := p.options.Discovery.Peers(ctx)
+	if err != nil {
+		return err
+	}
+
+	p.setPeers(peers)
+	return nil
+}
+
+// setPeers rebuilds the ring when the peers changed. This replica is always on it,
+// even before discovery reports it.
+func (p *PeerStorage) setPeers(discovered []string) {
+	seen := map[string]bool{p.self: true}
+	peers := []string{p.self}
+	for _, peer := range discovered {
+		if peer = normalizePeer(peer); peer != "" && !seen[peer] {
+			seen[peer] = true
+			peers = append(peers, peer)
+		}
+	}
+	sort.Strings(peers)
+
+	if current := p.ring.Load(); current != nil && reflect.DeepEqual(current.peers, peers) {
+		return
+	}
+
+	p.ring.Store(newHashRing(peers))
+	slog.Info("Rate limit peers", "peers", strings.Join(peers, ", "))
+}
+
+// refreshLoop discovers the peers periodically until the storage is closed
+func (p *PeerStorage) refreshLoop() {
+	ticker := time.NewTicker(p.options.Refresh)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), p.options.Refresh)
+			if err := p.Refresh(ctx); err != nil {
+				slog.Warn("Failed to refresh peers, keeping the current ones", "error", err)
+			}
+			cancel()
+		}
+	}
+}
+
+// route runs call on the owner of its key. Calls the owner cannot take run locally.
+func (p *PeerStorage) route(ctx context.Context, call peerCall) (*peerReply, error) {
+	owner := p.Owner(call.Key)
+	if owner == p.self {
+		return p.apply(ctx, call)
+	}
+
+	reply, err := p.forward(ctx, owner, call)
+	if err == nil {
+		return reply, nil
+	}
+	if ctx.Err() != nil {
+		return nil, err
+	}
+
+	slog.WarnContext(ctx, "Failed to reach peer, handling the operation locally", "peer", owner, "operation", call.Op, "error", err)
+	metrics.FailOpen.WithLabelValues("peer_unavailable").Inc()
+	return p.apply(ctx, call)
+}
+
+// broadcast runs call on every peer, skipping those that cannot be reached
+func (p *PeerStorage) broadcast(ctx context.Context, call peerCall) ([]*peerReply, error) {
+	peers := p.Peers()
+	replies := make([]*peerReply, len(peers))
+	errs := make([]error, len(peers))
+
+	var wg sync.WaitGroup
+	for i, peer := range peers {
+		wg.Add(1)
+		go func(i int, peer string) {
+			defer wg.Done()
+			if peer == p.self {
+				replies[i], errs[i] = p.apply(ctx, call)
+				return
+			}
+			replies[i], errs[i] = p.forward(ctx, peer, call)
+		}(i, peer)
+	}
+	wg.Wait()
+
+	var reachable []*peerReply
+	for i, reply := range replies {
+		if errs[i] != nil {
+			if peers[i] == p.self {
+				return nil, errs[i]
+			}
+			slog.WarnContext(ctx, "Failed to reach peer, leaving it out", "peer", peers[i], "operation", call.Op, "error", errs[i])
+			continue
+		}
+		reachable = append(reachable, reply)
+	}
+
+	return reachable, nil
+}
+
+// forward sends call to peer
+func (p *PeerStorage) forward(ctx context.Context, peer string, call peerCall) (*peerReply, error) {
+	body, err := json.Marshal(call)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, peer+PeerPath, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+p.options.Secret)
+	// The owner's spans join the trace of the request
+	telemetry.Propagator.Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var reply peerReply
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 32<<20)).Decode(&reply); err != nil {
+		return nil, fmt.Errorf("invalid reply (%s): %w", resp.Status, err)
+	}
+
+	if reply.Error != "" {
+		return nil, errors.New(reply.Error)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	return &reply, nil
+}
+
+// apply runs call against the local state
+func (p *PeerStorage) apply(ctx context.Context, call peerCall) (*peerReply, error) {
+	reply := &peerReply{}
+
+	var script Script
+	if call.Script != "" {
+		var found bool
+		if script, found = p.scripts[call.Script]; !found {
+			return nil, fmt.Errorf("unknown script %q", call.Script)
+		}
+	}
+
+	var err error
+	switch call.Op {
+	case "get_request_count":
+		reply.Count, err = p.local.GetRequestCount(ctx, call.Key)
+	case "increment_request_count":
+		err = p.local.IncrementRequestCount(ctx, call.Key, call.Duration)
+	case "consume":
+		if script == nil || call.Request == nil {
+			return nil, fmt.Errorf("consume requires a script and a request")
+		}
+		reply.Result, err = p.local.Consume(ctx, script, *call.Request)
+	case "consume_all":
+		if script == nil {
+			return nil, fmt.Errorf("consume_all requires a script")
+		}
+		reply.Outcomes, err = p.local.ConsumeAll(ctx, script, call.Key, call.Requests)
+	case "is_blocked":
+		reply.Blocked, err = p.local.IsBlocked(ctx, call.Key)
+	case "block_ttl":
+		reply.TTL, err = p.local.BlockTTL(ctx, call.Key)
+	case "block":
+		err = p.local.Block(ctx, call.Key, call.Duration)
+	case "unblock":
+		err = p.local.Unblock(ctx, call.Key)
+	case "list_blocks":
+		reply.Blocks, err = p.local.ListBlocks(ctx)
+	case "list_counters":
+		if script == nil {
+			return nil, fmt.Errorf("list_counters requires a script")
+		}
+		reply.Counters, err = p.local.ListCounters(ctx, script, call.Prefix)
+	case "reset_counter":
+		if script == nil {
+			return nil, fmt.Errorf("reset_counter requires a script")
+		}
+		err = p.local.ResetCounter(ctx, script, call.Key)
+	case "acquire_lease":
+		if call.Lease == nil {
+			return nil, fmt.Errorf("acquire_lease requires a lease")
+		}
+		reply.Lease, err = p.local.AcquireLease(ctx, *call.Lease)
+	case "release_lease":
+		err = p.local.ReleaseLease(ctx, call.Key, call.ID)
+	default:
+		return nil, fmt.Errorf("unknown operation %q", call.Op)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+// Handler serves the operations other peers forward to this replica at PeerPath
+func (p *PeerStorage) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			json.NewEncoder(w).Encode(peerReply{Error: "method not allowed"})
+			return
+		}
+
+		given, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !found || subtle.ConstantTimeCompare([]byte(given), []byte(p.options.Secret)) != 1 {
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(peerReply{Error: "unauthorized"})
+			return
+		}
+
+		var call peerCall
+		if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&call); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(peerReply{Error: "invalid operation: " + err.Error()})
+			return
+		}
+
+		ctx := telemetry.Propagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		reply, err := p.apply(ctx, call)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(peerReply{Error: err.Error()})
+			return
+		}
+
+		json.NewEncoder(w).Encode(reply)
+	})
+}
+
+// GetRequestCount returns the current request count for a key
+func (p *PeerStorage) GetRequestCount(ctx context.Context, key string) (int, error) {
+	ctx, done := observe(ctx, "peers", "get_request_count")
+	defer done()
+
+	reply, err := p.route(ctx, peerCall{Op: "get_request_count", Key: key})
+	if err != nil {
+		return 0, err
+	}
+	return reply.Count, nil
+}
+
+// IncrementRequestCount increments the request count for a key
+func (p *PeerStorage) IncrementRequestCount(ctx context.Context, key string, expiration time.Duration) error {
+	ctx, done := observe(ctx, "peers", "increment_request_count")
+	defer done()
+
+	_, err := p.route(ctx, peerCall{Op: "increment_request_count", Key: key, Duration: expiration})
+	return err
+}
+
+// Consume runs script against the state of a key on the replica owning it
+func (p *PeerStorage) Consume(ctx context.Context, script Script, req ConsumeRequest) (*ConsumeResult, error) {
+	ctx, done := observe(ctx, "peers", "consume")
+	defer done()
+
+	reply, err := p.route(ctx, peerCall{Op: "consume", Key: req.Key, Script: script.Name(), Request: &req})
+	if err != nil {
+		return nil, err
+	}
+	if reply.Result == nil {
+		return nil, fmt.Errorf("peer returned no result for %s", req.Key)
+	}
+	return reply.Result, nil
+}
+
+// ConsumeAll runs script against every key on the owner of their group
+func (p *PeerStorage) ConsumeAll(ctx context.Context, script Script, group string, reqs []ConsumeRequest) ([]Outcome, error) {
+	ctx, done := observe(ctx, "peers", "consume_all")
+	defer done()
+
+	reply, err := p.route(ctx, peerCall{Op: "consume_all", Key: group, Script: script.Name(), Requests: reqs})
+	if err != nil {
+		return nil, err
+	}
+	if len(reply.Outcomes) != len(reqs) {
+		return nil, fmt.Errorf("peer returned %d outcomes for %d requests of %s", len(reply.Outcomes), len(reqs), group)
+	}
+	return reply.Outcomes, nil
+}
+
+// IsBlocked checks if a key is currently blocked
+func (p *PeerStorage) IsBlocked(ctx context.Context, key string) (bool, error) {
+	ctx, done := observe(ctx, "peers", "is_blocked")
+	defer done()
+
+	reply, err := p.route(ctx, peerCall{Op: "is_blocked", Key: key})
+	if err != nil {
+		return false, err
+	}
+	return reply.Blocked, nil
+}
+
+// BlockTTL returns how long a key stays blocked, zero if it is not blocked
+func (p *PeerStorage) BlockTTL(ctx context.Context, key string) (time.Duration, error) {
+	ctx, done := observe(ctx, "peers", "block_ttl")
+	defer done()
+
+	reply, err := p.route(ctx, peerCall{Op: "block_ttl", Key: key})
+	if err != nil {
+		return 0, err
+	}
+	return reply.TTL, nil
+}
+
+// Block blocks a key for the specified duration
+func (p *PeerStorage) Block(ctx context.Context, key string, duration time.Duration) error {
+	ctx, done := observe(ctx, "peers", "block")
+	defer done()
+
+	_, err := p.route(ctx, peerCall{Op: "block", Key: key, Duration: duration})
+	return err
+}
+
+// Unblock removes the block for a key
+func (p *PeerStorage) Unblock(ctx context.Context, key string) error {
+	ctx, done := observe(ctx, "peers", "unblock")
+	defer done()
+
+	_, err := p.route(ctx, peerCall{Op: "unblock", Key: key})
+	return err
+}
+
+// ListBlocks returns every key blocked on any reachable peer, ordered by key
+func (p *PeerStorage) ListBlocks(ctx context.Context) ([]BlockInfo, error) {
+	ctx, done := observe(ctx, "peers", "list_blocks")
+	defer done()
+
+	replies, err := p.broadcast(ctx, peerCall{Op: "list_blocks"})
+	if err != nil {
+		return nil, err
+	}
+
+	// A key may be left on its previous owner after the peers changed
+	longest := make(map[string]BlockInfo)
+	for _, reply := range replies {
+		for _, block := range reply.Blocks {
+			if current, exists := longest[block.Key]; !exists || block.ExpiresIn > current.ExpiresIn {
+				longest[block.Key] = block
+			}
+		}
+	}
+
+	blocks := make([]BlockInfo, 0, len(longest))
+	for _, block := range longest {
+		blocks = append(blocks, block)
+	}
+	sort.Slice(blocks, func(i, j int) bool {
+		return blocks[i].Key < blocks[j].Key
+	})
+
+	return blocks, nil
+}
+
+// ListCounters returns the state script keeps for every key starting with prefix on
+// any reachable peer, ordered by key
+func (p *PeerStorage) ListCounters(ctx context.Context, script Script, prefix string) ([]CounterInfo, error) {
+	ctx, done := observe(ctx, "peers", "list_counters")
+	defer done()
+
+	replies, err := p.broadcast(ctx, peerCall{Op: "list_counters", Script: script.Name(), Prefix: prefix})
+	if err != nil {
+		return nil, err
+	}
+
+	counters := []CounterInfo{}
+	for _, reply := range replies {
+		counters = append(counters, reply.Counters...)
+	}
+	sort.SliceStable(counters, func(i, j int) bool {
+		return counters[i].Key < counters[j].Key
+	})
+
+	return counters, nil
+}
+
+// ResetCounter drops the state script keeps for a key
+func (p *PeerStorage) ResetCounter(ctx context.Context, script Script, key string) error {
+	ctx, done := observe(ctx, "peers", "reset_counter")
+	defer done()
+
+	_, err := p.route(ctx, peerCall{Op: "reset_counter", Key: key, Script: script.Name()})
+	return err
+}
+
+// AcquireLease takes one of the concurrent slots of a key on the replica owning it
+func (p *PeerStorage) AcquireLease(ctx context.Context, req LeaseRequest) (*LeaseResult, error) {
+	ctx, done := observe(ctx, "peers", "acquire_lease")
+	defer done()
+
+	reply, err := p.route(ctx, peerCall{Op: "acquire_lease", Key: req.Key, Lease: &req})
+	if err != nil {
+		return nil, err
+	}
+	if reply.Lease == nil {
+		return nil, fmt.Errorf("peer returned no lease for %s", req.Key)
+	}
+	return reply.Lease, nil
+}
+
+// ReleaseLease frees the slot held by a lease
+func (p *PeerStorage) ReleaseLease(ctx context.Context, key, id string) error {
+	ctx, done := observe(ctx, "peers", "release_lease")
+	defer done()
+
+	_, err := p.route(ctx, peerCall{Op: "release_lease", Key: key, ID: id})
+	return err
+}
+
+// Close stops refreshing the peers and drops the local state
+func (p *PeerStorage) Close() error {
+	p.stopOnce.Do(func() { close(p.stop) })
+	return p.local.Close()
+}
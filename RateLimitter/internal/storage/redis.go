@@ -2,8 +2,12 @@ package storage
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-redis/redis/v8"
@@ -11,30 +15,166 @@ import (
 
 // RedisStorage implements the Storage interface using Redis
 type RedisStorage struct {
-	client *redis.Client
+	client redis.UniversalClient
+	// cluster wraps keys in hash tags, so the state and the block of a key share a slot
+	cluster bool
+
+	mu      sync.Mutex
+	scripts map[string]*redis.Script
 }
 
 // NewRedisStorage creates a new Redis storage instance
 func NewRedisStorage(host, port, password string, db int) (*RedisStorage, error) {
-	rdb := redis.NewClient(&redis.Options{
-		Addr:     fmt.Sprintf("%s:%s", host, port),
-		Password: password,
-		DB:       db,
-	})
+	r := DialRedis(host, port, password, db)
 
 	// Test connection
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	if err := rdb.Ping(ctx).Err(); err != nil {
+	if err := r.Ping(ctx); err != nil {
+		r.Close()
 		return nil, fmt.Errorf("failed to connect to Redis: %w", err)
 	}
 
-	return &RedisStorage{client: rdb}, nil
+	return r, nil
+}
+
+// RedisOptions configures the connection to a single Redis node, a Sentinel managed
+// master or a Redis Cluster
+type RedisOptions struct {
+	// Addrs is the node address, the Sentinel addresses when MasterName is set, or the
+	// seed nodes when Cluster is set
+	Addrs []string
+	// MasterName is the name of the master monitored by the Sentinels
+	MasterName string
+	// Cluster connects to a Redis Cluster
+	Cluster bool
+
+	// Username and Password authenticate with Redis ACLs, or with requirepass when
+	// Username is empty
+	Username string
+	Password string
+	// SentinelPassword authenticates with the Sentinels
+	SentinelPassword string
+	// DB is not supported by Redis Cluster
+	DB int
+
+	// TLS enables TLS when set
+	TLS *tls.Config
+
+	// Pool and timeout settings, the go-redis defaults when zero
+	PoolSize     int
+	MinIdleConns int
+	PoolTimeout  time.Duration
+	DialTimeout  time.Duration
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+}
+
+// DialRedis creates a Redis storage without checking that Redis is up. The client
+// connects on first use and reconnects on its own, so the storage starts working as
+// soon as Redis does.
+func DialRedis(host, port, password string, db int) *RedisStorage {
+	return DialRedisOptions(RedisOptions{
+		Addrs:    []string{fmt.Sprintf("%s:%s", host, port)},
+		Password: password,
+		DB:       db,
+	})
+}
+
+// DialRedisOptions is DialRedis for Sentinel, Cluster, TLS and pool settings
+func DialRedisOptions(options RedisOptions) *RedisStorage {
+	universal := &redis.UniversalOptions{
+		Addrs:            options.Addrs,
+		MasterName:       options.MasterName,
+		Username:         options.Username,
+		Password:         options.Password,
+		SentinelPassword: options.SentinelPassword,
+		DB:               options.DB,
+		TLSConfig:        options.TLS,
+		PoolSize:         options.PoolSize,
+		MinIdleConns:     options.MinIdleConns,
+		PoolTimeout:      options.PoolTimeout,
+		DialTimeout:      options.DialTimeout,
+		ReadTimeout:      options.ReadTimeout,
+		WriteTimeout:     options.WriteTimeout,
+	}
+
+	var rdb redis.UniversalClient
+	switch {
+	case options.Cluster:
+		// Even a single seed address is a cluster here
+		rdb = redis.NewClusterClient(universal.Cluster())
+	case options.MasterName != "":
+		rdb = redis.NewFailoverClient(universal.Failover())
+	default:
+		rdb = redis.NewClient(universal.Simple())
+	}
+
+	return &RedisStorage{
+		client:  rdb,
+		cluster: options.Cluster,
+		scripts: make(map[string]*redis.Script),
+	}
+}
+
+// tag wraps key in a hash tag in cluster mode. Keys are stored as is otherwise, so
+// existing single node deployments keep their counters.
+func (r *RedisStorage) tag(key string) string {
+	if r.cluster {
+		return "{" + key + "}"
+	}
+	return key
+}
+
+// untag returns the key inside a hash tag
+func (r *RedisStorage) untag(key string) string {
+	if r.cluster {
+		return strings.TrimSuffix(strings.TrimPrefix(key, "{"), "}")
+	}
+	return key
+}
+
+// stateKey returns where script keeps its state for key
+func (r *RedisStorage) stateKey(script Script, key string) string {
+	return fmt.Sprintf("%s:%s", script.Name(), r.tag(key))
+}
+
+// groupStateKey returns where script keeps its state for a key of group. In cluster
+// mode the group is the hash tag, so the keys of a group share a slot and can be used
+// by a single script.
+func (r *RedisStorage) groupStateKey(script Script, group, key string) string {
+	if r.cluster {
+		return fmt.Sprintf("%s:{%s}%s", script.Name(), group, key)
+	}
+	return r.stateKey(script, key)
+}
+
+// leaseKey returns where the leases of key are kept
+func (r *RedisStorage) leaseKey(key string) string {
+	return fmt.Sprintf("lease:%s", r.tag(key))
+}
+
+// offenseKey returns where the recent offenses of key are kept
+func (r *RedisStorage) offenseKey(key string) string {
+	return fmt.Sprintf("offenses:%s", r.tag(key))
+}
+
+// blockKey returns where the block of key is kept
+func (r *RedisStorage) blockKey(key string) string {
+	return fmt.Sprintf("block:%s", r.tag(key))
+}
+
+// Ping checks that Redis answers
+func (r *RedisStorage) Ping(ctx context.Context) error {
+	return r.client.Ping(ctx).Err()
 }
 
 // GetRequestCount returns the current request count for a key
 func (r *RedisStorage) GetRequestCount(ctx context.Context, key string) (int, error) {
+	ctx, done := observe(ctx, "redis", "get_request_count")
+	defer done()
+
 	val, err := r.client.Get(ctx, key).Result()
 	if err == redis.Nil {
 		return 0, nil
@@ -53,38 +193,531 @@ func (r *RedisStorage) GetRequestCount(ctx context.Context, key string) (int, er
 
 // IncrementRequestCount increments the request count for a key
 func (r *RedisStorage) IncrementRequestCount(ctx context.Context, key string, expiration time.Duration) error {
+	ctx, done := observe(ctx, "redis", "increment_request_count")
+	defer done()
+
 	pipe := r.client.Pipeline()
 
 	// Increment counter
 	pipe.Incr(ctx, key)
 	// Set expiration only if key doesn't exist
-	pipe.Expire(ctx, key, expiration)
+	pipe.PExpire(ctx, key, expiration)
 
 	_, err := pipe.Exec(ctx)
 	return err
 }
 
+// consumeScript wraps the body of a Script with the block check and the block on denial.
+// KEYS[1] is the state key, KEYS[2] the block key and KEYS[3] the offenses of the key,
+// a hash with their count and the time of the last one. Blocks always carry an
+// expiration, so a block key without one is not taken for a block. It returns
+// {allowed, remaining, reset_after, retry_after, blocked, offenses} with times in
+// microseconds.
+const consumeScript = `
+local now = tonumber(ARGV[1])
+local limit = tonumber(ARGV[2])
+local window = tonumber(ARGV[3])
+local cost = tonumber(ARGV[4])
+local block = tonumber(ARGV[5])
+local factor = tonumber(ARGV[6])
+local max_block = tonumber(ARGV[7])
+local decay = tonumber(ARGV[8])
+
+local block_ttl = redis.call('PTTL', KEYS[2])
+if block_ttl > 0 then
+	local left = block_ttl * 1000
+	return {0, 0, left, left, 1, 0}
+end
+
+local allowed, remaining, reset_after, retry_after = (function()
+%s
+end)()
+
+local offenses = 0
+if allowed == 0 and cost > 0 and block > 0 then
+	if factor > 1 then
+		local previous = redis.call('HMGET', KEYS[3], 'count', 'last')
+		offenses = tonumber(previous[1]) or 0
+		local last = tonumber(previous[2]) or now
+		if decay > 0 and now > last then
+			offenses = math.max(0, offenses - math.floor((now - last) / decay))
+		end
+		offenses = offenses + 1
+
+		block = block * factor ^ (offenses - 1)
+		block = math.min(block, math.max(max_block, tonumber(ARGV[5])))
+
+		redis.call('HSET', KEYS[3], 'count', offenses, 'last', string.format('%%.0f', now))
+		redis.call('PEXPIRE', KEYS[3], math.max(1, math.ceil(decay * offenses / 1000)))
+	end
+
+	redis.call('SET', KEYS[2], '1', 'PX', math.max(1, math.floor(block / 1000)))
+	retry_after = block
+	reset_after = math.max(reset_after, block)
+end
+
+return {allowed, math.floor(remaining), math.ceil(reset_after), math.ceil(retry_after), 0, offenses}
+`
+
+// Consume runs script server side, so concurrent callers never see the same state
+func (r *RedisStorage) Consume(ctx context.Context, script Script, req ConsumeRequest) (*ConsumeResult, error) {
+	ctx, done := observe(ctx, "redis", "consume")
+	defer done()
+
+	keys := []string{r.stateKey(script, req.Key), r.blockKey(req.Key), r.offenseKey(req.Key)}
+
+	values, err := r.script(script).Run(ctx, r.client, keys,
+		req.Now.UnixMicro(),
+		req.Limit,
+		req.Window.Microseconds(),
+		req.Cost,
+		req.BlockDuration.Microseconds(),
+		req.BlockFactor,
+		req.MaxBlock.Microseconds(),
+		req.OffenseDecay.Microseconds(),
+	).Int64Slice()
+	if err != nil {
+		return nil, fmt.Errorf("failed to run %s script: %w", script.Name(), err)
+	}
+
+	if len(values) != 6 {
+		return nil, fmt.Errorf("unexpected %s script result: %v", script.Name(), values)
+	}
+
+	return &ConsumeResult{
+		Outcome: Outcome{
+			Allowed:    values[0] == 1,
+			Remaining:  int(values[1]),
+			ResetAfter: time.Duration(values[2]) * time.Microsecond,
+			RetryAfter: time.Duration(values[3]) * time.Microsecond,
+		},
+		Blocked:  values[4] == 1,
+		Offenses: int(values[5]),
+	}, nil
+}
+
+// consumeAllScript runs the body of a Script against every key in KEYS. ARGV holds
+// now, limit, window and cost for each key in turn. Every key is inspected before any
+// is counted, and none is counted unless all of them have room for their cost. It
+// returns {allowed, remaining, reset_after, retry_after} for each key, with times in
+// microseconds.
+const consumeAllScript = `
+local all_keys = KEYS
+
+local function run(i, cost)
+	local KEYS = {all_keys[i]}
+	local base = (i - 1) * 4
+	local now = tonumber(ARGV[base + 1])
+	local limit = tonumber(ARGV[base + 2])
+	local window = tonumber(ARGV[base + 3])
+	return (function()
+%s
+	end)()
+end
+
+local results = {}
+local fits = true
+for i = 1, #all_keys do
+	local _, remaining, reset_after, retry_after = run(i, 0)
+	local allowed = 0
+	if remaining >= tonumber(ARGV[i * 4]) then
+		allowed = 1
+	else
+		fits = false
+	end
+	results[i] = {allowed, remaining, reset_after, retry_after}
+end
+
+if fits then
+	for i = 1, #all_keys do
+		results[i] = {run(i, tonumber(ARGV[i * 4]))}
+	end
+end
+
+local flat = {}
+for i = 1, #all_keys do
+	local result = results[i]
+	table.insert(flat, result[1])
+	table.insert(flat, math.floor(result[2]))
+	table.insert(flat, math.ceil(result[3]))
+	table.insert(flat, math.ceil(result[4]))
+end
+return flat
+`
+
+// ConsumeAll runs script against every key in one server side call
+func (r *RedisStorage) ConsumeAll(ctx context.Context, script Script, group string, reqs []ConsumeRequest) ([]Outcome, error) {
+	ctx, done := observe(ctx, "redis", "consume_all")
+	defer done()
+
+	if len(reqs) == 0 {
+		return nil, nil
+	}
+
+	keys := make([]string, 0, len(reqs))
+	args := make([]any, 0, 4*len(reqs))
+	for _, req := range reqs {
+		keys = append(keys, r.groupStateKey(script, group, req.Key))
+		args = append(args, req.Now.UnixMicro(), req.Limit, req.Window.Microseconds(), req.Cost)
+	}
+
+	values, err := r.load("all:"+script.Name(), consumeAllScript, script).Run(ctx, r.client, keys, args...).Int64Slice()
+	if err != nil {
+		return nil, fmt.Errorf("failed to run %s script: %w", script.Name(), err)
+	}
+
+	if len(values) != 4*len(reqs) {
+		return nil, fmt.Errorf("unexpected %s script result: %v", script.Name(), values)
+	}
+
+	outcomes := make([]Outcome, len(reqs))
+	for i := range outcomes {
+		values := values[4*i:]
+		outcomes[i] = Outcome{
+			Allowed:    values[0] == 1,
+			Remaining:  int(values[1]),
+			ResetAfter: time.Duration(values[2]) * time.Microsecond,
+			RetryAfter: time.Duration(values[3]) * time.Microsecond,
+		}
+	}
+	return outcomes, nil
+}
+
+// script returns the loaded Redis script for a Script, building it on first use
+func (r *RedisStorage) script(script Script) *redis.Script {
+	return r.load(script.Name(), consumeScript, script)
+}
+
+// load returns the Redis script named name, wrapping the body of script in wrapper
+// on first use
+func (r *RedisStorage) load(name, wrapper string, script Script) *redis.Script {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	loaded, exists := r.scripts[name]
+	if !exists {
+		loaded = redis.NewScript(fmt.Sprintf(wrapper, script.Lua()))
+		r.scripts[name] = loaded
+	}
+
+	return loaded
+}
+
+// acquireLeaseScript keeps the leases of a key in a sorted set scored by expiry, in
+// milliseconds. KEYS[1] is the lease key and ARGV holds now, the lease ID, the limit and
+// the TTL. The set lives as long as its newest lease, so the slots of a crashed
+// instance are freed even if nothing else touches the key. It returns {acquired, in_flight}.
+var acquireLeaseScript = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local id = ARGV[2]
+local limit = tonumber(ARGV[3])
+local ttl = tonumber(ARGV[4])
+
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', now)
+
+local held = redis.call('ZSCORE', KEYS[1], id)
+local in_flight = redis.call('ZCARD', KEYS[1])
+if not held and in_flight >= limit then
+	return {0, in_flight}
+end
+
+redis.call('ZADD', KEYS[1], now + ttl, id)
+if redis.call('PTTL', KEYS[1]) < ttl then
+	redis.call('PEXPIRE', KEYS[1], ttl)
+end
+
+if not held then
+	in_flight = in_flight + 1
+end
+return {1, in_flight}
+`)
+
+// AcquireLease takes one of the concurrent slots of a key, or renews a lease already held
+func (r *RedisStorage) AcquireLease(ctx context.Context, req LeaseRequest) (*LeaseResult, error) {
+	ctx, done := observe(ctx, "redis", "acquire_lease")
+	defer done()
+
+	values, err := acquireLeaseScript.Run(ctx, r.client, []string{r.leaseKey(req.Key)},
+		req.Now.UnixMilli(),
+		req.ID,
+		req.Limit,
+		max(1, req.TTL.Milliseconds()),
+	).Int64Slice()
+	if err != nil {
+		return nil, fmt.Errorf("failed to acquire lease: %w", err)
+	}
+
+	if len(values) != 2 {
+		return nil, fmt.Errorf("unexpected lease script result: %v", values)
+	}
+
+	return &LeaseResult{Acquired: values[0] == 1, InFlight: int(values[1])}, nil
+}
+
+// ReleaseLease frees the slot held by a lease
+func (r *RedisStorage) ReleaseLease(ctx context.Context, key, id string) error {
+	ctx, done := observe(ctx, "redis", "release_lease")
+	defer done()
+
+	return r.client.ZRem(ctx, r.leaseKey(key), id).Err()
+}
+
 // IsBlocked checks if a key is currently blocked
 func (r *RedisStorage) IsBlocked(ctx context.Context, key string) (bool, error) {
-	blockKey := fmt.Sprintf("block:%s", key)
-	exists, err := r.client.Exists(ctx, blockKey).Result()
+	ctx, done := observe(ctx, "redis", "is_blocked")
+	defer done()
+
+	// A block key without an expiration is not a block, as for Consume
+	ttl, err := r.client.PTTL(ctx, r.blockKey(key)).Result()
 	if err != nil {
 		return false, err
 	}
 
-	return exists > 0, nil
+	return ttl > 0, nil
+}
+
+// BlockTTL returns how long a key stays blocked, zero if it is not blocked
+func (r *RedisStorage) BlockTTL(ctx context.Context, key string) (time.Duration, error) {
+	ctx, done := observe(ctx, "redis", "block_ttl")
+	defer done()
+
+	ttl, err := r.client.PTTL(ctx, r.blockKey(key)).Result()
+	if err != nil {
+		return 0, err
+	}
+
+	// A negative TTL means the key is missing or has no expiration, which blocks
+	// always carry
+	if ttl < 0 {
+		return 0, nil
+	}
+
+	return ttl, nil
 }
 
 // Block blocks a key for the specified duration
 func (r *RedisStorage) Block(ctx context.Context, key string, duration time.Duration) error {
-	blockKey := fmt.Sprintf("block:%s", key)
-	return r.client.Set(ctx, blockKey, "1", duration).Err()
+	ctx, done := observe(ctx, "redis", "block")
+	defer done()
+
+	// A zero expiration would make the block permanent in Redis
+	if duration <= 0 {
+		return nil
+	}
+
+	return r.client.Set(ctx, r.blockKey(key), "1", duration).Err()
 }
 
 // Unblock removes the block for a key
 func (r *RedisStorage) Unblock(ctx context.Context, key string) error {
-	blockKey := fmt.Sprintf("block:%s", key)
-	return r.client.Del(ctx, blockKey).Err()
+	ctx, done := observe(ctx, "redis", "unblock")
+	defer done()
+
+	// An unblocked key starts over rather than escalating from its past offenses
+	return r.client.Del(ctx, r.blockKey(key), r.offenseKey(key)).Err()
+}
+
+// AddToStream appends an entry to a Redis stream, trimming it to about maxLen entries
+// when maxLen is positive. Values alternate field names and values, kept in order.
+func (r *RedisStorage) AddToStream(ctx context.Context, stream string, maxLen int64, values []any) error {
+	ctx, done := observe(ctx, "redis", "add_to_stream")
+	defer done()
+
+	return r.client.XAdd(ctx, &redis.XAddArgs{
+		Stream: stream,
+		MaxLen: maxLen,
+		Approx: maxLen > 0,
+		Values: values,
+	}).Err()
+}
+
+// ListBlocks returns every key that is currently blocked, ordered by key
+func (r *RedisStorage) ListBlocks(ctx context.Context) ([]BlockInfo, error) {
+	ctx, done := observe(ctx, "redis", "list_blocks")
+	defer done()
+
+	keys, err := r.scan(ctx, "block:*")
+	if err != nil {
+		return nil, err
+	}
+
+	blocks := []BlockInfo{}
+	for _, blockKey := range keys {
+		ttl, err := r.client.PTTL(ctx, blockKey).Result()
+		if err != nil {
+			return nil, err
+		}
+
+		// The block may have expired since the scan
+		if ttl < 0 {
+			continue
+		}
+
+		blocks = append(blocks, BlockInfo{Key: r.untag(strings.TrimPrefix(blockKey, "block:")), ExpiresIn: ttl})
+	}
+
+	sort.Slice(blocks, func(i, j int) bool {
+		return blocks[i].Key < blocks[j].Key
+	})
+
+	return blocks, nil
+}
+
+// ListCounters returns the state script keeps for every key starting with prefix,
+// ordered by key
+func (r *RedisStorage) ListCounters(ctx context.Context, script Script, prefix string) ([]CounterInfo, error) {
+	ctx, done := observe(ctx, "redis", "list_counters")
+	defer done()
+
+	namespace := script.Name() + ":"
+
+	pattern := escapePattern(namespace+prefix) + "*"
+	if r.cluster {
+		pattern = escapePattern(namespace+"{"+prefix) + "*"
+	}
+
+	keys, err := r.scan(ctx, pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	counters := []CounterInfo{}
+	for _, stateKey := range keys {
+		counter, err := r.counter(ctx, script, stateKey)
+		if err != nil {
+			return nil, err
+		}
+
+		if counter == nil {
+			continue
+		}
+
+		counter.Key = r.untag(strings.TrimPrefix(stateKey, namespace))
+		counters = append(counters, *counter)
+	}
+
+	sort.Slice(counters, func(i, j int) bool {
+		return counters[i].Key < counters[j].Key
+	})
+
+	return counters, nil
+}
+
+// counter reads the state stored under stateKey, or nil if it expired meanwhile
+func (r *RedisStorage) counter(ctx context.Context, script Script, stateKey string) (*CounterInfo, error) {
+	counter := &CounterInfo{Script: script.Name(), Fields: make(map[string]float64)}
+
+	kind, err := r.client.Type(ctx, stateKey).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	switch kind {
+	case "none":
+		return nil, nil
+	case "string":
+		value, err := r.client.Get(ctx, stateKey).Float64()
+		if err == redis.Nil {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		field := "value"
+		if scalar, ok := script.(ScalarState); ok {
+			field = scalar.ScalarField()
+		}
+		counter.Fields[field] = value
+	case "hash":
+		values, err := r.client.HGetAll(ctx, stateKey).Result()
+		if err != nil {
+			return nil, err
+		}
+
+		for field, value := range values {
+			if number, err := strconv.ParseFloat(value, 64); err == nil {
+				counter.Fields[field] = number
+			}
+		}
+	case "zset":
+		entries, err := r.client.ZCard(ctx, stateKey).Result()
+		if err != nil {
+			return nil, err
+		}
+		counter.Entries = int(entries)
+	default:
+		return nil, fmt.Errorf("unexpected %s state under %s", kind, stateKey)
+	}
+
+	ttl, err := r.client.PTTL(ctx, stateKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	if ttl < 0 {
+		return nil, nil
+	}
+	counter.ExpiresIn = ttl
+
+	return counter, nil
+}
+
+// ResetCounter drops the state script keeps for a key
+func (r *RedisStorage) ResetCounter(ctx context.Context, script Script, key string) error {
+	ctx, done := observe(ctx, "redis", "reset_counter")
+	defer done()
+
+	return r.client.Del(ctx, r.stateKey(script, key)).Err()
+}
+
+// scan returns every key matching pattern without blocking Redis like KEYS would.
+// In a cluster every master is scanned.
+func (r *RedisStorage) scan(ctx context.Context, pattern string) ([]string, error) {
+	var keys []string
+	// SCAN may return a key more than once
+	seen := make(map[string]bool)
+	var mu sync.Mutex
+
+	scanNode := func(ctx context.Context, client redis.Cmdable) error {
+		iter := client.Scan(ctx, 0, pattern, 100).Iterator()
+		for iter.Next(ctx) {
+			mu.Lock()
+			if key := iter.Val(); !seen[key] {
+				seen[key] = true
+				keys = append(keys, key)
+			}
+			mu.Unlock()
+		}
+		return iter.Err()
+	}
+
+	var err error
+	if cluster, ok := r.client.(*redis.ClusterClient); ok {
+		err = cluster.ForEachMaster(ctx, func(ctx context.Context, client *redis.Client) error {
+			return scanNode(ctx, client)
+		})
+	} else {
+		err = scanNode(ctx, r.client)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan %s: %w", pattern, err)
+	}
+
+	return keys, nil
+}
+
+// escapePattern escapes the glob characters of a literal SCAN prefix
+func escapePattern(literal string) string {
+	var escaped strings.Builder
+	for _, c := range literal {
+		switch c {
+		case '*', '?', '[', ']', '\\':
+			escaped.WriteRune('\\')
+		}
+		escaped.WriteRune(c)
+	}
+	return escaped.String()
 }
 
 // Close closes the Redis connection
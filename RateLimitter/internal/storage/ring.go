@@ -0,0 +1,62 @@
+package storage
+
+import (
+	"hash/crc32"
+	"sort"
+	"strconv"
+)
+
+// ringReplicas is how many points each peer gets on the hash ring, enough to spread
+// keys evenly between a handful of peers
+const ringReplicas = 128
+
+// hashRing assigns keys to peers by consistent hashing, so adding or removing a peer
+// only moves the keys next to its points
+type hashRing struct {
+	peers  []string
+	hashes []uint32
+	owners map[uint32]string
+}
+
+// newHashRing places every peer on the ring
+func newHashRing(peers []string) *hashRing {
+	ring := &hashRing{
+		peers:  peers,
+		hashes: make([]uint32, 0, len(peers)*ringReplicas),
+		owners: make(map[uint32]string, len(peers)*ringReplicas),
+	}
+
+	for _, peer := range peers {
+		for i := 0; i < ringReplicas; i++ {
+			hash := crc32.ChecksumIEEE([]byte(peer + "#" + strconv.Itoa(i)))
+			if _, taken := ring.owners[hash]; taken {
+				continue
+			}
+			ring.owners[hash] = peer
+			ring.hashes = append(ring.hashes, hash)
+		}
+	}
+
+	sort.Slice(ring.hashes, func(i, j int) bool {
+		return ring.hashes[i] < ring.hashes[j]
+	})
+
+	return ring
+}
+
+// owner returns the peer owning key, the first one at or after its hash
+func (r *hashRing) owner(key string) string {
+	if len(r.hashes) == 0 {
+		return ""
+	}
+
+	hash := crc32.ChecksumIEEE([]byte(key))
+	i := sort.Search(len(r.hashes), func(i int) bool {
+		return r.hashes[i] >= hash
+	})
+	if i == len(r.hashes) {
+		i = 0
+	}
+
+	return r.owners[r.hashes[i]]
+}
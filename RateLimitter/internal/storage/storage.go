@@ -2,6 +2,7 @@ package storage
 
 import (
 	"context"
+	"math"
 	"time"
 )
 
@@ -13,15 +14,168 @@ type Storage interface {
 	// IncrementRequestCount increments the request count for a key
 	IncrementRequestCount(ctx context.Context, key string, expiration time.Duration) error
 
+	// Consume checks the block on a key, runs script against its state and blocks
+	// the key if the request is denied, all in a single atomic step
+	Consume(ctx context.Context, script Script, req ConsumeRequest) (*ConsumeResult, error)
+
+	// ConsumeAll runs script against the state of several keys in a single atomic
+	// step, counting the requests only if every key has room for its cost. Blocks are
+	// neither checked nor set. The keys are kept together by group, so they must
+	// always be passed with the same one.
+	ConsumeAll(ctx context.Context, script Script, group string, reqs []ConsumeRequest) ([]Outcome, error)
+
 	// IsBlocked checks if a key is currently blocked
 	IsBlocked(ctx context.Context, key string) (bool, error)
 
+	// BlockTTL returns how long a key stays blocked, zero if it is not blocked
+	BlockTTL(ctx context.Context, key string) (time.Duration, error)
+
 	// Block blocks a key for the specified duration
 	Block(ctx context.Context, key string, duration time.Duration) error
 
 	// Unblock removes the block for a key
 	Unblock(ctx context.Context, key string) error
 
+	// ListBlocks returns every key that is currently blocked
+	ListBlocks(ctx context.Context) ([]BlockInfo, error)
+
+	// ListCounters returns the state script keeps for every key starting with prefix
+	ListCounters(ctx context.Context, script Script, prefix string) ([]CounterInfo, error)
+
+	// ResetCounter drops the state script keeps for a key
+	ResetCounter(ctx context.Context, script Script, key string) error
+
+	// AcquireLease takes one of the concurrent slots of a key, dropping expired
+	// leases first, or renews the lease when it is already held
+	AcquireLease(ctx context.Context, req LeaseRequest) (*LeaseResult, error)
+
+	// ReleaseLease frees the slot held by a lease
+	ReleaseLease(ctx context.Context, key, id string) error
+
 	// Close closes the storage connection
 	Close() error
 }
+
+// ConsumeRequest describes a request to record against a key
+type ConsumeRequest struct {
+	Key    string
+	Limit  int
+	Window time.Duration
+	// Cost is how many units the request takes; zero only inspects the state
+	Cost int
+	// BlockDuration is how long the key is blocked when the request is denied
+	BlockDuration time.Duration
+	// BlockFactor above 1 escalates the blocks of repeat offenders: the block lasts
+	// BlockDuration times BlockFactor for each recent offense before this one, up to
+	// MaxBlock but never shorter than BlockDuration. One offense is forgotten every
+	// OffenseDecay.
+	BlockFactor  float64
+	MaxBlock     time.Duration
+	OffenseDecay time.Duration
+	Now          time.Time
+}
+
+// ConsumeResult is the outcome of a Consume call
+type ConsumeResult struct {
+	Outcome
+	// Blocked reports that the key was already blocked, so the script did not run.
+	// RetryAfter then holds the time left on the block.
+	Blocked bool
+	// Offenses is how many recent offenses the key has, the one that just blocked it
+	// included. It is only set when the request blocked the key with escalation on.
+	Offenses int
+}
+
+// LeaseRequest asks for one of the Limit concurrent slots of a key
+type LeaseRequest struct {
+	Key string
+	// ID identifies the lease, so it can be renewed and released
+	ID    string
+	Limit int
+	// TTL is how long the lease is held unless it is renewed
+	TTL time.Duration
+	Now time.Time
+}
+
+// LeaseResult is the outcome of an AcquireLease call
+type LeaseResult struct {
+	Acquired bool
+	// InFlight is how many leases the key holds after the call
+	InFlight int
+}
+
+// Outcome is what a Script decides for a single request
+type Outcome struct {
+	Allowed   bool
+	Remaining int
+	// ResetAfter is how long until the whole limit is available again
+	ResetAfter time.Duration
+	// RetryAfter is how long until a denied request could be allowed
+	RetryAfter time.Duration
+}
+
+// Script is a rate limiting algorithm that storages can run atomically
+type Script interface {
+	// Name identifies the algorithm and namespaces its state
+	Name() string
+
+	// Lua returns the body of the Redis script. It reads and writes its state under
+	// KEYS[1] and has the locals now, limit, window, cost (times in microseconds)
+	// in scope. It must return allowed (0 or 1), the remaining count and the reset
+	// and retry delays in microseconds, mirroring Outcome.
+	Lua() string
+
+	// Eval runs the algorithm against in-memory state, the equivalent of Lua
+	Eval(state *State, req ConsumeRequest) Outcome
+}
+
+// State is the state a Script keeps for a key in MemoryStorage
+type State struct {
+	Fields map[string]float64
+	Log    []int64
+	// TTL is how long the state has left to live, zero when it is new.
+	// Scripts extend it when they need the state kept longer.
+	TTL time.Duration
+}
+
+// ScalarState is implemented by scripts whose state is a single number, which Redis
+// keeps as a plain string. ScalarField names it so both storages report it alike.
+type ScalarState interface {
+	ScalarField() string
+}
+
+// BlockInfo describes a blocked key
+type BlockInfo struct {
+	Key       string
+	ExpiresIn time.Duration
+}
+
+// CounterInfo describes the state a script keeps for a key
+type CounterInfo struct {
+	Key    string
+	Script string
+	// Fields holds the numbers the script stores, such as a count or a timestamp
+	Fields map[string]float64
+	// Entries is the number of logged requests, for scripts that keep a log
+	Entries   int
+	ExpiresIn time.Duration
+}
+
+// escalatedBlock returns how long to block a key with offenses recent offenses, this
+// one included
+func escalatedBlock(req ConsumeRequest, offenses int) time.Duration {
+	block := float64(req.BlockDuration) * math.Pow(req.BlockFactor, float64(offenses-1))
+	if limit := max(req.MaxBlock, req.BlockDuration); block > float64(limit) {
+		return limit
+	}
+	return time.Duration(block)
+}
+
+// decayedOffenses returns how many of count offenses, the last one at last, are still
+// remembered at now
+func decayedOffenses(count int, last, now time.Time, decay time.Duration) int {
+	if decay <= 0 || !now.After(last) {
+		return count
+	}
+	return max(0, count-int(now.Sub(last)/decay))
+}
@@ -0,0 +1,86 @@
+// Package telemetry sets up OpenTelemetry tracing and structured logging, with the
+// trace of a request attached to its log lines.
+package telemetry
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	tracesdk "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	// Tracer creates the spans of the rate limiter. It uses the global tracer provider,
+	// which does nothing until InitTracing registers one.
+	Tracer = otel.Tracer("rate-limiter")
+
+	// Propagator reads and writes W3C trace context and baggage headers. Incoming
+	// traces reach the logs even when spans are not exported.
+	Propagator = propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	)
+)
+
+// InitTracing exports spans over OTLP HTTP to an OpenTelemetry Collector at
+// otlpEndpoint, such as otel-collector:4318, and propagates W3C trace context. The
+// returned provider must be shut down to flush the last spans.
+func InitTracing(serviceName, otlpEndpoint string) (*tracesdk.TracerProvider, error) {
+	var options []otlptracehttp.Option
+	switch {
+	case strings.HasPrefix(otlpEndpoint, "https://"):
+		options = append(options, otlptracehttp.WithEndpoint(strings.TrimPrefix(otlpEndpoint, "https://")))
+	default:
+		options = append(options,
+			otlptracehttp.WithEndpoint(strings.TrimPrefix(otlpEndpoint, "http://")),
+			otlptracehttp.WithInsecure(),
+		)
+	}
+
+	ctx := context.Background()
+	exporter, err := otlptracehttp.New(ctx, options...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP exporter: %w", err)
+	}
+
+	res, err := resource.New(ctx, resource.WithAttributes(semconv.ServiceName(serviceName)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create resource: %w", err)
+	}
+
+	tp := tracesdk.NewTracerProvider(
+		tracesdk.WithBatcher(exporter),
+		tracesdk.WithResource(res),
+	)
+
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(Propagator)
+
+	slog.Info("Tracing initialized", "service", serviceName, "otlp_endpoint", otlpEndpoint)
+
+	return tp, nil
+}
+
+// HashKey hides a rate limit key, which may be an IP or a token, behind a short hash
+// that still tells keys apart in traces
+func HashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:8])
+}
+
+// SpanError marks span as failed with err
+func SpanError(span trace.Span, err error) {
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
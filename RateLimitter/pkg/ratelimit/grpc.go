@@ -0,0 +1,146 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"rate-limiter/internal/middleware"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// UnaryServerInterceptor limits unary calls. Denied calls fail with
+// codes.ResourceExhausted and a RetryInfo detail telling when to retry.
+func UnaryServerInterceptor(rl *RateLimiter, opts ...Option) grpc.UnaryServerInterceptor {
+	o := newOptions(opts)
+
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		if err := o.checkCall(ctx, rl, info.FullMethod, func(md metadata.MD) error {
+			return grpc.SetHeader(ctx, md)
+		}); err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// StreamServerInterceptor limits streams when they are opened, counting each stream
+// as one request
+func StreamServerInterceptor(rl *RateLimiter, opts ...Option) grpc.StreamServerInterceptor {
+	o := newOptions(opts)
+
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if err := o.checkCall(ss.Context(), rl, info.FullMethod, ss.SetHeader); err != nil {
+			return err
+		}
+		return handler(srv, ss)
+	}
+}
+
+// checkCall checks a call to fullMethod, sending the rate limit headers through
+// setHeader, and returns the status error of a refused call
+func (o *options) checkCall(ctx context.Context, rl *RateLimiter, fullMethod string, setHeader func(metadata.MD) error) error {
+	ip, token := o.callKeys(ctx)
+
+	// gRPC calls are HTTP/2 POST requests to /package.Service/Method
+	policy := rl.MatchPolicy(http.MethodPost, fullMethod, fullMethod, o.group)
+	shadow := rl.MatchShadowPolicies(http.MethodPost, fullMethod, fullMethod, o.group)
+
+	incoming, _ := metadata.FromIncomingContext(ctx)
+	key := rl.BuildKey(ip, token, callKeySource{md: incoming, fullMethod: fullMethod}, append(shadow, policy)...)
+
+	result, err := rl.CheckPolicies(ctx, policy, shadow, key)
+	if errors.Is(err, ErrUnavailable) {
+		return status.Error(codes.Unavailable, "rate limiter unavailable")
+	}
+	if err != nil {
+		return status.Error(codes.Internal, "rate limiter error")
+	}
+
+	if result.Denied {
+		return status.Error(codes.PermissionDenied, result.Reason)
+	}
+
+	if result.Unauthenticated {
+		return status.Error(codes.Unauthenticated, result.Reason)
+	}
+
+	if result.Exempt {
+		return nil
+	}
+
+	header := http.Header{}
+	middleware.SetRateLimitHeaders(header, result)
+	md := metadata.MD{}
+	for key, values := range header {
+		md.Set(key, values...)
+	}
+
+	if !result.Allowed {
+		md.Set("retry-after", strconv.Itoa(middleware.RetryAfterSeconds(result)))
+		setHeader(md)
+
+		st, err := status.New(codes.ResourceExhausted, result.Reason).WithDetails(&errdetails.RetryInfo{
+			RetryDelay: durationpb.New(result.RetryAfter),
+		})
+		if err != nil {
+			return status.Error(codes.ResourceExhausted, result.Reason)
+		}
+		return st.Err()
+	}
+
+	// Headers can only be sent once; a failure here must not fail the call
+	setHeader(md)
+	return nil
+}
+
+// callKeys returns the client IP and token of a call. The IP is the peer address,
+// or the one forwarded in the metadata when the peer is a trusted proxy.
+func (o *options) callKeys(ctx context.Context) (ip, token string) {
+	md, _ := metadata.FromIncomingContext(ctx)
+
+	remoteAddr := ""
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		remoteAddr = p.Addr.String()
+	}
+
+	header := http.Header{}
+	for key, values := range md {
+		for _, value := range values {
+			header.Add(key, value)
+		}
+	}
+
+	if tokens := md.Get(o.tokenKey); len(tokens) > 0 {
+		token = tokens[0]
+	}
+
+	return middleware.ForwardedClientIP(remoteAddr, header, o.trustedProxies, o.clientIPHeader), token
+}
+
+// callKeySource reads key parts from the metadata of a call. Calls have no query or
+// path parameters, and their route is the full method.
+type callKeySource struct {
+	md         metadata.MD
+	fullMethod string
+}
+
+func (s callKeySource) Method() string      { return http.MethodPost }
+func (s callKeySource) Route() string       { return s.fullMethod }
+func (s callKeySource) Query(string) string { return "" }
+func (s callKeySource) Param(string) string { return "" }
+
+func (s callKeySource) Header(name string) string {
+	if values := s.md.Get(name); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
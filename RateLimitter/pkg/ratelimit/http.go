@@ -0,0 +1,89 @@
+package ratelimit
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"rate-limiter/internal/middleware"
+)
+
+// HTTPMiddleware limits the requests reaching a net/http handler, answering like the
+// gin middleware: 429 with the RateLimit headers when a limit is exceeded, 403 for
+// denylisted IPs, 401 for tokens that fail verification and 503 while a fail-closed
+// storage is unavailable
+func HTTPMiddleware(rl *RateLimiter, opts ...Option) func(http.Handler) http.Handler {
+	o := newOptions(opts)
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ip := middleware.ClientIP(r, o.trustedProxies, o.clientIPHeader)
+			token := r.Header.Get(o.tokenKey)
+
+			// Without a router there is no route pattern, so policies match the path
+			policy := rl.MatchPolicy(r.Method, r.URL.Path, r.URL.Path, o.group)
+			shadow := rl.MatchShadowPolicies(r.Method, r.URL.Path, r.URL.Path, o.group)
+
+			key := rl.BuildKey(ip, token, middleware.RequestKeySource(r), append(shadow, policy)...)
+
+			result, err := rl.CheckPolicies(r.Context(), policy, shadow, key)
+			if errors.Is(err, ErrUnavailable) {
+				w.Header().Set("Retry-After", "1")
+				writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": "rate limiter unavailable"})
+				return
+			}
+			if err != nil {
+				writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
+				return
+			}
+
+			if result.Denied {
+				writeJSON(w, http.StatusForbidden, map[string]string{"error": "forbidden", "reason": result.Reason})
+				return
+			}
+
+			if result.Unauthenticated {
+				writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid token", "reason": result.Reason})
+				return
+			}
+
+			if result.Exempt {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			middleware.SetRateLimitHeaders(w.Header(), result)
+
+			if !result.Allowed {
+				w.Header().Set("Retry-After", strconv.Itoa(middleware.RetryAfterSeconds(result)))
+				writeJSON(w, http.StatusTooManyRequests, map[string]string{
+					"error":  "you have reached the maximum number of requests or actions allowed within a certain time frame",
+					"reason": result.Reason,
+				})
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// Cost makes the requests reaching a handler count as cost requests. It must wrap the
+// handler returned by HTTPMiddleware:
+//
+//	handler = ratelimit.Cost(50)(ratelimit.HTTPMiddleware(limiter)(export))
+func Cost(cost int) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(w, r.WithContext(WithCost(r.Context(), cost)))
+		})
+	}
+}
+
+// writeJSON writes body as a JSON response
+func writeJSON(w http.ResponseWriter, code int, body any) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(body)
+}
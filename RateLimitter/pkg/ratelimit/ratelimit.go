@@ -0,0 +1,235 @@
+// Package ratelimit exposes the rate limiter to other services, with adapters for
+// net/http handlers and gRPC servers.
+//
+//	store, err := ratelimit.NewRedisStorage("localhost", "6379", "", 0)
+//	...
+//	limiter := ratelimit.New(store, cfg)
+//	handler = ratelimit.HTTPMiddleware(limiter)(handler)
+//	server := grpc.NewServer(
+//		grpc.UnaryInterceptor(ratelimit.UnaryServerInterceptor(limiter)),
+//		grpc.StreamInterceptor(ratelimit.StreamServerInterceptor(limiter)),
+//	)
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"time"
+
+	"rate-limiter/internal/audit"
+	"rate-limiter/internal/auth"
+	"rate-limiter/internal/clock"
+	"rate-limiter/internal/config"
+	"rate-limiter/internal/limiter"
+	"rate-limiter/internal/middleware"
+	"rate-limiter/internal/storage"
+)
+
+// RateLimiter checks requests against the IP, token and policy limits
+type RateLimiter = limiter.RateLimiter
+
+// Result is the outcome of a rate limit check
+type Result = limiter.LimiterResult
+
+// Config holds the whole rate limiter configuration, as read by LoadConfig
+type Config = config.Config
+
+// Limits holds the IP, token and policy limits
+type Limits = config.RateLimitConfig
+
+// TokenLimit is the limit of a single token, IP or range
+type TokenLimit = config.TokenLimit
+
+// Policy limits the requests matching some methods, paths or groups
+type Policy = config.Policy
+
+// Key is what a request is limited by, as built by RateLimiter.BuildKey
+type Key = limiter.Key
+
+// KeySource gives key extractors access to a request; RequestKeySource reads a net/http one
+type KeySource = limiter.KeySource
+
+// TokenAuth verifies JWTs and signed API keys, limiting them by the tier of their plan
+type TokenAuth = config.TokenAuth
+
+// AuditLog records blocks and admin operations, set with RateLimiter.SetAuditLog
+type AuditLog = audit.Log
+
+// AuditEvent is a block, unblock or admin operation
+type AuditEvent = audit.Event
+
+// AuditSink delivers audit events somewhere
+type AuditSink = audit.Sink
+
+// Storage keeps the rate limiter state
+type Storage = storage.Storage
+
+// RedisOptions configures NewRedisStorageWithOptions: Sentinel, Cluster, TLS, ACL
+// users and the connection pool
+type RedisOptions = storage.RedisOptions
+
+// BreakerOptions configures NewCircuitBreaker
+type BreakerOptions = storage.BreakerOptions
+
+// Clock tells the rate limiter and the storage the time, set with RateLimiter.SetClock
+type Clock = clock.Clock
+
+// Ticker fires at a fixed interval of a Clock
+type Ticker = clock.Ticker
+
+// FakeClock is a Clock that only moves when told to, for tests
+type FakeClock = clock.Fake
+
+// Key types a request can be limited by
+const (
+	KeyTypeIP     = limiter.KeyTypeIP
+	KeyTypeToken  = limiter.KeyTypeToken
+	KeyTypeCustom = limiter.KeyTypeCustom
+)
+
+// ErrUnavailable is returned while a fail-closed storage is unavailable
+var ErrUnavailable = storage.ErrUnavailable
+
+// New creates a rate limiter using cfg.RateLimit
+func New(store Storage, cfg *Config) *RateLimiter {
+	return limiter.NewRateLimiter(store, cfg)
+}
+
+// WithCost returns a context whose requests count as cost requests against the limits
+// and quotas, overriding the cost of the matching policy
+func WithCost(ctx context.Context, cost int) context.Context {
+	return limiter.WithCost(ctx, cost)
+}
+
+// SignAPIKey issues an API key verified with secret, the APIKeySecret of TokenAuth.
+// claims should hold sub and the plan claim, and may hold exp.
+func SignAPIKey(secret []byte, claims map[string]any) (string, error) {
+	return auth.SignAPIKey(secret, claims)
+}
+
+// RequestKeySource reads the key parts of a net/http request
+func RequestKeySource(r *http.Request) KeySource {
+	return middleware.RequestKeySource(r)
+}
+
+// NewAuditLog starts an audit log delivering events to sinks in the background
+func NewAuditLog(buffer int, sinks ...AuditSink) *AuditLog {
+	return audit.New(buffer, sinks...)
+}
+
+// NewAuditFileSink appends audit events to path as JSON lines
+func NewAuditFileSink(path string) (AuditSink, error) {
+	return audit.NewFileSink(path)
+}
+
+// NewAuditWebhookSink posts audit events to url, signed with secret when it is set
+func NewAuditWebhookSink(url string, secret []byte, timeout time.Duration) AuditSink {
+	return audit.NewWebhookSink(url, secret, timeout)
+}
+
+// NewAuditRedisStreamSink adds audit events to a stream of a Redis storage, capped at
+// about maxLen entries
+func NewAuditRedisStreamSink(store Storage, stream string, maxLen int64) (AuditSink, error) {
+	writer, ok := store.(audit.StreamWriter)
+	if !ok {
+		return nil, fmt.Errorf("audit streams need a Redis storage")
+	}
+	return audit.NewRedisStreamSink(writer, stream, maxLen), nil
+}
+
+// LoadConfig reads the configuration from the environment and the policy file
+func LoadConfig() (*Config, error) {
+	return config.Load()
+}
+
+// NewMemoryStorage creates a storage local to the process
+func NewMemoryStorage() Storage {
+	return storage.NewMemoryStorage()
+}
+
+// NewMemoryStorageWithClock is NewMemoryStorage reading the time from c
+func NewMemoryStorageWithClock(c Clock) Storage {
+	return storage.NewMemoryStorageWithClock(c)
+}
+
+// NewFakeClock returns a clock stopped at now
+func NewFakeClock(now time.Time) *FakeClock {
+	return clock.NewFake(now)
+}
+
+// NewRedisStorage creates a storage shared through Redis, failing when Redis is down
+func NewRedisStorage(host, port, password string, db int) (Storage, error) {
+	return storage.NewRedisStorage(host, port, password, db)
+}
+
+// NewRedisStorageWithOptions is NewRedisStorage for Sentinel, Cluster and TLS setups
+func NewRedisStorageWithOptions(options RedisOptions) (Storage, error) {
+	store := storage.DialRedisOptions(options)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := store.Ping(ctx); err != nil {
+		store.Close()
+		return nil, fmt.Errorf("failed to connect to Redis: %w", err)
+	}
+
+	return store, nil
+}
+
+// NewCircuitBreaker wraps a storage so requests fail open or closed while it is down
+func NewCircuitBreaker(primary Storage, options BreakerOptions) Storage {
+	return storage.NewCircuitBreaker(primary, options)
+}
+
+// Option configures the HTTP middleware and the gRPC interceptors
+type Option func(*options)
+
+type options struct {
+	group          string
+	trustedProxies []netip.Prefix
+	clientIPHeader string
+	tokenKey       string
+}
+
+// WithGroup names the group of routes or services limited, so policies can target it
+func WithGroup(name string) Option {
+	return func(o *options) {
+		o.group = name
+	}
+}
+
+// WithTrustedProxies sets the proxies whose forwarding headers or metadata are believed.
+// Without it the client IP is always the peer address.
+func WithTrustedProxies(prefixes []netip.Prefix) Option {
+	return func(o *options) {
+		o.trustedProxies = prefixes
+	}
+}
+
+// WithClientIPHeader names the forwarding header, or gRPC metadata key, trusted proxies
+// report the client IP in: X-Forwarded-For, the default, Forwarded or X-Real-IP
+func WithClientIPHeader(header string) Option {
+	return func(o *options) {
+		o.clientIPHeader = header
+	}
+}
+
+// WithTokenKey sets the header, or gRPC metadata key, holding the access token.
+// It defaults to API_KEY.
+func WithTokenKey(key string) Option {
+	return func(o *options) {
+		o.tokenKey = key
+	}
+}
+
+// newOptions applies opts over the defaults
+func newOptions(opts []Option) *options {
+	o := &options{tokenKey: "API_KEY"}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
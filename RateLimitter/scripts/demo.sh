@@ -59,6 +59,7 @@ echo ""
 echo "📊 Test 5: Admin Unblock"
 echo "Unblocking IP 127.0.0.1..."
 curl -s -X POST http://localhost:8080/admin/unblock \
+  -H "Authorization: Bearer ${ADMIN_TOKEN:-change-me}" \
   -H "Content-Type: application/json" \
   -d '{"type": "ip", "key": "127.0.0.1"}' | jq .
 echo ""
@@ -46,6 +46,7 @@ curl -s http://localhost:8080/api/status | jq .
 echo ""
 echo "Testing admin unblock endpoint..."
 curl -s -X POST http://localhost:8080/admin/unblock \
+  -H "Authorization: Bearer ${ADMIN_TOKEN:-change-me}" \
   -H "Content-Type: application/json" \
   -d '{"type": "ip", "key": "127.0.0.1"}' | jq .
 
@@ -0,0 +1,350 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"rate-limiter/internal/config"
+	"rate-limiter/internal/limiter"
+	"rate-limiter/internal/server"
+	"rate-limiter/internal/storage"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStorage_Enumeration(t *testing.T) {
+	ctx := context.Background()
+	limit := limiter.Limit{Requests: 10, Window: time.Minute}
+
+	for _, backend := range newTestBackends(t) {
+		t.Run(backend.name, func(t *testing.T) {
+			store := backend.store
+
+			require.NoError(t, store.Block(ctx, "192.168.1.1", time.Minute))
+			require.NoError(t, store.Block(ctx, "abc123", time.Hour))
+
+			blocks, err := store.ListBlocks(ctx)
+			require.NoError(t, err)
+			require.Len(t, blocks, 2)
+			assert.Equal(t, "192.168.1.1", blocks[0].Key)
+			assert.InDelta(t, time.Minute, blocks[0].ExpiresIn, float64(time.Second))
+			assert.Equal(t, "abc123", blocks[1].Key)
+
+			for i := 0; i < 3; i++ {
+				backend.consume(t, limiter.FixedWindow{}, "10.0.0.1", limit, 1)
+				backend.consume(t, limiter.SlidingWindowLog{}, "10.0.0.1", limit, 1)
+				backend.consume(t, limiter.TokenBucket{}, "10.0.0.1", limit, 1)
+			}
+			backend.consume(t, limiter.FixedWindow{}, "10.0.0.12", limit, 1)
+			backend.consume(t, limiter.FixedWindow{}, "other", limit, 1)
+
+			// Counters are listed by prefix and reported alike by both storages
+			counters, err := store.ListCounters(ctx, limiter.FixedWindow{}, "10.0.0.1")
+			require.NoError(t, err)
+			require.Len(t, counters, 2)
+			assert.Equal(t, "10.0.0.1", counters[0].Key)
+			assert.Equal(t, config.AlgorithmFixedWindow, counters[0].Script)
+			assert.Equal(t, map[string]float64{"count": 3}, counters[0].Fields)
+			assert.Greater(t, counters[0].ExpiresIn, time.Duration(0))
+			assert.Equal(t, "10.0.0.12", counters[1].Key)
+
+			counters, err = store.ListCounters(ctx, limiter.SlidingWindowLog{}, "")
+			require.NoError(t, err)
+			require.Len(t, counters, 1)
+			assert.Equal(t, 3, counters[0].Entries)
+
+			counters, err = store.ListCounters(ctx, limiter.TokenBucket{}, "10.0.0.1")
+			require.NoError(t, err)
+			require.Len(t, counters, 1)
+			assert.InDelta(t, 7, counters[0].Fields["tokens"], 0.1)
+
+			// Resetting drops only the state of that key
+			require.NoError(t, store.ResetCounter(ctx, limiter.FixedWindow{}, "10.0.0.1"))
+
+			counters, err = store.ListCounters(ctx, limiter.FixedWindow{}, "")
+			require.NoError(t, err)
+			require.Len(t, counters, 2)
+			assert.Equal(t, "10.0.0.12", counters[0].Key)
+			assert.Equal(t, "other", counters[1].Key)
+		})
+	}
+}
+
+// adminClient sends admin requests to a server
+type adminClient struct {
+	t       *testing.T
+	handler http.Handler
+	token   string
+}
+
+// do sends a request with an optional JSON body and decodes the JSON response
+func (a adminClient) do(method, path string, body any) (int, map[string]any) {
+	a.t.Helper()
+
+	var reader *bytes.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		require.NoError(a.t, err)
+		reader = bytes.NewReader(data)
+	} else {
+		reader = bytes.NewReader(nil)
+	}
+
+	req, _ := http.NewRequest(method, path, reader)
+	req.Header.Set("Content-Type", "application/json")
+	if a.token != "" {
+		req.Header.Set("Authorization", "Bearer "+a.token)
+	}
+
+	w := httptest.NewRecorder()
+	a.handler.ServeHTTP(w, req)
+
+	var response map[string]any
+	require.NoError(a.t, json.Unmarshal(w.Body.Bytes(), &response), w.Body.String())
+	return w.Code, response
+}
+
+// newAdminServer returns a server with the admin API enabled on memory storage
+func newAdminServer(t *testing.T, adminToken string) (http.Handler, storage.Storage) {
+	t.Helper()
+
+	gin.SetMode(gin.TestMode)
+
+	cfg := &config.Config{
+		RateLimit: config.RateLimitConfig{
+			IPRequestsPerSecond:    2,
+			IPBlockDurationMinutes: 1,
+			TokenLimits:            map[string]config.TokenLimit{"abc123": {RequestsPerSecond: 10, BlockDurationMinutes: 5}},
+			Policies:               []config.Policy{{Name: "writes", Methods: []string{"POST"}, Requests: 1, Window: time.Minute}},
+		},
+		Server: config.ServerConfig{AdminToken: adminToken},
+	}
+
+	store := storage.NewMemoryStorage()
+	t.Cleanup(func() { store.Close() })
+
+	srv, err := server.New(cfg, store)
+	require.NoError(t, err)
+
+	return srv.Handler(), store
+}
+
+func TestAdmin_Authentication(t *testing.T) {
+	handler, _ := newAdminServer(t, "secret")
+
+	code, _ := adminClient{t: t, handler: handler}.do("GET", "/admin/blocks", nil)
+	assert.Equal(t, http.StatusUnauthorized, code)
+
+	code, _ = adminClient{t: t, handler: handler, token: "wrong"}.do("GET", "/admin/blocks", nil)
+	assert.Equal(t, http.StatusUnauthorized, code)
+
+	code, _ = adminClient{t: t, handler: handler, token: "secret"}.do("GET", "/admin/blocks", nil)
+	assert.Equal(t, http.StatusOK, code)
+
+	// Without a configured token the admin API is off
+	disabled, _ := newAdminServer(t, "")
+	code, _ = adminClient{t: t, handler: disabled}.do("POST", "/admin/unblock", map[string]string{"type": "ip", "key": "192.168.1.1"})
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+}
+
+func TestAdmin_Blocks(t *testing.T) {
+	handler, store := newAdminServer(t, "secret")
+	admin := adminClient{t: t, handler: handler, token: "secret"}
+	ctx := context.Background()
+
+	code, response := admin.do("POST", "/admin/blocks", map[string]string{"type": "ip", "key": "192.168.1.1", "duration": "10m"})
+	require.Equal(t, http.StatusCreated, code, response)
+
+	code, response = admin.do("POST", "/admin/blocks", map[string]string{"type": "token", "key": "abc123", "policy": "writes", "duration": "1h"})
+	require.Equal(t, http.StatusCreated, code, response)
+	assert.Equal(t, "policy:writes:abc123", response["key"])
+
+	code, response = admin.do("GET", "/admin/blocks", nil)
+	require.Equal(t, http.StatusOK, code)
+	blocks := response["blocks"].([]any)
+	require.Len(t, blocks, 2)
+	assert.Equal(t, "192.168.1.1", blocks[0].(map[string]any)["key"])
+	assert.EqualValues(t, 600, blocks[0].(map[string]any)["expires_in_seconds"])
+	assert.Equal(t, "policy:writes:abc123", blocks[1].(map[string]any)["key"])
+
+	// The type is checked, a token is not an IP
+	code, response = admin.do("POST", "/admin/unblock", map[string]string{"type": "ip", "key": "abc123"})
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Contains(t, response["error"], "invalid IP address")
+
+	code, _ = admin.do("POST", "/admin/unblock", map[string]string{"type": "session", "key": "abc123"})
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	code, _ = admin.do("POST", "/admin/blocks", map[string]string{"type": "ip", "key": "192.168.1.2", "policy": "missing", "duration": "1m"})
+	assert.Equal(t, http.StatusNotFound, code)
+
+	code, _ = admin.do("POST", "/admin/blocks", map[string]string{"type": "ip", "key": "192.168.1.2", "duration": "forever"})
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	// Unblocking through the legacy endpoint and the query string form
+	code, _ = admin.do("POST", "/admin/unblock", map[string]string{"type": "ip", "key": "192.168.1.1"})
+	assert.Equal(t, http.StatusOK, code)
+
+	code, _ = admin.do("DELETE", "/admin/blocks?type=token&key=abc123&policy=writes", nil)
+	assert.Equal(t, http.StatusOK, code)
+
+	blocked, err := store.ListBlocks(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, blocked)
+}
+
+func TestAdmin_Counters(t *testing.T) {
+	handler, _ := newAdminServer(t, "secret")
+	admin := adminClient{t: t, handler: handler, token: "secret"}
+
+	send := func() int {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/api/test", nil)
+		req.RemoteAddr = "192.168.1.9:1234"
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	assert.Equal(t, 200, send())
+	assert.Equal(t, 200, send())
+
+	code, response := admin.do("GET", "/admin/counters?type=ip&key=192.168.1.9", nil)
+	require.Equal(t, http.StatusOK, code)
+	counters := response["counters"].([]any)
+	require.Len(t, counters, 1)
+	counter := counters[0].(map[string]any)
+	assert.Equal(t, "192.168.1.9", counter["key"])
+	assert.Equal(t, config.AlgorithmFixedWindow, counter["algorithm"])
+	assert.EqualValues(t, 2, counter["fields"].(map[string]any)["count"])
+
+	code, response = admin.do("GET", "/admin/counters", nil)
+	require.Equal(t, http.StatusOK, code)
+	assert.Len(t, response["counters"], 1)
+
+	// After a reset the whole limit is available again
+	code, _ = admin.do("DELETE", "/admin/counters?type=ip&key=192.168.1.9", nil)
+	require.Equal(t, http.StatusOK, code)
+
+	assert.Equal(t, 200, send())
+	assert.Equal(t, 200, send())
+	assert.Equal(t, 429, send())
+}
+
+func TestAdmin_Tokens(t *testing.T) {
+	handler, _ := newAdminServer(t, "secret")
+	admin := adminClient{t: t, handler: handler, token: "secret"}
+
+	code, response := admin.do("GET", "/admin/tokens", nil)
+	require.Equal(t, http.StatusOK, code)
+	assert.Len(t, response["tokens"], 1)
+
+	code, response = admin.do("PUT", "/admin/tokens/premium", map[string]any{"requests_per_second": 3, "block_duration_minutes": 1, "algorithm": "gcra"})
+	require.Equal(t, http.StatusOK, code, response)
+
+	code, response = admin.do("GET", "/admin/tokens/premium", nil)
+	require.Equal(t, http.StatusOK, code)
+	assert.EqualValues(t, 3, response["requests_per_second"])
+	assert.Equal(t, "gcra", response["algorithm"])
+
+	// The new limit applies to requests right away
+	send := func(token string) int {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/api/test", nil)
+		req.RemoteAddr = "192.168.1.10:1234"
+		req.Header.Set("API_KEY", token)
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, 200, send("premium"))
+	}
+	assert.Equal(t, 429, send("premium"))
+
+	code, response = admin.do("PUT", "/admin/tokens/premium", map[string]any{"requests_per_second": 3, "algorithm": "leaky"})
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Contains(t, response["error"], "unknown rate limit algorithm")
+
+	code, _ = admin.do("DELETE", "/admin/tokens/premium", nil)
+	assert.Equal(t, http.StatusOK, code)
+
+	code, _ = admin.do("DELETE", "/admin/tokens/premium", nil)
+	assert.Equal(t, http.StatusNotFound, code)
+
+	code, _ = admin.do("GET", "/admin/tokens/premium", nil)
+	assert.Equal(t, http.StatusNotFound, code)
+}
+
+func TestAdmin_TokensSurvivePolicyReload(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	path := writePolicyFile(t, "policies.yaml", "tokens: {abc: {requests_per_second: 1}, partner: {requests_per_second: 5}}")
+	t.Setenv("RATE_LIMIT_POLICIES_FILE", path)
+	t.Setenv("ADMIN_TOKEN", "secret")
+
+	cfg, err := config.Load()
+	require.NoError(t, err)
+
+	store := storage.NewMemoryStorage()
+	t.Cleanup(func() { store.Close() })
+
+	srv, err := server.New(cfg, store)
+	require.NoError(t, err)
+	admin := adminClient{t: t, handler: srv.Handler(), token: "secret"}
+
+	code, response := admin.do("PUT", "/admin/tokens/premium", map[string]any{"requests_per_second": 3})
+	require.Equal(t, http.StatusOK, code, response)
+	code, _ = admin.do("DELETE", "/admin/tokens/partner", nil)
+	require.Equal(t, http.StatusOK, code)
+
+	next := filepath.Join(filepath.Dir(path), "next.yaml")
+	require.NoError(t, os.WriteFile(next, []byte("tokens: {abc: {requests_per_second: 9}, partner: {requests_per_second: 5}}"), 0o600))
+	require.NoError(t, os.Rename(next, path))
+
+	assert.Eventually(t, func() bool {
+		_, response := admin.do("GET", "/admin/tokens/abc", nil)
+		return response["requests_per_second"] == float64(9)
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// The reload applies over the admin changes rather than dropping them
+	code, response = admin.do("GET", "/admin/tokens/premium", nil)
+	require.Equal(t, http.StatusOK, code)
+	assert.EqualValues(t, 3, response["requests_per_second"])
+
+	code, _ = admin.do("GET", "/admin/tokens/partner", nil)
+	assert.Equal(t, http.StatusNotFound, code)
+
+	// Deleting a token without a limit leaves nothing behind for a later reload to hide
+	code, _ = admin.do("DELETE", "/admin/tokens/trial", nil)
+	require.Equal(t, http.StatusNotFound, code)
+
+	// Dropping an override brings back the limit of the policy file, or none
+	code, _ = admin.do("DELETE", "/admin/tokens/partner/override", nil)
+	require.Equal(t, http.StatusOK, code)
+	code, _ = admin.do("DELETE", "/admin/tokens/premium/override", nil)
+	require.Equal(t, http.StatusOK, code)
+	code, _ = admin.do("DELETE", "/admin/tokens/premium/override", nil)
+	assert.Equal(t, http.StatusNotFound, code)
+
+	code, response = admin.do("GET", "/admin/tokens/partner", nil)
+	require.Equal(t, http.StatusOK, code)
+	assert.EqualValues(t, 5, response["requests_per_second"])
+	code, _ = admin.do("GET", "/admin/tokens/premium", nil)
+	assert.Equal(t, http.StatusNotFound, code)
+
+	require.NoError(t, os.WriteFile(next, []byte("tokens: {abc: {requests_per_second: 9}, partner: {requests_per_second: 5}, trial: {requests_per_second: 2}}"), 0o600))
+	require.NoError(t, os.Rename(next, path))
+
+	assert.Eventually(t, func() bool {
+		_, response := admin.do("GET", "/admin/tokens/trial", nil)
+		return response["requests_per_second"] == float64(2)
+	}, 5*time.Second, 10*time.Millisecond)
+}
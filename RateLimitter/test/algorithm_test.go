@@ -0,0 +1,291 @@
+package test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"rate-limiter/internal/clock"
+	"rate-limiter/internal/config"
+	"rate-limiter/internal/limiter"
+	"rate-limiter/internal/storage"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testBackend is a storage under test plus a way to let time pass for it
+type testBackend struct {
+	name  string
+	store storage.Storage
+	// clock is the time of the requests, and of the memory storage
+	clock   *clock.Fake
+	advance func(time.Duration)
+}
+
+// testStart is when fake clocks start, on a second boundary so windows line up
+var testStart = time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+// newTestBackends returns a memory storage and a Redis storage backed by miniredis,
+// each on its own fake clock
+func newTestBackends(t *testing.T) []testBackend {
+	t.Helper()
+
+	memoryClock := clock.NewFake(testStart)
+	memory := storage.NewMemoryStorageWithClock(memoryClock)
+	t.Cleanup(func() { memory.Close() })
+
+	server := miniredis.RunT(t)
+	host, port, err := net.SplitHostPort(server.Addr())
+	require.NoError(t, err)
+
+	redis, err := storage.NewRedisStorage(host, port, "", 0)
+	require.NoError(t, err)
+	t.Cleanup(func() { redis.Close() })
+
+	redisClock := clock.NewFake(testStart)
+
+	return []testBackend{
+		{name: "memory", store: memory, clock: memoryClock, advance: memoryClock.Advance},
+		{name: "redis", store: redis, clock: redisClock, advance: func(d time.Duration) {
+			redisClock.Advance(d)
+			// miniredis only expires keys when told to
+			server.FastForward(d)
+		}},
+	}
+}
+
+// consume records a request of the given cost against key at the time of the backend
+func (b testBackend) consume(t *testing.T, algorithm limiter.Algorithm, key string, limit limiter.Limit, cost int) *storage.ConsumeResult {
+	t.Helper()
+	return consumeAt(t, b.store, b.clock.Now(), algorithm, key, limit, cost)
+}
+
+var allAlgorithms = []string{
+	config.AlgorithmFixedWindow,
+	config.AlgorithmTokenBucket,
+	config.AlgorithmSlidingWindowLog,
+	config.AlgorithmSlidingWindowCounter,
+	config.AlgorithmGCRA,
+}
+
+// consume records a request of the given cost against key using algorithm
+func consume(t *testing.T, store storage.Storage, algorithm limiter.Algorithm, key string, limit limiter.Limit, cost int) *storage.ConsumeResult {
+	t.Helper()
+	return consumeAt(t, store, time.Now(), algorithm, key, limit, cost)
+}
+
+// consumeAt records a request of the given cost against key at now using algorithm
+func consumeAt(t *testing.T, store storage.Storage, now time.Time, algorithm limiter.Algorithm, key string, limit limiter.Limit, cost int) *storage.ConsumeResult {
+	t.Helper()
+
+	result, err := store.Consume(context.Background(), algorithm, storage.ConsumeRequest{
+		Key:           key,
+		Limit:         limit.Requests,
+		Window:        limit.Window,
+		Cost:          cost,
+		BlockDuration: limit.BlockDuration,
+		Now:           now,
+	})
+	require.NoError(t, err)
+
+	return result
+}
+
+func TestAlgorithms_AllowUpToLimit(t *testing.T) {
+	limit := limiter.Limit{Requests: 3, Window: 200 * time.Millisecond}
+
+	for _, backend := range newTestBackends(t) {
+		for _, name := range allAlgorithms {
+			t.Run(backend.name+"/"+name, func(t *testing.T) {
+				algorithm, err := limiter.NewAlgorithm(name)
+				require.NoError(t, err)
+				assert.Equal(t, name, algorithm.Name())
+
+				key := "limit-" + name
+
+				// A zero cost request only reports what is left
+				result := backend.consume(t, algorithm, key, limit, 0)
+				assert.Equal(t, 3, result.Remaining)
+
+				for i := 0; i < 3; i++ {
+					result := backend.consume(t, algorithm, key, limit, 1)
+					assert.True(t, result.Allowed, "request %d should be allowed", i+1)
+					assert.Equal(t, 2-i, result.Remaining)
+				}
+
+				result = backend.consume(t, algorithm, key, limit, 1)
+				assert.False(t, result.Allowed, "4th request should be denied")
+				assert.Equal(t, 0, result.Remaining)
+			})
+		}
+	}
+}
+
+func TestAlgorithms_RecoverAfterWindow(t *testing.T) {
+	limit := limiter.Limit{Requests: 2, Window: 100 * time.Millisecond}
+
+	for _, backend := range newTestBackends(t) {
+		for _, name := range allAlgorithms {
+			t.Run(backend.name+"/"+name, func(t *testing.T) {
+				algorithm, err := limiter.NewAlgorithm(name)
+				require.NoError(t, err)
+
+				key := "recover-" + name
+
+				for i := 0; i < 2; i++ {
+					backend.consume(t, algorithm, key, limit, 1)
+				}
+
+				assert.False(t, backend.consume(t, algorithm, key, limit, 1).Allowed)
+
+				// Two windows guarantee the sliding window counter forgets the previous one too
+				backend.advance(2 * limit.Window)
+
+				assert.True(t, backend.consume(t, algorithm, key, limit, 1).Allowed)
+			})
+		}
+	}
+}
+
+func TestAlgorithms_BlockOnDenial(t *testing.T) {
+	limit := limiter.Limit{Requests: 1, Window: time.Minute, BlockDuration: time.Minute}
+
+	for _, backend := range newTestBackends(t) {
+		for _, name := range allAlgorithms {
+			t.Run(backend.name+"/"+name, func(t *testing.T) {
+				algorithm, err := limiter.NewAlgorithm(name)
+				require.NoError(t, err)
+
+				key := "block-" + name
+
+				assert.True(t, backend.consume(t, algorithm, key, limit, 1).Allowed)
+
+				result := backend.consume(t, algorithm, key, limit, 1)
+				assert.False(t, result.Allowed)
+				assert.False(t, result.Blocked, "the denied request itself is not reported as blocked")
+
+				blocked, err := backend.store.IsBlocked(context.Background(), key)
+				require.NoError(t, err)
+				assert.True(t, blocked)
+
+				result = backend.consume(t, algorithm, key, limit, 1)
+				assert.False(t, result.Allowed)
+				assert.True(t, result.Blocked)
+				assert.InDelta(t, limit.BlockDuration.Seconds(), result.RetryAfter.Seconds(), 1)
+			})
+		}
+	}
+}
+
+func TestAlgorithms_ReportResetAndRetry(t *testing.T) {
+	limit := limiter.Limit{Requests: 2, Window: time.Minute}
+
+	for _, backend := range newTestBackends(t) {
+		for _, name := range allAlgorithms {
+			t.Run(backend.name+"/"+name, func(t *testing.T) {
+				algorithm, err := limiter.NewAlgorithm(name)
+				require.NoError(t, err)
+
+				key := "reset-" + name
+
+				result := backend.consume(t, algorithm, key, limit, 1)
+				assert.True(t, result.Allowed)
+				assert.Greater(t, result.ResetAfter, time.Duration(0))
+				assert.LessOrEqual(t, result.ResetAfter, 2*limit.Window)
+				assert.Zero(t, result.RetryAfter)
+
+				backend.consume(t, algorithm, key, limit, 1)
+
+				result = backend.consume(t, algorithm, key, limit, 1)
+				assert.False(t, result.Allowed)
+				assert.Greater(t, result.RetryAfter, time.Duration(0))
+				assert.LessOrEqual(t, result.RetryAfter, 2*limit.Window)
+				assert.LessOrEqual(t, result.RetryAfter, result.ResetAfter)
+			})
+		}
+	}
+}
+
+func TestAlgorithms_ConsumeAll(t *testing.T) {
+	for _, backend := range newTestBackends(t) {
+		for _, name := range allAlgorithms {
+			t.Run(backend.name+"/"+name, func(t *testing.T) {
+				algorithm, err := limiter.NewAlgorithm(name)
+				require.NoError(t, err)
+
+				ctx := context.Background()
+				consumeAll := func(cost int) []storage.Outcome {
+					t.Helper()
+					outcomes, err := backend.store.ConsumeAll(ctx, algorithm, "all-"+name, []storage.ConsumeRequest{
+						{Key: "all-" + name + ":small", Limit: 2, Window: time.Minute, Cost: cost, Now: backend.clock.Now()},
+						{Key: "all-" + name + ":large", Limit: 5, Window: time.Minute, Cost: cost, Now: backend.clock.Now()},
+					})
+					require.NoError(t, err)
+					require.Len(t, outcomes, 2)
+					return outcomes
+				}
+
+				outcomes := consumeAll(2)
+				assert.True(t, outcomes[0].Allowed)
+				assert.True(t, outcomes[1].Allowed)
+				assert.Equal(t, 0, outcomes[0].Remaining)
+				assert.Equal(t, 3, outcomes[1].Remaining)
+
+				// The small key has no room left, so the large one is not counted either
+				outcomes = consumeAll(1)
+				assert.False(t, outcomes[0].Allowed)
+				assert.True(t, outcomes[1].Allowed)
+
+				outcomes = consumeAll(0)
+				assert.Equal(t, 0, outcomes[0].Remaining)
+				assert.Equal(t, 3, outcomes[1].Remaining)
+			})
+		}
+	}
+}
+
+func TestNewAlgorithm_Unknown(t *testing.T) {
+	_, err := limiter.NewAlgorithm("leaky")
+	assert.Error(t, err)
+}
+
+func TestRateLimiter_TokenAlgorithmOverride(t *testing.T) {
+	cfg := &config.Config{
+		RateLimit: config.RateLimitConfig{
+			Algorithm:              config.AlgorithmFixedWindow,
+			IPRequestsPerSecond:    1,
+			IPBlockDurationMinutes: 0,
+			TokenLimits: map[string]config.TokenLimit{
+				"bucket-token": {
+					RequestsPerSecond:    4,
+					BlockDurationMinutes: 0,
+					Algorithm:            config.AlgorithmTokenBucket,
+				},
+			},
+		},
+	}
+
+	store := storage.NewMemoryStorage()
+	defer store.Close()
+
+	rl := limiter.NewRateLimiter(store, cfg)
+	ctx := context.Background()
+
+	for i := 0; i < 4; i++ {
+		result, err := rl.CheckRequest(ctx, limiter.Key{IP: "10.0.0.1", Token: "bucket-token"})
+		require.NoError(t, err)
+		assert.True(t, result.Allowed, "request %d should be allowed", i+1)
+	}
+
+	result, err := rl.CheckRequest(ctx, limiter.Key{IP: "10.0.0.1", Token: "bucket-token"})
+	require.NoError(t, err)
+	assert.False(t, result.Allowed)
+
+	// The token bucket state lives under its own key, so the IP's fixed window is untouched
+	result, err = rl.CheckRequest(ctx, limiter.Key{IP: "10.0.0.1"})
+	require.NoError(t, err)
+	assert.True(t, result.Allowed)
+}
@@ -0,0 +1,261 @@
+package test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"rate-limiter/internal/audit"
+	"rate-limiter/internal/config"
+	"rate-limiter/internal/limiter"
+	"rate-limiter/internal/server"
+	"rate-limiter/internal/storage"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// memorySink keeps the events it is given
+type memorySink struct {
+	mu     sync.Mutex
+	events []audit.Event
+}
+
+func (s *memorySink) Write(ctx context.Context, event audit.Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, event)
+	return nil
+}
+
+// readAuditFile decodes the events of a JSON-lines audit file
+func readAuditFile(t *testing.T, path string) []audit.Event {
+	t.Helper()
+
+	file, err := os.Open(path)
+	require.NoError(t, err)
+	defer file.Close()
+
+	var events []audit.Event
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var event audit.Event
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &event))
+		events = append(events, event)
+	}
+	require.NoError(t, scanner.Err())
+	return events
+}
+
+func TestAudit_Sinks(t *testing.T) {
+	// Webhook
+	var (
+		mu       sync.Mutex
+		received [][]byte
+	)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+
+		mac := hmac.New(sha256.New, []byte("hook-secret"))
+		mac.Write(body)
+		assert.Equal(t, "sha256="+hex.EncodeToString(mac.Sum(nil)), r.Header.Get(audit.SignatureHeader))
+
+		mu.Lock()
+		received = append(received, body)
+		mu.Unlock()
+	}))
+	defer webhook.Close()
+
+	// Redis stream
+	redisServer := miniredis.RunT(t)
+	host, port, err := net.SplitHostPort(redisServer.Addr())
+	require.NoError(t, err)
+	redis, err := storage.NewRedisStorage(host, port, "", 0)
+	require.NoError(t, err)
+	defer redis.Close()
+
+	// JSON lines file
+	path := filepath.Join(t.TempDir(), "audit.log")
+	file, err := audit.NewFileSink(path)
+	require.NoError(t, err)
+
+	log := audit.New(10,
+		file,
+		audit.NewRedisStreamSink(redis, "rate-limiter:audit", 1000),
+		audit.NewWebhookSink(webhook.URL, []byte("hook-secret"), time.Second),
+	)
+
+	event := audit.Event{
+		Type:            audit.EventBlock,
+		Actor:           audit.System,
+		Key:             "policy:login:192.168.1.1",
+		KeyType:         limiter.KeyTypeIP,
+		Policy:          "login",
+		IP:              "192.168.1.1",
+		Limit:           5,
+		WindowSeconds:   60,
+		Cost:            1,
+		DurationSeconds: 900,
+	}
+	log.Record(event)
+	log.Record(audit.Event{Type: audit.EventUnblock, Actor: audit.Actor{Name: "alice", IP: "10.0.0.1"}, Key: "192.168.1.1"})
+
+	// Closing delivers what is queued
+	require.NoError(t, log.Close())
+	log.Record(audit.Event{Type: audit.EventBlock, Key: "ignored"})
+
+	events := readAuditFile(t, path)
+	require.Len(t, events, 2)
+	assert.False(t, events[0].Time.IsZero())
+	events[0].Time = time.Time{}
+	assert.Equal(t, event, events[0])
+	assert.Equal(t, audit.Actor{Name: "alice", IP: "10.0.0.1"}, events[1].Actor)
+
+	entries, err := redisServer.Stream("rate-limiter:audit")
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	assert.Equal(t, []string{"type", "block", "key", "policy:login:192.168.1.1"}, entries[0].Values[:4])
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, received, 2)
+	var posted audit.Event
+	require.NoError(t, json.Unmarshal(received[1], &posted))
+	assert.Equal(t, audit.EventUnblock, posted.Type)
+}
+
+func TestAudit_RateLimiter(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	defer store.Close()
+
+	cfg := &config.Config{
+		RateLimit: config.RateLimitConfig{
+			IPRequestsPerSecond:    1,
+			IPBlockDurationMinutes: 1,
+			TokenLimits:            map[string]config.TokenLimit{"abc123": {RequestsPerSecond: 10}},
+		},
+	}
+	rl := limiter.NewRateLimiter(store, cfg)
+	sink := &memorySink{}
+	log := audit.New(10, sink)
+	rl.SetAuditLog(log)
+	ctx := context.Background()
+
+	// Only the request that got the IP blocked is recorded, not those refused after
+	for i := 0; i < 3; i++ {
+		_, err := rl.CheckRequest(ctx, limiter.Key{IP: "192.168.1.1"})
+		require.NoError(t, err)
+	}
+
+	admin := audit.WithActor(ctx, audit.Actor{Name: "alice", IP: "10.0.0.1"})
+	require.NoError(t, rl.Unblock(admin, "192.168.1.1"))
+	require.NoError(t, rl.Block(admin, "policy:writes:abc123", time.Hour))
+	require.NoError(t, rl.SetTokenLimit(admin, "def456", config.TokenLimit{RequestsPerSecond: 20}))
+	assert.True(t, rl.DeleteTokenLimit(admin, "def456"))
+	assert.False(t, rl.DeleteTokenLimit(admin, "def456"))
+
+	require.NoError(t, log.Close())
+	require.Len(t, sink.events, 5)
+
+	block := sink.events[0]
+	assert.Equal(t, audit.EventBlock, block.Type)
+	assert.Equal(t, audit.System, block.Actor)
+	assert.Equal(t, "192.168.1.1", block.Key)
+	assert.Equal(t, limiter.KeyTypeIP, block.KeyType)
+	assert.Equal(t, "192.168.1.1", block.IP)
+	assert.Equal(t, 1, block.Limit)
+	assert.Equal(t, 1.0, block.WindowSeconds)
+	assert.Equal(t, 1, block.Cost)
+	assert.Equal(t, 60.0, block.DurationSeconds)
+	assert.Contains(t, block.Reason, "Rate limit exceeded")
+
+	assert.Equal(t, audit.EventUnblock, sink.events[1].Type)
+	assert.Equal(t, "alice", sink.events[1].Actor.Name)
+
+	manual := sink.events[2]
+	assert.Equal(t, audit.EventBlock, manual.Type)
+	assert.Equal(t, limiter.KeyTypeToken, manual.KeyType)
+	assert.Equal(t, "writes", manual.Policy)
+	assert.Equal(t, 3600.0, manual.DurationSeconds)
+
+	assert.Equal(t, audit.EventSetTokenLimit, sink.events[3].Type)
+	assert.Equal(t, 20, sink.events[3].Limit)
+	assert.Equal(t, audit.EventDeleteTokenLimit, sink.events[4].Type)
+}
+
+func TestAudit_Admin(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	path := filepath.Join(t.TempDir(), "audit.log")
+
+	cfg := &config.Config{
+		RateLimit: config.RateLimitConfig{IPRequestsPerSecond: 2, IPBlockDurationMinutes: 1},
+		Server:    config.ServerConfig{AdminToken: "secret"},
+		Audit:     config.AuditConfig{File: path},
+	}
+	store := storage.NewMemoryStorage()
+	defer store.Close()
+
+	srv, err := server.New(cfg, store)
+	require.NoError(t, err)
+
+	body, _ := json.Marshal(map[string]string{"type": "ip", "key": "192.168.1.1", "duration": "10m"})
+	req, _ := http.NewRequest("POST", "/admin/blocks", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer secret")
+	req.Header.Set(server.ActorHeader, "alice")
+	req.RemoteAddr = "10.0.0.1:12345"
+	w := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(w, req)
+	require.Equal(t, http.StatusCreated, w.Code)
+
+	// Events are written in the background
+	var events []audit.Event
+	require.Eventually(t, func() bool {
+		events = readAuditFile(t, path)
+		return len(events) == 1
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, audit.EventBlock, events[0].Type)
+	assert.Equal(t, audit.Actor{Name: "alice", IP: "10.0.0.1"}, events[0].Actor)
+	assert.Equal(t, "192.168.1.1", events[0].Key)
+	assert.Equal(t, 600.0, events[0].DurationSeconds)
+}
+
+func TestAudit_Config(t *testing.T) {
+	t.Setenv("AUDIT_FILE", "/var/log/rate-limiter/audit.log")
+	t.Setenv("AUDIT_WEBHOOK_URL", "https://hooks.example.com/audit")
+	t.Setenv("AUDIT_WEBHOOK_SECRET", "hook-secret")
+
+	cfg, err := config.Load()
+	require.NoError(t, err)
+	assert.True(t, cfg.Audit.Enabled())
+	assert.Equal(t, "https://hooks.example.com/audit", cfg.Audit.WebhookURL)
+	assert.Equal(t, 5*time.Second, cfg.Audit.WebhookTimeout)
+	assert.Equal(t, 1024, cfg.Audit.Buffer)
+
+	t.Setenv("AUDIT_WEBHOOK_URL", "hooks.example.com")
+	_, err = config.Load()
+	assert.ErrorContains(t, err, "AUDIT_WEBHOOK_URL: expected an http or https URL")
+
+	t.Setenv("AUDIT_WEBHOOK_URL", "https://hooks.example.com/audit")
+	t.Setenv("AUDIT_REDIS_STREAM", "rate-limiter:audit")
+	t.Setenv("STORAGE_BACKEND", config.StoragePeers)
+	t.Setenv("CLUSTER_PEERS", "http://10.0.0.1:8080")
+	t.Setenv("CLUSTER_SECRET", "secret")
+	_, err = config.Load()
+	assert.ErrorContains(t, err, "AUDIT_REDIS_STREAM needs the redis storage backend")
+}
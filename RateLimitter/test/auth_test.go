@@ -0,0 +1,237 @@
+package test
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"rate-limiter/internal/auth"
+	"rate-limiter/internal/config"
+	"rate-limiter/internal/limiter"
+	"rate-limiter/internal/middleware"
+	"rate-limiter/internal/storage"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	testJWTSecret    = []byte("jwt-secret")
+	testAPIKeySecret = []byte("api-key-secret")
+)
+
+// authConfig verifies signed tokens against a free tier of 2 requests per second and a
+// pro tier of 5 with a daily quota of 4
+func authConfig() *config.Config {
+	return &config.Config{
+		RateLimit: config.RateLimitConfig{
+			IPRequestsPerSecond: 1,
+			TokenLimits:         map[string]config.TokenLimit{"abc123": {RequestsPerSecond: 10}},
+			Tiers: map[string]config.TokenLimit{
+				"free": {RequestsPerSecond: 2},
+				"pro":  {RequestsPerSecond: 5, Quotas: map[string]int{config.QuotaDay: 4}},
+			},
+			Auth: config.TokenAuth{
+				JWTSecret:    testJWTSecret,
+				APIKeySecret: testAPIKeySecret,
+				PlanClaim:    config.DefaultPlanClaim,
+			},
+		},
+	}
+}
+
+// signJWT signs claims as an HS256 JWT
+func signJWT(t *testing.T, secret []byte, claims jwt.MapClaims) string {
+	t.Helper()
+
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(secret)
+	require.NoError(t, err)
+	return token
+}
+
+// signAPIKey issues an API key for claims
+func signAPIKey(t *testing.T, secret []byte, claims map[string]any) string {
+	t.Helper()
+
+	key, err := auth.SignAPIKey(secret, claims)
+	require.NoError(t, err)
+	return key
+}
+
+func TestTokenAuth_Verify(t *testing.T) {
+	settings := authConfig().RateLimit.Auth
+
+	claims, err := auth.Verify(settings, signJWT(t, testJWTSecret, jwt.MapClaims{"sub": "alice", "plan": "pro"}))
+	require.NoError(t, err)
+	assert.Equal(t, "alice", claims.Subject)
+	assert.Equal(t, "pro", claims.Plan)
+
+	claims, err = auth.Verify(settings, signAPIKey(t, testAPIKeySecret, map[string]any{"sub": "bob", "plan": "free"}))
+	require.NoError(t, err)
+	assert.Equal(t, "bob", claims.Subject)
+	assert.Equal(t, "free", claims.Plan)
+
+	for name, token := range map[string]string{
+		"JWT with another secret":     signJWT(t, []byte("other"), jwt.MapClaims{"sub": "alice", "plan": "pro"}),
+		"API key with another secret": signAPIKey(t, []byte("other"), map[string]any{"sub": "bob", "plan": "pro"}),
+		"expired JWT":                 signJWT(t, testJWTSecret, jwt.MapClaims{"sub": "alice", "plan": "pro", "exp": time.Now().Add(-time.Minute).Unix()}),
+		"expired API key":             signAPIKey(t, testAPIKeySecret, map[string]any{"sub": "bob", "plan": "pro", "exp": time.Now().Add(-time.Minute).Unix()}),
+		"JWT without subject":         signJWT(t, testJWTSecret, jwt.MapClaims{"plan": "pro"}),
+		"API key without plan":        signAPIKey(t, testAPIKeySecret, map[string]any{"sub": "bob"}),
+		"plain token":                 "not-signed",
+	} {
+		_, err := auth.Verify(settings, token)
+		assert.ErrorIs(t, err, auth.ErrInvalidToken, name)
+	}
+
+	// A tampered payload no longer matches its signature
+	key := signAPIKey(t, testAPIKeySecret, map[string]any{"sub": "bob", "plan": "free"})
+	forged := signAPIKey(t, testAPIKeySecret, map[string]any{"sub": "bob", "plan": "enterprise"})
+	payload, _, _ := strings.Cut(forged, ".")
+	_, signature, _ := strings.Cut(key, ".")
+	_, err = auth.Verify(settings, payload+"."+signature)
+	assert.ErrorContains(t, err, "signature is invalid")
+
+	// Tokens without a plan get the default one when set
+	settings.DefaultPlan = "free"
+	claims, err = auth.Verify(settings, signJWT(t, testJWTSecret, jwt.MapClaims{"sub": "carol"}))
+	require.NoError(t, err)
+	assert.Equal(t, "free", claims.Plan)
+}
+
+func TestTokenAuth_RateLimiter(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	defer store.Close()
+	rl := limiter.NewRateLimiter(store, authConfig())
+	ctx := context.Background()
+
+	// Every token of a subject shares its limits, from the tier of its plan
+	tokens := []string{
+		signJWT(t, testJWTSecret, jwt.MapClaims{"sub": "alice", "plan": "free"}),
+		signAPIKey(t, testAPIKeySecret, map[string]any{"sub": "alice", "plan": "free"}),
+	}
+	for i := 0; i < 3; i++ {
+		result, err := rl.CheckRequest(ctx, limiter.Key{IP: "192.168.1.1", Token: tokens[i%2]})
+		require.NoError(t, err)
+		assert.Equal(t, limiter.KeyTypeToken, result.KeyType)
+		assert.Equal(t, 2, result.Limit)
+		assert.Equal(t, i < 2, result.Allowed, "request %d", i+1)
+	}
+
+	// Tiers bring their quotas along
+	pro := signJWT(t, testJWTSecret, jwt.MapClaims{"sub": "bob", "plan": "pro"})
+	result, err := rl.CheckRequest(ctx, limiter.Key{IP: "192.168.1.2", Token: pro})
+	require.NoError(t, err)
+	assert.True(t, result.Allowed)
+	assert.Equal(t, 5, result.Limit)
+	require.Len(t, result.Quotas, 1)
+	assert.Equal(t, 3, result.Quotas[0].Remaining)
+
+	// Listed tokens keep their own limits
+	result, err = rl.CheckRequest(ctx, limiter.Key{IP: "192.168.1.3", Token: "abc123"})
+	require.NoError(t, err)
+	assert.Equal(t, 10, result.Limit)
+
+	// Anything else is refused rather than limited by IP
+	for _, token := range []string{
+		"unknown",
+		signJWT(t, []byte("other"), jwt.MapClaims{"sub": "mallory", "plan": "pro"}),
+		signJWT(t, testJWTSecret, jwt.MapClaims{"sub": "mallory", "plan": "enterprise"}),
+	} {
+		result, err := rl.CheckRequest(ctx, limiter.Key{IP: "192.168.1.4", Token: token})
+		require.NoError(t, err)
+		assert.False(t, result.Allowed)
+		assert.True(t, result.Unauthenticated)
+		assert.Contains(t, result.Reason, "Invalid token: ")
+	}
+
+	// Without verification, unknown tokens are still limited by IP
+	rl.UpdateLimits(config.RateLimitConfig{IPRequestsPerSecond: 1})
+	result, err = rl.CheckRequest(ctx, limiter.Key{IP: "192.168.1.5", Token: "unknown"})
+	require.NoError(t, err)
+	assert.True(t, result.Allowed)
+	assert.Equal(t, limiter.KeyTypeIP, result.KeyType)
+}
+
+func TestTokenAuth_Middleware(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	defer store.Close()
+	rl := limiter.NewRateLimiter(store, authConfig())
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(middleware.RateLimiterMiddleware(rl))
+	router.GET("/test", func(c *gin.Context) {
+		c.JSON(200, gin.H{"message": "success"})
+	})
+
+	request := func(token string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/test", nil)
+		req.RemoteAddr = "192.168.1.1:12345"
+		req.Header.Set("API_KEY", token)
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := request(signAPIKey(t, testAPIKeySecret, map[string]any{"sub": "alice", "plan": "pro"}))
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "5", w.Header().Get("RateLimit-Limit"))
+
+	w = request(signAPIKey(t, []byte("other"), map[string]any{"sub": "alice", "plan": "pro"}))
+	assert.Equal(t, 401, w.Code)
+	assert.Contains(t, w.Body.String(), "signature is invalid")
+}
+
+func TestTokenAuth_Config(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKIXPublicKey(public)
+	require.NoError(t, err)
+	keyFile := writePolicyFile(t, "jwt.pem", string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})))
+
+	t.Setenv("RATE_LIMIT_JWT_PUBLIC_KEY_FILE", keyFile)
+	t.Setenv("RATE_LIMIT_JWT_ISSUER", "https://auth.example.com")
+	t.Setenv("RATE_LIMIT_PLAN_CLAIM", "tier")
+
+	_, err = config.Load()
+	assert.ErrorContains(t, err, "signed tokens need at least one tier")
+
+	t.Setenv("TIER_LIMIT_free", "2:1")
+	t.Setenv("TIER_QUOTA_free", "1000/day")
+	t.Setenv("RATE_LIMIT_POLICIES_FILE", writePolicyFile(t, "policies.yaml", "tiers:\n  pro: {requests_per_second: 50, block_duration_minutes: 1}\n"))
+
+	cfg, err := config.Load()
+	require.NoError(t, err)
+	assert.Equal(t, config.TokenLimit{RequestsPerSecond: 2, BlockDurationMinutes: 1, Quotas: map[string]int{config.QuotaDay: 1000}}, cfg.RateLimit.Tiers["free"])
+	assert.Equal(t, config.TokenLimit{RequestsPerSecond: 50, BlockDurationMinutes: 1}, cfg.RateLimit.Tiers["pro"])
+	assert.True(t, cfg.RateLimit.Auth.Enabled())
+
+	token, err := jwt.NewWithClaims(jwt.SigningMethodEdDSA, jwt.MapClaims{"sub": "alice", "tier": "pro", "iss": "https://auth.example.com"}).SignedString(private)
+	require.NoError(t, err)
+	claims, err := auth.Verify(cfg.RateLimit.Auth, token)
+	require.NoError(t, err)
+	assert.Equal(t, "alice", claims.Subject)
+	assert.Equal(t, "pro", claims.Plan)
+
+	// The issuer is checked, and HMAC JWTs are not accepted without a secret
+	token, err = jwt.NewWithClaims(jwt.SigningMethodEdDSA, jwt.MapClaims{"sub": "alice", "tier": "pro", "iss": "elsewhere"}).SignedString(private)
+	require.NoError(t, err)
+	_, err = auth.Verify(cfg.RateLimit.Auth, token)
+	assert.ErrorIs(t, err, auth.ErrInvalidToken)
+	_, err = auth.Verify(cfg.RateLimit.Auth, signJWT(t, testJWTSecret, jwt.MapClaims{"sub": "alice", "tier": "pro", "iss": "https://auth.example.com"}))
+	assert.ErrorIs(t, err, auth.ErrInvalidToken)
+
+	t.Setenv("RATE_LIMIT_DEFAULT_PLAN", "enterprise")
+	_, err = config.Load()
+	assert.ErrorContains(t, err, "default plan enterprise has no tier")
+}
@@ -0,0 +1,139 @@
+package test
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"rate-limiter/internal/clock"
+	"rate-limiter/internal/config"
+	"rate-limiter/internal/limiter"
+	"rate-limiter/internal/metrics"
+	"rate-limiter/internal/middleware"
+	"rate-limiter/internal/storage"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newBreaker returns a circuit breaker around a Redis storage on miniredis, timing its
+// cooldown with the returned clock
+func newBreaker(t *testing.T, failOpen bool) (*storage.CircuitBreaker, *miniredis.Miniredis, *clock.Fake) {
+	t.Helper()
+
+	server := miniredis.RunT(t)
+	host, port, err := net.SplitHostPort(server.Addr())
+	require.NoError(t, err)
+
+	clock := clock.NewFake(testStart)
+	breaker := storage.NewCircuitBreaker(storage.DialRedis(host, port, "", 0), storage.BreakerOptions{
+		FailOpen:  failOpen,
+		Threshold: 2,
+		Cooldown:  100 * time.Millisecond,
+		Clock:     clock,
+	})
+	t.Cleanup(func() { breaker.Close() })
+
+	return breaker, server, clock
+}
+
+func TestCircuitBreaker_FailOpen(t *testing.T) {
+	breaker, server, clock := newBreaker(t, true)
+	ctx := context.Background()
+
+	require.NoError(t, breaker.Block(ctx, "192.168.1.1", time.Minute))
+	assert.True(t, server.Exists("block:192.168.1.1"))
+
+	server.SetError("LOADING Redis is loading the dataset in memory")
+	fallbacks := testutil.ToFloat64(metrics.FailOpen.WithLabelValues("circuit_open"))
+
+	// Errors are absorbed by the in-memory fallback until the circuit opens
+	for i := 0; i < 2; i++ {
+		blocked, err := breaker.IsBlocked(ctx, "192.168.1.1")
+		require.NoError(t, err)
+		assert.False(t, blocked, "the fallback does not know about Redis blocks")
+	}
+	assert.True(t, breaker.Degraded())
+
+	// The degraded limiter still limits
+	limit := limiter.Limit{Requests: 2, Window: time.Minute}
+	consume(t, breaker, limiter.FixedWindow{}, "10.0.0.1", limit, 1)
+	consume(t, breaker, limiter.FixedWindow{}, "10.0.0.1", limit, 1)
+	assert.False(t, consume(t, breaker, limiter.FixedWindow{}, "10.0.0.1", limit, 1).Allowed)
+	assert.Equal(t, fallbacks+3, testutil.ToFloat64(metrics.FailOpen.WithLabelValues("circuit_open")))
+
+	// Admin changes and lease releases would be lost in the fallback, so they fail
+	assert.ErrorIs(t, breaker.Block(ctx, "10.0.0.2", time.Minute), storage.ErrUnavailable)
+	assert.ErrorIs(t, breaker.Unblock(ctx, "192.168.1.1"), storage.ErrUnavailable)
+	assert.ErrorIs(t, breaker.ResetCounter(ctx, limiter.FixedWindow{}, "10.0.0.1"), storage.ErrUnavailable)
+	assert.ErrorIs(t, breaker.ReleaseLease(ctx, "export", "a"), storage.ErrUnavailable)
+	assert.False(t, consume(t, breaker, limiter.FixedWindow{}, "10.0.0.1", limit, 1).Allowed, "the fallback counter was not reset")
+
+	// Redis is used again once it recovers and the cooldown has passed
+	server.SetError("")
+	clock.Advance(150 * time.Millisecond)
+
+	blocked, err := breaker.IsBlocked(ctx, "192.168.1.1")
+	require.NoError(t, err)
+	assert.True(t, blocked)
+	assert.False(t, breaker.Degraded())
+}
+
+func TestCircuitBreaker_FailedProbe(t *testing.T) {
+	breaker, server, clock := newBreaker(t, true)
+	ctx := context.Background()
+
+	breaker.Trip()
+	server.SetError("ERR still down")
+	clock.Advance(150 * time.Millisecond)
+
+	// The probe fails, so the circuit opens for another cooldown
+	_, err := breaker.IsBlocked(ctx, "192.168.1.1")
+	require.NoError(t, err)
+	assert.True(t, breaker.Degraded())
+
+	server.SetError("")
+	_, err = breaker.IsBlocked(ctx, "192.168.1.1")
+	require.NoError(t, err)
+	assert.True(t, breaker.Degraded(), "Redis is not tried again before the cooldown")
+
+	clock.Advance(150 * time.Millisecond)
+	_, err = breaker.IsBlocked(ctx, "192.168.1.1")
+	require.NoError(t, err)
+	assert.False(t, breaker.Degraded())
+}
+
+func TestCircuitBreaker_FailClosed(t *testing.T) {
+	breaker, server, _ := newBreaker(t, false)
+	ctx := context.Background()
+
+	server.SetError("ERR down")
+
+	_, err := breaker.IsBlocked(ctx, "192.168.1.1")
+	assert.ErrorIs(t, err, storage.ErrUnavailable)
+
+	_, err = breaker.IsBlocked(ctx, "192.168.1.1")
+	assert.ErrorIs(t, err, storage.ErrUnavailable)
+	assert.True(t, breaker.Degraded())
+
+	// Requests are refused with 503 rather than a server error
+	gin.SetMode(gin.TestMode)
+	cfg := &config.Config{RateLimit: config.RateLimitConfig{IPRequestsPerSecond: 5, IPBlockDurationMinutes: 1}}
+	router := gin.New()
+	router.Use(middleware.RateLimiterMiddleware(limiter.NewRateLimiter(breaker, cfg)))
+	router.GET("/test", func(c *gin.Context) { c.String(200, "ok") })
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/test", nil)
+	req.RemoteAddr = "192.168.1.1:1234"
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "1", w.Header().Get("Retry-After"))
+}
@@ -0,0 +1,171 @@
+package test
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"testing"
+
+	"rate-limiter/internal/config"
+	"rate-limiter/internal/middleware"
+	"rate-limiter/internal/server"
+
+	"github.com/pires/go-proxyproto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientIP(t *testing.T) {
+	trusted := []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/8"),
+		netip.MustParsePrefix("2001:db8:ffff::/48"),
+	}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		// header is the configured client IP header, X-Forwarded-For when empty
+		header  string
+		headers map[string][]string
+		want    string
+	}{
+		{"no headers", "203.0.113.1:1234", "", nil, "203.0.113.1"},
+		{"untrusted caller spoofing XFF", "203.0.113.1:1234", "", map[string][]string{"X-Forwarded-For": {"1.2.3.4"}}, "203.0.113.1"},
+		{"untrusted caller spoofing Forwarded", "203.0.113.1:1234", "", map[string][]string{"Forwarded": {"for=1.2.3.4"}}, "203.0.113.1"},
+		{"trusted proxy", "10.0.0.1:1234", "", map[string][]string{"X-Forwarded-For": {"198.51.100.7"}}, "198.51.100.7"},
+		{"client prepends a fake hop", "10.0.0.1:1234", "", map[string][]string{"X-Forwarded-For": {"1.2.3.4, 198.51.100.7"}}, "198.51.100.7"},
+		{"chain of trusted proxies", "10.0.0.1:1234", "", map[string][]string{"X-Forwarded-For": {"1.2.3.4, 198.51.100.7, 10.1.1.1", "10.2.2.2"}}, "198.51.100.7"},
+		{"only trusted hops", "10.0.0.1:1234", "", map[string][]string{"X-Forwarded-For": {"10.1.1.1, 10.2.2.2"}}, "10.1.1.1"},
+		{"malformed hop", "10.0.0.1:1234", "", map[string][]string{"X-Forwarded-For": {"198.51.100.7, garbage, 10.2.2.2"}}, "10.2.2.2"},
+		{"X-Real-IP from trusted proxy", "10.0.0.1:1234", config.ClientIPHeaderXRealIP, map[string][]string{"X-Real-Ip": {"198.51.100.7"}, "X-Forwarded-For": {"1.2.3.4"}}, "198.51.100.7"},
+		{"client spoofing Forwarded through an XFF proxy", "10.0.0.1:1234", "", map[string][]string{
+			"Forwarded":       {"for=1.2.3.4"},
+			"X-Forwarded-For": {"198.51.100.7"},
+		}, "198.51.100.7"},
+		{"client spoofing XFF through a Forwarded proxy", "10.0.0.1:1234", config.ClientIPHeaderForwarded, map[string][]string{
+			"Forwarded":       {"for=192.0.2.60;proto=http;by=203.0.113.43"},
+			"X-Forwarded-For": {"1.2.3.4"},
+		}, "192.0.2.60"},
+		{"Forwarded with port and IPv6", "10.0.0.1:1234", config.ClientIPHeaderForwarded, map[string][]string{"Forwarded": {`for="192.0.2.60:4711", For="[2001:db8:cafe::17]:4711"`}}, "2001:db8:cafe::17"},
+		{"Forwarded obfuscated node", "10.0.0.1:1234", config.ClientIPHeaderForwarded, map[string][]string{"Forwarded": {"for=192.0.2.60, for=_hidden"}}, "10.0.0.1"},
+		{"IPv6 trusted proxy", "[2001:db8:ffff::1]:443", "", map[string][]string{"X-Forwarded-For": {"2001:db8:1::5"}}, "2001:db8:1::5"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest("GET", "/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			for key, values := range tt.headers {
+				for _, value := range values {
+					req.Header.Add(key, value)
+				}
+			}
+
+			assert.Equal(t, tt.want, middleware.ClientIP(req, trusted, tt.header))
+		})
+	}
+
+	// Without trusted proxies forwarding headers are ignored
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.Header.Set("X-Forwarded-For", "198.51.100.7")
+	assert.Equal(t, "10.0.0.1", middleware.ClientIP(req, nil, ""))
+}
+
+// serveClientIP serves the client IP seen by the middleware on a PROXY protocol listener
+func serveClientIP(t *testing.T, trusted []netip.Prefix) net.Addr {
+	t.Helper()
+
+	listener, err := server.Listen(config.ServerConfig{Port: "0", ProxyProtocol: true, TrustedProxies: trusted})
+	require.NoError(t, err)
+
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, middleware.ClientIP(r, trusted, ""))
+	})}
+	go srv.Serve(listener)
+	t.Cleanup(func() { srv.Close() })
+
+	return listener.Addr()
+}
+
+// getThroughProxy sends a request preceded by a PROXY header claiming the given source
+func getThroughProxy(t *testing.T, addr net.Addr, version byte, source string) (string, error) {
+	t.Helper()
+
+	_, port, _ := net.SplitHostPort(addr.String())
+	conn, err := net.Dial("tcp", "127.0.0.1:"+port)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	header := proxyproto.HeaderProxyFromAddrs(version,
+		&net.TCPAddr{IP: net.ParseIP(source), Port: 5000},
+		&net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 8080},
+	)
+	_, err = header.WriteTo(conn)
+	require.NoError(t, err)
+
+	_, err = fmt.Fprint(conn, "GET / HTTP/1.1\r\nHost: test\r\nConnection: close\r\n\r\n")
+	require.NoError(t, err)
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	return string(body), err
+}
+
+func TestListen_ProxyProtocol(t *testing.T) {
+	addr := serveClientIP(t, []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")})
+
+	// Both header versions replace the peer address
+	for _, version := range []byte{1, 2} {
+		ip, err := getThroughProxy(t, addr, version, "198.51.100.7")
+		require.NoError(t, err)
+		assert.Equal(t, "198.51.100.7", ip, "PROXY protocol v%d", version)
+	}
+}
+
+func TestListen_ProxyProtocolUntrusted(t *testing.T) {
+	// A PROXY header from a peer that is not a trusted proxy is ignored and the
+	// connection keeps its own address, whether or not any proxy is trusted
+	for _, trusted := range [][]netip.Prefix{{netip.MustParsePrefix("10.0.0.0/8")}, nil} {
+		addr := serveClientIP(t, trusted)
+
+		ip, err := getThroughProxy(t, addr, 1, "198.51.100.7")
+		require.NoError(t, err)
+		assert.Equal(t, "127.0.0.1", ip, "trusted proxies %v", trusted)
+	}
+}
+
+func TestClientIP_Config(t *testing.T) {
+	cfg, err := config.Load()
+	require.NoError(t, err)
+	assert.Equal(t, config.ClientIPHeaderXForwardedFor, cfg.Server.ClientIPHeader)
+
+	t.Setenv("SERVER_CLIENT_IP_HEADER", "forwarded")
+	cfg, err = config.Load()
+	require.NoError(t, err)
+	assert.Equal(t, config.ClientIPHeaderForwarded, cfg.Server.ClientIPHeader)
+
+	t.Setenv("SERVER_CLIENT_IP_HEADER", "X-Client-IP")
+	_, err = config.Load()
+	assert.ErrorContains(t, err, "SERVER_CLIENT_IP_HEADER: expected X-Forwarded-For, Forwarded or X-Real-IP")
+}
+
+func TestListen_ProxyProtocolConfig(t *testing.T) {
+	// PROXY protocol without trusted proxies would let nobody set the client IP
+	t.Setenv("SERVER_PROXY_PROTOCOL", "true")
+	_, err := config.Load()
+	assert.ErrorContains(t, err, "SERVER_PROXY_PROTOCOL requires SERVER_TRUSTED_PROXIES")
+
+	t.Setenv("SERVER_TRUSTED_PROXIES", "10.0.0.0/8")
+	cfg, err := config.Load()
+	require.NoError(t, err)
+	assert.True(t, cfg.Server.ProxyProtocol)
+}
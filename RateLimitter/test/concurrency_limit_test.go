@@ -0,0 +1,190 @@
+package test
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"rate-limiter/internal/clock"
+	"rate-limiter/internal/config"
+	"rate-limiter/internal/limiter"
+	"rate-limiter/internal/middleware"
+	"rate-limiter/internal/storage"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// concurrencyConfig allows two exports in flight per client
+func concurrencyConfig() *config.Config {
+	return &config.Config{
+		RateLimit: config.RateLimitConfig{
+			IPRequestsPerSecond: 100,
+			TokenLimits:         map[string]config.TokenLimit{"abc123": {RequestsPerSecond: 100}},
+			ConcurrencyPolicies: []config.ConcurrencyPolicy{
+				{Name: "export", Paths: []string{"/export"}, Limit: 2, LeaseTTL: time.Minute},
+			},
+		},
+	}
+}
+
+func TestConcurrencyLimiter_Middleware(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	defer store.Close()
+	rl := limiter.NewRateLimiter(store, concurrencyConfig())
+
+	started := make(chan struct{}, 4)
+	finish := make(chan struct{})
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(middleware.RateLimiterMiddleware(rl), middleware.ConcurrencyLimiterMiddleware(rl))
+	router.GET("/export", func(c *gin.Context) {
+		started <- struct{}{}
+		<-finish
+		c.JSON(200, gin.H{"message": "success"})
+	})
+	router.GET("/ping", func(c *gin.Context) {
+		c.JSON(200, gin.H{"message": "success"})
+	})
+
+	request := func(path, token string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", path, nil)
+		req.RemoteAddr = "192.168.1.1:12345"
+		if token != "" {
+			req.Header.Set("API_KEY", token)
+		}
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.Equal(t, 200, request("/export", "").Code)
+		}()
+		<-started
+	}
+
+	// Both slots of the IP are taken
+	w := request("/export", "")
+	assert.Equal(t, 429, w.Code)
+	assert.Equal(t, "1", w.Header().Get("Retry-After"))
+	assert.Contains(t, w.Body.String(), "Concurrency limit exceeded: 2 requests in flight")
+
+	// Routes without a concurrency policy and known tokens are not affected
+	assert.Equal(t, 200, request("/ping", "").Code)
+	token := make(chan int)
+	go func() { token <- request("/export", "abc123").Code }()
+	<-started
+
+	// Slots are freed when the handlers return
+	close(finish)
+	wg.Wait()
+	assert.Equal(t, 200, <-token)
+	assert.Equal(t, 200, request("/export", "").Code)
+}
+
+func TestConcurrencyLimiter_Leases(t *testing.T) {
+	server := miniredis.RunT(t)
+	host, port, err := net.SplitHostPort(server.Addr())
+	require.NoError(t, err)
+
+	store, err := storage.NewRedisStorage(host, port, "", 0)
+	require.NoError(t, err)
+	defer store.Close()
+	ctx := context.Background()
+
+	now := time.Now()
+	req := storage.LeaseRequest{Key: "export", ID: "a", Limit: 1, TTL: time.Minute, Now: now}
+
+	result, err := store.AcquireLease(ctx, req)
+	require.NoError(t, err)
+	assert.True(t, result.Acquired)
+	assert.Equal(t, 1, result.InFlight)
+	assert.Greater(t, server.TTL("lease:export"), time.Duration(0))
+
+	// Renewing a lease keeps its slot
+	result, err = store.AcquireLease(ctx, req)
+	require.NoError(t, err)
+	assert.True(t, result.Acquired)
+	assert.Equal(t, 1, result.InFlight)
+
+	other := req
+	other.ID = "b"
+	result, err = store.AcquireLease(ctx, other)
+	require.NoError(t, err)
+	assert.False(t, result.Acquired)
+
+	// A lease that was not renewed, as when its instance crashed, frees its slot
+	other.Now = now.Add(2 * time.Minute)
+	result, err = store.AcquireLease(ctx, other)
+	require.NoError(t, err)
+	assert.True(t, result.Acquired)
+	assert.Equal(t, 1, result.InFlight)
+
+	require.NoError(t, store.ReleaseLease(ctx, "export", "b"))
+	assert.False(t, server.Exists("lease:export"))
+}
+
+func TestConcurrencyLimiter_Renewal(t *testing.T) {
+	clock := clock.NewFake(testStart)
+	store := storage.NewMemoryStorageWithClock(clock)
+	defer store.Close()
+
+	cfg := concurrencyConfig()
+	cfg.RateLimit.ConcurrencyPolicies[0].Limit = 1
+	cfg.RateLimit.ConcurrencyPolicies[0].LeaseTTL = 60 * time.Millisecond
+	rl := limiter.NewRateLimiter(store, cfg)
+	rl.SetClock(clock)
+	policy := rl.MatchConcurrency("GET", "/export", "/export", "")
+	require.NotNil(t, policy)
+	ctx := context.Background()
+
+	held, err := rl.Acquire(ctx, policy, "192.168.1.1", "")
+	require.NoError(t, err)
+	require.True(t, held.Acquired)
+
+	// The lease outlives its TTL while it is held, renewed every 20ms
+	for range 10 {
+		clock.Advance(20 * time.Millisecond)
+	}
+	result, err := rl.Acquire(ctx, policy, "192.168.1.1", "")
+	require.NoError(t, err)
+	assert.False(t, result.Acquired)
+
+	require.NoError(t, held.Lease.Release(ctx))
+	require.NoError(t, held.Lease.Release(ctx))
+
+	result, err = rl.Acquire(ctx, policy, "192.168.1.1", "")
+	require.NoError(t, err)
+	assert.True(t, result.Acquired)
+	require.NoError(t, result.Lease.Release(ctx))
+}
+
+func TestConcurrencyLimiter_Config(t *testing.T) {
+	t.Setenv("RATE_LIMIT_CONCURRENCY_export", "methods=GET;paths=/api/export/**;limit=2;lease=10s")
+	t.Setenv("RATE_LIMIT_POLICIES_FILE", writePolicyFile(t, "policies.yaml", "concurrency:\n  - {name: reports, paths: [/api/reports], limit: 1}\n"))
+
+	cfg, err := config.Load()
+	require.NoError(t, err)
+	require.Len(t, cfg.RateLimit.ConcurrencyPolicies, 2)
+	assert.Equal(t, config.ConcurrencyPolicy{Name: "reports", Paths: []string{"/api/reports"}, Limit: 1, LeaseTTL: config.DefaultLeaseTTL}, cfg.RateLimit.ConcurrencyPolicies[0])
+	assert.Equal(t, config.ConcurrencyPolicy{Name: "export", Methods: []string{"GET"}, Paths: []string{"/api/export/**"}, Limit: 2, LeaseTTL: 10 * time.Second}, cfg.RateLimit.ConcurrencyPolicies[1])
+
+	t.Setenv("RATE_LIMIT_CONCURRENCY_export", "paths=/api/export/**")
+	_, err = config.Load()
+	assert.ErrorContains(t, err, "concurrency policy export: limit must be positive")
+
+	_, err = config.ParsePolicyFile([]byte("concurrency:\n  - {name: reports, limit: 1, lease: soon}\n"), false)
+	assert.ErrorContains(t, err, "invalid lease")
+}
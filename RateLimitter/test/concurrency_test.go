@@ -0,0 +1,109 @@
+package test
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"rate-limiter/internal/config"
+	"rate-limiter/internal/limiter"
+	"rate-limiter/internal/storage"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	parallelClients   = 20
+	requestsPerClient = 25
+	concurrentLimit   = 100
+)
+
+// runParallelClients fires requests from parallel clients and returns how many were allowed
+func runParallelClients(t *testing.T, check func(client int) bool) int {
+	t.Helper()
+
+	var allowed int64
+	var wg sync.WaitGroup
+
+	for client := 0; client < parallelClients; client++ {
+		wg.Add(1)
+		go func(client int) {
+			defer wg.Done()
+			for i := 0; i < requestsPerClient; i++ {
+				if check(client) {
+					atomic.AddInt64(&allowed, 1)
+				}
+			}
+		}(client)
+	}
+
+	wg.Wait()
+	return int(allowed)
+}
+
+func TestConsume_NeverExceedsLimitConcurrently(t *testing.T) {
+	// A long window keeps refills and window changes out of the count
+	limit := limiter.Limit{Requests: concurrentLimit, Window: time.Hour}
+
+	for _, backend := range newTestBackends(t) {
+		for _, name := range allAlgorithms {
+			t.Run(backend.name+"/"+name, func(t *testing.T) {
+				algorithm, err := limiter.NewAlgorithm(name)
+				require.NoError(t, err)
+
+				key := "concurrent-" + name
+
+				allowed := runParallelClients(t, func(int) bool {
+					result, err := backend.store.Consume(context.Background(), algorithm, storage.ConsumeRequest{
+						Key:    key,
+						Limit:  limit.Requests,
+						Window: limit.Window,
+						Cost:   1,
+						Now:    backend.clock.Now(),
+					})
+					return assert.NoError(t, err) && result.Allowed
+				})
+
+				assert.Equal(t, concurrentLimit, allowed)
+			})
+		}
+	}
+}
+
+func TestRateLimiter_SharedRedisAcrossReplicas(t *testing.T) {
+	server := miniredis.RunT(t)
+	host, port, err := net.SplitHostPort(server.Addr())
+	require.NoError(t, err)
+
+	cfg := &config.Config{
+		RateLimit: config.RateLimitConfig{
+			Algorithm:              config.AlgorithmFixedWindow,
+			IPRequestsPerSecond:    concurrentLimit,
+			IPBlockDurationMinutes: 1,
+			TokenLimits:            make(map[string]config.TokenLimit),
+		},
+	}
+
+	// Every client is a separate replica with its own Redis connection pool
+	replicas := make([]*limiter.RateLimiter, parallelClients)
+	for i := range replicas {
+		store, err := storage.NewRedisStorage(host, port, "", 0)
+		require.NoError(t, err)
+		t.Cleanup(func() { store.Close() })
+
+		replicas[i] = limiter.NewRateLimiter(store, cfg)
+	}
+
+	allowed := runParallelClients(t, func(client int) bool {
+		result, err := replicas[client].CheckRequest(context.Background(), limiter.Key{IP: "203.0.113.7"})
+		return assert.NoError(t, err) && result.Allowed
+	})
+
+	// The first denial blocks the IP, so a new window cannot let more requests in
+	assert.Equal(t, concurrentLimit, allowed)
+}
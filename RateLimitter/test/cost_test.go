@@ -0,0 +1,192 @@
+package test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"rate-limiter/internal/config"
+	"rate-limiter/internal/limiter"
+	"rate-limiter/internal/middleware"
+	"rate-limiter/internal/storage"
+
+	ratelimitv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/common/ratelimit/v3"
+	rls "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+func TestCost_Remaining(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	defer store.Close()
+
+	rl := limiter.NewRateLimiter(store, &config.Config{
+		RateLimit: config.RateLimitConfig{IPRequestsPerSecond: 100, IPBlockDurationMinutes: 1},
+	})
+	ctx := limiter.WithCost(context.Background(), 40)
+
+	result, err := rl.CheckRequest(ctx, limiter.Key{IP: "192.168.1.1"})
+	require.NoError(t, err)
+	assert.True(t, result.Allowed)
+	assert.Equal(t, 40, result.Cost)
+	assert.Equal(t, 60, result.Remaining)
+
+	result, err = rl.CheckRequest(ctx, limiter.Key{IP: "192.168.1.1"})
+	require.NoError(t, err)
+	assert.True(t, result.Allowed)
+	assert.Equal(t, 20, result.Remaining)
+
+	// 20 requests are left, not enough for another 40
+	result, err = rl.CheckRequest(ctx, limiter.Key{IP: "192.168.1.1"})
+	require.NoError(t, err)
+	assert.False(t, result.Allowed)
+
+	// A request costing more than the limit can never be allowed
+	result, err = rl.CheckRequest(limiter.WithCost(context.Background(), 500), limiter.Key{IP: "192.168.1.2"})
+	require.NoError(t, err)
+	assert.False(t, result.Allowed)
+	assert.Equal(t, "Rate limit exceeded: request costs 500, limit is 100 requests per second", result.Reason)
+	assert.False(t, result.Blocked)
+
+	// and neither blocks the key nor counts as an offense
+	result, err = rl.CheckRequest(context.Background(), limiter.Key{IP: "192.168.1.2"})
+	require.NoError(t, err)
+	assert.True(t, result.Allowed)
+	assert.Equal(t, 99, result.Remaining)
+	assert.Zero(t, result.Offenses)
+
+	blocked, err := store.IsBlocked(context.Background(), "192.168.1.2")
+	require.NoError(t, err)
+	assert.False(t, blocked)
+}
+
+func TestCost_Policies(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	defer store.Close()
+
+	cfg := &config.Config{
+		RateLimit: config.RateLimitConfig{
+			IPRequestsPerSecond: 100,
+			Policies: []config.Policy{
+				{Name: "export", Paths: []string{"/export"}, Cost: 50, CostOnly: true},
+				{Name: "search", Paths: []string{"/search"}, Requests: 10, Window: time.Minute, Cost: 5},
+			},
+		},
+	}
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(middleware.RateLimiterMiddleware(limiter.NewRateLimiter(store, cfg)))
+	for _, path := range []string{"/ping", "/export", "/search"} {
+		router.GET(path, func(c *gin.Context) {
+			c.JSON(200, gin.H{"message": "success"})
+		})
+	}
+
+	request := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", path, nil)
+		req.RemoteAddr = "192.168.1.1:12345"
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	// Cost only policies count against the IP limit
+	w := request("/ping")
+	assert.Equal(t, "99", w.Header().Get("RateLimit-Remaining"))
+	w = request("/export")
+	assert.Equal(t, "49", w.Header().Get("RateLimit-Remaining"))
+	w = request("/ping")
+	assert.Equal(t, "48", w.Header().Get("RateLimit-Remaining"))
+	w = request("/export")
+	assert.Equal(t, 429, w.Code)
+
+	// A policy with a limit counts its cost against its own limit
+	w = request("/search")
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "10", w.Header().Get("RateLimit-Limit"))
+	assert.Equal(t, "5", w.Header().Get("RateLimit-Remaining"))
+}
+
+func TestCost_Context(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	defer store.Close()
+
+	cfg := quotaConfig()
+	cfg.RateLimit.Policies = []config.Policy{{Name: "export", Paths: []string{"/export"}, Cost: 50, CostOnly: true}}
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(middleware.Cost(2), middleware.RateLimiterMiddleware(limiter.NewRateLimiter(store, cfg)))
+	router.GET("/export", func(c *gin.Context) {
+		c.JSON(200, gin.H{"message": "success"})
+	})
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/export", nil)
+	req.RemoteAddr = "192.168.1.1:12345"
+	req.Header.Set("API_KEY", "paid")
+	router.ServeHTTP(w, req)
+
+	// The cost set by the handler chain wins over the policy, and is counted against
+	// the quotas too
+	require.Equal(t, 200, w.Code)
+	assert.Equal(t, "8", w.Header().Get("RateLimit-Remaining"))
+	assert.Equal(t, "1", w.Header().Get("RateLimit-Day-Remaining"))
+	assert.Equal(t, "3", w.Header().Get("RateLimit-Month-Remaining"))
+}
+
+func TestCost_Config(t *testing.T) {
+	t.Setenv("RATE_LIMIT_POLICY_export", "paths=/api/export;cost=50")
+	t.Setenv("RATE_LIMIT_POLICY_search", "paths=/api/search;limit=100;window=1m;cost=5")
+
+	cfg, err := config.Load()
+	require.NoError(t, err)
+	require.Len(t, cfg.RateLimit.Policies, 2)
+	assert.Equal(t, 50, cfg.RateLimit.Policies[0].Cost)
+	assert.True(t, cfg.RateLimit.Policies[0].CostOnly)
+	assert.Equal(t, 5, cfg.RateLimit.Policies[1].Cost)
+	assert.False(t, cfg.RateLimit.Policies[1].CostOnly)
+
+	t.Setenv("RATE_LIMIT_POLICY_export", "paths=/api/export;cost=-1")
+	_, err = config.Load()
+	assert.ErrorContains(t, err, "cost must not be negative")
+
+	t.Setenv("RATE_LIMIT_POLICY_export", "paths=/api/export;cost=50")
+	t.Setenv("RATE_LIMIT_POLICIES_FILE", writePolicyFile(t, "policies.yaml", "routes:\n  - name: reports\n    paths: [/api/reports]\n    cost: 20\n"))
+	cfg, err = config.Load()
+	require.NoError(t, err)
+	require.Len(t, cfg.RateLimit.Policies, 3)
+	assert.Equal(t, "reports", cfg.RateLimit.Policies[0].Name)
+	assert.True(t, cfg.RateLimit.Policies[0].CostOnly)
+}
+
+func TestEnvoy_HitsAddend(t *testing.T) {
+	client := newRateLimitServiceClient(t)
+	ctx := context.Background()
+
+	// The IP limit is 2 per second, so a request adding 2 hits uses it up
+	response, err := client.ShouldRateLimit(ctx, &rls.RateLimitRequest{
+		Domain:      "edge",
+		Descriptors: []*ratelimitv3.RateLimitDescriptor{descriptor("remote_address", "10.0.0.1")},
+		HitsAddend:  2,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, rls.RateLimitResponse_OK, response.OverallCode)
+	assert.Equal(t, uint32(0), response.Statuses[0].LimitRemaining)
+
+	// The hits_addend of a descriptor wins over the one of the request
+	limited := descriptor("remote_address", "10.0.0.2")
+	limited.HitsAddend = wrapperspb.UInt64(3)
+	response, err = client.ShouldRateLimit(ctx, &rls.RateLimitRequest{
+		Domain:      "edge",
+		Descriptors: []*ratelimitv3.RateLimitDescriptor{limited},
+		HitsAddend:  1,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, rls.RateLimitResponse_OVER_LIMIT, response.OverallCode)
+}
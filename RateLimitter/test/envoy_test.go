@@ -0,0 +1,200 @@
+package test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"rate-limiter/internal/config"
+	"rate-limiter/internal/limiter"
+	"rate-limiter/internal/metrics"
+	"rate-limiter/internal/server"
+	"rate-limiter/internal/storage"
+
+	ratelimitv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/common/ratelimit/v3"
+	rls "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	typev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// newRateLimitServiceClient serves the Envoy rate limit service over an in-memory
+// connection and returns a client for it
+func newRateLimitServiceClient(t *testing.T) rls.RateLimitServiceClient {
+	t.Helper()
+
+	cfg := &config.Config{
+		RateLimit: config.RateLimitConfig{
+			IPRequestsPerSecond:    2,
+			IPBlockDurationMinutes: 1,
+			TokenLimits:            map[string]config.TokenLimit{"abc123": {RequestsPerSecond: 5}},
+			Policies: []config.Policy{
+				{Name: "login", Methods: []string{"POST"}, Paths: []string{"/login"}, Requests: 1, Window: time.Minute},
+			},
+		},
+	}
+
+	store := storage.NewMemoryStorage()
+	t.Cleanup(func() { store.Close() })
+
+	srv, err := server.New(cfg, store)
+	require.NoError(t, err)
+
+	listener := bufconn.Listen(1 << 20)
+	grpcServer := srv.GRPCServer()
+	go grpcServer.Serve(listener)
+	t.Cleanup(grpcServer.Stop)
+
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	return rls.NewRateLimitServiceClient(conn)
+}
+
+// descriptor builds a descriptor from key and value pairs
+func descriptor(pairs ...string) *ratelimitv3.RateLimitDescriptor {
+	d := &ratelimitv3.RateLimitDescriptor{}
+	for i := 0; i+1 < len(pairs); i += 2 {
+		d.Entries = append(d.Entries, &ratelimitv3.RateLimitDescriptor_Entry{Key: pairs[i], Value: pairs[i+1]})
+	}
+	return d
+}
+
+// shouldRateLimit sends a request with the given descriptors
+func shouldRateLimit(t *testing.T, client rls.RateLimitServiceClient, descriptors ...*ratelimitv3.RateLimitDescriptor) *rls.RateLimitResponse {
+	t.Helper()
+
+	response, err := client.ShouldRateLimit(context.Background(), &rls.RateLimitRequest{Domain: "edge", Descriptors: descriptors})
+	require.NoError(t, err)
+	return response
+}
+
+func TestEnvoy_RemoteAddress(t *testing.T) {
+	client := newRateLimitServiceClient(t)
+
+	for i := 0; i < 2; i++ {
+		response := shouldRateLimit(t, client, descriptor("remote_address", "192.168.1.1"))
+		assert.Equal(t, rls.RateLimitResponse_OK, response.OverallCode)
+	}
+
+	response := shouldRateLimit(t, client, descriptor("remote_address", "192.168.1.1"))
+	assert.Equal(t, rls.RateLimitResponse_OVER_LIMIT, response.OverallCode)
+	require.Len(t, response.Statuses, 1)
+
+	descriptorStatus := response.Statuses[0]
+	assert.Equal(t, rls.RateLimitResponse_OVER_LIMIT, descriptorStatus.Code)
+	assert.EqualValues(t, 2, descriptorStatus.CurrentLimit.RequestsPerUnit)
+	assert.Equal(t, rls.RateLimitResponse_RateLimit_SECOND, descriptorStatus.CurrentLimit.Unit)
+	assert.EqualValues(t, 0, descriptorStatus.LimitRemaining)
+
+	headers := map[string]string{}
+	for _, header := range response.ResponseHeadersToAdd {
+		headers[header.Key] = header.Value
+	}
+	assert.Equal(t, "2", headers["RateLimit-Limit"])
+	assert.Equal(t, "60", headers["Retry-After"])
+
+	// The token entry selects the token limit
+	for i := 0; i < 5; i++ {
+		response := shouldRateLimit(t, client, descriptor("remote_address", "192.168.1.2", "api_key", "abc123"))
+		assert.Equal(t, rls.RateLimitResponse_OK, response.OverallCode)
+	}
+}
+
+func TestEnvoy_Policies(t *testing.T) {
+	client := newRateLimitServiceClient(t)
+
+	// Named through generic_key
+	assert.Equal(t, rls.RateLimitResponse_OK, shouldRateLimit(t, client, descriptor("generic_key", "login", "remote_address", "10.0.0.1")).OverallCode)
+	assert.Equal(t, rls.RateLimitResponse_OVER_LIMIT, shouldRateLimit(t, client, descriptor("generic_key", "login", "remote_address", "10.0.0.1")).OverallCode)
+
+	// Matched on the method and path, sharing the policy counters
+	response := shouldRateLimit(t, client, descriptor("method", "POST", "path", "/login?next=/", "remote_address", "10.0.0.1"))
+	assert.Equal(t, rls.RateLimitResponse_OVER_LIMIT, response.OverallCode)
+	assert.Equal(t, rls.RateLimitResponse_RateLimit_MINUTE, response.Statuses[0].CurrentLimit.Unit)
+
+	_, err := client.ShouldRateLimit(context.Background(), &rls.RateLimitRequest{
+		Domain:      "edge",
+		Descriptors: []*ratelimitv3.RateLimitDescriptor{descriptor("generic_key", "missing")},
+	})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestEnvoy_Descriptors(t *testing.T) {
+	client := newRateLimitServiceClient(t)
+
+	// Descriptors without an IP or token are limited by their entries
+	for i := 0; i < 2; i++ {
+		assert.Equal(t, rls.RateLimitResponse_OK, shouldRateLimit(t, client, descriptor("tenant", "acme")).OverallCode)
+	}
+	assert.Equal(t, rls.RateLimitResponse_OVER_LIMIT, shouldRateLimit(t, client, descriptor("tenant", "acme")).OverallCode)
+	assert.Equal(t, rls.RateLimitResponse_OK, shouldRateLimit(t, client, descriptor("tenant", "globex")).OverallCode)
+
+	// and counted as a custom key rather than taken for an IP
+	custom := func() float64 {
+		return testutil.ToFloat64(metrics.Decisions.WithLabelValues(metrics.Allowed, "default", limiter.KeyTypeCustom, "within_limit"))
+	}
+	before := custom()
+	assert.Equal(t, rls.RateLimitResponse_OK, shouldRateLimit(t, client, descriptor("tenant", "initech")).OverallCode)
+	assert.Equal(t, before+1, custom())
+
+	// A limit override replaces the configured limit
+	override := descriptor("remote_address", "10.0.0.2")
+	override.Limit = &ratelimitv3.RateLimitDescriptor_RateLimitOverride{RequestsPerUnit: 1, Unit: typev3.RateLimitUnit_HOUR}
+	response := shouldRateLimit(t, client, override)
+	assert.Equal(t, rls.RateLimitResponse_OK, response.OverallCode)
+	assert.Equal(t, rls.RateLimitResponse_RateLimit_HOUR, response.Statuses[0].CurrentLimit.Unit)
+	assert.Equal(t, rls.RateLimitResponse_OVER_LIMIT, shouldRateLimit(t, client, override).OverallCode)
+
+	// Override counters are kept apart by every entry value
+	override = descriptor("remote_address", "10.0.0.2", "tenant", "globex")
+	override.Limit = &ratelimitv3.RateLimitDescriptor_RateLimitOverride{RequestsPerUnit: 1, Unit: typev3.RateLimitUnit_HOUR}
+	assert.Equal(t, rls.RateLimitResponse_OK, shouldRateLimit(t, client, override).OverallCode)
+	assert.Equal(t, rls.RateLimitResponse_OVER_LIMIT, shouldRateLimit(t, client, override).OverallCode)
+	override.Entries[1].Value = "initech"
+	assert.Equal(t, rls.RateLimitResponse_OK, shouldRateLimit(t, client, override).OverallCode)
+
+	// Any descriptor over its limit puts the whole request over limit
+	response = shouldRateLimit(t, client, descriptor("remote_address", "10.0.0.3"), descriptor("tenant", "acme"))
+	assert.Equal(t, rls.RateLimitResponse_OVER_LIMIT, response.OverallCode)
+	require.Len(t, response.Statuses, 2)
+	assert.Equal(t, rls.RateLimitResponse_OK, response.Statuses[0].Code)
+	assert.Equal(t, rls.RateLimitResponse_OVER_LIMIT, response.Statuses[1].Code)
+
+	_, err := client.ShouldRateLimit(context.Background(), &rls.RateLimitRequest{Domain: "edge"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestEnvoy_OverridePolicyLabel(t *testing.T) {
+	client := newRateLimitServiceClient(t)
+
+	allowed := func() float64 {
+		return testutil.ToFloat64(metrics.Decisions.WithLabelValues(metrics.Allowed, "edge:remote_address", limiter.KeyTypeIP, "within_limit"))
+	}
+	before := allowed()
+
+	// Descriptor values, client IPs here, never make it into the policy label
+	for _, ip := range []string{"10.0.0.4", "10.0.0.5"} {
+		override := descriptor("remote_address", ip)
+		override.Limit = &ratelimitv3.RateLimitDescriptor_RateLimitOverride{RequestsPerUnit: 1, Unit: typev3.RateLimitUnit_HOUR}
+		assert.Equal(t, rls.RateLimitResponse_OK, shouldRateLimit(t, client, override).OverallCode)
+	}
+	assert.Equal(t, before+2, allowed())
+
+	for _, label := range []string{"edge:remote_address=10.0.0.4", "edge:remote_address=10.0.0.5"} {
+		assert.Zero(t, testutil.ToFloat64(metrics.Decisions.WithLabelValues(metrics.Allowed, label, limiter.KeyTypeIP, "within_limit")))
+	}
+}
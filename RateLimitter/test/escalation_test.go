@@ -0,0 +1,154 @@
+package test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"rate-limiter/internal/clock"
+	"rate-limiter/internal/config"
+	"rate-limiter/internal/limiter"
+	"rate-limiter/internal/storage"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEscalation_Storage(t *testing.T) {
+	for _, backend := range newTestBackends(t) {
+		t.Run(backend.name, func(t *testing.T) {
+			ctx := context.Background()
+
+			// offend exceeds the limit and waits out the block, so the next offense can
+			// be made right away
+			offend := func() *storage.ConsumeResult {
+				t.Helper()
+
+				req := storage.ConsumeRequest{
+					Key:           "offender",
+					Limit:         1,
+					Window:        time.Second,
+					Cost:          1,
+					BlockDuration: time.Minute,
+					BlockFactor:   2,
+					MaxBlock:      10 * time.Minute,
+					OffenseDecay:  time.Hour,
+					Now:           backend.clock.Now(),
+				}
+
+				_, err := backend.store.Consume(ctx, limiter.FixedWindow{}, req)
+				require.NoError(t, err)
+				result, err := backend.store.Consume(ctx, limiter.FixedWindow{}, req)
+				require.NoError(t, err)
+				require.False(t, result.Allowed)
+				backend.advance(result.RetryAfter)
+				return result
+			}
+
+			for i, block := range []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute, 8 * time.Minute, 10 * time.Minute} {
+				result := offend()
+				assert.Equal(t, i+1, result.Offenses)
+				assert.Equal(t, block, result.RetryAfter, "offense %d", i+1)
+			}
+
+			// Three hours later three of the five offenses are forgotten
+			backend.advance(3 * time.Hour)
+			result := offend()
+			assert.Equal(t, 3, result.Offenses)
+			assert.Equal(t, 4*time.Minute, result.RetryAfter)
+
+			// Lifting a block forgets the offenses too
+			require.NoError(t, backend.store.Unblock(ctx, "offender"))
+			result = offend()
+			assert.Equal(t, 1, result.Offenses)
+			assert.Equal(t, time.Minute, result.RetryAfter)
+		})
+	}
+}
+
+func TestEscalation_NoDecay(t *testing.T) {
+	for _, backend := range newTestBackends(t) {
+		t.Run(backend.name, func(t *testing.T) {
+			ctx := context.Background()
+
+			// Without a decay the offenses live no longer than the Redis hash does, so
+			// blocks never escalate
+			for i := 0; i < 3; i++ {
+				req := storage.ConsumeRequest{
+					Key:           "offender",
+					Limit:         1,
+					Window:        time.Second,
+					Cost:          1,
+					BlockDuration: time.Second,
+					BlockFactor:   2,
+					MaxBlock:      time.Minute,
+					Now:           backend.clock.Now(),
+				}
+				_, err := backend.store.Consume(ctx, limiter.FixedWindow{}, req)
+				require.NoError(t, err)
+				result, err := backend.store.Consume(ctx, limiter.FixedWindow{}, req)
+				require.NoError(t, err)
+				require.False(t, result.Allowed)
+				assert.Equal(t, 1, result.Offenses)
+				assert.Equal(t, time.Second, result.RetryAfter)
+				backend.advance(time.Second)
+			}
+		})
+	}
+}
+
+func TestEscalation_RateLimiter(t *testing.T) {
+	clock := clock.NewFake(testStart)
+	store := storage.NewMemoryStorageWithClock(clock)
+	defer store.Close()
+
+	rl := limiter.NewRateLimiter(store, &config.Config{
+		RateLimit: config.RateLimitConfig{
+			IPRequestsPerSecond:    1,
+			IPBlockDurationMinutes: 5,
+			Escalation:             config.BlockEscalation{Factor: 3, Max: time.Hour, Decay: time.Hour},
+		},
+	})
+	rl.SetClock(clock)
+	ctx := context.Background()
+
+	for offense, block := range []time.Duration{5 * time.Minute, 15 * time.Minute, 45 * time.Minute, time.Hour} {
+		_, err := rl.CheckRequest(ctx, limiter.Key{IP: "192.168.1.1"})
+		require.NoError(t, err)
+
+		result, err := rl.CheckRequest(ctx, limiter.Key{IP: "192.168.1.1"})
+		require.NoError(t, err)
+		assert.False(t, result.Allowed)
+		assert.Equal(t, offense+1, result.Offenses)
+		assert.Equal(t, block, result.RetryAfter)
+
+		// The next offense comes once the block is over
+		clock.Advance(block)
+	}
+}
+
+func TestEscalation_Config(t *testing.T) {
+	t.Setenv("RATE_LIMIT_BLOCK_ESCALATION_FACTOR", "2")
+	t.Setenv("RATE_LIMIT_BLOCK_MAX_MINUTES", "120")
+
+	cfg, err := config.Load()
+	require.NoError(t, err)
+	assert.Equal(t, config.BlockEscalation{Factor: 2, Max: 2 * time.Hour, Decay: time.Hour}, cfg.RateLimit.Escalation)
+	assert.True(t, cfg.RateLimit.Escalation.Enabled())
+
+	t.Setenv("RATE_LIMIT_OFFENSE_DECAY_MINUTES", "0")
+	_, err = config.Load()
+	assert.ErrorContains(t, err, "offense decay must be positive")
+
+	t.Setenv("RATE_LIMIT_BLOCK_ESCALATION_FACTOR", "")
+	cfg, err = config.Load()
+	require.NoError(t, err)
+	assert.False(t, cfg.RateLimit.Escalation.Enabled())
+
+	file, err := config.ParsePolicyFile([]byte("escalation: {factor: 1.5, max: 6h, decay: 30m}\n"), false)
+	require.NoError(t, err)
+	assert.Equal(t, &config.EscalationEntry{Factor: 1.5, Max: "6h", Decay: "30m"}, file.Escalation)
+
+	_, err = config.ParsePolicyFile([]byte("escalation: {factor: 2, decay: 30m}\n"), false)
+	assert.ErrorContains(t, err, "escalation: maximum block duration must be positive")
+}
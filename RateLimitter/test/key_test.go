@@ -0,0 +1,221 @@
+package test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"rate-limiter/internal/config"
+	"rate-limiter/internal/limiter"
+	"rate-limiter/internal/middleware"
+	"rate-limiter/internal/storage"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// accountConfig limits /accounts to 2 requests a minute per X-Account-ID header
+func accountConfig() *config.Config {
+	return &config.Config{
+		RateLimit: config.RateLimitConfig{
+			IPRequestsPerSecond: 100,
+			Policies: []config.Policy{
+				{
+					Name:     "accounts",
+					Paths:    []string{"/accounts/**"},
+					Requests: 2,
+					Window:   time.Minute,
+					Key:      config.KeyExtractor{{Kind: config.KeyHeader, Name: "X-Account-ID"}},
+				},
+			},
+		},
+	}
+}
+
+// testKeySource serves key parts from maps
+type testKeySource struct {
+	route   string
+	headers map[string]string
+}
+
+func (s testKeySource) Method() string            { return "GET" }
+func (s testKeySource) Route() string             { return s.route }
+func (s testKeySource) Header(name string) string { return s.headers[name] }
+func (s testKeySource) Query(string) string       { return "" }
+func (s testKeySource) Param(string) string       { return "" }
+
+func TestParseKeyExtractor(t *testing.T) {
+	extractor, err := config.ParseKeyExtractor("claim:tenant + route")
+	require.NoError(t, err)
+	assert.Equal(t, config.KeyExtractor{{Kind: config.KeyClaim, Name: "tenant"}, {Kind: config.KeyRoute}}, extractor)
+	assert.Equal(t, "claim:tenant+route", extractor.String())
+
+	for value, message := range map[string]string{
+		"header":       "key part header needs a name",
+		"ip:v4":        "key part ip takes no name",
+		"cookie:id":    `unknown key part "cookie:id"`,
+		"route+":       `unknown key part ""`,
+		"query:page+x": `unknown key part "x"`,
+	} {
+		_, err := config.ParseKeyExtractor(value)
+		assert.ErrorContains(t, err, message, value)
+	}
+}
+
+func TestKey_RateLimiter(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	defer store.Close()
+	rl := limiter.NewRateLimiter(store, accountConfig())
+	ctx := context.Background()
+
+	policy := rl.MatchPolicy("GET", "/accounts/42", "/accounts/42", "")
+	require.NotNil(t, policy)
+
+	// An account is limited wherever its requests come from
+	for i := 1; i <= 3; i++ {
+		source := testKeySource{route: "/accounts/42", headers: map[string]string{"X-Account-ID": "42"}}
+		key := rl.BuildKey(fmt.Sprintf("192.168.1.%d", i), "", source, policy)
+		assert.Equal(t, map[string]string{"header:X-Account-ID": "42"}, key.Values)
+
+		result, err := rl.CheckPolicy(ctx, policy, key)
+		require.NoError(t, err)
+		assert.Equal(t, limiter.KeyTypeCustom, result.KeyType)
+		assert.Equal(t, i <= 2, result.Allowed, "request %d", i)
+	}
+
+	// Other accounts have their own counters
+	key := rl.BuildKey("192.168.1.1", "", testKeySource{headers: map[string]string{"X-Account-ID": "7"}}, policy)
+	result, err := rl.CheckPolicy(ctx, policy, key)
+	require.NoError(t, err)
+	assert.True(t, result.Allowed)
+
+	// Requests without the header fall back to their IP
+	key = rl.BuildKey("192.168.1.1", "", testKeySource{}, policy)
+	result, err = rl.CheckPolicy(ctx, policy, key)
+	require.NoError(t, err)
+	assert.True(t, result.Allowed)
+	assert.Equal(t, limiter.KeyTypeIP, result.KeyType)
+}
+
+func TestKey_Claims(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	defer store.Close()
+
+	cfg := authConfig()
+	cfg.RateLimit.Policies = []config.Policy{
+		{
+			Name:     "tenants",
+			Paths:    []string{"/reports", "/exports"},
+			Requests: 1,
+			Window:   time.Minute,
+			Key:      config.KeyExtractor{{Kind: config.KeyClaim, Name: "tenant"}, {Kind: config.KeyRoute}},
+		},
+	}
+	rl := limiter.NewRateLimiter(store, cfg)
+	ctx := context.Background()
+
+	check := func(claims jwt.MapClaims, route string) *limiter.LimiterResult {
+		t.Helper()
+
+		policy := rl.MatchPolicy("GET", route, route, "")
+		require.NotNil(t, policy)
+		key := rl.BuildKey("192.168.1.1", signJWT(t, testJWTSecret, claims), testKeySource{route: route}, policy)
+		result, err := rl.CheckPolicy(ctx, policy, key)
+		require.NoError(t, err)
+		return result
+	}
+
+	// Users of a tenant share its limit on each route
+	assert.True(t, check(jwt.MapClaims{"sub": "alice", "plan": "pro", "tenant": "acme"}, "/reports").Allowed)
+	assert.False(t, check(jwt.MapClaims{"sub": "bob", "plan": "pro", "tenant": "acme"}, "/reports").Allowed)
+	assert.True(t, check(jwt.MapClaims{"sub": "bob", "plan": "pro", "tenant": "acme"}, "/exports").Allowed)
+	assert.True(t, check(jwt.MapClaims{"sub": "carol", "plan": "pro", "tenant": "globex"}, "/reports").Allowed)
+
+	// Claims of tokens that do not verify are never read
+	policy := rl.MatchPolicy("GET", "/reports", "/reports", "")
+	forged := signJWT(t, []byte("other"), jwt.MapClaims{"sub": "mallory", "plan": "pro", "tenant": "globex"})
+	key := rl.BuildKey("192.168.1.2", forged, testKeySource{route: "/reports"}, policy)
+	assert.NotContains(t, key.Values, "claim:tenant")
+	result, err := rl.CheckPolicy(ctx, policy, key)
+	require.NoError(t, err)
+	assert.True(t, result.Unauthenticated)
+}
+
+func TestKey_EscapedValues(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	defer store.Close()
+
+	cfg := accountConfig()
+	cfg.RateLimit.Policies[0].Requests = 1
+	cfg.RateLimit.Policies[0].Key = config.KeyExtractor{{Kind: config.KeyHeader, Name: "X-A"}, {Kind: config.KeyHeader, Name: "X-B"}}
+	rl := limiter.NewRateLimiter(store, cfg)
+	ctx := context.Background()
+
+	policy := rl.MatchPolicy("GET", "/accounts/42", "/accounts/42", "")
+	require.NotNil(t, policy)
+
+	check := func(a, b string) bool {
+		t.Helper()
+		key := rl.BuildKey("192.168.1.1", "", testKeySource{headers: map[string]string{"X-A": a, "X-B": b}}, policy)
+		result, err := rl.CheckPolicy(ctx, policy, key)
+		require.NoError(t, err)
+		return result.Allowed
+	}
+
+	// Values holding the separators cannot pass for other values
+	assert.True(t, check("a|header:X-B=b", "c"))
+	assert.True(t, check("a", "b|header:X-B=c"))
+	assert.False(t, check("a", "b|header:X-B=c"))
+}
+
+func TestKey_Middleware(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	defer store.Close()
+
+	cfg := accountConfig()
+	cfg.RateLimit.Policies[0].Key = config.KeyExtractor{{Kind: config.KeyParam, Name: "id"}}
+	rl := limiter.NewRateLimiter(store, cfg)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(middleware.RateLimiterMiddleware(rl))
+	router.GET("/accounts/:id", func(c *gin.Context) {
+		c.JSON(200, gin.H{"message": "success"})
+	})
+
+	request := func(path, ip string) int {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", path, nil)
+		req.RemoteAddr = ip + ":12345"
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	assert.Equal(t, 200, request("/accounts/42", "192.168.1.1"))
+	assert.Equal(t, 200, request("/accounts/42", "192.168.1.2"))
+	assert.Equal(t, 429, request("/accounts/42", "192.168.1.3"))
+	assert.Equal(t, 200, request("/accounts/7", "192.168.1.3"))
+}
+
+func TestKey_Config(t *testing.T) {
+	t.Setenv("RATE_LIMIT_POLICY_tenants", "paths=/reports;limit=10;window=1m;key=claim:tenant+route")
+	t.Setenv("RATE_LIMIT_POLICIES_FILE", writePolicyFile(t, "policies.yaml", "routes:\n  - {name: accounts, paths: [/accounts/**], limit: 5, key: header:X-Account-ID}\n"))
+
+	cfg, err := config.Load()
+	require.NoError(t, err)
+	require.Len(t, cfg.RateLimit.Policies, 2)
+	assert.Equal(t, "header:X-Account-ID", cfg.RateLimit.Policies[0].Key.String())
+	assert.Equal(t, "claim:tenant+route", cfg.RateLimit.Policies[1].Key.String())
+
+	t.Setenv("RATE_LIMIT_POLICY_tenants", "paths=/reports;limit=10;key=claim")
+	_, err = config.Load()
+	assert.ErrorContains(t, err, "policy tenants: invalid key: key part claim needs a name")
+
+	_, err = config.ParsePolicyFile([]byte("routes:\n  - {name: export, cost: 5, key: route}\n"), false)
+	assert.ErrorContains(t, err, "policy export: a policy with a key needs a limit")
+}
@@ -5,6 +5,7 @@ import (
 	"testing"
 	"time"
 
+	"rate-limiter/internal/clock"
 	"rate-limiter/internal/config"
 	"rate-limiter/internal/limiter"
 	"rate-limiter/internal/storage"
@@ -32,7 +33,7 @@ func TestRateLimiter_IPLimit(t *testing.T) {
 
 	// Test first 3 requests should be allowed
 	for i := 0; i < 3; i++ {
-		result, err := rl.CheckRequest(ctx, ip, "")
+		result, err := rl.CheckRequest(ctx, limiter.Key{IP: ip})
 		if err != nil {
 			t.Fatalf("Unexpected error: %v", err)
 		}
@@ -42,7 +43,7 @@ func TestRateLimiter_IPLimit(t *testing.T) {
 	}
 
 	// 4th request should be blocked
-	result, err := rl.CheckRequest(ctx, ip, "")
+	result, err := rl.CheckRequest(ctx, limiter.Key{IP: ip})
 	if err != nil {
 		t.Fatalf("Unexpected error: %v", err)
 	}
@@ -88,7 +89,7 @@ func TestRateLimiter_TokenLimit(t *testing.T) {
 
 	// Test token limits (5 requests should be allowed)
 	for i := 0; i < 5; i++ {
-		result, err := rl.CheckRequest(ctx, ip, token)
+		result, err := rl.CheckRequest(ctx, limiter.Key{IP: ip, Token: token})
 		if err != nil {
 			t.Fatalf("Unexpected error: %v", err)
 		}
@@ -98,7 +99,7 @@ func TestRateLimiter_TokenLimit(t *testing.T) {
 	}
 
 	// 6th request should be blocked
-	result, err := rl.CheckRequest(ctx, ip, token)
+	result, err := rl.CheckRequest(ctx, limiter.Key{IP: ip, Token: token})
 	if err != nil {
 		t.Fatalf("Unexpected error: %v", err)
 	}
@@ -144,7 +145,7 @@ func TestRateLimiter_UnknownTokenFallsBackToIP(t *testing.T) {
 
 	// Test that unknown token falls back to IP limits (2 requests)
 	for i := 0; i < 2; i++ {
-		result, err := rl.CheckRequest(ctx, ip, unknownToken)
+		result, err := rl.CheckRequest(ctx, limiter.Key{IP: ip, Token: unknownToken})
 		if err != nil {
 			t.Fatalf("Unexpected error: %v", err)
 		}
@@ -154,7 +155,7 @@ func TestRateLimiter_UnknownTokenFallsBackToIP(t *testing.T) {
 	}
 
 	// 3rd request should be blocked (IP limit)
-	result, err := rl.CheckRequest(ctx, ip, unknownToken)
+	result, err := rl.CheckRequest(ctx, limiter.Key{IP: ip, Token: unknownToken})
 	if err != nil {
 		t.Fatalf("Unexpected error: %v", err)
 	}
@@ -194,7 +195,7 @@ func TestRateLimiter_GetRemainingRequests(t *testing.T) {
 
 	// Make 2 requests
 	for i := 0; i < 2; i++ {
-		_, err := rl.CheckRequest(ctx, ip, "")
+		_, err := rl.CheckRequest(ctx, limiter.Key{IP: ip})
 		if err != nil {
 			t.Fatalf("Unexpected error: %v", err)
 		}
@@ -220,19 +221,20 @@ func TestRateLimiter_Expiration(t *testing.T) {
 		},
 	}
 
-	// Create memory storage for testing
-	storage := storage.NewMemoryStorage()
+	// Create memory storage and rate limiter sharing a fake clock
+	clock := clock.NewFake(testStart)
+	storage := storage.NewMemoryStorageWithClock(clock)
 	defer storage.Close()
 
-	// Create rate limiter
 	rl := limiter.NewRateLimiter(storage, cfg)
+	rl.SetClock(clock)
 
 	ctx := context.Background()
 	ip := "192.168.1.100" // Use different IP to avoid interference
 
 	// Make 2 requests to reach limit
 	for i := 0; i < 2; i++ {
-		result, err := rl.CheckRequest(ctx, ip, "")
+		result, err := rl.CheckRequest(ctx, limiter.Key{IP: ip})
 		if err != nil {
 			t.Fatalf("Unexpected error: %v", err)
 		}
@@ -242,7 +244,7 @@ func TestRateLimiter_Expiration(t *testing.T) {
 	}
 
 	// 3rd request should be blocked
-	result, err := rl.CheckRequest(ctx, ip, "")
+	result, err := rl.CheckRequest(ctx, limiter.Key{IP: ip})
 	if err != nil {
 		t.Fatalf("Unexpected error: %v", err)
 	}
@@ -250,11 +252,11 @@ func TestRateLimiter_Expiration(t *testing.T) {
 		t.Error("3rd request should be blocked")
 	}
 
-	// Wait for counter expiration (1 second)
-	time.Sleep(2 * time.Second)
+	// Let the counter expire (1 second)
+	clock.Advance(2 * time.Second)
 
 	// After counter expiration, requests should be allowed again
-	result, err = rl.CheckRequest(ctx, ip, "")
+	result, err = rl.CheckRequest(ctx, limiter.Key{IP: ip})
 	if err != nil {
 		t.Fatalf("Unexpected error: %v", err)
 	}
@@ -0,0 +1,137 @@
+package test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"rate-limiter/internal/config"
+	"rate-limiter/internal/limiter"
+	"rate-limiter/internal/metrics"
+	"rate-limiter/internal/storage"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimiter_DecisionMetrics(t *testing.T) {
+	cfg := &config.Config{
+		RateLimit: config.RateLimitConfig{
+			IPRequestsPerSecond:    1,
+			IPBlockDurationMinutes: 1,
+			TokenLimits:            map[string]config.TokenLimit{"metrics-token": {RequestsPerSecond: 1}},
+			Policies:               []config.Policy{{Name: "metrics-policy", Requests: 1, Window: time.Minute}},
+		},
+	}
+
+	rl := limiter.NewRateLimiter(storage.NewMemoryStorage(), cfg)
+	ctx := context.Background()
+
+	decisions := func(decision, policy, keyType, reason string) float64 {
+		return testutil.ToFloat64(metrics.Decisions.WithLabelValues(decision, policy, keyType, reason))
+	}
+
+	allowedIP := decisions(metrics.Allowed, "default", limiter.KeyTypeIP, "within_limit")
+	exceededIP := decisions(metrics.Denied, "default", limiter.KeyTypeIP, "limit_exceeded")
+	blockedIP := decisions(metrics.Denied, "default", limiter.KeyTypeIP, "blocked")
+	exceededToken := decisions(metrics.Denied, "default", limiter.KeyTypeToken, "limit_exceeded")
+	allowedPolicy := decisions(metrics.Allowed, "metrics-policy", limiter.KeyTypeIP, "within_limit")
+
+	for i := 0; i < 3; i++ {
+		_, err := rl.CheckRequest(ctx, limiter.Key{IP: "192.168.50.1"})
+		require.NoError(t, err)
+	}
+
+	for i := 0; i < 2; i++ {
+		_, err := rl.CheckRequest(ctx, limiter.Key{IP: "192.168.50.2", Token: "metrics-token"})
+		require.NoError(t, err)
+	}
+
+	_, err := rl.CheckPolicy(ctx, &cfg.RateLimit.Policies[0], limiter.Key{IP: "192.168.50.3"})
+	require.NoError(t, err)
+
+	assert.Equal(t, allowedIP+1, decisions(metrics.Allowed, "default", limiter.KeyTypeIP, "within_limit"))
+	assert.Equal(t, exceededIP+1, decisions(metrics.Denied, "default", limiter.KeyTypeIP, "limit_exceeded"))
+	assert.Equal(t, blockedIP+1, decisions(metrics.Denied, "default", limiter.KeyTypeIP, "blocked"))
+	assert.Equal(t, exceededToken+1, decisions(metrics.Denied, "default", limiter.KeyTypeToken, "limit_exceeded"))
+	assert.Equal(t, allowedPolicy+1, decisions(metrics.Allowed, "metrics-policy", limiter.KeyTypeIP, "within_limit"))
+}
+
+// storageSamples returns how many operations a storage latency series has observed
+func storageSamples(t *testing.T, backend, operation string) uint64 {
+	t.Helper()
+
+	var metric dto.Metric
+	require.NoError(t, metrics.StorageLatency.WithLabelValues(backend, operation).(prometheus.Metric).Write(&metric))
+	return metric.GetHistogram().GetSampleCount()
+}
+
+func TestStorage_LatencyMetrics(t *testing.T) {
+	for _, backend := range newTestBackends(t) {
+		t.Run(backend.name, func(t *testing.T) {
+			consumes := storageSamples(t, backend.name, "consume")
+			blockTTLs := storageSamples(t, backend.name, "block_ttl")
+
+			backend.consume(t, limiter.FixedWindow{}, "latency", limiter.Limit{Requests: 1, Window: time.Second}, 1)
+			_, err := backend.store.BlockTTL(context.Background(), "latency")
+			require.NoError(t, err)
+
+			assert.Equal(t, consumes+1, storageSamples(t, backend.name, "consume"))
+			assert.Equal(t, blockTTLs+1, storageSamples(t, backend.name, "block_ttl"))
+		})
+	}
+}
+
+func TestServer_MetricsEndpoint(t *testing.T) {
+	handler, store := newAdminServer(t, "secret")
+	require.NoError(t, store.Block(context.Background(), "192.168.60.1", time.Minute))
+	require.NoError(t, store.Block(context.Background(), "192.168.60.2", time.Minute))
+
+	// A denied request shows up in the counters
+	for i := 0; i < 3; i++ {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/api/test", nil)
+		req.RemoteAddr = "192.168.60.3:1234"
+		handler.ServeHTTP(w, req)
+	}
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/metrics", nil)
+	handler.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	body, err := io.ReadAll(w.Body)
+	require.NoError(t, err)
+
+	assert.Contains(t, string(body), "rate_limiter_active_blocks 3")
+	assert.Contains(t, string(body), `rate_limiter_requests_total{decision="denied",key_type="ip",policy="default",reason="limit_exceeded"}`)
+	assert.Contains(t, string(body), `rate_limiter_storage_operation_duration_seconds_bucket{backend="memory",operation="consume"`)
+	assert.Contains(t, string(body), "go_goroutines")
+}
+
+func TestMetrics_ActiveBlocksCached(t *testing.T) {
+	counts := 0
+	collector := metrics.NewActiveBlocksCollector(func(ctx context.Context) (int, error) {
+		counts++
+		return counts, nil
+	}, time.Minute)
+
+	// Scrapes within the TTL reuse the count instead of listing the blocks again
+	assert.Equal(t, float64(1), testutil.ToFloat64(collector))
+	assert.Equal(t, float64(1), testutil.ToFloat64(collector))
+	assert.Equal(t, 1, counts)
+
+	collector = metrics.NewActiveBlocksCollector(func(ctx context.Context) (int, error) {
+		counts++
+		return counts, nil
+	}, 0)
+	testutil.ToFloat64(collector)
+	testutil.ToFloat64(collector)
+	assert.Equal(t, 3, counts)
+}
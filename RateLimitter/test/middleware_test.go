@@ -3,6 +3,8 @@ package test
 import (
 	"net/http"
 	"net/http/httptest"
+	"net/netip"
+	"strconv"
 	"testing"
 
 	"rate-limiter/internal/config"
@@ -125,7 +127,7 @@ func TestRateLimiterMiddleware(t *testing.T) {
 
 	t.Run("X-Forwarded-For Header", func(t *testing.T) {
 		router := gin.New()
-		router.Use(middleware.RateLimiterMiddleware(rl))
+		router.Use(middleware.RateLimiterMiddleware(rl, middleware.WithTrustedProxies([]netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")})))
 		router.GET("/test", func(c *gin.Context) {
 			c.JSON(200, gin.H{"message": "success"})
 		})
@@ -151,3 +153,60 @@ func TestRateLimiterMiddleware(t *testing.T) {
 		assert.Equal(t, 429, w.Code)
 	})
 }
+
+func TestRateLimiterMiddleware_Headers(t *testing.T) {
+	cfg := &config.Config{
+		RateLimit: config.RateLimitConfig{
+			IPRequestsPerSecond:    2,
+			IPBlockDurationMinutes: 1,
+			TokenLimits:            make(map[string]config.TokenLimit),
+		},
+	}
+
+	storage := storage.NewMemoryStorage()
+	defer storage.Close()
+
+	rl := limiter.NewRateLimiter(storage, cfg)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(middleware.RateLimiterMiddleware(rl))
+	router.GET("/test", func(c *gin.Context) {
+		c.JSON(200, gin.H{"message": "success"})
+	})
+
+	send := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/test", nil)
+		req.RemoteAddr = "192.168.2.1:12345"
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := send()
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "2", w.Header().Get("RateLimit-Limit"))
+	assert.Equal(t, "1", w.Header().Get("RateLimit-Remaining"))
+	assert.Equal(t, "1", w.Header().Get("RateLimit-Reset"))
+	assert.Equal(t, "2;w=1", w.Header().Get("RateLimit-Policy"))
+	assert.Equal(t, "1", w.Header().Get("X-RateLimit-Remaining"))
+	assert.Empty(t, w.Header().Get("Retry-After"))
+
+	w = send()
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "0", w.Header().Get("RateLimit-Remaining"))
+
+	// The denied request blocks the IP for a minute
+	w = send()
+	assert.Equal(t, 429, w.Code)
+	assert.Equal(t, "0", w.Header().Get("RateLimit-Remaining"))
+	assert.Equal(t, "60", w.Header().Get("Retry-After"))
+	assert.Equal(t, "60", w.Header().Get("RateLimit-Reset"))
+
+	// Later requests report the time left on the block
+	w = send()
+	assert.Equal(t, 429, w.Code)
+	retryAfter, err := strconv.Atoi(w.Header().Get("Retry-After"))
+	assert.NoError(t, err)
+	assert.InDelta(t, 60, retryAfter, 1)
+}
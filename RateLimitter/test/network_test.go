@@ -0,0 +1,156 @@
+package test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"rate-limiter/internal/config"
+	"rate-limiter/internal/limiter"
+	"rate-limiter/internal/middleware"
+	"rate-limiter/internal/storage"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimitConfig_ClientKey(t *testing.T) {
+	rateLimit := config.RateLimitConfig{IPv6PrefixLength: 64}
+
+	// IPv6 addresses in the same /64 share a key
+	assert.Equal(t, "2001:db8:1:2::/64", rateLimit.ClientKey("2001:db8:1:2::1"))
+	assert.Equal(t, "2001:db8:1:2::/64", rateLimit.ClientKey("2001:db8:1:2:ffff:ffff:ffff:ffff"))
+	assert.Equal(t, "2001:db8:1:3::/64", rateLimit.ClientKey("2001:db8:1:3::1"))
+
+	// IPv4 keeps one key per address unless configured
+	assert.Equal(t, "192.168.1.1", rateLimit.ClientKey("192.168.1.1"))
+	rateLimit.IPv4PrefixLength = 24
+	assert.Equal(t, "192.168.1.0/24", rateLimit.ClientKey("192.168.1.1"))
+	assert.Equal(t, "192.168.1.0/24", rateLimit.ClientKey("::ffff:192.168.1.77"))
+
+	// Anything that is not an address is used as is
+	assert.Equal(t, "unknown", rateLimit.ClientKey("unknown"))
+}
+
+func TestLoad_AccessLists(t *testing.T) {
+	t.Setenv("RATE_LIMIT_ALLOWLIST", "10.0.0.0/8, 192.168.1.5")
+	t.Setenv("RATE_LIMIT_DENYLIST", "203.0.113.0/24")
+	t.Setenv("RATE_LIMIT_IPV6_PREFIX", "64")
+	t.Setenv("RATE_LIMIT_POLICIES_FILE", writePolicyFile(t, "policies.yaml", `
+allowlist: [2001:db8:ffff::/48]
+denylist: [198.51.100.7]
+ipv4_prefix: 24
+`))
+
+	cfg, err := config.Load()
+	require.NoError(t, err)
+
+	rateLimit := cfg.RateLimit
+	assert.Equal(t, []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/8"),
+		netip.MustParsePrefix("192.168.1.5/32"),
+		netip.MustParsePrefix("2001:db8:ffff::/48"),
+	}, rateLimit.Allowlist)
+	assert.Equal(t, 24, rateLimit.IPv4PrefixLength)
+	assert.Equal(t, 64, rateLimit.IPv6PrefixLength)
+
+	assert.True(t, rateLimit.IsAllowlisted("10.20.30.40"))
+	assert.True(t, rateLimit.IsAllowlisted("192.168.1.5"))
+	assert.False(t, rateLimit.IsAllowlisted("192.168.1.6"))
+	assert.True(t, rateLimit.IsDenylisted("203.0.113.9"))
+	assert.True(t, rateLimit.IsDenylisted("198.51.100.7"))
+	assert.False(t, rateLimit.IsDenylisted("198.51.100.8"))
+}
+
+func TestLoad_InvalidAccessLists(t *testing.T) {
+	t.Setenv("RATE_LIMIT_DENYLIST", "10.0.0.0/8,not-an-ip")
+
+	_, err := config.Load()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `RATE_LIMIT_DENYLIST: invalid IP address "not-an-ip"`)
+
+	t.Setenv("RATE_LIMIT_DENYLIST", "")
+	t.Setenv("RATE_LIMIT_IPV6_PREFIX", "129")
+
+	_, err = config.Load()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "IPv6 prefix length must be between 0 and 128")
+}
+
+func TestRateLimiter_IPv6SubnetAggregation(t *testing.T) {
+	cfg := &config.Config{
+		RateLimit: config.RateLimitConfig{
+			IPRequestsPerSecond:    3,
+			IPBlockDurationMinutes: 1,
+			IPv6PrefixLength:       64,
+		},
+	}
+
+	rl := limiter.NewRateLimiter(storage.NewMemoryStorage(), cfg)
+	ctx := context.Background()
+
+	// Rotating through addresses in the same /64 does not reset the limit
+	addresses := []string{"2001:db8::1", "2001:db8::2", "2001:db8::3", "2001:db8::4"}
+	for i, ip := range addresses {
+		result, err := rl.CheckRequest(ctx, limiter.Key{IP: ip})
+		require.NoError(t, err)
+		assert.Equal(t, i < 3, result.Allowed, "request from %s", ip)
+	}
+
+	// The whole subnet is blocked, another subnet is not
+	blocked, err := rl.IsBlocked(ctx, "2001:db8::99", "")
+	require.NoError(t, err)
+	assert.True(t, blocked)
+
+	result, err := rl.CheckRequest(ctx, limiter.Key{IP: "2001:db8:0:1::1"})
+	require.NoError(t, err)
+	assert.True(t, result.Allowed)
+}
+
+func TestRateLimiterMiddleware_AccessLists(t *testing.T) {
+	cfg := &config.Config{
+		RateLimit: config.RateLimitConfig{
+			IPRequestsPerSecond:    1,
+			IPBlockDurationMinutes: 0,
+			Allowlist:              []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+			Denylist:               []netip.Prefix{netip.MustParsePrefix("10.66.0.0/16")},
+		},
+	}
+
+	store := storage.NewMemoryStorage()
+	defer store.Close()
+
+	rl := limiter.NewRateLimiter(store, cfg)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(middleware.RateLimiterMiddleware(rl))
+	router.GET("/test", func(c *gin.Context) { c.Status(200) })
+
+	send := func(remoteAddr string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/test", nil)
+		req.RemoteAddr = remoteAddr
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	// Allowlisted IPs are never limited and get no rate limit headers
+	for i := 0; i < 5; i++ {
+		w := send("10.1.2.3:1234")
+		assert.Equal(t, 200, w.Code)
+		assert.Empty(t, w.Header().Get("RateLimit-Limit"))
+	}
+
+	// The denylist wins over the allowlist
+	w := send("10.66.0.1:1234")
+	assert.Equal(t, 403, w.Code)
+	assert.Contains(t, w.Body.String(), "IP is denied")
+
+	// Everything else is limited as usual
+	assert.Equal(t, 200, send("192.168.1.1:1234").Code)
+	assert.Equal(t, 429, send("192.168.1.1:1234").Code)
+}
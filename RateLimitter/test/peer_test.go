@@ -0,0 +1,248 @@
+package test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"rate-limiter/internal/config"
+	"rate-limiter/internal/limiter"
+	"rate-limiter/internal/server"
+	"rate-limiter/internal/storage"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testPeerSecret authenticates the calls between the replicas of newPeerCluster
+const testPeerSecret = "secret"
+
+// newPeerCluster starts n replicas sharing their state through a PeerStorage each
+func newPeerCluster(t *testing.T, n int) ([]*storage.PeerStorage, []*httptest.Server) {
+	t.Helper()
+
+	handlers := make([]http.Handler, n)
+	servers := make([]*httptest.Server, n)
+	var peers storage.StaticPeers
+
+	for i := range servers {
+		i := i
+		servers[i] = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			handlers[i].ServeHTTP(w, r)
+		}))
+		t.Cleanup(servers[i].Close)
+		peers = append(peers, servers[i].URL)
+	}
+
+	var scripts []storage.Script
+	for _, algorithm := range limiter.Algorithms() {
+		scripts = append(scripts, algorithm)
+	}
+
+	stores := make([]*storage.PeerStorage, n)
+	for i := range stores {
+		store, err := storage.NewPeerStorage(context.Background(), storage.PeerOptions{
+			Self:      servers[i].URL,
+			Discovery: peers,
+			Secret:    testPeerSecret,
+			Timeout:   time.Second,
+			Scripts:   scripts,
+		})
+		require.NoError(t, err)
+		t.Cleanup(func() { store.Close() })
+
+		stores[i] = store
+		handlers[i] = store.Handler()
+	}
+
+	return stores, servers
+}
+
+func TestPeerStorage_GlobalLimits(t *testing.T) {
+	stores, _ := newPeerCluster(t, 3)
+
+	cfg := &config.Config{
+		RateLimit: config.RateLimitConfig{
+			IPRequestsPerSecond:    5,
+			IPBlockDurationMinutes: 1,
+		},
+	}
+
+	limiters := make([]*limiter.RateLimiter, len(stores))
+	for i, store := range stores {
+		limiters[i] = limiter.NewRateLimiter(store, cfg)
+	}
+
+	// Requests spread over the replicas share a single limit
+	allowed := 0
+	for i := 0; i < 15; i++ {
+		result, err := limiters[i%len(limiters)].CheckRequest(context.Background(), limiter.Key{IP: "192.168.1.1"})
+		require.NoError(t, err)
+		if result.Allowed {
+			allowed++
+		}
+	}
+	assert.Equal(t, 5, allowed)
+
+	// And so does the block
+	for _, rl := range limiters {
+		blocked, err := rl.IsBlocked(context.Background(), "192.168.1.1", "")
+		require.NoError(t, err)
+		assert.True(t, blocked)
+	}
+}
+
+func TestPeerStorage_Ownership(t *testing.T) {
+	stores, _ := newPeerCluster(t, 3)
+	ctx := context.Background()
+
+	// Every replica agrees on the owners, and keys spread over all of them
+	owners := make(map[string]int)
+	for i := 0; i < 300; i++ {
+		key := fmt.Sprintf("10.0.%d.%d", i/256, i%256)
+		owner := stores[0].Owner(key)
+		assert.Equal(t, owner, stores[1].Owner(key))
+		assert.Equal(t, owner, stores[2].Owner(key))
+		owners[owner]++
+	}
+	require.Len(t, owners, 3)
+	for owner, keys := range owners {
+		assert.Greater(t, keys, 30, "%s owns too few keys", owner)
+	}
+
+	// Blocks made through any replica are listed by every replica
+	require.NoError(t, stores[0].Block(ctx, "10.0.0.1", time.Minute))
+	require.NoError(t, stores[1].Block(ctx, "10.0.0.2", time.Minute))
+	require.NoError(t, stores[2].Block(ctx, "10.0.0.3", time.Minute))
+
+	blocks, err := stores[1].ListBlocks(ctx)
+	require.NoError(t, err)
+	require.Len(t, blocks, 3)
+	assert.Equal(t, "10.0.0.1", blocks[0].Key)
+
+	require.NoError(t, stores[2].Unblock(ctx, "10.0.0.1"))
+	blocked, err := stores[0].IsBlocked(ctx, "10.0.0.1")
+	require.NoError(t, err)
+	assert.False(t, blocked)
+}
+
+func TestPeerStorage_UnreachablePeer(t *testing.T) {
+	stores, servers := newPeerCluster(t, 2)
+	ctx := context.Background()
+
+	// Find a key owned by the second replica, then take it down
+	var key string
+	for i := 0; key == ""; i++ {
+		if candidate := fmt.Sprintf("key-%d", i); stores[0].Owner(candidate) == servers[1].URL {
+			key = candidate
+		}
+	}
+	servers[1].Close()
+
+	// The first replica keeps limiting the key locally
+	require.NoError(t, stores[0].Block(ctx, key, time.Minute))
+	blocked, err := stores[0].IsBlocked(ctx, key)
+	require.NoError(t, err)
+	assert.True(t, blocked)
+
+	// Listing leaves the unreachable replica out
+	blocks, err := stores[0].ListBlocks(ctx)
+	require.NoError(t, err)
+	assert.Len(t, blocks, 1)
+}
+
+func TestPeerStorage_Secret(t *testing.T) {
+	stores, servers := newPeerCluster(t, 1)
+
+	resp, err := http.Post(servers[0].URL+storage.PeerPath, "application/json", strings.NewReader(`{"op":"is_blocked","key":"k"}`))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	req, _ := http.NewRequest("POST", servers[0].URL+storage.PeerPath, strings.NewReader(`{"op":"is_blocked","key":"k"}`))
+	req.Header.Set("Authorization", "Bearer "+testPeerSecret)
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// The server's peer route refuses clients trying to lift their own block
+	ctx := context.Background()
+	require.NoError(t, stores[0].Block(ctx, "192.168.1.1", time.Hour))
+	srv, err := server.New(&config.Config{RateLimit: config.RateLimitConfig{IPRequestsPerSecond: 10}}, stores[0])
+	require.NoError(t, err)
+
+	req = httptest.NewRequest("POST", storage.PeerPath, strings.NewReader(`{"op":"unblock","key":"192.168.1.1"}`))
+	w := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	blocked, err := stores[0].IsBlocked(ctx, "192.168.1.1")
+	require.NoError(t, err)
+	assert.True(t, blocked)
+
+	// A storage without a secret would serve anyone
+	_, err = storage.NewPeerStorage(ctx, storage.PeerOptions{Discovery: storage.StaticPeers{servers[0].URL}, Self: servers[0].URL})
+	assert.ErrorContains(t, err, "peer storage requires a secret")
+}
+
+func TestPeerStorage_Discovery(t *testing.T) {
+	addrs := []string{"10.0.0.2", "10.0.0.1"}
+	discovery := storage.DNSPeers{
+		Host: "rate-limiter.default.svc",
+		Port: "8080",
+		Lookup: func(ctx context.Context, host string) ([]string, error) {
+			assert.Equal(t, "rate-limiter.default.svc", host)
+			return addrs, nil
+		},
+	}
+
+	peers, err := discovery.Peers(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"http://10.0.0.1:8080", "http://10.0.0.2:8080"}, peers)
+
+	store, err := storage.NewPeerStorage(context.Background(), storage.PeerOptions{
+		Self:      "http://10.0.0.1:8080/",
+		Discovery: discovery,
+		Secret:    testPeerSecret,
+	})
+	require.NoError(t, err)
+	defer store.Close()
+	assert.Equal(t, "http://10.0.0.1:8080", store.Self())
+	assert.Len(t, store.Peers(), 2)
+
+	// Refreshing picks up new replicas
+	addrs = append(addrs, "10.0.0.3")
+	require.NoError(t, store.Refresh(context.Background()))
+	assert.Equal(t, []string{"http://10.0.0.1:8080", "http://10.0.0.2:8080", "http://10.0.0.3:8080"}, store.Peers())
+}
+
+func TestPeerStorage_Config(t *testing.T) {
+	t.Setenv("STORAGE_BACKEND", "peers")
+	_, err := config.Load()
+	assert.ErrorContains(t, err, "peers storage requires CLUSTER_PEERS or CLUSTER_DNS")
+
+	t.Setenv("CLUSTER_PEERS", "http://10.0.0.1:8080, http://10.0.0.2:8080")
+	t.Setenv("CLUSTER_SELF", "http://10.0.0.1:8080")
+	_, err = config.Load()
+	assert.ErrorContains(t, err, "CLUSTER_SECRET is required")
+
+	t.Setenv("CLUSTER_SECRET", testPeerSecret)
+	cfg, err := config.Load()
+	require.NoError(t, err)
+	assert.Equal(t, config.StoragePeers, cfg.Storage)
+	assert.Equal(t, []string{"http://10.0.0.1:8080", "http://10.0.0.2:8080"}, cfg.Cluster.Peers)
+
+	t.Setenv("CLUSTER_DNS", "rate-limiter:8080")
+	_, err = config.Load()
+	assert.ErrorContains(t, err, "not both")
+
+	t.Setenv("CLUSTER_DNS", "")
+	t.Setenv("CLUSTER_PEERS", "10.0.0.1:8080")
+	_, err = config.Load()
+	assert.ErrorContains(t, err, "CLUSTER_PEERS: invalid peer URL")
+}
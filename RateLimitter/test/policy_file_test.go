@@ -0,0 +1,268 @@
+package test
+
+import (
+	"context"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"rate-limiter/internal/config"
+	"rate-limiter/internal/limiter"
+	"rate-limiter/internal/storage"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testPolicyYAML = `
+algorithm: token_bucket
+ip:
+  requests_per_second: 3
+  block_duration_minutes: 1
+ips:
+  "192.168.1.10":
+    requests_per_second: 50
+cidrs:
+  - cidr: 10.0.0.0/8
+    requests_per_second: 20
+  - cidr: 10.1.0.0/16
+    requests_per_second: 1
+    algorithm: gcra
+tokens:
+  partner:
+    requests_per_second: 200
+    block_duration_minutes: 10
+routes:
+  - name: login
+    methods: [POST]
+    paths: [/api/login]
+    limit: 5
+    window: 1m
+    block: 15m
+`
+
+// writePolicyFile writes a policy file into a temporary directory
+func writePolicyFile(t *testing.T, name, contents string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(path, []byte(contents), 0o600))
+	return path
+}
+
+func TestLoad_PolicyFileYAML(t *testing.T) {
+	t.Setenv("TOKEN_LIMIT_basic", "10:5")
+	t.Setenv("RATE_LIMIT_POLICY_reads", "methods=GET;limit=100")
+	t.Setenv("RATE_LIMIT_POLICIES_FILE", writePolicyFile(t, "policies.yaml", testPolicyYAML))
+
+	cfg, err := config.Load()
+	require.NoError(t, err)
+
+	rateLimit := cfg.RateLimit
+	assert.Equal(t, config.AlgorithmTokenBucket, rateLimit.Algorithm)
+	assert.Equal(t, 3, rateLimit.IPRequestsPerSecond)
+	assert.Equal(t, 1, rateLimit.IPBlockDurationMinutes)
+
+	// File tokens are merged with the environment ones
+	assert.Equal(t, config.TokenLimit{RequestsPerSecond: 10, BlockDurationMinutes: 5}, rateLimit.TokenLimits["basic"])
+	assert.Equal(t, config.TokenLimit{RequestsPerSecond: 200, BlockDurationMinutes: 10}, rateLimit.TokenLimits["partner"])
+
+	// File routes come before the environment policies
+	require.Len(t, rateLimit.Policies, 2)
+	assert.Equal(t, config.Policy{
+		Name:          "login",
+		Methods:       []string{"POST"},
+		Paths:         []string{"/api/login"},
+		Requests:      5,
+		Window:        time.Minute,
+		BlockDuration: 15 * time.Minute,
+	}, rateLimit.Policies[0])
+	assert.Equal(t, "reads", rateLimit.Policies[1].Name)
+
+	// The most specific range wins, exact addresses beat ranges
+	require.Len(t, rateLimit.CIDRLimits, 2)
+	assert.Equal(t, netip.MustParsePrefix("10.1.0.0/16"), rateLimit.CIDRLimits[0].Prefix)
+
+	limit, ok := rateLimit.IPLimit("10.1.2.3")
+	require.True(t, ok)
+	assert.Equal(t, config.TokenLimit{RequestsPerSecond: 1, Algorithm: config.AlgorithmGCRA}, limit)
+
+	limit, ok = rateLimit.IPLimit("10.2.0.1")
+	require.True(t, ok)
+	assert.Equal(t, 20, limit.RequestsPerSecond)
+
+	limit, ok = rateLimit.IPLimit("::ffff:192.168.1.10")
+	require.True(t, ok)
+	assert.Equal(t, 50, limit.RequestsPerSecond)
+
+	_, ok = rateLimit.IPLimit("172.16.0.1")
+	assert.False(t, ok)
+}
+
+func TestLoad_PolicyFileJSON(t *testing.T) {
+	t.Setenv("RATE_LIMIT_POLICIES_FILE", writePolicyFile(t, "policies.json", `{
+		"cidrs": [{"cidr": "2001:db8::/32", "requests_per_second": 7}],
+		"tokens": {"partner": {"requests_per_second": 200, "algorithm": "gcra"}},
+		"routes": [{"name": "search", "paths": ["/api/search/**"], "limit": 2, "window": "10s"}]
+	}`))
+
+	cfg, err := config.Load()
+	require.NoError(t, err)
+
+	limit, ok := cfg.RateLimit.IPLimit("2001:db8::1")
+	require.True(t, ok)
+	assert.Equal(t, 7, limit.RequestsPerSecond)
+
+	assert.Equal(t, config.AlgorithmGCRA, cfg.RateLimit.TokenLimits["partner"].Algorithm)
+	require.Len(t, cfg.RateLimit.Policies, 1)
+	assert.Equal(t, 10*time.Second, cfg.RateLimit.Policies[0].Window)
+}
+
+func TestParsePolicyFile_Invalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		isJSON  bool
+		wantErr string
+	}{
+		{"unknown field", "tokenz: {}", false, "field tokenz not found"},
+		{"unknown JSON field", `{"tokenz": {}}`, true, `unknown field "tokenz"`},
+		{"bad YAML", "ips: [", false, "invalid YAML"},
+		{"bad algorithm", "algorithm: leaky", false, `unknown rate limit algorithm "leaky"`},
+		{"bad IP", "ips: {\"10.0.0.300\": {requests_per_second: 1}}", false, `ips: invalid IP address "10.0.0.300"`},
+		{"bad CIDR", "cidrs: [{cidr: 10.0.0.0/33}]", false, `cidrs[0]: invalid CIDR "10.0.0.0/33"`},
+		{"negative token limit", "tokens: {abc: {requests_per_second: -1}}", false, "tokens: abc: requests per second must not be negative"},
+		{"bad token algorithm", "tokens: {abc: {algorithm: leaky}}", false, `tokens: abc: unknown rate limit algorithm "leaky"`},
+		{"route without name", "routes: [{limit: 1}]", false, "routes[0]: policy name is required"},
+		{"bad route window", "routes: [{name: a, limit: 1, window: soon}]", false, "routes[0]: policy a: invalid window"},
+		{"route without limit", "routes: [{name: a, paths: [/api/**]}]", false, "routes[0]: policy a: limit is required"},
+		{"duplicate route", "routes: [{name: a, limit: 1}, {name: a, limit: 2}]", false, "routes[1]: duplicate policy a"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := config.ParsePolicyFile([]byte(tt.data), tt.isJSON)
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tt.wantErr)
+		})
+	}
+}
+
+func TestLoad_InvalidPolicyFile(t *testing.T) {
+	path := writePolicyFile(t, "policies.yaml", "routes: [{name: a, limit: 1, window: 0s}]")
+	t.Setenv("RATE_LIMIT_POLICIES_FILE", path)
+
+	_, err := config.Load()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), path)
+	assert.Contains(t, err.Error(), "policy a: window must be positive")
+
+	// Env policies can clash with the file ones
+	t.Setenv("RATE_LIMIT_POLICY_a", "limit=1")
+	t.Setenv("RATE_LIMIT_POLICIES_FILE", writePolicyFile(t, "policies.yaml", "routes: [{name: a, limit: 2}]"))
+
+	_, err = config.Load()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "duplicate policy a")
+}
+
+func TestLoad_InvalidTokenLimit(t *testing.T) {
+	t.Setenv("TOKEN_LIMIT_abc", "ten:5")
+
+	_, err := config.Load()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `TOKEN_LIMIT_abc: invalid requests per second "ten"`)
+}
+
+func TestRateLimiter_IPOverrides(t *testing.T) {
+	t.Setenv("RATE_LIMIT_IP_REQUESTS_PER_SECOND", "1")
+	t.Setenv("RATE_LIMIT_POLICIES_FILE", writePolicyFile(t, "policies.yaml", testPolicyYAML))
+
+	cfg, err := config.Load()
+	require.NoError(t, err)
+
+	rl := limiter.NewRateLimiter(storage.NewMemoryStorage(), cfg)
+	ctx := context.Background()
+
+	allowed := func(ip string, requests int) int {
+		count := 0
+		for i := 0; i < requests; i++ {
+			result, err := rl.CheckRequest(ctx, limiter.Key{IP: ip})
+			require.NoError(t, err)
+			if result.Allowed {
+				count++
+			}
+		}
+		return count
+	}
+
+	assert.Equal(t, 50, allowed("192.168.1.10", 60))
+	assert.Equal(t, 20, allowed("10.2.0.1", 30))
+	assert.Equal(t, 1, allowed("10.1.0.1", 5))
+	assert.Equal(t, 3, allowed("172.16.0.1", 5))
+}
+
+func TestRateLimiter_UpdateLimits(t *testing.T) {
+	cfg := &config.Config{
+		RateLimit: config.RateLimitConfig{IPRequestsPerSecond: 1, IPBlockDurationMinutes: 0},
+	}
+
+	rl := limiter.NewRateLimiter(storage.NewMemoryStorage(), cfg)
+	ctx := context.Background()
+
+	result, err := rl.CheckRequest(ctx, limiter.Key{IP: "192.168.1.1"})
+	require.NoError(t, err)
+	assert.True(t, result.Allowed)
+
+	result, err = rl.CheckRequest(ctx, limiter.Key{IP: "192.168.1.1"})
+	require.NoError(t, err)
+	assert.False(t, result.Allowed)
+
+	limits := rl.Limits()
+	limits.TokenLimits = map[string]config.TokenLimit{"abc123": {RequestsPerSecond: 5}}
+	rl.UpdateLimits(limits)
+
+	result, err = rl.CheckRequest(ctx, limiter.Key{IP: "192.168.1.1", Token: "abc123"})
+	require.NoError(t, err)
+	assert.True(t, result.Allowed)
+	assert.Equal(t, 5, result.Limit)
+}
+
+func TestWatchPolicyFile_Reload(t *testing.T) {
+	path := writePolicyFile(t, "policies.yaml", "tokens: {abc: {requests_per_second: 1}}")
+	t.Setenv("RATE_LIMIT_POLICIES_FILE", path)
+
+	cfg, err := config.Load()
+	require.NoError(t, err)
+
+	rl := limiter.NewRateLimiter(storage.NewMemoryStorage(), cfg)
+	errs := make(chan error, 10)
+
+	watcher, err := cfg.WatchPolicyFile(rl.UpdateLimits, func(err error) { errs <- err })
+	require.NoError(t, err)
+	defer watcher.Close()
+
+	tokenLimit := func() int {
+		return rl.Limits().TokenLimits["abc"].RequestsPerSecond
+	}
+
+	// A file replaced through a rename is picked up
+	next := filepath.Join(filepath.Dir(path), "next.yaml")
+	require.NoError(t, os.WriteFile(next, []byte("tokens: {abc: {requests_per_second: 9}}"), 0o600))
+	require.NoError(t, os.Rename(next, path))
+
+	assert.Eventually(t, func() bool { return tokenLimit() == 9 }, 5*time.Second, 10*time.Millisecond)
+
+	// A broken file is reported and the previous limits stay in place
+	require.NoError(t, os.WriteFile(path, []byte("tokens: {abc: {requests_per_second: -1}}"), 0o600))
+
+	select {
+	case err := <-errs:
+		assert.Contains(t, err.Error(), "requests per second must not be negative")
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected a reload error")
+	}
+	assert.Equal(t, 9, tokenLimit())
+}
@@ -0,0 +1,197 @@
+package test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"rate-limiter/internal/config"
+	"rate-limiter/internal/limiter"
+	"rate-limiter/internal/middleware"
+	"rate-limiter/internal/storage"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPolicy_Matches(t *testing.T) {
+	policy := config.Policy{
+		Name:    "items-write",
+		Methods: []string{"POST", "put"},
+		Paths:   []string{"/api/items", "/api/items/:id", "/api/export/**"},
+		Group:   "api",
+	}
+
+	tests := []struct {
+		name        string
+		method      string
+		routePath   string
+		requestPath string
+		group       string
+		want        bool
+	}{
+		{"exact path", "POST", "/api/items", "/api/items", "api", true},
+		{"route template", "PUT", "/api/items/:id", "/api/items/42", "api", true},
+		{"method case", "put", "/api/items", "/api/items", "api", true},
+		{"prefix root", "POST", "", "/api/export", "api", true},
+		{"prefix nested", "POST", "", "/api/export/users/csv", "api", true},
+		{"prefix lookalike", "POST", "", "/api/exports", "api", false},
+		{"other method", "GET", "/api/items", "/api/items", "api", false},
+		{"other path", "POST", "/api/orders", "/api/orders", "api", false},
+		{"other group", "POST", "/api/items", "/api/items", "admin", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, policy.Matches(tt.method, tt.routePath, tt.requestPath, tt.group))
+		})
+	}
+
+	// A policy without criteria matches everything
+	assert.True(t, config.Policy{Name: "all"}.Matches("DELETE", "/x", "/x", ""))
+
+	// Globs match a single path segment
+	glob := config.Policy{Name: "glob", Paths: []string{"/api/*/status"}}
+	assert.True(t, glob.Matches("GET", "", "/api/orders/status", ""))
+	assert.False(t, glob.Matches("GET", "", "/api/orders/1/status", ""))
+}
+
+func TestLoad_Policies(t *testing.T) {
+	t.Setenv("RATE_LIMIT_POLICY_writes", "methods=POST,PUT; paths=/api/items,/api/export/**; limit=2; window=1m; block=5m; group=api; algorithm=gcra")
+	t.Setenv("RATE_LIMIT_POLICY_reads", "methods=GET;limit=100")
+
+	cfg, err := config.Load()
+	require.NoError(t, err)
+	require.Len(t, cfg.RateLimit.Policies, 2)
+
+	// Policies from the environment are ordered by name
+	reads, writes := cfg.RateLimit.Policies[0], cfg.RateLimit.Policies[1]
+
+	assert.Equal(t, "reads", reads.Name)
+	assert.Equal(t, []string{"GET"}, reads.Methods)
+	assert.Equal(t, 100, reads.Requests)
+	assert.Equal(t, time.Second, reads.Window)
+
+	assert.Equal(t, config.Policy{
+		Name:          "writes",
+		Methods:       []string{"POST", "PUT"},
+		Paths:         []string{"/api/items", "/api/export/**"},
+		Group:         "api",
+		Requests:      2,
+		Window:        time.Minute,
+		BlockDuration: 5 * time.Minute,
+		Algorithm:     config.AlgorithmGCRA,
+	}, writes)
+}
+
+func TestLoad_InvalidPolicies(t *testing.T) {
+	tests := map[string]string{
+		"unknown field":     "limit=1;burst=2",
+		"missing value":     "limit",
+		"bad limit":         "limit=many",
+		"bad window":        "limit=1;window=soon",
+		"zero window":       "limit=1;window=0s",
+		"unknown algorithm": "limit=1;algorithm=leaky",
+		"bad pattern":       "limit=1;paths=/api/[",
+		"no limit":          "paths=/api/**;window=1m",
+	}
+
+	for name, value := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv("RATE_LIMIT_POLICY_broken", value)
+
+			_, err := config.Load()
+			assert.ErrorContains(t, err, "broken")
+		})
+	}
+
+	// Only cost-only policies may leave the limit out
+	t.Setenv("RATE_LIMIT_POLICY_broken", "paths=/api/**")
+	_, err := config.Load()
+	assert.ErrorContains(t, err, "policy broken: limit is required")
+
+	t.Setenv("RATE_LIMIT_POLICY_broken", "paths=/api/**;cost=2")
+	cfg, err := config.Load()
+	require.NoError(t, err)
+	assert.True(t, cfg.RateLimit.Policies[0].CostOnly)
+}
+
+func TestRateLimiterMiddleware_Policies(t *testing.T) {
+	cfg := &config.Config{
+		RateLimit: config.RateLimitConfig{
+			IPRequestsPerSecond:    5,
+			IPBlockDurationMinutes: 0,
+			TokenLimits:            make(map[string]config.TokenLimit),
+			Policies: []config.Policy{
+				{
+					Name:          "writes",
+					Methods:       []string{"POST"},
+					Paths:         []string{"/api/items"},
+					Group:         "api",
+					Requests:      1,
+					Window:        time.Minute,
+					BlockDuration: time.Minute,
+				},
+				{
+					Name:     "reads",
+					Methods:  []string{"GET"},
+					Group:    "api",
+					Requests: 3,
+					Window:   time.Minute,
+				},
+			},
+		},
+	}
+
+	store := storage.NewMemoryStorage()
+	defer store.Close()
+
+	rl := limiter.NewRateLimiter(store, cfg)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	api := router.Group("/api")
+	api.Use(middleware.RateLimiterMiddleware(rl, middleware.WithGroup("api")))
+	api.GET("/items", func(c *gin.Context) { c.Status(200) })
+	api.POST("/items", func(c *gin.Context) { c.Status(201) })
+	api.DELETE("/items", func(c *gin.Context) { c.Status(204) })
+
+	other := router.Group("/other")
+	other.Use(middleware.RateLimiterMiddleware(rl))
+	other.GET("/items", func(c *gin.Context) { c.Status(200) })
+
+	send := func(method, path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, path, nil)
+		req.RemoteAddr = "192.168.3.1:12345"
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	// The expensive POST gets a single request per minute
+	assert.Equal(t, 201, send("POST", "/api/items").Code)
+	w := send("POST", "/api/items")
+	assert.Equal(t, 429, w.Code)
+	assert.Equal(t, "1;w=60", w.Header().Get("RateLimit-Policy"))
+
+	// GETs have their own budget and keys, so the blocked POST does not affect them
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, 200, send("GET", "/api/items").Code, "GET %d should be allowed", i+1)
+	}
+	assert.Equal(t, 429, send("GET", "/api/items").Code)
+
+	// Requests matching no policy fall back to the IP limit
+	assert.Equal(t, 204, send("DELETE", "/api/items").Code)
+
+	// Policies restricted to the api group do not apply to other groups
+	w = send("GET", "/other/items")
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "5", w.Header().Get("RateLimit-Limit"))
+
+	blocked, err := store.IsBlocked(context.Background(), "policy:writes:192.168.3.1")
+	require.NoError(t, err)
+	assert.True(t, blocked)
+}
@@ -0,0 +1,248 @@
+package test
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"rate-limiter/internal/config"
+	"rate-limiter/internal/server"
+	"rate-limiter/internal/storage"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newProxyServer runs the server in proxy mode in front of the given upstreams,
+// allowing 3 requests per IP
+func newProxyServer(t *testing.T, upstreams ...config.Upstream) *httptest.Server {
+	t.Helper()
+
+	gin.SetMode(gin.TestMode)
+
+	cfg := &config.Config{
+		RateLimit: config.RateLimitConfig{
+			IPRequestsPerSecond:    3,
+			IPBlockDurationMinutes: 1,
+			Policies:               []config.Policy{{Name: "uploads", Paths: []string{"/upload"}, Group: "proxy", Requests: 1, Window: time.Minute}},
+		},
+		Server: config.ServerConfig{
+			Mode:           config.ModeProxy,
+			Upstreams:      upstreams,
+			TrustedProxies: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+		},
+	}
+
+	store := storage.NewMemoryStorage()
+	t.Cleanup(func() { store.Close() })
+
+	srv, err := server.New(cfg, store)
+	require.NoError(t, err)
+
+	proxy := httptest.NewServer(srv.Handler())
+	t.Cleanup(proxy.Close)
+
+	return proxy
+}
+
+// upstream serves handler and returns it as an upstream mounted at prefix
+func upstream(t *testing.T, prefix string, handler http.HandlerFunc) config.Upstream {
+	t.Helper()
+
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+
+	target, err := url.Parse(srv.URL)
+	require.NoError(t, err)
+
+	return config.Upstream{PathPrefix: prefix, URL: target}
+}
+
+func TestProxy_Forwarding(t *testing.T) {
+	var hits int
+	legacy := upstream(t, "/", func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		w.Header().Set("X-Upstream", "legacy")
+		fmt.Fprintf(w, "%s %s xff=%s real=%s", r.Method, r.URL.Path, r.Header.Get("X-Forwarded-For"), r.Header.Get("X-Real-IP"))
+	})
+	orders := upstream(t, "/orders", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "orders")
+	})
+
+	proxy := newProxyServer(t, orders, legacy)
+
+	get := func(path string) (*http.Response, string) {
+		resp, err := http.Get(proxy.URL + path)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp, string(body)
+	}
+
+	resp, body := get("/legacy/page")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "GET /legacy/page xff=127.0.0.1 real=127.0.0.1", body)
+	assert.Equal(t, "legacy", resp.Header.Get("X-Upstream"))
+
+	// The rate limit headers are added to the upstream response
+	assert.Equal(t, "3", resp.Header.Get("RateLimit-Limit"))
+	assert.Equal(t, "2", resp.Header.Get("RateLimit-Remaining"))
+
+	// The longest prefix wins
+	_, body = get("/orders/42")
+	assert.Equal(t, "orders", body)
+
+	_, _ = get("/legacy/page")
+	resp, _ = get("/legacy/page")
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.Equal(t, "60", resp.Header.Get("Retry-After"))
+	assert.Equal(t, 2, hits, "denied requests never reach the upstream")
+
+	// The routes of the limiter itself are not proxied
+	resp, _ = get("/health")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, 2, hits)
+}
+
+func TestProxy_Policies(t *testing.T) {
+	proxy := newProxyServer(t, upstream(t, "/", func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.WriteHeader(http.StatusCreated)
+	}))
+
+	post := func() int {
+		resp, err := http.Post(proxy.URL+"/upload", "text/plain", strings.NewReader("data"))
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// Policies for the proxy group apply before forwarding
+	assert.Equal(t, http.StatusCreated, post())
+	assert.Equal(t, http.StatusTooManyRequests, post())
+}
+
+func TestProxy_Streaming(t *testing.T) {
+	release := make(chan struct{})
+	proxy := newProxyServer(t, upstream(t, "/", func(w http.ResponseWriter, r *http.Request) {
+		// Echo the request body as it arrives, then wait before finishing
+		http.NewResponseController(w).EnableFullDuplex()
+		reader := bufio.NewReader(r.Body)
+		line, _ := reader.ReadString('\n')
+		fmt.Fprint(w, "got "+line)
+		w.(http.Flusher).Flush()
+		<-release
+		fmt.Fprint(w, "done\n")
+	}))
+	defer close(release)
+
+	pr, pw := io.Pipe()
+	req, _ := http.NewRequest("POST", proxy.URL+"/events", pr)
+
+	done := make(chan *http.Response)
+	go func() {
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			close(done)
+			return
+		}
+		done <- resp
+	}()
+
+	// The request body is streamed to the upstream before it is complete
+	_, err := pw.Write([]byte("hello\n"))
+	require.NoError(t, err)
+
+	var resp *http.Response
+	select {
+	case resp = <-done:
+		require.NotNil(t, resp)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the response was not streamed")
+	}
+	defer resp.Body.Close()
+
+	// And the first chunk of the response arrives while the upstream still writes
+	line, err := bufio.NewReader(resp.Body).ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "got hello\n", line)
+	pw.Close()
+}
+
+func TestProxy_WebSocket(t *testing.T) {
+	proxy := newProxyServer(t, upstream(t, "/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "websocket" {
+			http.Error(w, "upgrade required", http.StatusUpgradeRequired)
+			return
+		}
+
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		fmt.Fprint(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		rw.Flush()
+
+		// Echo whatever the client sends on the upgraded connection
+		io.Copy(conn, rw)
+	}))
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(proxy.URL, "http://"))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	fmt.Fprint(conn, "GET /socket HTTP/1.1\r\nHost: test\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+	assert.Equal(t, "2", resp.Header.Get("RateLimit-Remaining"))
+
+	_, err = fmt.Fprint(conn, "ping\n")
+	require.NoError(t, err)
+
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	line, err := reader.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "ping\n", line)
+}
+
+func TestProxy_Config(t *testing.T) {
+	t.Setenv("PROXY_UPSTREAMS", "http://web:8080, /api=http://api:9000/v1")
+	t.Setenv("SERVER_MODE", "proxy")
+
+	cfg, err := config.Load()
+	require.NoError(t, err)
+	require.Len(t, cfg.Server.Upstreams, 2)
+	assert.Equal(t, config.ModeProxy, cfg.Server.Mode)
+
+	upstream, ok := cfg.Server.UpstreamFor("/api/users")
+	require.True(t, ok)
+	assert.Equal(t, "http://api:9000/v1", upstream.URL.String())
+
+	upstream, ok = cfg.Server.UpstreamFor("/apis")
+	require.True(t, ok)
+	assert.Equal(t, "http://web:8080", upstream.URL.String())
+
+	t.Setenv("PROXY_UPSTREAMS", "/api=ftp://files")
+	_, err = config.Load()
+	assert.ErrorContains(t, err, "PROXY_UPSTREAMS: invalid upstream URL")
+
+	// Proxy mode needs an upstream
+	_, err = server.New(&config.Config{Server: config.ServerConfig{Mode: config.ModeProxy}}, storage.NewMemoryStorage())
+	assert.ErrorContains(t, err, "proxy mode requires PROXY_UPSTREAMS")
+}
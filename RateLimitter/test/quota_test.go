@@ -0,0 +1,206 @@
+package test
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"rate-limiter/internal/config"
+	"rate-limiter/internal/limiter"
+	"rate-limiter/internal/middleware"
+	"rate-limiter/internal/storage"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// quotaConfig limits the paid token to 10 requests per second, 3 per day and 5 per month
+func quotaConfig() *config.Config {
+	return &config.Config{
+		RateLimit: config.RateLimitConfig{
+			IPRequestsPerSecond:    2,
+			IPBlockDurationMinutes: 1,
+			TokenLimits: map[string]config.TokenLimit{
+				"paid": {
+					RequestsPerSecond:    10,
+					BlockDurationMinutes: 1,
+					Quotas:               map[string]int{config.QuotaDay: 3, config.QuotaMonth: 5},
+				},
+			},
+		},
+	}
+}
+
+func TestQuota_Tiers(t *testing.T) {
+	server := miniredis.RunT(t)
+	host, port, err := net.SplitHostPort(server.Addr())
+	require.NoError(t, err)
+
+	redis, err := storage.NewRedisStorage(host, port, "", 0)
+	require.NoError(t, err)
+
+	rl := limiter.NewRateLimiter(redis, quotaConfig())
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		result, err := rl.CheckRequest(ctx, limiter.Key{IP: "192.168.1.1", Token: "paid"})
+		require.NoError(t, err)
+		require.True(t, result.Allowed)
+		require.Len(t, result.Quotas, 2)
+		assert.Equal(t, config.QuotaDay, result.Quotas[0].Period)
+		assert.Equal(t, 2-i, result.Quotas[0].Remaining)
+		assert.Equal(t, config.QuotaMonth, result.Quotas[1].Period)
+		assert.Equal(t, 4-i, result.Quotas[1].Remaining)
+	}
+
+	// The day quota runs out long before the per second limit does
+	result, err := rl.CheckRequest(ctx, limiter.Key{IP: "192.168.1.1", Token: "paid"})
+	require.NoError(t, err)
+	assert.False(t, result.Allowed)
+	assert.Equal(t, config.QuotaDay, result.Quota)
+	assert.Equal(t, "Quota exceeded: 3 requests per day", result.Reason)
+	assert.Equal(t, 7, result.Remaining, "the per second limit still describes the burst tier, untouched by the refused request")
+
+	_, midnight, _ := config.QuotaWindow(config.QuotaDay, time.Now())
+	assert.InDelta(t, time.Until(midnight).Seconds(), result.RetryAfter.Seconds(), 2)
+
+	// A refused request does not use up the month
+	assert.Equal(t, 2, result.Quotas[1].Remaining)
+
+	// Usage is kept in Redis, so it survives a restart
+	redis.Close()
+	redis, err = storage.NewRedisStorage(host, port, "", 0)
+	require.NoError(t, err)
+	defer redis.Close()
+
+	result, err = limiter.NewRateLimiter(redis, quotaConfig()).CheckRequest(ctx, limiter.Key{IP: "192.168.1.1", Token: "paid"})
+	require.NoError(t, err)
+	assert.False(t, result.Allowed)
+	assert.Equal(t, config.QuotaDay, result.Quota)
+}
+
+func TestQuota_DeniedUsesNoQuota(t *testing.T) {
+	cfg := quotaConfig()
+	cfg.RateLimit.TokenLimits["paid"] = config.TokenLimit{
+		RequestsPerSecond: 10,
+		Quotas:            map[string]int{config.QuotaHour: 5, config.QuotaMonth: 2},
+	}
+
+	for _, backend := range newTestBackends(t) {
+		t.Run(backend.name, func(t *testing.T) {
+			rl := limiter.NewRateLimiter(backend.store, cfg)
+			rl.SetClock(backend.clock)
+			ctx := context.Background()
+
+			for i := 0; i < 2; i++ {
+				result, err := rl.CheckRequest(ctx, limiter.Key{IP: "192.168.1.1", Token: "paid"})
+				require.NoError(t, err)
+				require.True(t, result.Allowed)
+			}
+
+			// The month quota is used up, and the requests it refuses leave the hour and
+			// the per second limit alone
+			for i := 0; i < 3; i++ {
+				result, err := rl.CheckRequest(ctx, limiter.Key{IP: "192.168.1.1", Token: "paid"})
+				require.NoError(t, err)
+				require.False(t, result.Allowed)
+				assert.Equal(t, config.QuotaMonth, result.Quota)
+				assert.Equal(t, 8, result.Remaining)
+				require.Len(t, result.Quotas, 2)
+				assert.Equal(t, config.QuotaHour, result.Quotas[0].Period)
+				assert.Equal(t, 3, result.Quotas[0].Remaining)
+			}
+		})
+	}
+}
+
+func TestQuota_Headers(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	defer store.Close()
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(middleware.RateLimiterMiddleware(limiter.NewRateLimiter(store, quotaConfig())))
+	router.GET("/test", func(c *gin.Context) {
+		c.JSON(200, gin.H{"message": "success"})
+	})
+
+	request := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/test", nil)
+		req.RemoteAddr = "192.168.1.1:12345"
+		req.Header.Set("API_KEY", "paid")
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := request()
+	require.Equal(t, 200, w.Code)
+	assert.Equal(t, "10", w.Header().Get("RateLimit-Limit"))
+	assert.Equal(t, "3", w.Header().Get("RateLimit-Day-Limit"))
+	assert.Equal(t, "2", w.Header().Get("RateLimit-Day-Remaining"))
+	assert.Equal(t, "5", w.Header().Get("RateLimit-Month-Limit"))
+	assert.Equal(t, "4", w.Header().Get("RateLimit-Month-Remaining"))
+	assert.Contains(t, w.Header().Get("RateLimit-Policy"), `3;w=86400;name="day"`)
+
+	reset, err := strconv.Atoi(w.Header().Get("RateLimit-Day-Reset"))
+	require.NoError(t, err)
+	assert.Greater(t, reset, 0)
+	assert.LessOrEqual(t, reset, 86400)
+
+	request()
+	request()
+	w = request()
+	assert.Equal(t, 429, w.Code)
+	assert.Equal(t, "0", w.Header().Get("RateLimit-Day-Remaining"))
+	assert.Equal(t, w.Header().Get("RateLimit-Day-Reset"), w.Header().Get("Retry-After"))
+}
+
+func TestQuota_Windows(t *testing.T) {
+	now := time.Date(2024, time.January, 31, 22, 30, 0, 0, time.FixedZone("BRT", -3*3600))
+
+	// Periods are calendar periods in UTC
+	start, end, stamp := config.QuotaWindow(config.QuotaDay, now)
+	assert.Equal(t, time.Date(2024, time.February, 1, 0, 0, 0, 0, time.UTC), start)
+	assert.Equal(t, time.Date(2024, time.February, 2, 0, 0, 0, 0, time.UTC), end)
+	assert.Equal(t, "2024-02-01", stamp)
+
+	start, end, stamp = config.QuotaWindow(config.QuotaMonth, now)
+	assert.Equal(t, time.Date(2024, time.February, 1, 0, 0, 0, 0, time.UTC), start)
+	assert.Equal(t, time.Date(2024, time.March, 1, 0, 0, 0, 0, time.UTC), end)
+	assert.Equal(t, "2024-02", stamp)
+
+	_, end, stamp = config.QuotaWindow(config.QuotaHour, now)
+	assert.Equal(t, time.Date(2024, time.February, 1, 2, 0, 0, 0, time.UTC), end)
+	assert.Equal(t, "2024-02-01T01", stamp)
+}
+
+func TestQuota_Config(t *testing.T) {
+	t.Setenv("TOKEN_LIMIT_paid", "10:1")
+	t.Setenv("TOKEN_QUOTA_paid", "50000/day, 1000000/month")
+
+	cfg, err := config.Load()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{"day": 50000, "month": 1000000}, cfg.RateLimit.TokenLimits["paid"].Quotas)
+
+	t.Setenv("TOKEN_QUOTA_paid", "50000/week")
+	_, err = config.Load()
+	assert.ErrorContains(t, err, `unknown quota period "week"`)
+
+	t.Setenv("TOKEN_QUOTA_paid", "")
+	t.Setenv("TOKEN_QUOTA_free", "100/day")
+	_, err = config.Load()
+	assert.ErrorContains(t, err, "has no TOKEN_LIMIT_free")
+
+	_, err = config.ParsePolicyFile([]byte("tokens:\n  paid:\n    requests_per_second: 10\n    quotas: {day: 50000, month: 1000000}\n"), false)
+	assert.NoError(t, err)
+
+	_, err = config.ParsePolicyFile([]byte("ip:\n  requests_per_second: 10\n  quotas: {day: 100}\n"), false)
+	assert.ErrorContains(t, err, "quotas are only supported for tokens")
+}
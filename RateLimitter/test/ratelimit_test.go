@@ -0,0 +1,184 @@
+package test
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strconv"
+	"testing"
+	"time"
+
+	"rate-limiter/pkg/ratelimit"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// newLibraryLimiter returns a limiter built through the public package, allowing
+// 2 requests per second per IP and 5 for token abc123
+func newLibraryLimiter(t *testing.T) *ratelimit.RateLimiter {
+	t.Helper()
+
+	store := ratelimit.NewMemoryStorage()
+	t.Cleanup(func() { store.Close() })
+
+	return ratelimit.New(store, &ratelimit.Config{
+		RateLimit: ratelimit.Limits{
+			IPRequestsPerSecond:    2,
+			IPBlockDurationMinutes: 1,
+			TokenLimits:            map[string]ratelimit.TokenLimit{"abc123": {RequestsPerSecond: 5, BlockDurationMinutes: 1}},
+			Denylist:               []netip.Prefix{netip.MustParsePrefix("203.0.113.0/24")},
+		},
+	})
+}
+
+func TestHTTPMiddleware(t *testing.T) {
+	handler := ratelimit.HTTPMiddleware(newLibraryLimiter(t), ratelimit.WithTokenKey("X-Api-Key"))(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("ok"))
+		}),
+	)
+
+	send := func(remoteAddr, token string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/orders", nil)
+		req.RemoteAddr = remoteAddr
+		if token != "" {
+			req.Header.Set("X-Api-Key", token)
+		}
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	for i := 0; i < 2; i++ {
+		w := send("192.168.1.1:1234", "")
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "ok", w.Body.String())
+		assert.Equal(t, "2", w.Header().Get("RateLimit-Limit"))
+	}
+
+	w := send("192.168.1.1:1234", "")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "60", w.Header().Get("Retry-After"))
+	assert.Contains(t, w.Body.String(), "maximum number of requests")
+
+	// The token header configured replaces the IP limit
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, http.StatusOK, send("192.168.1.2:1234", "abc123").Code)
+	}
+	assert.Equal(t, http.StatusTooManyRequests, send("192.168.1.2:1234", "abc123").Code)
+
+	w = send("203.0.113.9:1234", "")
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Contains(t, w.Body.String(), "forbidden")
+}
+
+// dialHealth serves the gRPC health service behind the interceptors and returns a client
+func dialHealth(t *testing.T, rl *ratelimit.RateLimiter, opts ...ratelimit.Option) healthpb.HealthClient {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	server := grpc.NewServer(
+		grpc.UnaryInterceptor(ratelimit.UnaryServerInterceptor(rl, opts...)),
+		grpc.StreamInterceptor(ratelimit.StreamServerInterceptor(rl, opts...)),
+	)
+	healthpb.RegisterHealthServer(server, health.NewServer())
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.Dial(listener.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	return healthpb.NewHealthClient(conn)
+}
+
+func TestUnaryServerInterceptor(t *testing.T) {
+	client := dialHealth(t, newLibraryLimiter(t))
+	ctx := context.Background()
+
+	// The token is read from the metadata
+	tokenCtx := metadata.AppendToOutgoingContext(ctx, "api_key", "abc123")
+	for i := 0; i < 5; i++ {
+		_, err := client.Check(tokenCtx, &healthpb.HealthCheckRequest{})
+		require.NoError(t, err)
+	}
+	_, err := client.Check(tokenCtx, &healthpb.HealthCheckRequest{})
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+
+	// Without a token the peer address is limited
+	for i := 0; i < 2; i++ {
+		var header metadata.MD
+		_, err := client.Check(ctx, &healthpb.HealthCheckRequest{}, grpc.Header(&header))
+		require.NoError(t, err)
+		assert.Equal(t, []string{"2"}, header.Get("ratelimit-limit"))
+		assert.Equal(t, []string{strconv.Itoa(1 - i)}, header.Get("ratelimit-remaining"))
+	}
+
+	var header metadata.MD
+	_, err = client.Check(ctx, &healthpb.HealthCheckRequest{}, grpc.Header(&header))
+	require.Error(t, err)
+
+	st := status.Convert(err)
+	assert.Equal(t, codes.ResourceExhausted, st.Code())
+	require.Len(t, st.Details(), 1)
+	retry, ok := st.Details()[0].(*errdetails.RetryInfo)
+	require.True(t, ok)
+	assert.InDelta(t, time.Minute, retry.RetryDelay.AsDuration(), float64(time.Second))
+	assert.Equal(t, []string{"60"}, header.Get("retry-after"))
+}
+
+func TestUnaryServerInterceptor_ForwardedClient(t *testing.T) {
+	client := dialHealth(t, newLibraryLimiter(t),
+		ratelimit.WithTrustedProxies([]netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}),
+	)
+
+	check := func(clientIP string) codes.Code {
+		ctx := metadata.AppendToOutgoingContext(context.Background(), "x-forwarded-for", clientIP)
+		_, err := client.Check(ctx, &healthpb.HealthCheckRequest{})
+		return status.Code(err)
+	}
+
+	// Each forwarded client has its own limit
+	assert.Equal(t, codes.OK, check("198.51.100.1"))
+	assert.Equal(t, codes.OK, check("198.51.100.1"))
+	assert.Equal(t, codes.ResourceExhausted, check("198.51.100.1"))
+	assert.Equal(t, codes.OK, check("198.51.100.2"))
+
+	assert.Equal(t, codes.PermissionDenied, check("203.0.113.5"))
+}
+
+func TestStreamServerInterceptor(t *testing.T) {
+	client := dialHealth(t, newLibraryLimiter(t))
+
+	watch := func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		stream, err := client.Watch(ctx, &healthpb.HealthCheckRequest{})
+		if err != nil {
+			return err
+		}
+		_, err = stream.Recv()
+		return err
+	}
+
+	// Each stream opened counts as one request
+	require.NoError(t, watch())
+	require.NoError(t, watch())
+
+	err := watch()
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+}
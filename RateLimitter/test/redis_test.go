@@ -0,0 +1,211 @@
+package test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"rate-limiter/internal/config"
+	"rate-limiter/internal/limiter"
+	"rate-limiter/internal/storage"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRedisStorage_Cluster(t *testing.T) {
+	server := miniredis.RunT(t)
+
+	store := storage.DialRedisOptions(storage.RedisOptions{Addrs: []string{server.Addr()}, Cluster: true})
+	defer store.Close()
+	ctx := context.Background()
+
+	req := storage.ConsumeRequest{Key: "192.168.1.1", Limit: 1, Window: time.Second, Cost: 1, BlockDuration: time.Minute, Now: time.Now()}
+	result, err := store.Consume(ctx, limiter.FixedWindow{}, req)
+	require.NoError(t, err)
+	assert.True(t, result.Allowed)
+
+	result, err = store.Consume(ctx, limiter.FixedWindow{}, req)
+	require.NoError(t, err)
+	assert.False(t, result.Allowed)
+
+	// The state and the block of a key share a hash tag, so they live in the same slot
+	assert.True(t, server.Exists("fixed_window:{192.168.1.1}"))
+	assert.True(t, server.Exists("block:{192.168.1.1}"))
+
+	blocks, err := store.ListBlocks(ctx)
+	require.NoError(t, err)
+	require.Len(t, blocks, 1)
+	assert.Equal(t, "192.168.1.1", blocks[0].Key)
+
+	counters, err := store.ListCounters(ctx, limiter.FixedWindow{}, "192.168.")
+	require.NoError(t, err)
+	require.Len(t, counters, 1)
+	assert.Equal(t, "192.168.1.1", counters[0].Key)
+	assert.Equal(t, float64(1), counters[0].Fields["count"])
+
+	require.NoError(t, store.ResetCounter(ctx, limiter.FixedWindow{}, "192.168.1.1"))
+	require.NoError(t, store.Unblock(ctx, "192.168.1.1"))
+	assert.False(t, server.Exists("fixed_window:{192.168.1.1}"))
+	assert.False(t, server.Exists("block:{192.168.1.1}"))
+}
+
+func TestRedisStorage_BlockWithoutExpiry(t *testing.T) {
+	server := miniredis.RunT(t)
+
+	store := storage.DialRedisOptions(storage.RedisOptions{Addrs: []string{server.Addr()}})
+	defer store.Close()
+	ctx := context.Background()
+
+	// Blocks always expire, so a block key left without an expiration blocks nothing
+	require.NoError(t, server.Set("block:192.168.1.1", "1"))
+
+	blocked, err := store.IsBlocked(ctx, "192.168.1.1")
+	require.NoError(t, err)
+	assert.False(t, blocked)
+
+	req := storage.ConsumeRequest{Key: "192.168.1.1", Limit: 1, Window: time.Second, Cost: 1, BlockDuration: time.Minute, Now: time.Now()}
+	result, err := store.Consume(ctx, limiter.FixedWindow{}, req)
+	require.NoError(t, err)
+	assert.True(t, result.Allowed)
+	assert.False(t, result.Blocked)
+
+	// A denied request replaces it with a block that expires
+	result, err = store.Consume(ctx, limiter.FixedWindow{}, req)
+	require.NoError(t, err)
+	assert.False(t, result.Allowed)
+	assert.Equal(t, time.Minute, result.RetryAfter)
+	assert.Equal(t, time.Minute, server.TTL("block:192.168.1.1"))
+
+	result, err = store.Consume(ctx, limiter.FixedWindow{}, req)
+	require.NoError(t, err)
+	assert.True(t, result.Blocked)
+	assert.Positive(t, result.RetryAfter)
+}
+
+func TestRedisStorage_ACL(t *testing.T) {
+	server := miniredis.RunT(t)
+	server.RequireUserAuth("limiter", "s3cret")
+	ctx := context.Background()
+
+	store := storage.DialRedisOptions(storage.RedisOptions{Addrs: []string{server.Addr()}, Username: "limiter", Password: "s3cret"})
+	defer store.Close()
+	require.NoError(t, store.Ping(ctx))
+
+	wrong := storage.DialRedisOptions(storage.RedisOptions{Addrs: []string{server.Addr()}, Username: "limiter", Password: "wrong"})
+	defer wrong.Close()
+	assert.Error(t, wrong.Ping(ctx))
+}
+
+func TestRedisStorage_TLS(t *testing.T) {
+	caFile, serverCert := newTestCA(t)
+
+	server, err := miniredis.RunTLS(&tls.Config{Certificates: []tls.Certificate{serverCert}})
+	require.NoError(t, err)
+	defer server.Close()
+	ctx := context.Background()
+
+	cfg := config.RedisConfig{TLS: config.RedisTLSConfig{Enabled: true, CAFile: caFile}}
+	tlsConfig, err := cfg.TLSConfig()
+	require.NoError(t, err)
+
+	store := storage.DialRedisOptions(storage.RedisOptions{Addrs: []string{server.Addr()}, TLS: tlsConfig, PoolSize: 2, DialTimeout: time.Second})
+	defer store.Close()
+	require.NoError(t, store.Ping(ctx))
+
+	// The system pool does not trust the test CA
+	untrusted := storage.DialRedisOptions(storage.RedisOptions{Addrs: []string{server.Addr()}, TLS: &tls.Config{}, DialTimeout: time.Second})
+	defer untrusted.Close()
+	assert.Error(t, untrusted.Ping(ctx))
+}
+
+func TestRedisConfig_Topologies(t *testing.T) {
+	t.Setenv("REDIS_SENTINEL_ADDRS", "sentinel-1:26379, sentinel-2:26379")
+	t.Setenv("REDIS_SENTINEL_MASTER", "mymaster")
+	t.Setenv("REDIS_USERNAME", "limiter")
+	t.Setenv("REDIS_POOL_SIZE", "50")
+	t.Setenv("REDIS_READ_TIMEOUT_MS", "250")
+
+	cfg, err := config.Load()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"sentinel-1:26379", "sentinel-2:26379"}, cfg.Redis.Addrs())
+	assert.Equal(t, "mymaster", cfg.Redis.MasterName)
+	assert.Equal(t, "limiter", cfg.Redis.Username)
+	assert.Equal(t, 50, cfg.Redis.PoolSize)
+	assert.Equal(t, 250*time.Millisecond, cfg.Redis.ReadTimeout)
+
+	t.Setenv("REDIS_CLUSTER_ADDRS", "node-1:6379")
+	_, err = config.Load()
+	assert.ErrorContains(t, err, "not both")
+
+	t.Setenv("REDIS_SENTINEL_ADDRS", "")
+	t.Setenv("REDIS_SENTINEL_MASTER", "")
+	cfg, err = config.Load()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"node-1:6379"}, cfg.Redis.Addrs())
+
+	t.Setenv("REDIS_CLUSTER_ADDRS", "")
+	t.Setenv("REDIS_SENTINEL_MASTER", "mymaster")
+	_, err = config.Load()
+	assert.ErrorContains(t, err, "must be set together")
+
+	t.Setenv("REDIS_SENTINEL_MASTER", "")
+	t.Setenv("REDIS_TLS", "true")
+	t.Setenv("REDIS_TLS_CA_FILE", filepath.Join(t.TempDir(), "missing.pem"))
+	_, err = config.Load()
+	assert.ErrorContains(t, err, "REDIS_TLS_CA_FILE")
+}
+
+// newTestCA creates a CA, writes it to a file and issues a certificate for 127.0.0.1
+func newTestCA(t *testing.T) (string, tls.Certificate) {
+	t.Helper()
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	require.NoError(t, err)
+	caCert, err := x509.ParseCertificate(caDER)
+	require.NoError(t, err)
+
+	serverKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	serverTemplate := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "redis"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	serverDER, err := x509.CreateCertificate(rand.Reader, serverTemplate, caCert, &serverKey.PublicKey, caKey)
+	require.NoError(t, err)
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	require.NoError(t, os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER}), 0o600))
+
+	return caFile, tls.Certificate{Certificate: [][]byte{serverDER}, PrivateKey: serverKey}
+}
@@ -0,0 +1,148 @@
+package test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"rate-limiter/internal/config"
+	"rate-limiter/internal/limiter"
+	"rate-limiter/internal/metrics"
+	"rate-limiter/internal/middleware"
+	"rate-limiter/internal/storage"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// shadowConfig tries a limit of 2 requests a minute on /api while 4 are enforced
+func shadowConfig() *config.Config {
+	return &config.Config{
+		RateLimit: config.RateLimitConfig{
+			IPRequestsPerSecond: 100,
+			Policies: []config.Policy{
+				{Name: "strict", Paths: []string{"/api/**"}, Requests: 2, Window: time.Minute, BlockDuration: time.Hour, Shadow: true},
+				{Name: "api", Paths: []string{"/api/**"}, Requests: 4, Window: time.Minute},
+			},
+		},
+	}
+}
+
+func TestShadow_RateLimiter(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	defer store.Close()
+	rl := limiter.NewRateLimiter(store, shadowConfig())
+	ctx := context.Background()
+
+	shadowDenials := func() float64 {
+		return testutil.ToFloat64(metrics.Shadow.WithLabelValues(metrics.Denied, "strict", limiter.KeyTypeIP, "blocked"))
+	}
+	before := shadowDenials()
+
+	// The shadow policy does not hide the enforced one
+	policy := rl.MatchPolicy("GET", "/api/users", "/api/users", "")
+	require.NotNil(t, policy)
+	assert.Equal(t, "api", policy.Name)
+	shadow := rl.MatchShadowPolicies("GET", "/api/users", "/api/users", "")
+	require.Len(t, shadow, 1)
+	assert.Equal(t, "strict", shadow[0].Name)
+
+	for i := 1; i <= 5; i++ {
+		result, err := rl.CheckPolicies(ctx, policy, shadow, limiter.Key{IP: "192.168.1.1"})
+		require.NoError(t, err)
+		assert.Equal(t, "api", result.Policy)
+		assert.Equal(t, i <= 4, result.Allowed, "request %d", i)
+
+		if i <= 2 {
+			assert.Empty(t, result.ShadowDenials, "request %d", i)
+		} else {
+			assert.Equal(t, []string{"strict"}, result.ShadowDenials, "request %d", i)
+		}
+	}
+
+	// The shadow block keeps counting would-be denials but blocks nothing
+	assert.Equal(t, 2.0, shadowDenials()-before)
+	blocked, err := rl.IsBlocked(ctx, "192.168.1.1", "")
+	require.NoError(t, err)
+	assert.False(t, blocked)
+
+	// A shadow policy given directly is evaluated while the IP limits are enforced
+	result, err := rl.CheckPolicy(ctx, shadow[0], limiter.Key{IP: "192.168.1.2"})
+	require.NoError(t, err)
+	assert.True(t, result.Allowed)
+	assert.Empty(t, result.Policy)
+	assert.Equal(t, 100, result.Limit)
+}
+
+func TestShadow_CheckRequest(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	defer store.Close()
+
+	cfg := shadowConfig()
+	cfg.RateLimit.Policies = append(cfg.RateLimit.Policies, config.Policy{Name: "global", Requests: 1, Window: time.Minute, Shadow: true})
+	rl := limiter.NewRateLimiter(store, cfg)
+	ctx := context.Background()
+
+	// Only shadow policies matching any request apply without a route
+	for i := 1; i <= 3; i++ {
+		result, err := rl.CheckRequest(ctx, limiter.Key{IP: "192.168.1.1"})
+		require.NoError(t, err)
+		assert.True(t, result.Allowed)
+		if i == 1 {
+			assert.Empty(t, result.ShadowDenials)
+		} else {
+			assert.Equal(t, []string{"global"}, result.ShadowDenials)
+		}
+	}
+}
+
+func TestShadow_Middleware(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	defer store.Close()
+
+	cfg := shadowConfig()
+	cfg.RateLimit.Policies = cfg.RateLimit.Policies[:1]
+	rl := limiter.NewRateLimiter(store, cfg)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(middleware.RateLimiterMiddleware(rl))
+	router.GET("/api/users", func(c *gin.Context) {
+		c.JSON(200, gin.H{"message": "success"})
+	})
+
+	for i := 0; i < 5; i++ {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/api/users", nil)
+		req.RemoteAddr = "192.168.1.1:12345"
+		router.ServeHTTP(w, req)
+
+		// Clients only see the limits that are enforced
+		assert.Equal(t, 200, w.Code)
+		assert.Equal(t, "100", w.Header().Get("RateLimit-Limit"))
+	}
+}
+
+func TestShadow_Config(t *testing.T) {
+	t.Setenv("RATE_LIMIT_POLICY_strict", "paths=/api/**;limit=2;window=1m;shadow=true")
+	t.Setenv("RATE_LIMIT_POLICIES_FILE", writePolicyFile(t, "policies.yaml", "routes:\n  - {name: login, paths: [/login], limit: 1, window: 1m, shadow: true}\n"))
+
+	cfg, err := config.Load()
+	require.NoError(t, err)
+	require.Len(t, cfg.RateLimit.Policies, 2)
+	assert.Equal(t, "login", cfg.RateLimit.Policies[0].Name)
+	assert.True(t, cfg.RateLimit.Policies[0].Shadow)
+	assert.Equal(t, "strict", cfg.RateLimit.Policies[1].Name)
+	assert.True(t, cfg.RateLimit.Policies[1].Shadow)
+
+	t.Setenv("RATE_LIMIT_POLICY_strict", "paths=/api/**;limit=2;shadow=maybe")
+	_, err = config.Load()
+	assert.ErrorContains(t, err, "policy strict: invalid shadow")
+
+	_, err = config.ParsePolicyFile([]byte("routes:\n  - {name: export, cost: 5, shadow: true}\n"), false)
+	assert.ErrorContains(t, err, "policy export: a shadow policy needs a limit")
+}
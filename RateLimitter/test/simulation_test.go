@@ -0,0 +1,97 @@
+package test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"rate-limiter/internal/limiter"
+	"rate-limiter/internal/simulation"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// simulate replays trace against the algorithm called name on backend
+func simulate(t *testing.T, backend testBackend, name string, limit limiter.Limit, trace []simulation.Request) simulation.Timeline {
+	t.Helper()
+
+	algorithm, err := limiter.NewAlgorithm(name)
+	require.NoError(t, err)
+
+	timeline, err := simulation.New(backend.store, backend.clock, backend.advance).Run(context.Background(), algorithm, limit, trace)
+	require.NoError(t, err)
+	return timeline
+}
+
+func TestSimulation_Algorithms(t *testing.T) {
+	// A burst over the limit, then a request every quarter of the window
+	limit := limiter.Limit{Requests: 3, Window: time.Second}
+	trace := simulation.Merge(
+		simulation.Burst("client", 0, 4),
+		simulation.Steady("client", 500*time.Millisecond, 250*time.Millisecond, 8),
+	)
+
+	expected := map[string]string{
+		limiter.FixedWindow{}.Name():          "+++---+++-++",
+		limiter.TokenBucket{}.Name():          "+++-+++-+++-",
+		limiter.SlidingWindowLog{}.Name():     "+++---+++-++",
+		limiter.SlidingWindowCounter{}.Name(): "+++-----+++-",
+		limiter.GCRA{}.Name():                 "+++-+++-+++-",
+	}
+
+	for _, name := range allAlgorithms {
+		// Both storages make the same decisions
+		for _, backend := range newTestBackends(t) {
+			t.Run(backend.name+"/"+name, func(t *testing.T) {
+				timeline := simulate(t, backend, name, limit, trace)
+				assert.Equal(t, expected[name], timeline.Pattern(), "\n%s", timeline)
+			})
+		}
+	}
+}
+
+func TestSimulation_Blocks(t *testing.T) {
+	limit := limiter.Limit{Requests: 2, Window: time.Second, BlockDuration: 3 * time.Second}
+	trace := simulation.Merge(
+		simulation.Burst("client", 0, 3),
+		simulation.Steady("client", time.Second, time.Second, 4),
+	)
+
+	for _, backend := range newTestBackends(t) {
+		t.Run(backend.name, func(t *testing.T) {
+			timeline := simulate(t, backend, limiter.FixedWindow{}.Name(), limit, trace)
+
+			// The third request is denied and blocks the key until 3s
+			assert.Equal(t, "++-xx++", timeline.Pattern(), "\n%s", timeline)
+			assert.Equal(t, 3*time.Second, timeline[2].RetryAfter)
+			assert.Equal(t, 2*time.Second, timeline[3].RetryAfter)
+		})
+	}
+}
+
+func TestSimulation_Timeline(t *testing.T) {
+	limit := limiter.Limit{Requests: 2, Window: time.Second}
+	trace := simulation.Merge(
+		simulation.Burst("a", 0, 3),
+		simulation.Burst("b", 0, 1),
+		[]simulation.Request{{At: 100 * time.Millisecond, Key: "b", Cost: 2}},
+	)
+
+	backend := newTestBackends(t)[0]
+	start := backend.clock.Now()
+	timeline := simulate(t, backend, limiter.FixedWindow{}.Name(), limit, trace)
+
+	require.Len(t, timeline, 5)
+	assert.Equal(t, 3, timeline.Allowed())
+	assert.Equal(t, 2, timeline.Denied())
+
+	// Keys are limited apart
+	assert.Equal(t, "++-", timeline.Key("a").Pattern())
+	assert.Equal(t, "+-", timeline.Key("b").Pattern())
+	assert.Equal(t, 2, timeline.Key("b")[1].Cost)
+
+	// The clock is left at the last request
+	assert.Equal(t, start.Add(100*time.Millisecond), backend.clock.Now())
+	assert.Contains(t, timeline.String(), "100ms  b                    denied   remaining=1")
+}
@@ -5,13 +5,15 @@ import (
 	"testing"
 	"time"
 
+	"rate-limiter/internal/clock"
 	"rate-limiter/internal/storage"
 
 	"github.com/stretchr/testify/assert"
 )
 
 func TestMemoryStorage(t *testing.T) {
-	storage := storage.NewMemoryStorage()
+	clock := clock.NewFake(testStart)
+	storage := storage.NewMemoryStorageWithClock(clock)
 	defer storage.Close()
 
 	ctx := context.Background()
@@ -80,8 +82,8 @@ func TestMemoryStorage(t *testing.T) {
 		assert.NoError(t, err)
 		assert.Equal(t, 1, count)
 
-		// Wait for expiration
-		time.Sleep(200 * time.Millisecond)
+		// Let the count expire
+		clock.Advance(200 * time.Millisecond)
 
 		// Count should be 0 after expiration
 		count, err = storage.GetRequestCount(ctx, expKey)
@@ -0,0 +1,216 @@
+package test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"rate-limiter/internal/config"
+	"rate-limiter/internal/limiter"
+	"rate-limiter/internal/server"
+	"rate-limiter/internal/storage"
+	"rate-limiter/internal/telemetry"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	tracesdk "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+var (
+	spanExporterOnce sync.Once
+	spanExporter     *tracetest.InMemoryExporter
+)
+
+// recordSpans makes the global tracer provider keep the spans ended by the test.
+// Tracers stay bound to the first provider registered, so it is registered once.
+func recordSpans(t *testing.T) *tracetest.InMemoryExporter {
+	t.Helper()
+
+	spanExporterOnce.Do(func() {
+		spanExporter = tracetest.NewInMemoryExporter()
+		otel.SetTracerProvider(tracesdk.NewTracerProvider(tracesdk.WithSyncer(spanExporter)))
+	})
+	spanExporter.Reset()
+	return spanExporter
+}
+
+// findSpan returns the span named name, failing the test when there is none
+func findSpan(t *testing.T, spans tracetest.SpanStubs, name string) tracetest.SpanStub {
+	t.Helper()
+
+	for _, span := range spans {
+		if span.Name == name {
+			return span
+		}
+	}
+	require.Failf(t, "span not found", "no span named %s", name)
+	return tracetest.SpanStub{}
+}
+
+// spanAttributes returns the attributes of span as strings
+func spanAttributes(span tracetest.SpanStub) map[string]string {
+	attrs := make(map[string]string)
+	for _, attr := range span.Attributes {
+		attrs[string(attr.Key)] = attr.Value.Emit()
+	}
+	return attrs
+}
+
+func TestTelemetry_CheckRequestSpans(t *testing.T) {
+	exporter := recordSpans(t)
+
+	cfg := &config.Config{
+		RateLimit: config.RateLimitConfig{
+			IPRequestsPerSecond:    10,
+			IPBlockDurationMinutes: 1,
+			TokenLimits:            map[string]config.TokenLimit{"abc123": {RequestsPerSecond: 1, BlockDurationMinutes: 1}},
+		},
+	}
+	store := storage.NewMemoryStorage()
+	defer store.Close()
+	rl := limiter.NewRateLimiter(store, cfg)
+
+	key := limiter.Key{IP: "192.168.1.1", Token: "abc123"}
+	_, err := rl.CheckRequest(context.Background(), key)
+	require.NoError(t, err)
+
+	spans := exporter.GetSpans()
+	check := findSpan(t, spans, "ratelimit.CheckRequest")
+	attrs := spanAttributes(check)
+	assert.Equal(t, "allowed", attrs["rate_limiter.decision"])
+	assert.Equal(t, limiter.KeyTypeToken, attrs["rate_limiter.key_type"])
+	assert.Equal(t, "0", attrs["rate_limiter.remaining"])
+	require.NotEmpty(t, attrs["rate_limiter.key_hash"])
+
+	// Tokens never reach the traces
+	for _, span := range spans {
+		for _, value := range spanAttributes(span) {
+			assert.NotContains(t, value, "abc123")
+		}
+	}
+
+	// Storage operations are children of the check
+	consume := findSpan(t, spans, "storage.consume")
+	assert.Equal(t, check.SpanContext.SpanID(), consume.Parent.SpanID())
+	assert.Equal(t, "memory", spanAttributes(consume)["rate_limiter.storage.backend"])
+
+	exporter.Reset()
+	_, err = rl.CheckRequest(context.Background(), key)
+	require.NoError(t, err)
+
+	attrs = spanAttributes(findSpan(t, exporter.GetSpans(), "ratelimit.CheckRequest"))
+	assert.Equal(t, "denied", attrs["rate_limiter.decision"])
+}
+
+func TestTelemetry_Middleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	exporter := recordSpans(t)
+
+	var logs bytes.Buffer
+	previous := slog.Default()
+	slog.SetDefault(telemetry.NewLogger(&logs, slog.LevelInfo, telemetry.LogJSON))
+	defer slog.SetDefault(previous)
+
+	cfg := &config.Config{
+		RateLimit: config.RateLimitConfig{IPRequestsPerSecond: 10, IPBlockDurationMinutes: 1},
+	}
+	store := storage.NewMemoryStorage()
+	defer store.Close()
+	srv, err := server.New(cfg, store)
+	require.NoError(t, err)
+
+	traceID := "4bf92f3577b34da6a3ce929d0e0e4736"
+	req, _ := http.NewRequest("GET", "/api/test", nil)
+	req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	req.Header.Set(telemetry.RequestIDHeader, "req-1")
+	req.RemoteAddr = "192.168.1.1:12345"
+	w := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "req-1", w.Header().Get(telemetry.RequestIDHeader))
+
+	// The request span continues the caller's trace and parents the check
+	spans := exporter.GetSpans()
+	request := findSpan(t, spans, "GET /api/test")
+	assert.Equal(t, traceID, request.SpanContext.TraceID().String())
+	assert.Equal(t, "/api/test", spanAttributes(request)["http.route"])
+	assert.Equal(t, "200", spanAttributes(request)["http.response.status_code"])
+	check := findSpan(t, spans, "ratelimit.CheckRequest")
+	assert.Equal(t, request.SpanContext.SpanID(), check.Parent.SpanID())
+
+	// The access log carries the request and trace IDs
+	var line map[string]any
+	scanner := bufio.NewScanner(&logs)
+	for scanner.Scan() {
+		var entry map[string]any
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &entry))
+		if entry["msg"] == "Request handled" {
+			line = entry
+		}
+	}
+	require.NotNil(t, line)
+	assert.Equal(t, "req-1", line["request_id"])
+	assert.Equal(t, traceID, line["trace_id"])
+	assert.Equal(t, float64(http.StatusOK), line["status"])
+
+	// Requests without an ID get a new one
+	req, _ = http.NewRequest("GET", "/health", nil)
+	w = httptest.NewRecorder()
+	srv.Handler().ServeHTTP(w, req)
+	assert.Len(t, w.Header().Get(telemetry.RequestIDHeader), 32)
+
+	// So do requests whose ID is too long or could forge log lines
+	for _, id := range []string{strings.Repeat("a", 129), "req-1\nlevel=ERROR msg=forged", "<script>"} {
+		req, _ = http.NewRequest("GET", "/health", nil)
+		req.Header.Set(telemetry.RequestIDHeader, id)
+		w = httptest.NewRecorder()
+		srv.Handler().ServeHTTP(w, req)
+		assert.Len(t, w.Header().Get(telemetry.RequestIDHeader), 32, "request ID %q", id)
+	}
+}
+
+func TestTelemetry_ValidRequestID(t *testing.T) {
+	for _, id := range []string{"req-1", "4bf92f3577b34da6a3ce929d0e0e4736", "f47ac10b-58cc-4372-a567-0e02b2c3d479", "Root=1-5759e988-bd862e3fe1be46a994272793", strings.Repeat("a", 128)} {
+		assert.True(t, telemetry.ValidRequestID(id), id)
+	}
+	for _, id := range []string{"", strings.Repeat("a", 129), "a b", "a\nb", "a\"b", "ação"} {
+		assert.False(t, telemetry.ValidRequestID(id), id)
+	}
+}
+
+func TestTelemetry_Config(t *testing.T) {
+	cfg, err := config.Load()
+	require.NoError(t, err)
+	assert.Equal(t, "rate-limiter", cfg.Telemetry.ServiceName)
+	assert.False(t, cfg.Telemetry.TracingEnabled())
+	assert.Equal(t, slog.LevelInfo, cfg.Telemetry.LogLevel)
+	assert.Equal(t, telemetry.LogJSON, cfg.Telemetry.LogFormat)
+
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", "otel-collector:4318")
+	t.Setenv("LOG_LEVEL", "debug")
+	t.Setenv("LOG_FORMAT", "text")
+	cfg, err = config.Load()
+	require.NoError(t, err)
+	assert.True(t, cfg.Telemetry.TracingEnabled())
+	assert.Equal(t, slog.LevelDebug, cfg.Telemetry.LogLevel)
+	assert.Equal(t, telemetry.LogText, cfg.Telemetry.LogFormat)
+
+	t.Setenv("LOG_FORMAT", "xml")
+	_, err = config.Load()
+	assert.ErrorContains(t, err, "LOG_FORMAT: expected json or text")
+
+	t.Setenv("LOG_FORMAT", "json")
+	t.Setenv("LOG_LEVEL", "verbose")
+	_, err = config.Load()
+	assert.ErrorContains(t, err, "LOG_LEVEL: expected debug, info, warn or error")
+}